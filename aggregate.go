@@ -0,0 +1,172 @@
+package snek
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// AggregateFunction is a function computed over a field of the structs selected by a query, see View.Aggregate.
+type AggregateFunction string
+
+const (
+	// Count is the number of non NULL values of the field, or the number of structs if the Aggregate has no Field.
+	Count AggregateFunction = "COUNT"
+	// CountDistinct is the number of distinct non NULL values of the field.
+	CountDistinct AggregateFunction = "COUNT DISTINCT"
+	// Sum is the sum of the values of the field.
+	Sum AggregateFunction = "SUM"
+	// Avg is the average of the non NULL values of the field.
+	Avg AggregateFunction = "AVG"
+	// Min is the smallest value of the field.
+	Min AggregateFunction = "MIN"
+	// Max is the largest value of the field.
+	Max AggregateFunction = "MAX"
+)
+
+// Aggregate is an AggregateFunction of a field, like the fields of conditions, e.g. "Inner.Float".
+// Except Count and CountDistinct, which work for any unencrypted field, the functions only work for integer, float, and bool fields.
+//
+// Filter, if set, makes the aggregate only include the structs in the Set, e.g. to count both all messages and the unread
+// messages of a user in a single query, using Aggregate{Function: Count} and Aggregate{Function: Count, Filter: Cond{"Read", EQ, false}}.
+type Aggregate struct {
+	Function AggregateFunction
+	Field    string
+	Filter   Set
+}
+
+func (a Aggregate) validate(caller Caller, structType reflect.Type) error {
+	if a.Filter != nil {
+		if err := (&Query{Set: a.Filter}).validate(caller, structType); err != nil {
+			return err
+		}
+	}
+	if a.Function == Count && a.Field == "" {
+		return nil
+	}
+	fieldInfo, found := (&valueInfo{typ: structType}).fields(false)[a.Field]
+	if !found {
+		return fmt.Errorf("%s has no field %q", structType.Name(), a.Field)
+	}
+	if fieldInfo.encrypted {
+		return fmt.Errorf("%s.%s is encrypted, and can't be aggregated", structType.Name(), a.Field)
+	}
+	switch a.Function {
+	case Count, CountDistinct:
+		return nil
+	case Sum, Avg, Min, Max:
+		switch fieldInfo.columnType {
+		case "INTEGER", "REAL", "BOOLEAN":
+			return nil
+		}
+		return fmt.Errorf("%s.%s is %s, and can't be aggregated using %s", structType.Name(), a.Field, fieldInfo.columnType, a.Function)
+	default:
+		return fmt.Errorf("unrecognized aggregate function %q", a.Function)
+	}
+}
+
+// toSQL returns the aggregate of the column of the field in the table (or subquery) named tableName.
+// Filtered aggregates aggregate NULL instead of the values of the structs outside the Filter, which all the functions ignore.
+func (a Aggregate) toSQL(n naming, tableName string) (string, []any) {
+	value := "1"
+	if a.Field != "" {
+		value = fmt.Sprintf("\"%s\".\"%s\"", tableName, n.column(a.Field))
+	}
+	var params []any
+	if a.Filter != nil {
+		var filterSQL string
+		filterSQL, params = a.Filter.toWhereCondition(n, tableName)
+		value = fmt.Sprintf("CASE WHEN %s THEN %s END", filterSQL, value)
+	}
+	if a.Function == CountDistinct {
+		return fmt.Sprintf("COUNT(DISTINCT %s)", value), params
+	}
+	return fmt.Sprintf("%s(%s)", a.Function, value), params
+}
+
+func (q *Query) toAggregateStatement(n naming, structType reflect.Type, aggregates []Aggregate) (string, []any) {
+	tableName := n.table(structType)
+	columns := []string{}
+	params := []any{}
+	for _, aggregate := range aggregates {
+		column, columnParams := aggregate.toSQL(n, tableName)
+		columns = append(columns, column)
+		params = append(params, columnParams...)
+	}
+	selectSQL, selectParams := q.toSelectStatement(n, structType)
+	// Aliasing the selected structs as their table makes the filters apply to them.
+	return fmt.Sprintf("SELECT %s FROM (%s) AS \"%s\";", strings.Join(columns, ", "), strings.TrimSuffix(selectSQL, ";"), tableName), append(params, selectParams...)
+}
+
+// Aggregate returns aggregate computed over the structs of the same type as structPointer that the query would select, or zero if
+// the aggregate is NULL, e.g. the Sum of no structs.
+//
+// Like Count, the structs are those visible through the query control (and default Set) of the type, and Limit, Offset, and Joins
+// apply before the aggregate is computed. Since the aggregates are computed without loading the structs, types with field controls
+// (see RegisterFieldControl) can't be aggregated by callers not bypassing the control.
+func (v *View) Aggregate(structPointer any, query *Query, aggregate Aggregate) (float64, error) {
+	result, err := v.Aggregates(structPointer, query, aggregate)
+	if err != nil {
+		return 0, err
+	}
+	return result[0], nil
+}
+
+// Aggregates is like Aggregate, but computes all the aggregates in a single query, e.g. several differently filtered aggregates
+// for a dashboard, and returns them in the same order.
+func (v *View) Aggregates(structPointer any, query *Query, aggregates ...Aggregate) ([]float64, error) {
+	if query == nil {
+		query = &Query{}
+	}
+	typ := reflect.TypeOf(structPointer)
+	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return nil, &InvalidArgumentError{Allowed: "pointers to structs", Argument: typ}
+	}
+	if len(aggregates) == 0 {
+		return nil, fmt.Errorf("no aggregates to compute")
+	}
+	structType := typ.Elem()
+	prepared := make([]Aggregate, len(aggregates))
+	for index, aggregate := range aggregates {
+		if err := aggregate.validate(v.caller, structType); err != nil {
+			return nil, err
+		}
+		if aggregate.Filter != nil {
+			filterQuery := &Query{Set: cloneSet(aggregate.Filter)}
+			filterQuery.normalize(structType)
+			for filterType := range filterQuery.types(structType) {
+				if _, found := v.snek.permissions[filterType.Name()]; !found {
+					return nil, &NotRegisteredError{TypeName: filterType.Name()}
+				}
+			}
+			aggregate.Filter = filterQuery.Set
+		}
+		prepared[index] = aggregate
+	}
+	if v.hasFieldControl(structType) {
+		return nil, fmt.Errorf("%s has a field control, and can't be aggregated", structType.Name())
+	}
+	queryCopy, err := v.prepareQuery(structType, query)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]sql.NullFloat64, len(prepared))
+	dests := make([]any, len(prepared))
+	for index := range results {
+		dests[index] = &results[index]
+	}
+	sql, params := queryCopy.toAggregateStatement(v.snek.naming(), structType, prepared)
+	started := time.Now()
+	err = v.tx.QueryRowxContext(v.ctx, sql, params...).Scan(dests...)
+	v.logSQL(sql, params, nil, started, err)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]float64, len(results))
+	for index := range results {
+		result[index] = results[index].Float64
+	}
+	return result, nil
+}
@@ -0,0 +1,115 @@
+package snek
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+const (
+	bigIntDigits         = 100
+	bigIntPositivePrefix = "p"
+	bigIntNegativePrefix = "n"
+)
+
+var (
+	bigIntType = reflect.TypeOf(BigInt{})
+)
+
+// BigInt is an arbitrary precision integer that can be stored and compared.
+//
+// It's stored as TEXT in a fixed width form, a sign character followed by
+// 100 zero padded decimal digits (in nines' complement for negative numbers),
+// so that comparisons and ordering in SQL are numerically correct.
+//
+// Limitations:
+//   - Values with more than 100 decimal digits can't be stored.
+//   - BigInt fields can only be compared to BigInt values, and string fields can't be compared to BigInt values,
+//     since the values are compared as TEXT. Queries comparing them to anything else fail with an IncompatibleCondError.
+//   - A BigInt with a nil Int is treated as zero.
+type BigInt struct {
+	*big.Int
+}
+
+// NewBigInt returns a BigInt with the value of i.
+func NewBigInt(i int64) BigInt {
+	return BigInt{big.NewInt(i)}
+}
+
+func (b BigInt) bigInt() *big.Int {
+	if b.Int == nil {
+		return new(big.Int)
+	}
+	return b.Int
+}
+
+// String returns the decimal representation of b.
+func (b BigInt) String() string {
+	return b.bigInt().String()
+}
+
+// Value implements driver.Valuer.
+func (b BigInt) Value() (driver.Value, error) {
+	i := b.bigInt()
+	digits := new(big.Int).Abs(i).String()
+	if len(digits) > bigIntDigits {
+		return nil, fmt.Errorf("%v has more than %d digits", i, bigIntDigits)
+	}
+	padded := strings.Repeat("0", bigIntDigits-len(digits)) + digits
+	if i.Sign() >= 0 {
+		return bigIntPositivePrefix + padded, nil
+	}
+	return bigIntNegativePrefix + ninesComplement(padded), nil
+}
+
+// Scan implements sql.Scanner.
+func (b *BigInt) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("can't scan %T into BigInt", src)
+	}
+	if len(s) != bigIntDigits+1 {
+		return fmt.Errorf("%q isn't a stored BigInt", s)
+	}
+	digits := s[1:]
+	switch s[:1] {
+	case bigIntPositivePrefix:
+	case bigIntNegativePrefix:
+		digits = "-" + ninesComplement(digits)
+	default:
+		return fmt.Errorf("%q isn't a stored BigInt", s)
+	}
+	i, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return fmt.Errorf("%q isn't a stored BigInt", s)
+	}
+	b.Int = i
+	return nil
+}
+
+func ninesComplement(digits string) string {
+	result := []byte(digits)
+	for index, digit := range result {
+		result[index] = '9' - (digit - '0')
+	}
+	return string(result)
+}
+
+// toBigInt returns val as a *big.Int, if it's a BigInt or an integer.
+func toBigInt(val reflect.Value) (*big.Int, bool) {
+	if val.Type() == bigIntType {
+		return val.Interface().(BigInt).bigInt(), true
+	} else if val.CanInt() {
+		return big.NewInt(val.Int()), true
+	} else if val.CanUint() {
+		return new(big.Int).SetUint64(val.Uint()), true
+	}
+	return nil, false
+}
@@ -0,0 +1,148 @@
+package snek
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// QueryCacheStats describes the usage of the query cache.
+type QueryCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+}
+
+type queryCacheEntry struct {
+	types map[reflect.Type]bool
+	rows  reflect.Value
+}
+
+// queryCache caches the results of Selects in Views, keyed by the generated SQL and parameters.
+//
+// Entries are removed when an Update commits changes to any type involved in their query. To avoid
+// caching results read from snapshots older than such a commit, results are only cached if no
+// Update has committed changes since the View they were read in began.
+type queryCache struct {
+	lock       sync.Mutex
+	size       int
+	generation uint64
+	entries    map[string]queryCacheEntry
+	stats      QueryCacheStats
+}
+
+func newQueryCache(size int) *queryCache {
+	return &queryCache{
+		size:    size,
+		entries: map[string]queryCacheEntry{},
+	}
+}
+
+func queryCacheKey(sql string, params []any) string {
+	return fmt.Sprintf("%s\n%#v", sql, params)
+}
+
+func (c *queryCache) currentGeneration() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.generation
+}
+
+// get returns the cached rows for key, if they are of sliceType.
+func (c *queryCache) get(key string, sliceType reflect.Type) (reflect.Value, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, found := c.entries[key]
+	if !found || entry.rows.Type() != sliceType {
+		c.stats.Misses++
+		return reflect.Value{}, false
+	}
+	c.stats.Hits++
+	return entry.rows, true
+}
+
+// put caches rows for key, unless the cache has been invalidated since generation.
+func (c *queryCache) put(generation uint64, key string, types map[reflect.Type]bool, rows reflect.Value) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if _, found := c.entries[key]; !found && len(c.entries) >= c.size {
+		// Evict an arbitrary entry.
+		for evictKey := range c.entries {
+			delete(c.entries, evictKey)
+			break
+		}
+	}
+	c.entries[key] = queryCacheEntry{types: types, rows: rows}
+}
+
+// invalidate removes the entries involving any of types, or all entries if all is set.
+func (c *queryCache) invalidate(types map[reflect.Type]bool, all bool) {
+	if !all && len(types) == 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	for key, entry := range c.entries {
+		if all {
+			delete(c.entries, key)
+			continue
+		}
+		for typ := range types {
+			if entry.types[typ] {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// QueryCacheStats returns the usage of the query cache enabled by Options.QueryCacheSize.
+func (s *Snek) QueryCacheStats() QueryCacheStats {
+	if s.queryCache == nil {
+		return QueryCacheStats{}
+	}
+	s.queryCache.lock.Lock()
+	defer s.queryCache.lock.Unlock()
+	result := s.queryCache.stats
+	result.Entries = len(s.queryCache.entries)
+	return result
+}
+
+// types returns the types whose tables the query reads when selecting structType.
+func (q *Query) types(structType reflect.Type) map[reflect.Type]bool {
+	result := map[reflect.Type]bool{structType: true}
+	addSetTypes(q.Set, result)
+	for _, join := range q.Joins {
+		result[join.typ] = true
+		addSetTypes(join.set, result)
+	}
+	for _, order := range q.Order {
+		for _, orderCase := range order.Cases {
+			addSetTypes(orderCase.Set, result)
+		}
+	}
+	if q.Recursion != nil {
+		addSetTypes(q.Recursion.Start, result)
+	}
+	return result
+}
+
+func addSetTypes(set Set, types map[reflect.Type]bool) {
+	switch v := set.(type) {
+	case And:
+		for _, part := range v {
+			addSetTypes(part, types)
+		}
+	case Or:
+		for _, part := range v {
+			addSetTypes(part, types)
+		}
+	case existsSet:
+		types[v.typ] = true
+		addSetTypes(v.set, types)
+	}
+}
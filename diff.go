@@ -0,0 +1,78 @@
+package snek
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"sort"
+)
+
+// Diff returns the sorted names of the stored fields that differ between prev and next, which must be pointers to structs of the same type.
+// Nested fields are named the same way as in Cond, e.g. "Inner.Float", and fields are compared using the values stored for them.
+// If either of prev and next is nil, e.g. in the UpdateControl of an insert or removal, all stored fields differ.
+//
+// It can be used in UpdateControls to restrict which fields may change, e.g. by comparing the result to an allowed list.
+func Diff(prev, next any) ([]string, error) {
+	prevVal, nextVal := reflect.ValueOf(prev), reflect.ValueOf(next)
+	if prev == nil || (prevVal.Kind() == reflect.Pointer && prevVal.IsNil()) {
+		return allFields(nextVal)
+	}
+	if next == nil || (nextVal.Kind() == reflect.Pointer && nextVal.IsNil()) {
+		return allFields(prevVal)
+	}
+	prevInfo, err := getValueInfo(prevVal)
+	if err != nil {
+		return nil, err
+	}
+	nextInfo, err := getValueInfo(nextVal)
+	if err != nil {
+		return nil, err
+	}
+	if prevInfo.typ != nextInfo.typ {
+		return nil, &InvalidArgumentError{Allowed: "pointers to structs of the same type", Argument: next}
+	}
+	prevFields, nextFields := prevInfo.fields(true), nextInfo.fields(true)
+	result := []string{}
+	for fieldName, prevField := range prevFields {
+		equal, err := storedValuesEqual(prevField.value, nextFields[fieldName].value)
+		if err != nil {
+			return nil, err
+		}
+		if !equal {
+			result = append(result, fieldName)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func allFields(structPointer reflect.Value) ([]string, error) {
+	if !structPointer.IsValid() || (structPointer.Kind() == reflect.Pointer && structPointer.IsNil()) {
+		return nil, &InvalidArgumentError{Allowed: "at least one non nil pointer to a struct"}
+	}
+	info, err := getValueInfo(structPointer)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for fieldName := range info.fields(false) {
+		result = append(result, fieldName)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// storedValuesEqual returns whether a and b, values of the same field, would be stored as the same value.
+func storedValuesEqual(a, b any) (bool, error) {
+	var err error
+	if valuer, ok := a.(driver.Valuer); ok {
+		if a, err = valuer.Value(); err != nil {
+			return false, err
+		}
+	}
+	if valuer, ok := b.(driver.Valuer); ok {
+		if b, err = valuer.Value(); err != nil {
+			return false, err
+		}
+	}
+	return reflect.DeepEqual(a, b), nil
+}
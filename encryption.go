@@ -0,0 +1,184 @@
+package snek
+
+import (
+	"crypto/rand"
+	"fmt"
+	"reflect"
+)
+
+// encryptedFields returns the names of the encrypted fields of structType, i.e. the fields of string or []byte type
+// tagged with `snek:"encrypt"`, which are encrypted with Options.Encryption before being stored, and decrypted when loaded.
+func encryptedFields(structType reflect.Type) []string {
+	result := []string{}
+	for name, field := range (&valueInfo{typ: structType}).fields(false) {
+		if field.encrypted {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// additionalData binds ciphertexts to their column, to prevent them from being moved to other columns.
+func additionalData(structType reflect.Type, fieldName string) []byte {
+	return []byte(structType.Name() + "." + fieldName)
+}
+
+// encrypt replaces the values of the encrypted fields in info with their ciphertexts.
+func (s *Snek) encrypt(info *valueInfo) error {
+	fields := info.fields(true)
+	for name, field := range fields {
+		if !field.encrypted || field.value == nil {
+			continue
+		}
+		if s.options.Encryption == nil {
+			return fmt.Errorf("%s.%s is encrypted, but no encryption is configured", info.typ.Name(), name)
+		}
+		val := reflect.ValueOf(field.value)
+		var plaintext []byte
+		if val.Kind() == reflect.String {
+			plaintext = []byte(val.String())
+		} else {
+			plaintext = val.Bytes()
+		}
+		nonce := make([]byte, s.options.Encryption.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		field.value = s.options.Encryption.Seal(nonce, nonce, plaintext, additionalData(info.typ, name))
+		fields[name] = field
+	}
+	return nil
+}
+
+// decrypt replaces the encrypted fields in structPointer, or in each element if it's a pointer to a slice, with their plaintexts.
+func (s *Snek) decrypt(structPointer any) error {
+	return s.decryptAs(structPointer, nil)
+}
+
+// decryptAs is decrypt for structs loaded from the table of sourceType, e.g. by SelectInto, whose fields were encrypted with
+// sourceType as additional data. A nil sourceType means the type of the structs.
+func (s *Snek) decryptAs(structPointer any, sourceType reflect.Type) error {
+	val := reflect.ValueOf(structPointer)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		return nil
+	}
+	val = val.Elem()
+	structType := val.Type()
+	if structType.Kind() == reflect.Slice {
+		structType = structType.Elem()
+	}
+	if sourceType == nil {
+		sourceType = structType
+	}
+	fieldNames := encryptedFields(structType)
+	if len(fieldNames) == 0 {
+		return nil
+	}
+	if s.options.Encryption == nil {
+		return fmt.Errorf("%s has encrypted fields, but no encryption is configured", structType.Name())
+	}
+	decryptStruct := func(structVal reflect.Value) error {
+		for _, name := range fieldNames {
+			fieldVal, err := fieldByName(structVal, name)
+			if err != nil {
+				return err
+			}
+			if !fieldVal.IsValid() {
+				continue
+			}
+			var ciphertext []byte
+			if fieldVal.Kind() == reflect.String {
+				ciphertext = []byte(fieldVal.String())
+			} else {
+				ciphertext = fieldVal.Bytes()
+			}
+			if len(ciphertext) == 0 {
+				continue
+			}
+			nonceSize := s.options.Encryption.NonceSize()
+			if len(ciphertext) < nonceSize {
+				return fmt.Errorf("%s.%s is too short to be encrypted", sourceType.Name(), name)
+			}
+			plaintext, err := s.options.Encryption.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], additionalData(sourceType, name))
+			if err != nil {
+				return fmt.Errorf("decrypting %s.%s: %v", sourceType.Name(), name, err)
+			}
+			if fieldVal.Kind() == reflect.String {
+				fieldVal.SetString(string(plaintext))
+			} else {
+				fieldVal.SetBytes(plaintext)
+			}
+		}
+		return nil
+	}
+	if val.Kind() == reflect.Slice {
+		for index := 0; index < val.Len(); index++ {
+			if err := decryptStruct(val.Index(index)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return decryptStruct(val)
+}
+
+// isEncrypted returns whether fieldName is an encrypted field of structType.
+func isEncrypted(structType reflect.Type, fieldName string) bool {
+	field, found := (&valueInfo{typ: structType}).fields(false)[fieldName]
+	return found && field.encrypted
+}
+
+// findEncryptedCond returns the type and name of the first field in set, including in the sets and correlations of Exists,
+// that is an encrypted field of structType or of the type of the Exists, if any.
+//
+// Since each value is encrypted with a random nonce, the stored ciphertexts can't be compared to anything, so conditions
+// on encrypted fields are rejected. Ordering by encrypted fields is allowed, but meaningless.
+func findEncryptedCond(structType reflect.Type, set Set) (string, bool) {
+	switch v := set.(type) {
+	case And:
+		for _, part := range v {
+			if field, found := findEncryptedCond(structType, part); found {
+				return field, true
+			}
+		}
+	case Or:
+		for _, part := range v {
+			if field, found := findEncryptedCond(structType, part); found {
+				return field, true
+			}
+		}
+	case Cond:
+		if isEncrypted(structType, v.Field) {
+			return structType.Name() + "." + v.Field, true
+		}
+	case *Cond:
+		if v != nil {
+			return findEncryptedCond(structType, *v)
+		}
+	case In:
+		for _, field := range v.Fields {
+			if isEncrypted(structType, field) {
+				return structType.Name() + "." + field, true
+			}
+		}
+	case existsSet:
+		if field, found := findEncryptedOn(structType, v.typ, v.correlation); found {
+			return field, true
+		}
+		return findEncryptedCond(v.typ, v.set)
+	}
+	return "", false
+}
+
+// findEncryptedOn returns the type and name of the first field compared by on, joining structType with joinType, that is encrypted, if any.
+func findEncryptedOn(structType reflect.Type, joinType reflect.Type, on []On) (string, bool) {
+	for _, o := range on {
+		if isEncrypted(structType, o.MainField) {
+			return structType.Name() + "." + o.MainField, true
+		}
+		if isEncrypted(joinType, o.JoinField) {
+			return joinType.Name() + "." + o.JoinField, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,161 @@
+package snek
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// NotRegisteredError is returned when a type is used without being registered, or without the control needed for the operation.
+type NotRegisteredError struct {
+	TypeName string
+	// Control is "query" or "update" if the type isn't registered with that kind of control, and empty if it isn't registered at all.
+	Control string
+}
+
+func (n *NotRegisteredError) Error() string {
+	if n.Control != "" {
+		return fmt.Sprintf("%s not registered with %s control", n.TypeName, n.Control)
+	}
+	return fmt.Sprintf("%s not registered", n.TypeName)
+}
+
+// InvalidArgumentError is returned when an argument is of a kind that isn't allowed.
+type InvalidArgumentError struct {
+	// Allowed describes the kind of arguments that are allowed.
+	Allowed  string
+	Argument any
+}
+
+func (i *InvalidArgumentError) Error() string {
+	return fmt.Sprintf("only %s allowed, not %v", i.Allowed, i.Argument)
+}
+
+// UniqueConstraintError is returned when an insert or update would violate a unique constraint,
+// i.e. a `snek:"unique"` field, a combination returned by Uniquer.Unique, or the ID.
+type UniqueConstraintError struct {
+	TypeName string
+	// Fields are the fields of the violated unique constraint, in the order they were declared.
+	Fields []string
+	err    error
+}
+
+func (u *UniqueConstraintError) Error() string {
+	return fmt.Sprintf("%s with the same %s already exists: %v", u.TypeName, strings.Join(u.Fields, ", "), u.err)
+}
+
+func (u *UniqueConstraintError) Unwrap() error {
+	return u.err
+}
+
+// ImmutableFieldError is returned when an update would change a `snek:"immutable"` field.
+type ImmutableFieldError struct {
+	TypeName string
+	Field    string
+}
+
+func (i *ImmutableFieldError) Error() string {
+	return fmt.Sprintf("immutable field %q of %s can't be changed", i.Field, i.TypeName)
+}
+
+// IncompatibleCondError is returned when a Cond compares a field to a value of a type that the column of the field can't be consistently compared to,
+// e.g. a string field to an int, which SQLite would silently coerce while Cond.Matches would fail.
+type IncompatibleCondError struct {
+	TypeName   string
+	Field      string
+	ColumnType string
+	Value      any
+}
+
+func (i *IncompatibleCondError) Error() string {
+	return fmt.Sprintf("%s.%s is %s and can't be compared to %v (%T)", i.TypeName, i.Field, i.ColumnType, i.Value, i.Value)
+}
+
+// NonFiniteFloatError is returned when writing a NaN or infinite float that Options.NonFiniteFloats doesn't allow.
+type NonFiniteFloatError struct {
+	TypeName string
+	Field    string
+	Value    float64
+}
+
+func (n *NonFiniteFloatError) Error() string {
+	return fmt.Sprintf("%s.%s can't be %v, see Options.NonFiniteFloats", n.TypeName, n.Field, n.Value)
+}
+
+// InvalidIDError is returned by Snek.CheckID for IDs that couldn't have been created by NewID recently.
+type InvalidIDError struct {
+	ID     ID
+	Reason string
+}
+
+func (i *InvalidIDError) Error() string {
+	return fmt.Sprintf("invalid ID %v: %s", i.ID, i.Reason)
+}
+
+// RestrictedRemoveError is returned when removing a struct that structs of another type refer to using a Restrict Relation.
+type RestrictedRemoveError struct {
+	TypeName          string
+	ReferringTypeName string
+	Field             string
+}
+
+func (r *RestrictedRemoveError) Error() string {
+	return fmt.Sprintf("%s can't be removed while %s refers to it using %q", r.TypeName, r.ReferringTypeName, r.Field)
+}
+
+// ScanBudgetError is returned when a Select would scan more rows without an index than Options.MaxScanRows allows.
+type ScanBudgetError struct {
+	// FullScans maps the tables that would be scanned without an index to the number of rows in them.
+	FullScans map[string]int
+	Max       int
+}
+
+func (s *ScanBudgetError) Error() string {
+	tables := []string{}
+	rows := 0
+	for table, tableRows := range s.FullScans {
+		tables = append(tables, table)
+		rows += tableRows
+	}
+	sort.Strings(tables)
+	return fmt.Sprintf("scanning %v rows of %s without an index exceeds the budget of %v rows", rows, strings.Join(tables, ", "), s.Max)
+}
+
+var (
+	uniqueConstraintPattern = regexp.MustCompile(`UNIQUE constraint failed: (.+)$`)
+)
+
+// wrapConstraintError returns err wrapped in a UniqueConstraintError if it's a unique constraint violation for info.
+func wrapConstraintError(n naming, info *valueInfo, err error) error {
+	sqliteErr := sqlite3.Error{}
+	if !errors.As(err, &sqliteErr) || (sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique && sqliteErr.ExtendedCode != sqlite3.ErrConstraintPrimaryKey) {
+		return err
+	}
+	// SQLite reports the violated index as `UNIQUE constraint failed: table.column1, table.column2`.
+	match := uniqueConstraintPattern.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+	columnFields := map[string]string{}
+	for field := range info.fields(false) {
+		columnFields[n.column(field)] = field
+	}
+	fields := []string{}
+	for _, part := range strings.Split(match[1], ", ") {
+		column := strings.TrimPrefix(part, n.table(info.typ)+".")
+		if field, found := columnFields[column]; found {
+			fields = append(fields, field)
+		} else {
+			fields = append(fields, column)
+		}
+	}
+	return &UniqueConstraintError{
+		TypeName: info.typ.Name(),
+		Fields:   fields,
+		err:      err,
+	}
+}
@@ -0,0 +1,67 @@
+package snek
+
+import (
+	"math"
+	"reflect"
+)
+
+// NonFiniteFloats decides what happens when Update.Insert, Update, or UpdateFields write NaN or infinite floats.
+// SQLite stores NaN as NULL, which can't be read back into a float field, so without a policy the value read back would differ from (or fail to load into) the value written.
+type NonFiniteFloats int
+
+const (
+	// RejectNonFiniteFloats makes writing NaN or infinite floats fail with a NonFiniteFloatError.
+	RejectNonFiniteFloats NonFiniteFloats = iota
+	// AllowInfiniteFloats stores infinite floats, which SQLite round trips, but rejects NaN like RejectNonFiniteFloats.
+	AllowInfiniteFloats
+	// CoerceNonFiniteFloats replaces NaN with 0, and infinities with the largest finite floats of the same sign, before storing them.
+	// Like text normalization, the replacement happens in the struct being written, so it contains the stored values afterwards.
+	CoerceNonFiniteFloats
+)
+
+// handleNonFiniteFloats applies policy to the float fields in the struct in info, or only to the fields in onlyFields if it isn't nil.
+// Encrypted fields are stored as opaque blobs that round trip any float, and are left alone.
+func handleNonFiniteFloats(info *valueInfo, policy NonFiniteFloats, onlyFields map[string]bool) error {
+	for fieldName, field := range info.fields(false) {
+		if field.encrypted || field.generated != "" || (onlyFields != nil && !onlyFields[fieldName]) {
+			continue
+		}
+		fieldVal, err := fieldByName(info.val, fieldName)
+		if err != nil {
+			return err
+		}
+		if !fieldVal.IsValid() || !fieldVal.CanFloat() {
+			continue
+		}
+		f := fieldVal.Float()
+		if !math.IsNaN(f) && !math.IsInf(f, 0) {
+			continue
+		}
+		switch policy {
+		case CoerceNonFiniteFloats:
+			fieldVal.SetFloat(finiteFloat(f, fieldVal.Type()))
+		case AllowInfiniteFloats:
+			if math.IsNaN(f) {
+				return &NonFiniteFloatError{TypeName: info.typ.Name(), Field: fieldName, Value: f}
+			}
+		default:
+			return &NonFiniteFloatError{TypeName: info.typ.Name(), Field: fieldName, Value: f}
+		}
+	}
+	return nil
+}
+
+// finiteFloat returns 0 for NaN, and the largest finite float of typ with the same sign for infinities.
+func finiteFloat(f float64, typ reflect.Type) float64 {
+	if math.IsNaN(f) {
+		return 0
+	}
+	max := math.MaxFloat64
+	if typ.Kind() == reflect.Float32 {
+		max = math.MaxFloat32
+	}
+	if f < 0 {
+		return -max
+	}
+	return max
+}
@@ -0,0 +1,69 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// Client calls the snek.Snek service.
+type Client struct {
+	conn grpc.ClientConnInterface
+}
+
+// NewClient returns a client calling the service over conn, e.g. a *grpc.ClientConn.
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{conn: conn}
+}
+
+func fullMethod(method string) string {
+	return fmt.Sprintf("/%s/%s", serviceName, method)
+}
+
+// Query returns the structs matching the request.
+func (c *Client) Query(ctx context.Context, req *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error) {
+	resp := &QueryResponse{}
+	if err := c.conn.Invoke(ctx, fullMethod("Query"), req, resp, append(opts, grpc.ForceCodec(Codec{}))...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Update executes the request.
+func (c *Client) Update(ctx context.Context, req *UpdateRequest, opts ...grpc.CallOption) (*UpdateResponse, error) {
+	resp := &UpdateResponse{}
+	if err := c.conn.Invoke(ctx, fullMethod("Update"), req, resp, append(opts, grpc.ForceCodec(Codec{}))...); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SubscribeClient receives the responses of a subscription.
+type SubscribeClient struct {
+	stream grpc.ClientStream
+}
+
+// Recv returns the next response of the subscription.
+func (s *SubscribeClient) Recv() (*SubscribeResponse, error) {
+	resp := &SubscribeResponse{}
+	if err := s.stream.RecvMsg(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Subscribe subscribes to the structs matching the request, until ctx is canceled.
+func (c *Client) Subscribe(ctx context.Context, req *SubscribeRequest, opts ...grpc.CallOption) (*SubscribeClient, error) {
+	stream, err := c.conn.NewStream(ctx, &serviceDesc.Streams[0], fullMethod("Subscribe"), append(opts, grpc.ForceCodec(Codec{}))...)
+	if err != nil {
+		return nil, err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return nil, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &SubscribeClient{stream: stream}, nil
+}
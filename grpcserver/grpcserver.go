@@ -0,0 +1,344 @@
+// Package grpcserver serves a snek store over gRPC, as an alternative to the WebSocket server for service to service use.
+//
+// The service, snek.Snek, has the unary methods Query and Update, and the server streaming method Subscribe.
+// Instead of protobuf the messages are encoded using CBOR, as maps from the field names of the message types to their values,
+// with the content subtype CodecName, i.e. the content type "application/grpc+cbor". Queries are described using snek.QuerySpec,
+// and structs are transferred as CBOR encoded blobs, like in the WebSocket server.
+//
+// Codec isn't registered globally, so servers must be created with ServerOption, and Go clients either use Client or
+// the grpc.ForceCodec call option.
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/zond/snek"
+	"github.com/zond/snek/synch"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/mem"
+)
+
+const (
+	// CodecName is the gRPC content subtype of the messages of the service.
+	CodecName   = "cbor"
+	serviceName = "snek.Snek"
+)
+
+// Codec is the gRPC codec of the messages of the service.
+type Codec struct{}
+
+func (c Codec) Marshal(v any) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (c Codec) Unmarshal(b []byte, v any) error {
+	return cbor.Unmarshal(b, v)
+}
+
+func (c Codec) Name() string {
+	return CodecName
+}
+
+// serverCodec uses Codec for the messages of the service, and the proto codec for the messages of other services of the same server.
+type serverCodec struct{}
+
+func (s serverCodec) serviceMessage(v any) bool {
+	switch v.(type) {
+	case *QueryRequest, *QueryResponse, *UpdateRequest, *UpdateResponse, *SubscribeRequest, *SubscribeResponse:
+		return true
+	}
+	return false
+}
+
+func (s serverCodec) Marshal(v any) (mem.BufferSlice, error) {
+	if !s.serviceMessage(v) {
+		return encoding.GetCodecV2(proto.Name).Marshal(v)
+	}
+	b, err := Codec{}.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return mem.BufferSlice{mem.SliceBuffer(b)}, nil
+}
+
+func (s serverCodec) Unmarshal(data mem.BufferSlice, v any) error {
+	if !s.serviceMessage(v) {
+		return encoding.GetCodecV2(proto.Name).Unmarshal(data, v)
+	}
+	return Codec{}.Unmarshal(data.Materialize(), v)
+}
+
+func (s serverCodec) Name() string {
+	return CodecName
+}
+
+// ServerOption returns the option a *grpc.Server serving the service must be created with, making it use Codec for the messages
+// of the service, and the proto codec for the messages of any other services it serves, whatever content subtype clients use.
+func ServerOption() grpc.ServerOption {
+	return grpc.ForceServerCodecV2(serverCodec{})
+}
+
+// QueryRequest asks for the structs of the type named TypeName matching Query.
+type QueryRequest struct {
+	TypeName string
+	Query    snek.QuerySpec
+}
+
+// QueryResponse contains the CBOR encoded slice of structs matching a QueryRequest.
+type QueryResponse struct {
+	Blob []byte
+}
+
+// UpdateRequest inserts, updates, or removes the CBOR encoded struct of the type named TypeName.
+// Exactly one of Insert, Update, and Remove must be populated.
+type UpdateRequest struct {
+	TypeName string
+	Insert   []byte
+	Update   []byte
+	Remove   []byte
+}
+
+// UpdateResponse is returned when an UpdateRequest succeeds.
+type UpdateResponse struct{}
+
+// SubscribeRequest subscribes to the structs of the type named TypeName matching Query.
+type SubscribeRequest struct {
+	TypeName string
+	Query    snek.QuerySpec
+}
+
+// SubscribeResponse contains the CBOR encoded slice of structs matching a SubscribeRequest, each time they change.
+// Initial is set for the first delivered results, and Error is set if loading the results failed.
+type SubscribeResponse struct {
+	Initial bool
+	Error   string
+	Blob    []byte
+}
+
+// Identifier returns the caller of a call, e.g. using the metadata of ctx.
+type Identifier func(ctx context.Context) (snek.Caller, error)
+
+// AnonymousIdentifier identifies all calls as snek.AnonCaller.
+func AnonymousIdentifier(context.Context) (snek.Caller, error) {
+	return snek.AnonCaller{}, nil
+}
+
+// Server implements the snek.Snek gRPC service.
+type Server struct {
+	Snek       *snek.Snek
+	identifier Identifier
+	types      map[string]reflect.Type
+}
+
+// New returns a server for the store, identifying callers using identifier.
+func New(s *snek.Snek, identifier Identifier) *Server {
+	return &Server{
+		Snek:       s,
+		identifier: identifier,
+		types:      map[string]reflect.Type{},
+	}
+}
+
+// Register registers the type of the example structPointer in the server and store and ensures there is a table for the type.
+func Register[T any](s *Server, structPointer *T, queryControl snek.QueryControl, updateControl snek.UpdateControl[T]) error {
+	if err := snek.Register(s.Snek, structPointer, queryControl, updateControl); err != nil {
+		return err
+	}
+	structType := reflect.TypeOf(structPointer).Elem()
+	s.types[structType.Name()] = structType
+	return nil
+}
+
+// RegisterService registers the snek.Snek service in registrar, e.g. a *grpc.Server created with ServerOption.
+func (s *Server) RegisterService(registrar grpc.ServiceRegistrar) {
+	registrar.RegisterService(&serviceDesc, s)
+}
+
+// caller returns the caller of a call, carrying ctx.
+func (s *Server) caller(ctx context.Context) (snek.Caller, error) {
+	caller, err := s.identifier(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return snek.WithContext(caller, ctx), nil
+}
+
+func (s *Server) getType(typeName string) (reflect.Type, error) {
+	typ, found := s.types[typeName]
+	if !found {
+		return nil, &snek.NotRegisteredError{TypeName: typeName}
+	}
+	return typ, nil
+}
+
+// Query returns the structs matching the request.
+func (s *Server) Query(ctx context.Context, req *QueryRequest) (*QueryResponse, error) {
+	caller, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := s.getType(req.TypeName)
+	if err != nil {
+		return nil, err
+	}
+	query, err := req.Query.ToQuery()
+	if err != nil {
+		return nil, err
+	}
+	results := reflect.New(reflect.SliceOf(typ))
+	results.Elem().Set(reflect.MakeSlice(reflect.SliceOf(typ), 0, 0))
+	if err := s.Snek.View(caller, func(v *snek.View) error {
+		return v.Select(results.Interface(), query)
+	}); err != nil {
+		return nil, err
+	}
+	b, err := cbor.Marshal(results.Elem().Interface())
+	if err != nil {
+		return nil, err
+	}
+	return &QueryResponse{Blob: b}, nil
+}
+
+// Update executes the request.
+func (s *Server) Update(ctx context.Context, req *UpdateRequest) (*UpdateResponse, error) {
+	caller, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := s.getType(req.TypeName)
+	if err != nil {
+		return nil, err
+	}
+	nonNilFields := 0
+	var op func(*snek.Update, any) error
+	var b []byte
+	if len(req.Insert) > 0 {
+		op, b = (*snek.Update).Insert, req.Insert
+		nonNilFields++
+	}
+	if len(req.Update) > 0 {
+		op, b = (*snek.Update).Update, req.Update
+		nonNilFields++
+	}
+	if len(req.Remove) > 0 {
+		op, b = (*snek.Update).Remove, req.Remove
+		nonNilFields++
+	}
+	if nonNilFields != 1 {
+		return nil, fmt.Errorf("exactly one of Insert, Update, and Remove must be populated")
+	}
+	instance := reflect.New(typ).Interface()
+	if err := cbor.Unmarshal(b, instance); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", req.TypeName, err)
+	}
+	if err := s.Snek.Update(caller, func(u *snek.Update) error {
+		return op(u, instance)
+	}); err != nil {
+		return nil, err
+	}
+	return &UpdateResponse{}, nil
+}
+
+// Subscribe sends the structs matching the request to stream, each time they change, until the call is canceled or sending fails.
+func (s *Server) Subscribe(req *SubscribeRequest, stream grpc.ServerStream) error {
+	caller, err := s.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+	typ, err := s.getType(req.TypeName)
+	if err != nil {
+		return err
+	}
+	query, err := req.Query.ToQuery()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	// The stream must not be used after Subscribe returns, so deliveries still running when it's done are dropped.
+	sendLock := synch.Lock{}
+	done := false
+	subscription, err := snek.Subscribe(s.Snek, caller, query, snek.AnySnapshotSubscriber(typ, func(structSlice any, initial bool, err error) error {
+		resp := &SubscribeResponse{Initial: initial}
+		if err == nil {
+			resp.Blob, err = cbor.Marshal(structSlice)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		return sendLock.Sync(func() error {
+			if done {
+				return fmt.Errorf("subscription closed")
+			}
+			if err := stream.SendMsg(resp); err != nil {
+				cancel()
+				return err
+			}
+			return nil
+		})
+	}))
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	subscription.Close()
+	sendLock.Sync(func() error {
+		done = true
+		return nil
+	})
+	return nil
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Query",
+			Handler:    unaryHandler("Query", (*Server).Query),
+		},
+		{
+			MethodName: "Update",
+			Handler:    unaryHandler("Update", (*Server).Update),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       subscribeHandler,
+			ServerStreams: true,
+		},
+	},
+}
+
+func unaryHandler[Req, Resp any](method string, f func(*Server, context.Context, *Req) (*Resp, error)) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return f(srv.(*Server), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: fullMethod(method),
+		}
+		return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			return f(srv.(*Server), ctx, req.(*Req))
+		})
+	}
+}
+
+func subscribeHandler(srv any, stream grpc.ServerStream) error {
+	req := &SubscribeRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(*Server).Subscribe(req, stream)
+}
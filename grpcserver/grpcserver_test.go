@@ -0,0 +1,111 @@
+package grpcserver
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/zond/snek"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type testStruct struct {
+	ID     snek.ID
+	String string
+}
+
+func withClient(t *testing.T, f func(s *Server, c *Client)) {
+	dir, err := os.MkdirTemp(os.TempDir(), "snek_grpcserver_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := snek.DefaultOptions(filepath.Join(dir, "sqlite.db")).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(store, AnonymousIdentifier)
+	grpcServer := grpc.NewServer(ServerOption())
+	s.RegisterService(grpcServer)
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	listener := bufconn.Listen(1024 * 1024)
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f(s, NewClient(conn))
+}
+
+func TestQueryUpdateSubscribe(t *testing.T) {
+	withClient(t, func(s *Server, c *Client) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sub, err := c.Subscribe(ctx, &SubscribeRequest{TypeName: "testStruct"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		receive := func(wantInitial bool, wantStrings ...string) {
+			t.Helper()
+			resp, err := sub.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []testStruct{}
+			if err := cbor.Unmarshal(resp.Blob, &got); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Initial != wantInitial || resp.Error != "" || len(got) != len(wantStrings) {
+				t.Fatalf("got %+v with %+v, wanted initial %v and %v", resp, got, wantInitial, wantStrings)
+			}
+			for index := range got {
+				if got[index].String != wantStrings[index] {
+					t.Errorf("got %+v, wanted %v", got, wantStrings)
+				}
+			}
+		}
+		receive(true)
+		b, err := cbor.Marshal(&testStruct{ID: s.Snek.NewID(), String: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Update(ctx, &UpdateRequest{TypeName: "testStruct", Insert: b}); err != nil {
+			t.Fatal(err)
+		}
+		receive(false, "a")
+		resp, err := c.Query(ctx, &QueryRequest{TypeName: "testStruct", Query: snek.QuerySpec{Match: snek.Match{Cond: &snek.Cond{Field: "String", Comparator: snek.EQ, Value: "a"}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []testStruct{}
+		if err := cbor.Unmarshal(resp.Blob, &got); err != nil || len(got) != 1 || got[0].String != "a" {
+			t.Errorf("got %+v, %v, wanted one struct", got, err)
+		}
+		if _, err := c.Update(ctx, &UpdateRequest{TypeName: "testStruct", Insert: b, Remove: b}); err == nil {
+			t.Errorf("wanted error for multiple operations")
+		}
+		if _, err := c.Query(ctx, &QueryRequest{TypeName: "missing"}); err == nil {
+			t.Errorf("wanted error for unregistered type")
+		}
+		// Other services of the same server still use protobuf.
+		if resp, err := healthpb.NewHealthClient(c.conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil || resp.Status != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("got %+v, %v, wanted a serving health check", resp, err)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package snek
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	historyTimeColumn    = "snek_time"
+	historyRemovedColumn = "snek_removed"
+)
+
+func historyTable(n naming, structType reflect.Type) string {
+	return fmt.Sprintf("%s_history", n.table(structType))
+}
+
+// toCreateHistoryStatement returns a statement creating an append-only table containing every version of the structs of the type.
+// Each row has the columns of the type, without the primary key, and the time the version was written.
+// Removals are recorded as rows with only the ID and the time.
+func (i *valueInfo) toCreateHistoryStatement(n naming) string {
+	tableName := historyTable(n, i.typ)
+	builder := &bytes.Buffer{}
+	fmt.Fprintf(builder, "CREATE TABLE IF NOT EXISTS \"%s\" (\n", tableName)
+	fieldParts := []string{}
+	for fieldName, fieldInfo := range i.fields(false) {
+		// Generated columns are computed from the other columns of the version.
+		fieldParts = append(fieldParts, fmt.Sprintf("  \"%s\" %s%s", n.column(fieldName), fieldInfo.columnType, fieldInfo.generatedClause()))
+	}
+	fieldParts = append(fieldParts, fmt.Sprintf("  \"%s\" TEXT NOT NULL", historyTimeColumn), fmt.Sprintf("  \"%s\" BOOLEAN NOT NULL", historyRemovedColumn))
+	fmt.Fprintf(builder, "%s);", strings.Join(fieldParts, ",\n"))
+	fmt.Fprintf(builder, "\nCREATE INDEX IF NOT EXISTS \"%s.%s_%s\" ON \"%s\" (\"%s\", \"%s\");", tableName, n.column("ID"), historyTimeColumn, tableName, n.column("ID"), historyTimeColumn)
+	return builder.String()
+}
+
+// RegisterHistory makes every insert, update, and removal of structs of type T, using Update, also record the new version in a history table,
+// so that AsOf can return the version of a struct at a given time. Changes made using Update.Exec aren't recorded.
+// T must already be registered, and registering T again stops the recording, but keeps the history table.
+func RegisterHistory[T any](s *Snek) error {
+	typ := reflect.TypeOf(*new(T))
+	perms, found := s.permissions[typ.Name()]
+	if !found {
+		return &NotRegisteredError{TypeName: typ.Name()}
+	}
+	if key := primaryKey(typ); len(key) != 1 || key[0] != "ID" {
+		return fmt.Errorf("%s has the primary key %v, and only types with ID primary keys can record history", typ.Name(), key)
+	}
+	perms.history = true
+	s.permissions[typ.Name()] = perms
+	if s.options.NoAutoMigrate {
+		return nil
+	}
+	return s.Update(SystemCaller{}, func(u *Update) error {
+		return u.exec((&valueInfo{typ: typ}).toCreateHistoryStatement(s.naming()))
+	})
+}
+
+// historyTime returns the representation of t in history tables, which sorts chronologically.
+func historyTime(t time.Time) TimeText {
+	return ToText(t.UTC())
+}
+
+// recordHistory records the version in info, with values as stored in the store, in the history table of its type, if it has one.
+func (u *Update) recordHistory(info *valueInfo, removed bool) error {
+	if !u.snek.permissions[info.typ.Name()].history {
+		return nil
+	}
+	n := u.snek.naming()
+	columns := []string{fmt.Sprintf("\"%s\"", historyTimeColumn), fmt.Sprintf("\"%s\"", historyRemovedColumn)}
+	params := []any{historyTime(u.snek.Now()), removed}
+	if removed {
+		columns = append(columns, fmt.Sprintf("\"%s\"", n.column("ID")))
+		params = append(params, info.id)
+	} else {
+		for fieldName, fieldInfo := range info.fields(true) {
+			if fieldInfo.generated != "" {
+				continue
+			}
+			columns = append(columns, fmt.Sprintf("\"%s\"", n.column(fieldName)))
+			params = append(params, fieldInfo.value)
+		}
+	}
+	return u.exec(fmt.Sprintf("INSERT INTO \"%s\"\n  (%s) VALUES\n  (%s);", historyTable(n, info.typ), strings.Join(columns, ", "), strings.Repeat("?, ", len(columns)-1)+"?"), params...)
+}
+
+// AsOf returns the version of the struct of type T with the given ID at time t, as recorded since RegisterHistory was called for T.
+// If the struct didn't exist at t, or no version was recorded before t, sql.ErrNoRows is returned.
+// Like Get, the version must be visible through the query control of T, which is applied to the version as if it was current,
+// i.e. Joins added by the control join the version with the current structs of the joined types. Query controls adding Recursion
+// aren't supported.
+func AsOf[T any](s *Snek, caller Caller, id ID, t time.Time) (*T, error) {
+	typ := reflect.TypeOf(*new(T))
+	if !s.permissions[typ.Name()].history {
+		return nil, fmt.Errorf("%s has no history, see RegisterHistory", typ.Name())
+	}
+	n := s.naming()
+	result := new(T)
+	if err := s.View(caller, func(v *View) error {
+		version := struct {
+			RowID   int64 `db:"rowid"`
+			Removed bool  `db:"snek_removed"`
+		}{}
+		versionSQL := fmt.Sprintf("SELECT rowid AS \"rowid\", \"%s\" FROM \"%s\" WHERE \"%s\" = ? AND \"%s\" <= ? ORDER BY \"%s\" DESC, rowid DESC LIMIT 1;", historyRemovedColumn, historyTable(n, typ), n.column("ID"), historyTimeColumn, historyTimeColumn)
+		versionParams := []any{id, historyTime(t)}
+		started := time.Now()
+		err := v.tx.GetContext(v.ctx, &version, versionSQL, versionParams...)
+		v.logSQL(versionSQL, versionParams, nil, started, err)
+		if err != nil {
+			return err
+		}
+		if version.Removed {
+			return sql.ErrNoRows
+		}
+		query := &Query{Set: &Cond{"ID", EQ, id}}
+		v.applyDefaultSet(typ, query)
+		if err := v.queryControl(typ, query); err != nil {
+			return err
+		}
+		if query.Recursion != nil {
+			return fmt.Errorf("the query control of %s adds Recursion, which past versions can't be matched against", typ.Name())
+		}
+		// Aliasing the history table as the table of the type makes the query control Set and Joins apply to it.
+		tableName := n.table(typ)
+		columns := []string{}
+		for fieldName := range (&valueInfo{typ: typ}).fields(false) {
+			columns = append(columns, fmt.Sprintf("\"%s\".\"%s\"", tableName, n.column(fieldName)))
+		}
+		buf := &bytes.Buffer{}
+		fmt.Fprintf(buf, "SELECT %s FROM \"%s\" AS \"%s\"", strings.Join(columns, ", "), historyTable(n, typ), tableName)
+		params := []any{}
+		whereParts := []string{fmt.Sprintf("\"%s\".rowid = ?", tableName)}
+		for joinIndex, join := range query.Joins {
+			if _, found := s.permissions[join.typ.Name()]; !found {
+				return &NotRegisteredError{TypeName: join.typ.Name()}
+			}
+			joinName := joinAlias(joinIndex)
+			fmt.Fprintf(buf, "\nJOIN \"%s\" %s ON %s", n.table(join.typ), joinName, join.toOnCondition(n, tableName, joinName))
+			joinSQL, joinParams := join.set.toWhereCondition(n, joinName)
+			whereParts = append(whereParts, joinSQL)
+			params = append(params, joinParams...)
+		}
+		whereSQL, whereParams := query.Set.toWhereCondition(n, tableName)
+		whereParts = append(whereParts, whereSQL)
+		fmt.Fprintf(buf, "\nWHERE %s LIMIT 1;", strings.Join(whereParts, " AND "))
+		selectSQL := buf.String()
+		params = append(append([]any{version.RowID}, params...), whereParams...)
+		started = time.Now()
+		err = v.tx.GetContext(v.ctx, result, selectSQL, params...)
+		v.logSQL(selectSQL, params, nil, started, err)
+		if err != nil {
+			return err
+		}
+		if err := s.decrypt(result); err != nil {
+			return err
+		}
+		if err := afterLoad(result); err != nil {
+			return err
+		}
+		return v.fieldControl(typ, result)
+	}); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
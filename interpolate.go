@@ -0,0 +1,77 @@
+package snek
+
+import (
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// interpolateSQL returns query with each ? placeholder outside quotes replaced by the corresponding parameter as an SQLite literal.
+// It's only meant for logging, and the result must never be executed.
+func interpolateSQL(query string, params []any) string {
+	builder := &strings.Builder{}
+	var quote rune
+	paramIndex := 0
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?' && paramIndex < len(params):
+			builder.WriteString(sqlLiteral(params[paramIndex]))
+			paramIndex++
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
+
+// sqlLiteral returns param as an SQLite literal.
+func sqlLiteral(param any) string {
+	if valuer, ok := param.(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return fmt.Sprintf("/* %v */ NULL", err)
+		}
+		param = value
+	}
+	quoted := func(s string) string {
+		return fmt.Sprintf("'%s'", strings.ReplaceAll(s, "'", "''"))
+	}
+	switch v := param.(type) {
+	case nil:
+		return "NULL"
+	case ID:
+		return fmt.Sprintf("X'%s'", hex.EncodeToString(v))
+	case []byte:
+		return fmt.Sprintf("X'%s'", hex.EncodeToString(v))
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case time.Time:
+		return quoted(v.Format("2006-01-02 15:04:05.999999999-07:00"))
+	}
+	val := reflect.ValueOf(param)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return fmt.Sprintf("%v", param)
+	case reflect.String:
+		return quoted(val.String())
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			return fmt.Sprintf("X'%s'", hex.EncodeToString(val.Bytes()))
+		}
+	}
+	return quoted(fmt.Sprintf("%+v", param))
+}
@@ -0,0 +1,56 @@
+package snek
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+)
+
+var (
+	ipType = reflect.TypeOf(net.IP{})
+)
+
+// canonicalIP returns the 16 byte form of ip, or ip itself if it's not a valid address.
+//
+// net.IP fields, and net.IP values in conditions, are stored as BLOBs in this form, with IPv4 addresses mapped
+// to ::ffff:a.b.c.d. This makes IPv4 addresses equal regardless of whether they were created in
+// their 4 or 16 byte form, and makes the bytewise ordering of stored addresses numerically correct.
+func canonicalIP(ip net.IP) net.IP {
+	if canonical := ip.To16(); canonical != nil {
+		return canonical
+	}
+	return ip
+}
+
+// toIPBytes returns val as the bytes of a canonical net.IP, if it's a net.IP or a byte slice.
+func toIPBytes(val reflect.Value) ([]byte, bool) {
+	if val.Type() == ipType {
+		return []byte(canonicalIP(val.Interface().(net.IP))), true
+	}
+	if val.CanConvert(byteSliceType) {
+		return val.Convert(byteSliceType).Interface().([]byte), true
+	}
+	return nil, false
+}
+
+// CIDR returns a Set matching the net.IP values of field inside network, or an error if network is nil or its mask doesn't fit its IP.
+func CIDR(field string, network *net.IPNet) (Set, error) {
+	if network == nil {
+		return nil, fmt.Errorf("no network to match %s against", field)
+	}
+	masked := network.IP.Mask(network.Mask)
+	if masked == nil {
+		return nil, fmt.Errorf("invalid network %v to match %s against", network, field)
+	}
+	first := canonicalIP(masked)
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.IPMask(bytes.Repeat([]byte{0xff}, net.IPv6len-net.IPv4len)), mask...)
+	}
+	last := make(net.IP, len(first))
+	for index := range first {
+		last[index] = first[index] | ^mask[index]
+	}
+	return And{Cond{field, GE, first}, Cond{field, LE, last}}, nil
+}
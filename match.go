@@ -0,0 +1,88 @@
+package snek
+
+import (
+	"fmt"
+)
+
+// Match is a serializable Set, for transports translating query descriptions from clients to Sets.
+// At most one of the fields may be populated, and an empty Match matches all structs.
+type Match struct {
+	And  []Match `sbor:",omitempty"`
+	Or   []Match `sbor:",omitempty"`
+	Cond *Cond   `sbor:",omitempty"`
+}
+
+func (m *Match) String() string {
+	return fmt.Sprintf("%+v", *m)
+}
+
+func (m *Match) validate() error {
+	nonNilFields := 0
+	if len(m.And) > 0 {
+		nonNilFields++
+	}
+	if len(m.Or) > 0 {
+		nonNilFields++
+	}
+	if m.Cond != nil {
+		nonNilFields++
+	}
+	if nonNilFields > 1 {
+		return fmt.Errorf("at most one of the nullable fields of Match must be populated, not %+v", m)
+	}
+	return nil
+}
+
+// ToSet returns the Set described by the Match, validating the conditions like NewCond.
+func (m *Match) ToSet() (Set, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	makeSubSet := func(subMatches []Match) ([]Set, error) {
+		result := []Set{}
+		for _, subMatch := range subMatches {
+			subSet, err := subMatch.ToSet()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, subSet)
+		}
+		return result, nil
+	}
+	switch {
+	case len(m.And) > 0:
+		subSet, err := makeSubSet(m.And)
+		return And(subSet), err
+	case len(m.Or) > 0:
+		subSet, err := makeSubSet(m.Or)
+		return Or(subSet), err
+	case m.Cond != nil:
+		return NewCond(m.Cond.Field, m.Cond.Comparator, m.Cond.Value)
+	default:
+		return All{}, nil
+	}
+}
+
+// QuerySpec is a serializable Query, for transports translating query descriptions from clients to Querys.
+type QuerySpec struct {
+	Order    []Order `sbor:",omitempty"`
+	Limit    uint    `sbor:",omitempty"`
+	Offset   uint    `sbor:",omitempty"`
+	Distinct bool    `sbor:",omitempty"`
+	Match    Match   `sbor:",omitempty"`
+}
+
+// ToQuery returns the Query described by the QuerySpec.
+func (q *QuerySpec) ToQuery() (*Query, error) {
+	set, err := q.Match.ToSet()
+	if err != nil {
+		return nil, err
+	}
+	return &Query{
+		Set:      set,
+		Limit:    q.Limit,
+		Offset:   q.Offset,
+		Distinct: q.Distinct,
+		Order:    q.Order,
+	}, nil
+}
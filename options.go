@@ -2,8 +2,16 @@ package snek
 
 import (
 	"context"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
 	"log"
-	"math/rand"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/zond/snek/synch"
@@ -11,34 +19,222 @@ import (
 
 // Options defines the options to use when opening a store.
 type Options struct {
-	Path       string
+	Path string
+	// RandomSeed, if not zero, seeds the random parts of the IDs created by NewID. If zero, as in DefaultOptions, a seed
+	// is read from crypto/rand when the store is opened, so that different processes create different IDs.
 	RandomSeed int64
 	Logger     *log.Logger
 	LogSQL     bool
+
+	// ViewIsolation and UpdateIsolation are the isolation levels requested when beginning View and Update transactions.
+	// Note that github.com/mattn/go-sqlite3 ignores the requested level: SQLite always serializes writers, and readers
+	// always see a consistent snapshot (without blocking writers if the database uses WAL journaling, e.g. via
+	// "?_journal_mode=WAL" in the path). The levels are still forwarded to database/sql to allow future or alternative
+	// drivers to honor them.
+	ViewIsolation   sql.IsolationLevel
+	UpdateIsolation sql.IsolationLevel
+
+	// NameMapper, if set, maps Go type and field names to SQL table and column names, e.g. SnakeCase to store OwnerID in
+	// the column owner_id. Field names used in Cond, Order, On and similar are always Go field names, and get mapped the same way.
+	NameMapper func(string) string
+
+	// Now, if set, replaces time.Now as the source of time in the store. Combined with a non zero RandomSeed it makes
+	// NewID deterministic, which is useful in tests.
+	Now func() time.Time
+
+	// NoAutoMigrate makes Register leave the schema alone, for when it's managed externally.
+	NoAutoMigrate bool
+
+	// SlowQueryThreshold, if set, makes the store log only (and regardless of LogSQL) the SQL statements that take at
+	// least that long to execute.
+	SlowQueryThreshold time.Duration
+
+	// Encryption, if set, encrypts fields tagged with `snek:"encrypt"` at rest. Conditions on encrypted fields are
+	// rejected, since the stored values can't be compared.
+	Encryption cipher.AEAD
+
+	// SystemRunsControl makes system callers run through the query, update, and field control functions like any other
+	// caller, and the control functions can check Caller#IsSystem themselves. If not set, system callers skip them.
+	SystemRunsControl bool
+
+	// QueryCacheSize, if set, caches the results of up to that many distinct Selects in Views. Cached results are removed
+	// when an Update commits changes to any type involved in their query, or executes raw SQL. Note that cached structs
+	// are copied shallowly, so pointers, slices, and maps in them are shared between the results of cache hits.
+	QueryCacheSize int
+
+	// MaxScanRows, if set, makes Select examine the query plan before executing it, and abort with a ScanBudgetError if
+	// it would scan tables with more than that many rows in total without using an index. Counting the rows of the
+	// scanned tables isn't free, so it's not recommended for large tables.
+	MaxScanRows int
+
+	// QueryObserver, if set, gets the QueryStats of each executed or aborted Select. Like MaxScanRows, it makes Select
+	// examine the query plan first.
+	QueryObserver func(QueryStats)
+
+	// ReadPath, if set, makes Views use a separate pool of connections opened with ReadPath instead of Path, e.g.
+	// "file:snek.db?mode=ro" to open the same database read-only, while Updates use a pool limited to a single connection
+	// since SQLite only allows one writer at a time anyway. For readers not to block the writer (and vice versa) the
+	// database should use WAL journaling, e.g. via "?_journal_mode=WAL" in Path.
+	ReadPath string
+
+	// LogInterpolatedSQL makes SQL statements logged due to LogSQL or SlowQueryThreshold also include a copy of the
+	// statement with the parameters interpolated as SQLite literals, for pasting into e.g. the sqlite3 shell when
+	// debugging. Since it logs the values of the parameters in full, it shouldn't be used with sensitive data.
+	LogInterpolatedSQL bool
+
+	// IDBytes is the length of the IDs created by NewID, 32 if not set. It must be at least 16, to fit the timestamp the
+	// IDs start with and at least 8 random bytes, so IDs created in the same nanosecond (or under a fixed Now) differ.
+	// Since IDs are stored as BLOBs, IDs of other lengths (e.g. created by clients, like the 32 byte IDs of newID in the
+	// demo JS client) can still be stored and queried, but IDs of different lengths never equal each other, so clients
+	// creating their own IDs should use the same length.
+	IDBytes int
+
+	// CheckIDCollisions, if set, makes NewID remember that many of the most recently created IDs, and panic if it creates
+	// one of them again. It's meant for debugging, e.g. to detect misconfigured RandomSeed and Now in tests.
+	CheckIDCollisions int
+
+	// ReloadWindows maps type names to the minimum time between reloads of the subscriptions of the types, to avoid high
+	// write rates making all subscriptions of a type reload continuously. Subscriptions affected by Updates committed
+	// within the window after a reload are reloaded once at the end of it, so the latest state is always eventually
+	// delivered. Unlike Throttled, which limits the deliveries of a single subscription, it limits the reloads caused by
+	// the Updates of a type for all its subscriptions together.
+	ReloadWindows map[string]time.Duration
+
+	// NonFiniteFloats decides whether writing NaN or infinite floats fails (RejectNonFiniteFloats, the default), stores
+	// infinities but fails for NaN (AllowInfiniteFloats), or replaces them with finite floats (CoerceNonFiniteFloats).
+	NonFiniteFloats NonFiniteFloats
+
+	// PushWorkers, if set, limits the number of goroutines loading and delivering subscription results to that many.
+	// Subscriptions affected by Updates while all workers are busy are queued, and a subscription already in the queue
+	// isn't queued again, since its push loads the results after all changes before it. If not set, each affected
+	// subscription is pushed in its own goroutine, which can create many goroutines for popular types under load.
+	PushWorkers int
+
+	// ShareLoads makes subscriptions delivering structs share the results of loads running concurrently with, or
+	// completed since the last committed change before, their own loads, if their effective queries (including what the
+	// query control added for their callers) generate identical SQL, e.g. when many callers subscribe to the messages of
+	// the same public group. Subscriptions with different effective queries, e.g. restricted differently by the query
+	// control, never share results, and neither do subscriptions of types with field controls (see RegisterFieldControl).
+	// Like with QueryCacheSize, shared structs are copied shallowly.
+	ShareLoads bool
+
+	// ValidateType, if set, is called by Register with each registered type, after the built in checks, and makes
+	// Register fail with the error it returns, e.g. to enforce conventions like all types having a GroupID field of type ID.
+	ValidateType func(reflect.Type) error
 }
 
 // DefaultOptions returns default options with the provided path as file storage.
 func DefaultOptions(path string) Options {
 	return Options{
-		Path: path,
+		Path:            path,
+		ViewIsolation:   sql.LevelSerializable,
+		UpdateIsolation: sql.LevelSerializable,
+		Now:             time.Now,
+		IDBytes:         32,
 	}
 }
 
 // Open returns a store using the provided options.
 func (o Options) Open() (*Snek, error) {
+	if o.IDBytes == 0 {
+		o.IDBytes = 32
+	} else if o.IDBytes < 16 {
+		return nil, fmt.Errorf("IDBytes must be at least 16, not %v", o.IDBytes)
+	}
+	seed := o.RandomSeed
+	if seed == 0 {
+		seedBytes := make([]byte, 8)
+		if _, err := cryptorand.Read(seedBytes); err != nil {
+			return nil, err
+		}
+		seed = int64(binary.BigEndian.Uint64(seedBytes))
+	}
 	db, err := sqlx.Open("sqlite3", o.Path)
 	if err != nil {
 		return nil, err
 	}
-	db.MapperFunc(func(s string) string {
-		return s
-	})
+	db.MapperFunc(naming(o.NameMapper).name)
+	readDB := db
+	if o.ReadPath != "" {
+		if readDB, err = sqlx.Open("sqlite3", o.ReadPath); err != nil {
+			db.Close()
+			return nil, err
+		}
+		readDB.MapperFunc(naming(o.NameMapper).name)
+		db.SetMaxOpenConns(1)
+	}
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+	var cache *queryCache
+	if o.QueryCacheSize > 0 {
+		cache = newQueryCache(o.QueryCacheSize)
+	}
+	var pool *pushPool
+	if o.PushWorkers > 0 {
+		pool = newPushPool(o.PushWorkers)
+	}
+	var loads *sharedLoads
+	if o.ShareLoads {
+		loads = newSharedLoads()
+	}
 	return &Snek{
-		ctx:           context.Background(),
-		db:            db,
-		options:       o,
-		rng:           rand.New(rand.NewSource(o.RandomSeed)),
-		subscriptions: synch.NewSMap[string, *synch.SMap[string, Subscription]](),
-		permissions:   map[string]permissions{},
+		ctx:                     context.Background(),
+		db:                      db,
+		options:                 o,
+		ids:                     synch.New(newIDGenerator(seed, o.CheckIDCollisions)),
+		subscriptions:           synch.NewSMap[string, *synch.SMap[string, Subscription]](),
+		correlatedSubscriptions: synch.NewSMap[string, *synch.SMap[string, *subscription]](),
+		permissions:             map[string]permissions{},
+		queryCache:              cache,
+		readDB:                  readDB,
+		watchers:                synch.NewSMap[string, *synch.SMap[string, watcher]](),
+		reloadBatches:           synch.NewSMap[string, *reloadBatch](),
+		commitTimes:             synch.NewSMap[string, time.Time](),
+		pushPool:                pool,
+		sharedLoads:             loads,
 	}, nil
 }
+
+// naming maps Go names to SQL names. A nil naming maps names to themselves.
+type naming func(string) string
+
+func (n naming) name(s string) string {
+	if n == nil {
+		return s
+	}
+	return n(s)
+}
+
+func (n naming) table(typ reflect.Type) string {
+	return n.name(typ.Name())
+}
+
+// column maps each part of a (possibly nested, "." separated) field name, the same way sqlx does when scanning.
+func (n naming) column(field string) string {
+	if n == nil {
+		return field
+	}
+	parts := strings.Split(field, ".")
+	for index := range parts {
+		parts[index] = n(parts[index])
+	}
+	return strings.Join(parts, ".")
+}
+
+// SnakeCase is a NameMapper converting names like OwnerID to owner_id.
+func SnakeCase(s string) string {
+	runes := []rune(s)
+	buf := &strings.Builder{}
+	for index, r := range runes {
+		if unicode.IsUpper(r) {
+			if index > 0 && (!unicode.IsUpper(runes[index-1]) || (index+1 < len(runes) && unicode.IsLower(runes[index+1]))) {
+				buf.WriteRune('_')
+			}
+			buf.WriteRune(unicode.ToLower(r))
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
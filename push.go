@@ -0,0 +1,62 @@
+package snek
+
+import (
+	"sync"
+)
+
+// pushPool pushes subscriptions using at most a fixed number of goroutines, as configured by Options.PushWorkers.
+// Workers are started when pushes are queued, and exit when the queue is empty.
+type pushPool struct {
+	lock    sync.Mutex
+	workers int
+	running int
+	// queue contains the IDs of the subscriptions waiting to be pushed, in the order they were queued, and queued maps them
+	// to the subscriptions. A subscription is only queued once, since a single push loads the results after all changes before it.
+	queue  []string
+	queued subscriptionSet
+}
+
+func newPushPool(workers int) *pushPool {
+	return &pushPool{
+		workers: workers,
+		queued:  subscriptionSet{},
+	}
+}
+
+// push pushes subs, using a goroutine per subscription if p is nil, and queueing them for the workers of p otherwise.
+func (p *pushPool) push(subs subscriptionSet) {
+	if p == nil {
+		subs.push()
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for id, sub := range subs {
+		if _, found := p.queued[id]; found {
+			continue
+		}
+		p.queued[id] = sub
+		p.queue = append(p.queue, id)
+	}
+	for p.running < p.workers && p.running < len(p.queue) {
+		p.running++
+		go p.work()
+	}
+}
+
+func (p *pushPool) work() {
+	for {
+		p.lock.Lock()
+		if len(p.queue) == 0 {
+			p.running--
+			p.lock.Unlock()
+			return
+		}
+		id := p.queue[0]
+		p.queue = p.queue[1:]
+		sub := p.queued[id]
+		delete(p.queued, id)
+		p.lock.Unlock()
+		sub.push()
+	}
+}
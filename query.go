@@ -3,7 +3,12 @@ package snek
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"net"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -15,7 +20,7 @@ import (
 // Includes and Excludes methods. No false positives should
 // be returned however.
 type Set interface {
-	toWhereCondition(string) (string, []any)
+	toWhereCondition(naming, string) (string, []any)
 	matches(reflect.Value) (bool, error)
 	// Returns true if this set contains the value referred to by structPointer.
 	Matches(structPointer any) (bool, error)
@@ -32,7 +37,7 @@ type Set interface {
 // None matches nothing.
 type None struct{}
 
-func (n None) toWhereCondition(_ string) (string, []any) {
+func (n None) toWhereCondition(_ naming, _ string) (string, []any) {
 	return "1 = 0", nil
 }
 
@@ -59,7 +64,7 @@ func (n None) Matches(structPointer any) (bool, error) {
 // All matches everything.
 type All struct{}
 
-func (a All) toWhereCondition(_ string) (string, []any) {
+func (a All) toWhereCondition(_ naming, _ string) (string, []any) {
 	return "1 = 1", nil
 }
 
@@ -93,12 +98,40 @@ const (
 	GE Comparator = ">="
 	LT Comparator = "<"
 	LE Comparator = "<="
+	// HASBIT matches integer fields having all the bits of the value set.
+	HASBIT Comparator = "HASBIT"
+	// ANYBIT matches integer fields having any of the bits of the value set.
+	ANYBIT Comparator = "ANYBIT"
 )
 
 func (c Comparator) unrecognizedErr() error {
 	return fmt.Errorf("unrecognized comparator %v", c)
 }
 
+func (c Comparator) validate() error {
+	switch c {
+	case EQ, NE, GT, GE, LT, LE, HASBIT, ANYBIT:
+		return nil
+	default:
+		return c.unrecognizedErr()
+	}
+}
+
+func (c Comparator) isBitwise() bool {
+	return c == HASBIT || c == ANYBIT
+}
+
+func compareBits(c Comparator, a, b uint64) (bool, error) {
+	switch c {
+	case HASBIT:
+		return a&b == b, nil
+	case ANYBIT:
+		return a&b != 0, nil
+	default:
+		return false, c.unrecognizedErr()
+	}
+}
+
 func compareBytes(c Comparator, a, b []byte) (bool, error) {
 	cmp := bytes.Compare(a, b)
 	switch c {
@@ -152,6 +185,8 @@ func (c Comparator) invert() (Comparator, error) {
 		return GE, nil
 	case LE:
 		return GT, nil
+	case HASBIT, ANYBIT:
+		return "", fmt.Errorf("bitwise comparator %v can't be inverted", c)
 	default:
 		return "", c.unrecognizedErr()
 	}
@@ -168,6 +203,38 @@ func (c Comparator) apply(a, b reflect.Value) (bool, error) {
 	if !a.IsValid() || !b.IsValid() {
 		return false, fmt.Errorf("can't compare invalid values %v, %v", a, b)
 	}
+	if c.isBitwise() {
+		toBits := func(v reflect.Value) (uint64, bool) {
+			if v.CanInt() {
+				return uint64(v.Int()), true
+			} else if v.CanUint() {
+				return v.Uint(), true
+			}
+			return 0, false
+		}
+		aBits, aOK := toBits(a)
+		bBits, bOK := toBits(b)
+		if !aOK || !bOK {
+			return incomparableB()
+		}
+		return compareBits(c, aBits, bBits)
+	}
+	if a.Type() == bigIntType || b.Type() == bigIntType {
+		aBig, aOK := toBigInt(a)
+		bBig, bOK := toBigInt(b)
+		if !aOK || !bOK {
+			return incomparableB()
+		}
+		return comparePrimitives(c, aBig.Cmp(bBig), 0)
+	}
+	if a.Type() == ipType || b.Type() == ipType {
+		aBytes, aOK := toIPBytes(a)
+		bBytes, bOK := toIPBytes(b)
+		if !aOK || !bOK {
+			return incomparableB()
+		}
+		return compareBytes(c, aBytes, bBytes)
+	}
 	if a.Kind() == reflect.String {
 		if b.Kind() == reflect.String {
 			return comparePrimitives(c, a.String(), b.String())
@@ -226,12 +293,12 @@ func noImplication(a, b reflect.Value) (bool, error) {
 func incInt(aDelta, bDelta uint, f comparison) comparison {
 	return func(a, b reflect.Value) (bool, error) {
 		if a.CanInt() && b.CanInt() {
-			aFix := reflect.ValueOf(a.Int() + int64(aDelta))
-			bFix := reflect.ValueOf(b.Int() + int64(bDelta))
+			aFix := reflect.ValueOf(saturatingAddInt(a.Int(), aDelta))
+			bFix := reflect.ValueOf(saturatingAddInt(b.Int(), bDelta))
 			return f(aFix, bFix)
 		} else if a.CanUint() && b.CanUint() {
-			aFix := reflect.ValueOf(a.Uint() + uint64(aDelta))
-			bFix := reflect.ValueOf(b.Uint() + uint64(bDelta))
+			aFix := reflect.ValueOf(saturatingAddUint(a.Uint(), aDelta))
+			bFix := reflect.ValueOf(saturatingAddUint(b.Uint(), bDelta))
 			return f(aFix, bFix)
 		} else {
 			return f(a, b)
@@ -239,10 +306,36 @@ func incInt(aDelta, bDelta uint, f comparison) comparison {
 	}
 }
 
+// saturatingAddInt returns i + delta, or math.MaxInt64 if the sum would overflow.
+// Clamping is safe for the implications, since e.g. "> math.MaxInt64" contains no integers and implies anything.
+func saturatingAddInt(i int64, delta uint) int64 {
+	if uint64(delta) > uint64(math.MaxInt64) || i > math.MaxInt64-int64(delta) {
+		return math.MaxInt64
+	}
+	return i + int64(delta)
+}
+
+// saturatingAddUint returns u + delta, or math.MaxUint64 if the sum would overflow.
+func saturatingAddUint(u uint64, delta uint) uint64 {
+	if u > math.MaxUint64-uint64(delta) {
+		return math.MaxUint64
+	}
+	return u + uint64(delta)
+}
+
 func implications(a, b Comparator) (isTrue, isFalse comparison, err error) {
 	unrecognizedComparator := func(c Comparator) (comparison, comparison, error) {
 		return nil, nil, c.unrecognizedErr()
 	}
+	if a.isBitwise() || b.isBitwise() {
+		if err := a.validate(); err != nil {
+			return nil, nil, err
+		}
+		if err := b.validate(); err != nil {
+			return nil, nil, err
+		}
+		return noImplication, noImplication, nil
+	}
 	switch a {
 	case EQ:
 		switch b {
@@ -358,6 +451,29 @@ type Cond struct {
 	Value      any
 }
 
+// NewCond returns a Cond after validating that the comparator is known and that the value is of a comparable kind.
+// Use it instead of a Cond literal when the parts come from untrusted sources.
+func NewCond(field string, comparator Comparator, value any) (Cond, error) {
+	if field == "" {
+		return Cond{}, fmt.Errorf("conditions need a field")
+	}
+	if err := comparator.validate(); err != nil {
+		return Cond{}, err
+	}
+	val := reflect.ValueOf(value)
+	if !val.IsValid() {
+		return Cond{}, fmt.Errorf("%q %s nil: nil isn't comparable", field, comparator)
+	}
+	if comparator.isBitwise() {
+		if !val.CanInt() && !val.CanUint() {
+			return Cond{}, fmt.Errorf("%q %s %v: bitwise comparators need integer values, not %T", field, comparator, value, value)
+		}
+	} else if val.Type() != bigIntType && val.Kind() != reflect.String && val.Kind() != reflect.Bool && !val.CanInt() && !val.CanUint() && !val.CanFloat() && !val.CanConvert(byteSliceType) {
+		return Cond{}, fmt.Errorf("%q %s %v: %T isn't comparable", field, comparator, value, value)
+	}
+	return Cond{Field: field, Comparator: comparator, Value: value}, nil
+}
+
 func (c *Cond) String() string {
 	return fmt.Sprintf("%+v", *c)
 }
@@ -402,6 +518,10 @@ func (c Cond) Includes(s Set) (bool, error) {
 		return false, nil
 
 	}
+	if c.Comparator.isBitwise() {
+		// Bitwise conditions can't be inverted, so we can't reason about them.
+		return false, nil
+	}
 	invertedC, err := c.Invert()
 	if err != nil {
 		return false, err
@@ -423,23 +543,37 @@ func (c Cond) Matches(structPointer any) (bool, error) {
 
 func (c Cond) matches(val reflect.Value) (bool, error) {
 	if val.Kind() != reflect.Struct {
-		return false, fmt.Errorf("only structs allowed, not %v", val.Interface())
+		return false, &InvalidArgumentError{Allowed: "structs", Argument: val.Interface()}
+	}
+	fieldVal, err := fieldByName(val, c.Field)
+	if err != nil {
+		return false, err
+	}
+	if !fieldVal.IsValid() {
+		// Like NULL in SQL, nil doesn't compare to anything.
+		return false, nil
 	}
-	return c.Comparator.apply(val.FieldByName(c.Field), reflect.ValueOf(c.Value))
+	return c.Comparator.apply(fieldVal, reflect.ValueOf(c.Value))
 }
 
-func (c Cond) toWhereCondition(tablePrefix string) (string, []any) {
-	return fmt.Sprintf("\"%s\".\"%s\" %s ?", tablePrefix, c.Field, c.Comparator), []any{c.Value}
+func (c Cond) toWhereCondition(n naming, tablePrefix string) (string, []any) {
+	switch c.Comparator {
+	case HASBIT:
+		return fmt.Sprintf("(\"%s\".\"%s\" & ?) = ?", tablePrefix, n.column(c.Field)), []any{c.Value, c.Value}
+	case ANYBIT:
+		return fmt.Sprintf("(\"%s\".\"%s\" & ?) != 0", tablePrefix, n.column(c.Field)), []any{c.Value}
+	}
+	return fmt.Sprintf("\"%s\".\"%s\" %s ?", tablePrefix, n.column(c.Field), c.Comparator), []any{c.Value}
 }
 
 // And defines a Set of all structs present in all contained Sets.
 type And []Set
 
-func (a And) toWhereCondition(tablePrefix string) (string, []any) {
+func (a And) toWhereCondition(n naming, tablePrefix string) (string, []any) {
 	stringParts := []string{}
 	valueParts := []any{}
 	for _, set := range a {
-		sql, params := getWhereCondition(tablePrefix, set, All{})
+		sql, params := getWhereCondition(n, tablePrefix, set, All{})
 		stringParts = append(stringParts, fmt.Sprintf("(%s)", sql))
 		valueParts = append(valueParts, params...)
 	}
@@ -489,28 +623,66 @@ func (a And) Matches(structPointer any) (bool, error) {
 }
 
 func (a And) matches(val reflect.Value) (bool, error) {
-	acc := true
+	// Errors are only returned if no other part decides the result.
+	var firstErr error
 	for _, part := range a {
 		inc, err := part.matches(val)
 		if err != nil {
-			return false, err
-		}
-		acc = acc && inc
-		if !acc {
-			break
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if !inc {
+			return false, nil
 		}
 	}
-	return acc, nil
+	if firstErr != nil {
+		return false, firstErr
+	}
+	return true, nil
 }
 
 // Or defines a Set of all structs contained in any contained Set.
 type Or []Set
 
-func (o Or) toWhereCondition(tablePrefix string) (string, []any) {
+// inCondition returns the field and values of o if o only contains EQ conditions on the same field.
+func (o Or) inCondition() (string, []any, bool) {
+	if len(o) < 2 {
+		return "", nil, false
+	}
+	field := ""
+	values := []any{}
+	for _, set := range o {
+		var cond Cond
+		switch v := set.(type) {
+		case Cond:
+			cond = v
+		case *Cond:
+			if v == nil {
+				return "", nil, false
+			}
+			cond = *v
+		default:
+			return "", nil, false
+		}
+		if cond.Comparator != EQ || (field != "" && cond.Field != field) {
+			return "", nil, false
+		}
+		field = cond.Field
+		values = append(values, cond.Value)
+	}
+	return field, values, true
+}
+
+func (o Or) toWhereCondition(n naming, tablePrefix string) (string, []any) {
+	// Large Ors of equalities, e.g. from query control functions, are much faster as IN conditions.
+	if field, values, ok := o.inCondition(); ok {
+		qms := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+		return fmt.Sprintf("\"%s\".\"%s\" IN (%s)", tablePrefix, n.column(field), qms), values
+	}
 	stringParts := []string{}
 	valueParts := []any{}
 	for _, set := range o {
-		sql, params := getWhereCondition(tablePrefix, set, None{})
+		sql, params := getWhereCondition(n, tablePrefix, set, None{})
 		stringParts = append(stringParts, fmt.Sprintf("(%s)", sql))
 		valueParts = append(valueParts, params...)
 	}
@@ -560,24 +732,299 @@ func (o Or) Matches(structPointer any) (bool, error) {
 }
 
 func (o Or) matches(val reflect.Value) (bool, error) {
-	acc := false
+	// Errors are only returned if no other part decides the result.
+	var firstErr error
 	for _, part := range o {
 		inc, err := part.matches(val)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if inc {
+			return true, nil
+		}
+	}
+	if firstErr != nil {
+		return false, firstErr
+	}
+	return false, nil
+}
+
+// PrefixMatch returns a Set of all structs whose string field starts with prefix.
+// Instead of LIKE it uses the range field >= prefix AND field < prefix with its last byte incremented,
+// which SQLite can use an index for. Trailing 0xFF bytes can't be incremented, so they are dropped
+// before incrementing the byte before them, and a prefix consisting of only 0xFF bytes has no upper bound.
+// The empty prefix matches all structs.
+func PrefixMatch(field, prefix string) Set {
+	if prefix == "" {
+		return All{}
+	}
+	upper := []byte(prefix)
+	for len(upper) > 0 && upper[len(upper)-1] == 0xff {
+		upper = upper[:len(upper)-1]
+	}
+	if len(upper) == 0 {
+		return Cond{field, GE, prefix}
+	}
+	upper[len(upper)-1]++
+	return And{Cond{field, GE, prefix}, Cond{field, LT, string(upper)}}
+}
+
+// In defines a Set of all structs whose Fields, taken together, equal one of the tuples in Values,
+// e.g. In{Fields: []string{"GroupID", "UserID"}, Values: [][]any{{g1, u1}, {g2, u2}}}, which is faster
+// and indexes better than the equivalent Or of Ands. Each tuple must have one value per field.
+// Like NULL in SQL, nil fields don't equal anything.
+type In struct {
+	Fields []string
+	Values [][]any
+	// inverted makes the Set contain the structs not in Values instead.
+	inverted bool
+}
+
+func (i In) toWhereCondition(n naming, tablePrefix string) (string, []any) {
+	if len(i.Values) == 0 {
+		if i.inverted {
+			return "1 = 1", nil
+		}
+		return "1 = 0", nil
+	}
+	columns := make([]string, len(i.Fields))
+	for index, field := range i.Fields {
+		columns[index] = fmt.Sprintf("\"%s\".\"%s\"", tablePrefix, n.column(field))
+	}
+	tupleQMs := fmt.Sprintf("(%s)", strings.TrimSuffix(strings.Repeat("?, ", len(i.Fields)), ", "))
+	tuples := make([]string, len(i.Values))
+	params := []any{}
+	for index, tuple := range i.Values {
+		tuples[index] = tupleQMs
+		params = append(params, tuple...)
+	}
+	not := ""
+	if i.inverted {
+		not = "NOT "
+	}
+	return fmt.Sprintf("(%s) %sIN (VALUES %s)", strings.Join(columns, ", "), not, strings.Join(tuples, ", ")), params
+}
+
+func (i In) Matches(structPointer any) (bool, error) {
+	return i.matches(reflect.ValueOf(structPointer))
+}
+
+func (i In) matches(val reflect.Value) (bool, error) {
+	if val.Kind() != reflect.Struct {
+		return false, &InvalidArgumentError{Allowed: "structs", Argument: val.Interface()}
+	}
+	fieldVals := make([]reflect.Value, len(i.Fields))
+	for index, field := range i.Fields {
+		fieldVal, err := fieldByName(val, field)
 		if err != nil {
 			return false, err
 		}
-		acc = acc || inc
-		if acc {
-			break
+		fieldVals[index] = fieldVal
+	}
+	// Like SQL, a tuple containing nil fields is unknown instead of unequal, unless another field is unequal,
+	// and NOT IN is only true if every tuple is unequal.
+	unknown := false
+	for _, tuple := range i.Values {
+		if len(tuple) != len(fieldVals) {
+			return false, &InvalidArgumentError{Allowed: fmt.Sprintf("tuples with %v values", len(fieldVals)), Argument: tuple}
 		}
+		equal, tupleUnknown := true, false
+		for index, fieldVal := range fieldVals {
+			if !fieldVal.IsValid() {
+				tupleUnknown = true
+				continue
+			}
+			eq, err := EQ.apply(fieldVal, reflect.ValueOf(tuple[index]))
+			if err != nil {
+				return false, err
+			}
+			if !eq {
+				equal = false
+				break
+			}
+		}
+		if equal && !tupleUnknown {
+			return !i.inverted, nil
+		}
+		unknown = unknown || (equal && tupleUnknown)
 	}
-	return acc, nil
+	return i.inverted && !unknown, nil
+}
+
+// Excludes only knows that In excludes None, since reasoning about tuples of conditions isn't worth the risk of false positives.
+func (i In) Excludes(s Set) (bool, error) {
+	_, isNone := s.(None)
+	return isNone, nil
+}
+
+// Includes only knows that In includes None, since reasoning about tuples of conditions isn't worth the risk of false positives.
+func (i In) Includes(s Set) (bool, error) {
+	_, isNone := s.(None)
+	return isNone, nil
+}
+
+func (i In) Invert() (Set, error) {
+	i.inverted = !i.inverted
+	return i, nil
+}
+
+// normalize returns i with the values of all tuples converted like Cond.normalize, dropping tuples that can't equal any struct.
+func (i In) normalize(columns fieldInfoMap) Set {
+	values := make([][]any, 0, len(i.Values))
+	for _, tuple := range i.Values {
+		if len(tuple) != len(i.Fields) {
+			// Left for validation or matches to reject.
+			return i
+		}
+		normalized := make([]any, len(tuple))
+		possible := true
+		for index, value := range tuple {
+			switch v := (Cond{i.Fields[index], EQ, value}).normalize(columns).(type) {
+			case Cond:
+				normalized[index] = v.Value
+			default:
+				possible = false
+			}
+		}
+		if possible {
+			values = append(values, normalized)
+		}
+	}
+	i.Values = values
+	return i
+}
+
+func (i In) clone() In {
+	i.Fields = append([]string{}, i.Fields...)
+	values := make([][]any, len(i.Values))
+	for index, tuple := range i.Values {
+		values[index] = make([]any, len(tuple))
+		for valueIndex, value := range tuple {
+			values[index][valueIndex] = Cond{Value: value}.clone().Value
+		}
+	}
+	i.Values = values
+	return i
 }
 
 // Order defines an order for the structs returned by a query.
+// Field refers to a field of the main type of the query, or to a
+// field of a joined type if created using JoinField.
+// Expression, if set, is used verbatim as the ORDER BY expression
+// instead of Field, e.g. to order by computed values. Since it isn't
+// escaped in any way, only system and admin callers may use it.
+// Cases, if set, is used instead of Field to order the structs by the
+// Rank of the first case whose Set contains them, e.g. to put pinned
+// structs first. Structs in no case rank after all cases.
+// Nulls, if set, places NULLs (e.g. nil pointer fields) first or last
+// regardless of Desc.
 type Order struct {
-	Field string
-	Desc  bool
+	Field      string
+	Desc       bool
+	Expression string
+	Cases      []OrderCase
+	Nulls      NullPlacement
+	// rowID makes the order the rowid of the main table instead, i.e. the order the structs were inserted, used by Tail.
+	rowID bool
+}
+
+// NullPlacement defines where an Order places NULLs.
+type NullPlacement string
+
+const (
+	// NullsDefault leaves the placement to SQLite, which considers NULLs smaller than all other values.
+	NullsDefault NullPlacement = ""
+	NullsFirst   NullPlacement = "FIRST"
+	NullsLast    NullPlacement = "LAST"
+)
+
+// OrderCase ranks the structs in Set as Rank when ordering by Order.Cases.
+type OrderCase struct {
+	Set  Set
+	Rank int
+}
+
+func (o Order) clone() Order {
+	if o.Cases != nil {
+		cases := make([]OrderCase, len(o.Cases))
+		for i, orderCase := range o.Cases {
+			cases[i] = OrderCase{Set: cloneSet(orderCase.Set), Rank: orderCase.Rank}
+		}
+		o.Cases = cases
+	}
+	return o
+}
+
+func (o Order) toOrderTerm(n naming, q *Query, mainTableName string) (string, []any) {
+	term := ""
+	params := []any{}
+	if o.Expression != "" {
+		term = fmt.Sprintf("(%s)", o.Expression)
+	} else if o.rowID {
+		term = fmt.Sprintf("\"%s\".rowid", mainTableName)
+	} else if len(o.Cases) > 0 {
+		buf := &bytes.Buffer{}
+		fmt.Fprint(buf, "CASE")
+		elseRank := 0
+		for i, orderCase := range o.Cases {
+			caseSQL, caseParams := getWhereCondition(n, mainTableName, orderCase.Set, All{})
+			fmt.Fprintf(buf, " WHEN (%s) THEN %d", caseSQL, orderCase.Rank)
+			params = append(params, caseParams...)
+			if i == 0 || orderCase.Rank+1 > elseRank {
+				elseRank = orderCase.Rank + 1
+			}
+		}
+		fmt.Fprintf(buf, " ELSE %d END", elseRank)
+		term = buf.String()
+	} else {
+		tableName, field, _ := q.parseField(mainTableName, o.Field)
+		term = fmt.Sprintf("\"%s\".\"%s\"", tableName, n.column(field))
+	}
+	// SQLite doesn't support NULLS FIRST/LAST, so NULLs are placed by first ordering by whether the term is NULL.
+	// Cases are never NULL, and would need their params repeated.
+	nullsTerm := ""
+	if len(o.Cases) == 0 {
+		switch o.Nulls {
+		case NullsFirst:
+			nullsTerm = fmt.Sprintf("%s IS NULL DESC, ", term)
+		case NullsLast:
+			nullsTerm = fmt.Sprintf("%s IS NULL ASC, ", term)
+		}
+	}
+	if o.Desc {
+		return nullsTerm + term + " DESC", params
+	}
+	return nullsTerm + term + " ASC", params
+}
+
+var (
+	joinFieldPattern = regexp.MustCompile(`^j(\d+)\.(.+)$`)
+)
+
+// JoinField returns a field name referring to field in the join at joinIndex of a query.
+// Since unexported fields are never stored, the generated name can't collide with a field of the main type.
+func JoinField(joinIndex int, field string) string {
+	return fmt.Sprintf("%s.%s", joinAlias(joinIndex), field)
+}
+
+func joinAlias(joinIndex int) string {
+	return fmt.Sprintf("j%d", joinIndex)
+}
+
+// parseField returns the table prefix and field referred to by field.
+func (q *Query) parseField(mainTableName string, field string) (string, string, error) {
+	if match := joinFieldPattern.FindStringSubmatch(field); match != nil {
+		joinIndex, err := strconv.Atoi(match[1])
+		if err != nil {
+			return "", "", err
+		}
+		if joinIndex >= len(q.Joins) {
+			return "", "", fmt.Errorf("%q refers to join %d, but query only has %d joins", field, joinIndex, len(q.Joins))
+		}
+		return joinAlias(joinIndex), match[2], nil
+	}
+	return mainTableName, field, nil
 }
 
 // On represents the ON part of a JOIN.
@@ -601,73 +1048,595 @@ type Join struct {
 	on  []On
 }
 
-func (j Join) toOnCondition(mainTypeName, joinTypeName string) string {
+func (j Join) toOnCondition(n naming, mainTableName, joinTableName string) string {
 	parts := []string{}
 	for _, on := range j.on {
-		parts = append(parts, fmt.Sprintf("\"%s\".\"%s\" %s \"%s\".\"%s\"", mainTypeName, on.MainField, on.Comparator, joinTypeName, on.JoinField))
+		parts = append(parts, fmt.Sprintf("\"%s\".\"%s\" %s \"%s\".\"%s\"", mainTableName, n.column(on.MainField), on.Comparator, joinTableName, n.column(on.JoinField)))
 	}
 	return strings.Join(parts, " AND ")
 }
 
+// errNeedsDatabase is returned when a Set can't be matched against a value without database access.
+var errNeedsDatabase = fmt.Errorf("set can't be matched without database access")
+
+// Exists returns a Set of all structs for which there exists a struct of the same type as structPointer
+// that is in set, and whose fields relate to the fields of the matched struct as defined by correlation.
+// Unlike a Join it never duplicates results, but since it can't be matched without database access,
+// subscriptions using it will reload on every change of the subscribed type and the type of structPointer.
+func Exists(structPointer any, correlation []On, set Set) Set {
+	typ := reflect.TypeOf(structPointer)
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return existsSet{typ: typ, correlation: correlation, set: set}
+}
+
+type existsSet struct {
+	typ         reflect.Type
+	correlation []On
+	set         Set
+	inverted    bool
+}
+
+func (e existsSet) toWhereCondition(n naming, tablePrefix string) (string, []any) {
+	alias := fmt.Sprintf("%s_exists", tablePrefix)
+	parts := []string{}
+	for _, on := range e.correlation {
+		parts = append(parts, fmt.Sprintf("\"%s\".\"%s\" %s \"%s\".\"%s\"", tablePrefix, n.column(on.MainField), on.Comparator, alias, n.column(on.JoinField)))
+	}
+	sql, params := getWhereCondition(n, alias, e.set, All{})
+	parts = append(parts, fmt.Sprintf("(%s)", sql))
+	not := ""
+	if e.inverted {
+		not = "NOT "
+	}
+	return fmt.Sprintf("%sEXISTS (SELECT 1 FROM \"%s\" \"%s\" WHERE %s)", not, n.table(e.typ), alias, strings.Join(parts, " AND ")), params
+}
+
+func (e existsSet) matches(reflect.Value) (bool, error) {
+	return false, errNeedsDatabase
+}
+
+func (e existsSet) Matches(structPointer any) (bool, error) {
+	return false, errNeedsDatabase
+}
+
+func (e existsSet) Excludes(s Set) (bool, error) {
+	_, isNone := s.(None)
+	return isNone, nil
+}
+
+func (e existsSet) Includes(s Set) (bool, error) {
+	_, isNone := s.(None)
+	return isNone, nil
+}
+
+func (e existsSet) Invert() (Set, error) {
+	e.inverted = !e.inverted
+	return e, nil
+}
+
+// rowIDSet contains the structs with rowids greater than after, i.e. the structs inserted after the struct with that rowid,
+// since SQLite serializes writes and gives inserted rows the rowid after the greatest one in the table. It's used by Tail.
+type rowIDSet struct {
+	after    int64
+	inverted bool
+}
+
+func (r rowIDSet) toWhereCondition(n naming, tablePrefix string) (string, []any) {
+	if r.inverted {
+		return fmt.Sprintf("\"%s\".rowid <= ?", tablePrefix), []any{r.after}
+	}
+	return fmt.Sprintf("\"%s\".rowid > ?", tablePrefix), []any{r.after}
+}
+
+func (r rowIDSet) matches(reflect.Value) (bool, error) {
+	return false, errNeedsDatabase
+}
+
+func (r rowIDSet) Matches(structPointer any) (bool, error) {
+	return false, errNeedsDatabase
+}
+
+func (r rowIDSet) Excludes(s Set) (bool, error) {
+	_, isNone := s.(None)
+	return isNone, nil
+}
+
+func (r rowIDSet) Includes(s Set) (bool, error) {
+	_, isNone := s.(None)
+	return isNone, nil
+}
+
+func (r rowIDSet) Invert() (Set, error) {
+	r.inverted = !r.inverted
+	return r, nil
+}
+
+// Recursion defines a tree of structs, starting with the structs
+// matching Start and recursively including all structs whose ParentField
+// is the ID of an already included struct.
+type Recursion struct {
+	ParentField string
+	Start       Set
+}
+
+const (
+	recursionTableName = "snek_recursion"
+)
+
+func (r *Recursion) toWithStatement(n naming, structType reflect.Type) (string, []any) {
+	tableName := n.table(structType)
+	idColumn := n.column("ID")
+	startSQL, params := getWhereCondition(n, tableName, r.Start, All{})
+	return fmt.Sprintf("WITH RECURSIVE \"%s\"(\"%s\") AS (\n  SELECT \"%s\".\"%s\" FROM \"%s\" WHERE %s\n  UNION\n  SELECT \"%s\".\"%s\" FROM \"%s\" JOIN \"%s\" ON \"%s\".\"%s\" = \"%s\".\"%s\")\n",
+		recursionTableName, idColumn,
+		tableName, idColumn, tableName, startSQL,
+		tableName, idColumn, tableName, recursionTableName, tableName, n.column(r.ParentField), recursionTableName, idColumn), params
+}
+
 // Query defines a Set of structs to be returned in a particular amount in a particular order.
+// If Offset is set, that many structs are skipped before the returned ones.
+// If Recursion is set, only structs in the tree it defines are returned.
+// If IndexedBy is set, SQLite is forced to use the index with that name to find the structs, e.g. "Message.Timestamp" for a field
+// tagged `snek:"index"`, or "Member.GroupID_UserID" for a combination returned by Uniquer. Indexes of joined types can't be forced.
 type Query struct {
-	Set      Set
-	Limit    uint
-	Distinct bool
-	Order    []Order
-	Joins    []Join
+	Set       Set
+	Limit     uint
+	Offset    uint
+	Distinct  bool
+	Order     []Order
+	Joins     []Join
+	Recursion *Recursion
+	IndexedBy string
+}
+
+// normalize converts the values of all conditions in the query to match the declared types of their columns.
+func (q *Query) normalize(structType reflect.Type) {
+	columns := (&valueInfo{typ: structType}).fields(false)
+	q.Set = normalizeSet(q.Set, columns)
+	if q.Recursion != nil {
+		q.Recursion.Start = normalizeSet(q.Recursion.Start, columns)
+	}
+	for _, order := range q.Order {
+		for index := range order.Cases {
+			order.Cases[index].Set = normalizeSet(order.Cases[index].Set, columns)
+		}
+	}
+	for index := range q.Joins {
+		q.Joins[index].set = normalizeSet(q.Joins[index].set, (&valueInfo{typ: q.Joins[index].typ}).fields(false))
+	}
+}
+
+// normalizeSet returns s with the values of all conditions converted to match the declared types of their columns,
+// so that SQLite and Cond.matches agree about which structs are included.
+func normalizeSet(s Set, columns fieldInfoMap) Set {
+	switch v := s.(type) {
+	case And:
+		result := make(And, len(v))
+		for i, part := range v {
+			result[i] = normalizeSet(part, columns)
+		}
+		return result
+	case Or:
+		result := make(Or, len(v))
+		for i, part := range v {
+			result[i] = normalizeSet(part, columns)
+		}
+		return result
+	case Cond:
+		return v.normalize(columns)
+	case *Cond:
+		if v == nil {
+			return v
+		}
+		return v.normalize(columns)
+	case In:
+		return v.normalize(columns)
+	default:
+		return s
+	}
+}
+
+// normalize returns c with the value converted to match the declared type of the column.
+// Floats compared to INTEGER columns are rounded in the direction that keeps the set the same,
+// since SQLite and Go would otherwise disagree about e.g. precision.
+func (c Cond) normalize(columns fieldInfoMap) Set {
+	column, found := columns[c.Field]
+	if !found || c.Comparator.isBitwise() {
+		return c
+	}
+	val := reflect.ValueOf(c.Value)
+	if !val.IsValid() || val.Type() == bigIntType {
+		return c
+	}
+	if val.Type() == ipType {
+		c.Value = canonicalIP(c.Value.(net.IP))
+		return c
+	}
+	if column.normalizeText != nil && val.Kind() == reflect.String {
+		c.Value = column.normalizeText(val.String())
+		return c
+	}
+	switch column.columnType {
+	case "REAL":
+		if val.CanInt() {
+			c.Value = float64(val.Int())
+		} else if val.CanUint() {
+			c.Value = float64(val.Uint())
+		}
+	case "INTEGER":
+		if !val.CanFloat() {
+			return c
+		}
+		f := val.Float()
+		if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return c
+		}
+		if f == math.Trunc(f) {
+			c.Value = int64(f)
+			return c
+		}
+		switch c.Comparator {
+		case EQ:
+			return None{}
+		case NE:
+			return All{}
+		case GT, LE:
+			c.Value = int64(math.Floor(f))
+		case GE, LT:
+			c.Value = int64(math.Ceil(f))
+		}
+	}
+	return c
+}
+
+func (q *Query) validate(caller Caller, structType reflect.Type) error {
+	for _, order := range q.Order {
+		if order.Nulls != NullsDefault && order.Nulls != NullsFirst && order.Nulls != NullsLast {
+			return &InvalidArgumentError{Allowed: "NullsDefault, NullsFirst, and NullsLast", Argument: order.Nulls}
+		}
+		if order.rowID {
+			continue
+		}
+		if order.Expression != "" {
+			if !caller.IsSystem() && !caller.IsAdmin() {
+				return fmt.Errorf("only system and admin callers can order by expressions")
+			}
+		} else if len(order.Cases) > 0 {
+			if order.Field != "" {
+				return fmt.Errorf("orders can't have both Field and Cases")
+			}
+		} else if _, _, err := q.parseField(structType.Name(), order.Field); err != nil {
+			return err
+		}
+	}
+	sets := []Set{q.Set, q.recursionStart()}
+	for _, order := range q.Order {
+		for _, orderCase := range order.Cases {
+			sets = append(sets, orderCase.Set)
+		}
+	}
+	columns := (&valueInfo{typ: structType}).fields(false)
+	for _, set := range sets {
+		if err := validateCondTypes(structType, set, columns); err != nil {
+			return err
+		}
+	}
+	for _, join := range q.Joins {
+		if err := validateCondTypes(join.typ, join.set, (&valueInfo{typ: join.typ}).fields(false)); err != nil {
+			return err
+		}
+	}
+	for _, set := range sets {
+		if field, found := findEncryptedCond(structType, set); found {
+			return fmt.Errorf("%s is encrypted and can't be used in conditions", field)
+		}
+	}
+	for _, join := range q.Joins {
+		field, found := findEncryptedOn(structType, join.typ, join.on)
+		if !found {
+			field, found = findEncryptedCond(join.typ, join.set)
+		}
+		if found {
+			return fmt.Errorf("%s is encrypted and can't be used in conditions", field)
+		}
+	}
+	return nil
+}
+
+// validateCondTypes returns an IncompatibleCondError if a condition in s compares a column of structType to a value that
+// SQLite would compare differently than Cond.matches, so that queries and subscriptions never disagree about which structs are included.
+// Conditions on unknown fields, and with nil values, are left to fail (or not) when executed.
+func validateCondTypes(structType reflect.Type, s Set, columns fieldInfoMap) error {
+	switch v := s.(type) {
+	case And:
+		for _, part := range v {
+			if err := validateCondTypes(structType, part, columns); err != nil {
+				return err
+			}
+		}
+	case Or:
+		for _, part := range v {
+			if err := validateCondTypes(structType, part, columns); err != nil {
+				return err
+			}
+		}
+	case Cond:
+		column, found := columns[v.Field]
+		val := reflect.ValueOf(v.Value)
+		if !found || !val.IsValid() || column.encrypted {
+			return nil
+		}
+		if !condValueCompatible(column, v.Comparator, val) {
+			return &IncompatibleCondError{TypeName: structType.Name(), Field: v.Field, ColumnType: column.columnType, Value: v.Value}
+		}
+	case *Cond:
+		if v != nil {
+			return validateCondTypes(structType, *v, columns)
+		}
+	case In:
+		if len(v.Fields) == 0 {
+			return &InvalidArgumentError{Allowed: "In sets with fields", Argument: v}
+		}
+		for _, tuple := range v.Values {
+			if len(tuple) != len(v.Fields) {
+				return &InvalidArgumentError{Allowed: fmt.Sprintf("tuples with %v values", len(v.Fields)), Argument: tuple}
+			}
+			for index, value := range tuple {
+				if err := validateCondTypes(structType, Cond{v.Fields[index], EQ, value}, columns); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// condValueCompatible returns whether val can be compared to column using comparator.
+func condValueCompatible(column fieldInfo, comparator Comparator, val reflect.Value) bool {
+	isNumber := val.CanInt() || val.CanUint() || val.CanFloat()
+	if comparator.isBitwise() {
+		return column.columnType == "INTEGER" && (val.CanInt() || val.CanUint())
+	}
+	switch column.columnType {
+	case "TEXT":
+		// BigInts are stored in a fixed width form that only compares correctly to other BigInts.
+		if column.bigInt {
+			return val.Type() == bigIntType
+		}
+		return val.Kind() == reflect.String
+	case "BOOLEAN":
+		return val.Kind() == reflect.Bool
+	case "INTEGER", "REAL":
+		return isNumber
+	case "BLOB":
+		return (val.Kind() == reflect.Slice || val.Kind() == reflect.Array) && val.Type().Elem().Kind() == reflect.Uint8
+	}
+	return true
+}
+
+func (q *Query) recursionStart() Set {
+	if q.Recursion == nil {
+		return nil
+	}
+	return q.Recursion.Start
+}
+
+// cloneSet returns a deep copy of s, so that mutations of the copy don't affect the original.
+func cloneSet(s Set) Set {
+	switch v := s.(type) {
+	case And:
+		result := make(And, len(v))
+		for i, part := range v {
+			result[i] = cloneSet(part)
+		}
+		return result
+	case Or:
+		result := make(Or, len(v))
+		for i, part := range v {
+			result[i] = cloneSet(part)
+		}
+		return result
+	case Cond:
+		return v.clone()
+	case *Cond:
+		if v == nil {
+			return v
+		}
+		result := v.clone()
+		return &result
+	case In:
+		return v.clone()
+	case existsSet:
+		v.correlation = append([]On{}, v.correlation...)
+		v.set = cloneSet(v.set)
+		return v
+	default:
+		return s
+	}
+}
+
+func (c Cond) clone() Cond {
+	switch v := c.Value.(type) {
+	case ID:
+		c.Value = append(ID{}, v...)
+	case []byte:
+		c.Value = append([]byte{}, v...)
+	}
+	return c
 }
 
 func (q *Query) clone() *Query {
-	return &Query{
-		Set:      q.Set,
-		Limit:    q.Limit,
-		Distinct: q.Distinct,
-		Order:    append([]Order{}, q.Order...),
-		Joins:    append([]Join{}, q.Joins...),
+	result := &Query{
+		Set:       cloneSet(q.Set),
+		Limit:     q.Limit,
+		Offset:    q.Offset,
+		Distinct:  q.Distinct,
+		Order:     make([]Order, len(q.Order)),
+		Joins:     make([]Join, len(q.Joins)),
+		IndexedBy: q.IndexedBy,
+	}
+	for i, order := range q.Order {
+		result.Order[i] = order.clone()
+	}
+	for i, join := range q.Joins {
+		result.Joins[i] = Join{
+			typ: join.typ,
+			set: cloneSet(join.set),
+			on:  append([]On{}, join.on...),
+		}
+	}
+	if q.Recursion != nil {
+		result.Recursion = &Recursion{
+			ParentField: q.Recursion.ParentField,
+			Start:       cloneSet(q.Recursion.Start),
+		}
+	}
+	return result
+}
+
+func getSet(s Set, def Set) Set {
+	if s == nil {
+		return def
 	}
+	return s
 }
 
-func getWhereCondition(tablePrefix string, s Set, def Set) (string, []any) {
+func getWhereCondition(n naming, tablePrefix string, s Set, def Set) (string, []any) {
 	if s == nil {
-		return def.toWhereCondition(tablePrefix)
+		return def.toWhereCondition(n, tablePrefix)
 	}
-	return s.toWhereCondition(tablePrefix)
+	return s.toWhereCondition(n, tablePrefix)
 }
 
-func (q *Query) toSelectStatement(structType reflect.Type) (string, []any) {
+func (q *Query) toCountStatement(n naming, structType reflect.Type) (string, []any) {
+	selectSQL, params := q.toSelectStatement(n, structType)
+	return fmt.Sprintf("SELECT COUNT(*) FROM (%s);", strings.TrimSuffix(selectSQL, ";")), params
+}
+
+// GroupCount is the number of structs selected by a query that have Key as the value of the field they are grouped by.
+// Key is the value as returned by the SQLite driver, e.g. a string, bool, int64, float64, or []byte, or nil for NULL.
+type GroupCount struct {
+	Key   any
+	Count int
+}
+
+func (q *Query) toGroupCountStatement(n naming, structType reflect.Type, field string) (string, []any) {
+	selectSQL, params := q.toSelectStatement(n, structType)
+	column := n.column(field)
+	return fmt.Sprintf("SELECT \"%s\" AS \"%s\", COUNT(*) AS \"%s\" FROM (%s) GROUP BY \"%s\" ORDER BY \"%s\";",
+		column, n.name("Key"), n.name("Count"), strings.TrimSuffix(selectSQL, ";"), column, column), params
+}
+
+func (q *Query) toSelectStatement(n naming, structType reflect.Type) (string, []any) {
+	return q.toSelectFieldsStatement(n, structType, nil)
+}
+
+// toSelectFieldsStatement returns a statement selecting only the columns of fields, or all columns if fields is nil.
+func (q *Query) toSelectFieldsStatement(n naming, structType reflect.Type, fields []string) (string, []any) {
+	tableName := n.table(structType)
+	columns := selectColumns{sql: fmt.Sprintf("\"%s\".*", tableName)}
+	if fields != nil {
+		columnParts := []string{}
+		for _, field := range fields {
+			columnParts = append(columnParts, fmt.Sprintf("\"%s\".\"%s\"", tableName, n.column(field)))
+		}
+		columns.sql = strings.Join(columnParts, ", ")
+	}
+	return q.toSelectColumnsStatement(n, structType, columns)
+}
+
+// joinCountAlias is the alias of the table counted in statements created by toJoinCountStatement.
+const joinCountAlias = "jc"
+
+// toJoinCountStatement returns a statement selecting the columns of structType as fields of JoinCount.Struct, and the number of
+// structs related to each of them via join as JoinCount.Count, ordered by the count before the order of the query.
+func (q *Query) toJoinCountStatement(n naming, structType reflect.Type, join Join, desc bool) (string, []any) {
+	tableName := n.table(structType)
+	fieldNames := []string{}
+	for fieldName := range (&valueInfo{typ: structType}).fields(false) {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	columnParts := []string{}
+	for _, fieldName := range fieldNames {
+		columnParts = append(columnParts, fmt.Sprintf("\"%s\".\"%s\" AS \"%s\"", tableName, n.column(fieldName), n.column("Struct."+fieldName)))
+	}
+	countColumn := n.name("Count")
+	joinSQL, joinParams := getWhereCondition(n, joinCountAlias, join.set, All{})
+	columnParts = append(columnParts, fmt.Sprintf("(SELECT COUNT(*) FROM \"%s\" %s WHERE %s AND (%s)) AS \"%s\"",
+		n.table(join.typ), joinCountAlias, join.toOnCondition(n, tableName, joinCountAlias), joinSQL, countColumn))
+	direction := "ASC"
+	if desc {
+		direction = "DESC"
+	}
+	return q.toSelectColumnsStatement(n, structType, selectColumns{
+		sql:        strings.Join(columnParts, ", "),
+		params:     joinParams,
+		orderTerms: []string{fmt.Sprintf("\"%s\" %s", countColumn, direction)},
+	})
+}
+
+// selectColumns are the columns selected by a statement, and terms ordering by them before the order of the query.
+type selectColumns struct {
+	sql        string
+	params     []any
+	orderTerms []string
+}
+
+func (q *Query) toSelectColumnsStatement(n naming, structType reflect.Type, columns selectColumns) (string, []any) {
+	tableName := n.table(structType)
 	buf := &bytes.Buffer{}
+	params := []any{}
+	if q.Recursion != nil {
+		withSQL, withParams := q.Recursion.toWithStatement(n, structType)
+		fmt.Fprint(buf, withSQL)
+		params = append(params, withParams...)
+	}
 	distinct := ""
 	if q.Distinct {
 		distinct = "DISTINCT "
 	}
-	fmt.Fprintf(buf, "SELECT %s\"%s\".* FROM \"%s\"", distinct, structType.Name(), structType.Name())
+	fmt.Fprintf(buf, "SELECT %s%s FROM \"%s\"", distinct, columns.sql, tableName)
+	if q.IndexedBy != "" {
+		fmt.Fprintf(buf, " INDEXED BY \"%s\"", strings.ReplaceAll(q.IndexedBy, "\"", "\"\""))
+	}
+	params = append(params, columns.params...)
 	if q.Set == nil {
 		q.Set = All{}
 	}
-	mainSQL, params := q.Set.toWhereCondition(structType.Name())
+	mainSQL, mainParams := q.Set.toWhereCondition(n, tableName)
+	params = append(params, mainParams...)
 	sqlParts := []string{mainSQL}
+	if q.Recursion != nil {
+		sqlParts = append(sqlParts, fmt.Sprintf("\"%s\".\"%s\" IN (SELECT \"%s\" FROM \"%s\")", tableName, n.column("ID"), n.column("ID"), recursionTableName))
+	}
 	for joinIndex, join := range q.Joins {
-		joinName := fmt.Sprintf("j%d", joinIndex)
-		fmt.Fprintf(buf, "\nJOIN \"%s\" %s ON %s", join.typ.Name(), joinName, join.toOnCondition(structType.Name(), joinName))
-		joinSQL, joinParams := join.set.toWhereCondition(joinName)
+		joinName := joinAlias(joinIndex)
+		fmt.Fprintf(buf, "\nJOIN \"%s\" %s ON %s", n.table(join.typ), joinName, join.toOnCondition(n, tableName, joinName))
+		joinSQL, joinParams := join.set.toWhereCondition(n, joinName)
 		sqlParts = append(sqlParts, joinSQL)
 		params = append(params, joinParams...)
 	}
 	fmt.Fprintf(buf, "\nWHERE %s", strings.Join(sqlParts, " AND "))
-	if len(q.Order) > 0 {
-		orderParts := []string{}
+	if len(columns.orderTerms) > 0 || len(q.Order) > 0 {
+		orderParts := append([]string{}, columns.orderTerms...)
 		for _, order := range q.Order {
-			if order.Desc {
-				orderParts = append(orderParts, fmt.Sprintf("\"%s\" DESC", order.Field))
-			} else {
-				orderParts = append(orderParts, fmt.Sprintf("\"%s\" ASC", order.Field))
-			}
+			orderSQL, orderParams := order.toOrderTerm(n, q, tableName)
+			orderParts = append(orderParts, orderSQL)
+			params = append(params, orderParams...)
 		}
 		fmt.Fprintf(buf, " ORDER BY %s", strings.Join(orderParts, ", "))
 	}
 	if q.Limit != 0 {
 		fmt.Fprintf(buf, " LIMIT %d", q.Limit)
+	} else if q.Offset != 0 {
+		// SQLite doesn't allow OFFSET without LIMIT.
+		fmt.Fprint(buf, " LIMIT -1")
+	}
+	if q.Offset != 0 {
+		fmt.Fprintf(buf, " OFFSET %d", q.Offset)
 	}
 	fmt.Fprint(buf, ";")
 	return buf.String(), params
@@ -685,6 +1654,47 @@ func SetIncludes(superset, subset Set) error {
 	return nil
 }
 
+// HasResults is a typed convenience for control functions that returns whether the query has any results of type T.
+func HasResults[T any](v *View, q *Query) (bool, error) {
+	if q == nil {
+		q = &Query{}
+	}
+	limited := q.clone()
+	limited.Limit = 1
+	results := []T{}
+	if err := v.Select(&results, limited); err != nil {
+		return false, err
+	}
+	return len(results) > 0, nil
+}
+
+// Load is a typed convenience for control functions that returns the T with the given ID, and whether it was found.
+func Load[T any](v *View, id ID) (*T, bool, error) {
+	results := []T{}
+	if err := v.Select(&results, &Query{Set: Cond{"ID", EQ, id}, Limit: 1}); err != nil {
+		return nil, false, err
+	}
+	if len(results) == 0 {
+		return nil, false, nil
+	}
+	return &results[0], true, nil
+}
+
+// ListAll is a convenience for admin tooling that returns all structs of type T, as seen by the query control.
+// Only admin and system callers are allowed to use it.
+func ListAll[T any](s *Snek, caller Caller) ([]T, error) {
+	if !caller.IsAdmin() && !caller.IsSystem() {
+		return nil, fmt.Errorf("only system and admin callers can list all structs")
+	}
+	results := []T{}
+	if err := s.View(caller, func(v *View) error {
+		return v.Select(&results, &Query{Set: All{}})
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 // QueryHasResults is a convenience for query control functions that checks if the query has results.
 func QueryHasResults[T any](v *View, s []T, q *Query) error {
 	if err := v.Select(&s, q); err != nil {
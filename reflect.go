@@ -3,14 +3,17 @@ package snek
 import (
 	"bytes"
 	"fmt"
+	"net"
 	"reflect"
 	"strings"
 )
 
 type valueInfo struct {
-	val                  reflect.Value
-	typ                  reflect.Type
-	id                   ID
+	val reflect.Value
+	typ reflect.Type
+	id  ID
+	// key is the names of the fields making up the primary key.
+	key                  []string
 	_fieldsWithValues    fieldInfoMap
 	_fieldsWithoutValues fieldInfoMap
 }
@@ -21,6 +24,14 @@ type fieldInfo struct {
 	indexed    bool
 	unique     bool
 	primaryKey bool
+	encrypted  bool
+	immutable  bool
+	// normalizeText is the normalization of text fields tagged with one, e.g. `snek:"nfc"`.
+	normalizeText func(string) string
+	// generated is the SQL expression computing the field, if it's returned by Generator.GeneratedColumns.
+	generated string
+	// bigInt is whether the field is a BigInt, stored as TEXT like strings but only comparable to other BigInts.
+	bigInt bool
 }
 
 type fieldInfoMap map[string]fieldInfo
@@ -31,14 +42,93 @@ type Uniquer interface {
 	Unique() [][]string
 }
 
-func (i *valueInfo) toCreateStatement() string {
+// PrimaryKeyer are types whose primary key is a combination of fields instead of the ID field, e.g. the fields
+// referring to both sides of a link table. Get, Update, UpdateFields, and Remove identify their structs by those fields,
+// and they don't need an ID field. Features identifying structs by ID, like Relations, AsOf, and Load, don't support them.
+type PrimaryKeyer interface {
+	// PrimaryKey returns the names of the fields making up the primary key.
+	PrimaryKey() []string
+}
+
+// primaryKey returns the names of the fields making up the primary key of typ.
+func primaryKey(typ reflect.Type) []string {
+	if keyer, ok := reflect.New(typ).Interface().(PrimaryKeyer); ok {
+		return keyer.PrimaryKey()
+	}
+	return []string{"ID"}
+}
+
+// Generator are types with fields computed by SQLite, e.g. to query and index derived values like the lower case
+// version of a name. The fields are stored as generated columns, and can be used in conditions and orders like any
+// other field. The values in structs given to Insert, Update, or UpdateFields are ignored, and replaced with the computed
+// values once stored. Since SQLite can't add generated columns to existing tables, they must be declared when the type
+// is first registered.
+type Generator interface {
+	// GeneratedColumns returns the names of the generated fields mapped to the SQL expressions computing them,
+	// e.g. {"LowerName": "lower(\"Name\")"}. The expressions must refer to columns using their (mapped) column names.
+	GeneratedColumns() map[string]string
+}
+
+// generatedColumns returns the generated fields of typ mapped to the expressions computing them.
+func generatedColumns(typ reflect.Type) map[string]string {
+	if generator, ok := reflect.New(typ).Interface().(Generator); ok {
+		return generator.GeneratedColumns()
+	}
+	return nil
+}
+
+// AfterLoader are types that process themselves after being loaded from the store, e.g. to compute derived fields.
+type AfterLoader interface {
+	// AfterLoad is called on each loaded struct before it's returned.
+	AfterLoad() error
+}
+
+// BeforeSaver are types that process themselves before being saved in the store, e.g. to normalize fields.
+type BeforeSaver interface {
+	// BeforeSave is called on each struct before it's inserted or updated, and before the update control is consulted.
+	BeforeSave() error
+}
+
+// afterLoad calls AfterLoad on structPointer, or on each element if it's a pointer to a slice, if they are AfterLoaders.
+func afterLoad(structPointer any) error {
+	val := reflect.ValueOf(structPointer)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		return nil
+	}
+	if val.Elem().Kind() == reflect.Slice {
+		slice := val.Elem()
+		for index := 0; index < slice.Len(); index++ {
+			if err := afterLoad(slice.Index(index).Addr().Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if loader, ok := structPointer.(AfterLoader); ok {
+		return loader.AfterLoad()
+	}
+	return nil
+}
+
+// beforeSave calls BeforeSave on structPointer if it's a BeforeSaver.
+func beforeSave(structPointer any) error {
+	if saver, ok := structPointer.(BeforeSaver); ok {
+		return saver.BeforeSave()
+	}
+	return nil
+}
+
+func (i *valueInfo) toCreateStatement(n naming) string {
+	tableName := n.table(i.typ)
 	builder := &bytes.Buffer{}
-	fmt.Fprintf(builder, "CREATE TABLE IF NOT EXISTS \"%s\" (\n", i.typ.Name())
+	fmt.Fprintf(builder, "CREATE TABLE IF NOT EXISTS \"%s\" (\n", tableName)
 	fieldParts := []string{}
 	createIndexParts := []string{}
+	key := primaryKey(i.typ)
 	for fieldName, fieldInfo := range i.fields(false) {
+		columnName := n.column(fieldName)
 		primaryKey := ""
-		if fieldInfo.primaryKey {
+		if fieldInfo.primaryKey && len(key) == 1 {
 			primaryKey = " PRIMARY KEY"
 		}
 		if fieldInfo.indexed || fieldInfo.unique {
@@ -46,19 +136,28 @@ func (i *valueInfo) toCreateStatement() string {
 			if fieldInfo.unique {
 				unique = " UNIQUE"
 			}
-			createIndexParts = append(createIndexParts, fmt.Sprintf("CREATE%s INDEX IF NOT EXISTS \"%s.%s\" ON \"%s\" (\"%s\");", unique, i.typ.Name(), fieldName, i.typ.Name(), fieldName))
+			createIndexParts = append(createIndexParts, fmt.Sprintf("CREATE%s INDEX IF NOT EXISTS \"%s.%s\" ON \"%s\" (\"%s\");", unique, tableName, columnName, tableName, columnName))
 		}
-		fieldParts = append(fieldParts, fmt.Sprintf("  \"%s\" %s%s", fieldName, fieldInfo.columnType, primaryKey))
+		fieldParts = append(fieldParts, fmt.Sprintf("  \"%s\" %s%s%s", columnName, fieldInfo.columnType, primaryKey, fieldInfo.generatedClause()))
 	}
 	if uniquer, ok := i.val.Interface().(Uniquer); ok {
 		for _, combo := range uniquer.(Uniquer).Unique() {
 			fieldParts := []string{}
+			columnNames := []string{}
 			for _, part := range combo {
-				fieldParts = append(fieldParts, fmt.Sprintf("\"%s\"", part))
+				fieldParts = append(fieldParts, fmt.Sprintf("\"%s\"", n.column(part)))
+				columnNames = append(columnNames, n.column(part))
 			}
-			createIndexParts = append(createIndexParts, fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS \"%s.%s\" ON \"%s\" (%s);", i.typ.Name(), strings.Join(combo, "_"), i.typ.Name(), strings.Join(fieldParts, ", ")))
+			createIndexParts = append(createIndexParts, fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS \"%s.%s\" ON \"%s\" (%s);", tableName, strings.Join(columnNames, "_"), tableName, strings.Join(fieldParts, ", ")))
 		}
 	}
+	if len(key) > 1 {
+		keyParts := []string{}
+		for _, field := range key {
+			keyParts = append(keyParts, fmt.Sprintf("\"%s\"", n.column(field)))
+		}
+		fieldParts = append(fieldParts, fmt.Sprintf("  PRIMARY KEY (%s)", strings.Join(keyParts, ", ")))
+	}
 	fmt.Fprintf(builder, "%s);", strings.Join(fieldParts, ",\n"))
 	if len(createIndexParts) > 0 {
 		fmt.Fprintf(builder, "\n%s", strings.Join(createIndexParts, "\n"))
@@ -66,22 +165,80 @@ func (i *valueInfo) toCreateStatement() string {
 	return builder.String()
 }
 
-func (i *valueInfo) toGetStatement() (string, []any) {
-	return fmt.Sprintf("SELECT * FROM \"%s\" WHERE \"ID\" = ?;", i.typ.Name()), []any{i.id}
+// keyValues returns the values of the primary key fields of the struct in i, as stored in the store.
+// The fields are read directly instead of using fields(true), which would cache the values of all fields
+// before e.g. BeforeSave and the update control change them.
+func (i *valueInfo) keyValues() []any {
+	if len(i.key) == 1 && i.key[0] == "ID" {
+		return []any{i.id}
+	}
+	result := make([]any, len(i.key))
+	for index, field := range i.key {
+		fieldVal, _ := fieldByName(i.val, field)
+		result[index] = storedValue(fieldVal)
+	}
+	return result
+}
+
+// storedValue returns fieldVal the way fields(true) stores it, i.e. nil for invalid values, canonical net.IPs, and byte arrays as slices.
+func storedValue(fieldVal reflect.Value) any {
+	if !fieldVal.IsValid() {
+		return nil
+	}
+	if fieldVal.Type() == ipType {
+		return canonicalIP(fieldVal.Interface().(net.IP))
+	}
+	if fieldVal.Kind() == reflect.Array && fieldVal.Type().Elem().Kind() == reflect.Uint8 {
+		cpy := make([]uint8, fieldVal.Len())
+		reflect.Copy(reflect.ValueOf(cpy), fieldVal)
+		return cpy
+	}
+	return fieldVal.Interface()
+}
+
+// keyCondition returns an SQL condition matching the primary key of the struct in i.
+func (i *valueInfo) keyCondition(n naming) (string, []any) {
+	parts := []string{}
+	for _, field := range i.key {
+		parts = append(parts, fmt.Sprintf("\"%s\" = ?", n.column(field)))
+	}
+	return strings.Join(parts, " AND "), i.keyValues()
+}
+
+// keySet returns a Set containing only the struct in i.
+func (i *valueInfo) keySet() Set {
+	values := i.keyValues()
+	if len(i.key) == 1 {
+		return Cond{i.key[0], EQ, values[0]}
+	}
+	result := And{}
+	for index, field := range i.key {
+		result = append(result, Cond{field, EQ, values[index]})
+	}
+	return result
+}
+
+func (i *valueInfo) toGetStatement(n naming) (string, []any) {
+	keySQL, keyParams := i.keyCondition(n)
+	return fmt.Sprintf("SELECT * FROM \"%s\" WHERE %s;", n.table(i.typ), keySQL), keyParams
 }
 
-func (i *valueInfo) toDelStatement() (string, []any) {
-	return fmt.Sprintf("DELETE FROM \"%s\" WHERE \"ID\" = ?;", i.typ.Name()), []any{i.id}
+func (i *valueInfo) toDelStatement(n naming) (string, []any) {
+	keySQL, keyParams := i.keyCondition(n)
+	return fmt.Sprintf("DELETE FROM \"%s\" WHERE %s;", n.table(i.typ), keySQL), keyParams
 }
 
-func (i *valueInfo) toInsertStatement() (string, []any) {
+func (i *valueInfo) toInsertStatement(n naming) (string, []any) {
 	builder := &bytes.Buffer{}
-	fmt.Fprintf(builder, "INSERT INTO \"%s\"\n  (", i.typ.Name())
+	fmt.Fprintf(builder, "INSERT INTO \"%s\"\n  (", n.table(i.typ))
 	fieldNameParts := []string{}
 	fieldQMParts := []string{}
 	fieldValueParts := []any{}
 	for fieldName, fieldInfo := range i.fields(true) {
-		fieldNameParts = append(fieldNameParts, fmt.Sprintf("\"%s\"", fieldName))
+		if fieldInfo.generated != "" {
+			continue
+		}
+		fieldNameParts = append(fieldNameParts, fmt.Sprintf("\"%s\"", n.column(fieldName)))
 		fieldQMParts = append(fieldQMParts, "?")
 		fieldValueParts = append(fieldValueParts, fieldInfo.value)
 	}
@@ -89,38 +246,200 @@ func (i *valueInfo) toInsertStatement() (string, []any) {
 	return builder.String(), fieldValueParts
 }
 
-func (i *valueInfo) toUpdateStatement() (string, []any) {
+// toUpdateStatement returns a statement updating the fields in onlyFields, or all fields if onlyFields is nil.
+func (i *valueInfo) toUpdateStatement(n naming, onlyFields map[string]bool) (string, []any) {
 	builder := &bytes.Buffer{}
-	fmt.Fprintf(builder, "UPDATE \"%s\" SET\n", i.typ.Name())
+	fmt.Fprintf(builder, "UPDATE \"%s\" SET\n", n.table(i.typ))
 	fieldNameParts := []string{}
 	fieldValueParts := []any{}
-	var primaryKey any
 	for fieldName, fieldInfo := range i.fields(true) {
-		if fieldInfo.primaryKey {
-			primaryKey = fieldInfo.value
-		} else {
-			fieldNameParts = append(fieldNameParts, fmt.Sprintf("  \"%s\" = ?", fieldName))
+		if !fieldInfo.primaryKey && fieldInfo.generated == "" && (onlyFields == nil || onlyFields[fieldName]) {
+			fieldNameParts = append(fieldNameParts, fmt.Sprintf("  \"%s\" = ?", n.column(fieldName)))
 			fieldValueParts = append(fieldValueParts, fieldInfo.value)
 		}
 	}
-	fmt.Fprintf(builder, "%s\nWHERE \"ID\" = ?;", strings.Join(fieldNameParts, ",\n"))
-	fieldValueParts = append(fieldValueParts, primaryKey)
-	return builder.String(), fieldValueParts
+	keySQL, keyParams := i.keyCondition(n)
+	fmt.Fprintf(builder, "%s\nWHERE %s;", strings.Join(fieldNameParts, ",\n"), keySQL)
+	return builder.String(), append(fieldValueParts, keyParams...)
+}
+
+// fieldByName returns the field of val named by field, which may refer to nested fields like "Inner.Float".
+// If a pointer on the way to the field is nil, an invalid value is returned.
+func fieldByName(val reflect.Value, field string) (reflect.Value, error) {
+	for _, part := range strings.Split(field, ".") {
+		for val.Kind() == reflect.Pointer {
+			if val.IsNil() {
+				return reflect.Value{}, nil
+			}
+			val = val.Elem()
+		}
+		if val.Kind() != reflect.Struct {
+			return reflect.Value{}, fmt.Errorf("%q isn't a field of %v", field, val.Type())
+		}
+		fieldVal := val.FieldByName(part)
+		if !fieldVal.IsValid() {
+			return reflect.Value{}, fmt.Errorf("%q isn't a field of %v", field, val.Type())
+		}
+		val = fieldVal
+	}
+	for val.Kind() == reflect.Pointer {
+		if val.IsNil() {
+			return reflect.Value{}, nil
+		}
+		val = val.Elem()
+	}
+	return val, nil
+}
+
+// copyField copies the field at path (field names split on ".") from src to dst.
+// Pointers on the way to the field are copied, to avoid modifying structs shared with other values.
+func copyField(dst, src reflect.Value, path []string) {
+	if len(path) == 0 {
+		dst.Set(src)
+		return
+	}
+	for dst.Kind() == reflect.Pointer {
+		if src.IsNil() {
+			dst.Set(reflect.Zero(dst.Type()))
+			return
+		}
+		cpy := reflect.New(dst.Type().Elem())
+		if !dst.IsNil() {
+			cpy.Elem().Set(dst.Elem())
+		}
+		dst.Set(cpy)
+		dst, src = dst.Elem(), src.Elem()
+	}
+	copyField(dst.FieldByName(path[0]), src.FieldByName(path[0]), path[1:])
+}
+
+// validateType returns an error if the `snek` tags of the fields of typ have unrecognized options, or options not applicable to their
+// fields, if the combinations returned by Uniquer contain fields that aren't stored, or if the primary key or generated fields
+// aren't unencrypted stored fields, to catch e.g. `snek:"indexed"` at Register.
+func validateType(typ reflect.Type) error {
+	if err := validateTags(typ.Name(), typ, map[reflect.Type]bool{}); err != nil {
+		return err
+	}
+	fields := (&valueInfo{typ: typ}).fields(false)
+	for _, field := range primaryKey(typ) {
+		fieldInfo, found := fields[field]
+		if !found {
+			return fmt.Errorf("primary key field %q isn't a stored field of %s", field, typ.Name())
+		}
+		if fieldInfo.encrypted {
+			return fmt.Errorf("primary key field %q of %s can't be encrypted", field, typ.Name())
+		}
+		if fieldInfo.generated != "" {
+			return fmt.Errorf("primary key field %q of %s can't be generated", field, typ.Name())
+		}
+	}
+	for field := range generatedColumns(typ) {
+		if fieldInfo, found := fields[field]; !found || fieldInfo.encrypted {
+			return fmt.Errorf("generated field %q isn't an unencrypted stored field of %s", field, typ.Name())
+		}
+	}
+	if uniquer, ok := reflect.New(typ).Interface().(Uniquer); ok {
+		for _, combo := range uniquer.Unique() {
+			for _, field := range combo {
+				if _, found := fields[field]; !found {
+					return fmt.Errorf("unique combination %v of %s contains %q, which isn't a stored field", combo, typ.Name(), field)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateTags(path string, typ reflect.Type, visited map[reflect.Type]bool) error {
+	if visited[typ] {
+		return nil
+	}
+	visited[typ] = true
+	for _, field := range reflect.VisibleFields(typ) {
+		if !field.IsExported() {
+			continue
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		isText := fieldType.Kind() == reflect.String
+		isBytes := fieldType.Kind() == reflect.Slice && fieldType.Elem().Kind() == reflect.Uint8
+		if tag := field.Tag.Get("snek"); tag != "" {
+			for _, option := range strings.Split(tag, ",") {
+				switch {
+				case option == "-" || option == "index" || option == "unique" || option == "immutable":
+				case option == "encrypt":
+					if !isText && !isBytes {
+						return fmt.Errorf("%s.%s is tagged %q, but only string and []byte fields can be encrypted", path, field.Name, option)
+					}
+				case textNormalizations[option] != nil:
+					if !isText {
+						return fmt.Errorf("%s.%s is tagged %q, but only string fields can be normalized", path, field.Name, option)
+					}
+				default:
+					return fmt.Errorf("%s.%s has the unrecognized snek tag option %q", path, field.Name, option)
+				}
+			}
+		}
+		if fieldType.Kind() == reflect.Struct && fieldType != bigIntType && !hasSnekTag(field, "-") {
+			if err := validateTags(path+"."+field.Name, fieldType, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hasSnekTag returns whether the `snek` tag of field, a comma separated list like `snek:"index,immutable"`, contains option.
+func hasSnekTag(field reflect.StructField, option string) bool {
+	for _, part := range strings.Split(field.Tag.Get("snek"), ",") {
+		if part == option {
+			return true
+		}
+	}
+	return false
 }
 
 func (f fieldInfoMap) processField(prefix string, field reflect.StructField, typ reflect.Type, fieldVal *reflect.Value) {
 	makeFieldInfo := func(columnType string, val *reflect.Value) fieldInfo {
 		res := fieldInfo{
 			columnType: columnType,
-			indexed:    field.Tag.Get("snek") == "index",
-			unique:     field.Tag.Get("snek") == "unique",
-			primaryKey: prefix == "" && field.Name == "ID",
+			indexed:    hasSnekTag(field, "index"),
+			unique:     hasSnekTag(field, "unique"),
+			encrypted:  hasSnekTag(field, "encrypt") && (typ.Kind() == reflect.String || (typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8)),
+			immutable:  hasSnekTag(field, "immutable"),
+		}
+		if res.encrypted {
+			res.columnType = "BLOB"
+		}
+		if typ.Kind() == reflect.String {
+			for _, option := range textNormalizationOrder {
+				if hasSnekTag(field, option) {
+					res.normalizeText = textNormalizations[option]
+				}
+			}
 		}
 		if val != nil {
 			res.value = (*val).Interface()
 		}
 		return res
 	}
+	if typ == bigIntType {
+		res := makeFieldInfo("TEXT", fieldVal)
+		res.bigInt = true
+		f[prefix+field.Name] = res
+		return
+	}
+	if typ == ipType {
+		var canonicalVal *reflect.Value
+		if fieldVal != nil {
+			canonicalValMem := reflect.ValueOf(canonicalIP((*fieldVal).Interface().(net.IP)))
+			canonicalVal = &canonicalValMem
+		}
+		f[prefix+field.Name] = makeFieldInfo("BLOB", canonicalVal)
+		return
+	}
 	switch typ.Kind() {
 	case reflect.Bool:
 		f[prefix+field.Name] = makeFieldInfo("BOOLEAN", fieldVal)
@@ -180,7 +499,8 @@ func (f fieldInfoMap) processField(prefix string, field reflect.StructField, typ
 
 func (f fieldInfoMap) addFields(prefix string, typ reflect.Type, val *reflect.Value) {
 	for _, field := range reflect.VisibleFields(typ) {
-		if !field.IsExported() {
+		// Fields tagged `snek:"-"` aren't stored.
+		if !field.IsExported() || hasSnekTag(field, "-") {
 			continue
 		}
 		var fieldValue *reflect.Value
@@ -192,39 +512,83 @@ func (f fieldInfoMap) addFields(prefix string, typ reflect.Type, val *reflect.Va
 	}
 }
 
+// markPrimaryKey marks the fields making up the primary key of typ.
+func (f fieldInfoMap) markPrimaryKey(typ reflect.Type) {
+	for _, field := range primaryKey(typ) {
+		if info, found := f[field]; found {
+			info.primaryKey = true
+			f[field] = info
+		}
+	}
+}
+
+// markGenerated marks the generated fields of typ with their expressions.
+func (f fieldInfoMap) markGenerated(typ reflect.Type) {
+	for field, expression := range generatedColumns(typ) {
+		if info, found := f[field]; found {
+			info.generated = expression
+			f[field] = info
+		}
+	}
+}
+
+// generatedClause returns the clause making the column of f generated, if it is.
+func (f fieldInfo) generatedClause() string {
+	if f.generated == "" {
+		return ""
+	}
+	return fmt.Sprintf(" GENERATED ALWAYS AS (%s) STORED", f.generated)
+}
+
 func (i *valueInfo) fields(values bool) fieldInfoMap {
 	if values {
 		if len(i._fieldsWithValues) == 0 {
 			i._fieldsWithValues = fieldInfoMap{}
 			i._fieldsWithValues.addFields("", i.typ, &i.val)
+			i._fieldsWithValues.markPrimaryKey(i.typ)
+			i._fieldsWithValues.markGenerated(i.typ)
 		}
 		return i._fieldsWithValues
 	} else {
 		if len(i._fieldsWithoutValues) == 0 {
 			i._fieldsWithoutValues = fieldInfoMap{}
 			i._fieldsWithoutValues.addFields("", i.typ, nil)
+			i._fieldsWithoutValues.markPrimaryKey(i.typ)
+			i._fieldsWithoutValues.markGenerated(i.typ)
 		}
 		return i._fieldsWithoutValues
 	}
 }
 
 func getValueInfo(val reflect.Value) (*valueInfo, error) {
+	return getKeyedValueInfo(val, nil)
+}
+
+// getKeyedValueInfo is getValueInfo using key as the primary key, or the key returned by primaryKey if key is nil.
+func getKeyedValueInfo(val reflect.Value, key []string) (*valueInfo, error) {
 	if val.Kind() != reflect.Ptr || val.Type().Elem().Kind() != reflect.Struct {
-		return nil, fmt.Errorf("only pointers to structs allowed, not %v", val.Interface())
+		return nil, &InvalidArgumentError{Allowed: "pointers to structs", Argument: val.Interface()}
 	}
 	val = val.Elem()
 	typ := val.Type()
 	if typ.Kind() != reflect.Struct {
-		return nil, fmt.Errorf("only struct types allowed, not %v", val.Interface())
+		return nil, &InvalidArgumentError{Allowed: "struct types", Argument: val.Interface()}
 	}
-	idField, found := typ.FieldByName("ID")
-	if !found || idField.Type != idType {
-		return nil, fmt.Errorf("only struct types with ID field of type ID allowed, not %v", val.Interface())
+	if key == nil {
+		key = primaryKey(typ)
 	}
-	id := val.FieldByIndex(idField.Index).Interface().(ID)
-	return &valueInfo{
+	result := &valueInfo{
 		val: val,
-		typ: val.Type(),
-		id:  id,
-	}, nil
+		typ: typ,
+		key: key,
+	}
+	if idField, found := typ.FieldByName("ID"); found && idField.Type == idType {
+		result.id = val.FieldByIndex(idField.Index).Interface().(ID)
+	} else if _, ok := val.Addr().Interface().(PrimaryKeyer); !ok {
+		return nil, &InvalidArgumentError{Allowed: "struct types with ID field of type ID, or PrimaryKeyers", Argument: val.Interface()}
+	}
+	if len(result.key) == 0 {
+		return nil, fmt.Errorf("%s has an empty primary key", typ.Name())
+	}
+	return result, nil
 }
@@ -0,0 +1,119 @@
+package snek
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// RelationPolicy decides what happens to referring structs when the struct they refer to is removed.
+type RelationPolicy int
+
+const (
+	// Restrict makes removing the referred struct fail with a RestrictedRemoveError while referring structs exist.
+	Restrict RelationPolicy = iota
+	// Cascade removes the referring structs along with the referred struct.
+	Cascade
+)
+
+// Relation describes structs of another type referring to a struct using a field containing its ID.
+type Relation struct {
+	// Type is a pointer to an example struct of the referring type, e.g. &Member{}.
+	Type any
+	// Field is the field of the referring type containing the ID of the referred struct, e.g. "GroupID".
+	Field  string
+	Policy RelationPolicy
+}
+
+// Relater are types that structs of other types refer to.
+type Relater interface {
+	// Relations returns the relations of the structs referring to this type.
+	Relations() []Relation
+}
+
+// removeRelated applies the relations of the struct in info, which is about to be removed, if it's a Relater.
+//
+// First all Restrict relations are checked, in the order returned by Relations, and then the referring structs
+// of each Cascade relation are removed in the same order. Referring structs are found regardless of the query
+// controls and default Sets of their types, but their removal consults their update controls.
+func (u *Update) removeRelated(info *valueInfo) error {
+	relater, ok := info.val.Addr().Interface().(Relater)
+	if !ok {
+		return nil
+	}
+	relations := relater.Relations()
+	for _, relation := range relations {
+		if relation.Policy != Restrict {
+			continue
+		}
+		referring, err := u.selectReferring(relation, info.id)
+		if err != nil {
+			return err
+		}
+		if referring.Len() > 0 {
+			return &RestrictedRemoveError{TypeName: info.typ.Name(), ReferringTypeName: referring.Type().Elem().Name(), Field: relation.Field}
+		}
+	}
+	for _, relation := range relations {
+		if relation.Policy != Cascade {
+			continue
+		}
+		referring, err := u.selectReferring(relation, info.id)
+		if err != nil {
+			return err
+		}
+		for index := 0; index < referring.Len(); index++ {
+			if err := u.Remove(referring.Index(index).Addr().Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// selectReferring returns a slice of the structs referring to id via relation, loaded like Get loads them, excluding structs already being removed.
+func (u *Update) selectReferring(relation Relation, id ID) (reflect.Value, error) {
+	typ := reflect.TypeOf(relation.Type)
+	if typ == nil || typ.Kind() != reflect.Pointer || typ.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, &InvalidArgumentError{Allowed: "relations with pointers to structs as Type", Argument: relation.Type}
+	}
+	if relation.Policy != Restrict && relation.Policy != Cascade {
+		return reflect.Value{}, fmt.Errorf("unknown relation policy %v", relation.Policy)
+	}
+	structType := typ.Elem()
+	query := &Query{Set: Cond{relation.Field, EQ, id}}
+	if err := query.validate(u.caller, structType); err != nil {
+		return reflect.Value{}, err
+	}
+	query.normalize(structType)
+	sql, params := query.toSelectStatement(u.snek.naming(), structType)
+	referring := reflect.New(reflect.SliceOf(structType))
+	started := time.Now()
+	err := u.tx.SelectContext(u.ctx, referring.Interface(), sql, params...)
+	u.logSQL(sql, params, referring.Interface(), started, err)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if err := u.snek.decrypt(referring.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	if err := afterLoad(referring.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	result := reflect.MakeSlice(referring.Elem().Type(), 0, referring.Elem().Len())
+	for index := 0; index < referring.Elem().Len(); index++ {
+		elem := referring.Elem().Index(index)
+		elemInfo, err := u.snek.getValueInfo(elem.Addr())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if !u.removing[removalKey(elemInfo)] {
+			result = reflect.Append(result, elem)
+		}
+	}
+	return result, nil
+}
+
+func removalKey(info *valueInfo) string {
+	return fmt.Sprintf("%s/%v", info.typ.Name(), info.keyValues())
+}
@@ -0,0 +1,54 @@
+package snek
+
+import (
+	"sync"
+	"time"
+)
+
+// reloadBatch collects the subscriptions of a type with a reload window that were affected by Updates during the window.
+type reloadBatch struct {
+	lock       sync.Mutex
+	lastReload time.Time
+	// pending is non nil while a reload at the end of the window is scheduled.
+	pending subscriptionSet
+}
+
+// pushSubscriptions pushes subs, the subscriptions of the type named typeName affected by an Update,
+// immediately or at the end of the reload window of the type.
+func (s *Snek) pushSubscriptions(typeName string, subs subscriptionSet) {
+	window := s.options.ReloadWindows[typeName]
+	if window <= 0 {
+		s.pushPool.push(subs)
+		return
+	}
+	batch, _ := s.reloadBatches.SetIfMissing(typeName, &reloadBatch{})
+	batch.lock.Lock()
+	defer batch.lock.Unlock()
+	if batch.pending != nil {
+		batch.pending.merge(subs)
+		return
+	}
+	elapsed := time.Since(batch.lastReload)
+	if elapsed >= window {
+		batch.lastReload = time.Now()
+		s.pushPool.push(subs)
+		return
+	}
+	batch.pending = subscriptionSet{}.merge(subs)
+	time.AfterFunc(window-elapsed, func() {
+		batch.lock.Lock()
+		pending := batch.pending
+		batch.pending = nil
+		batch.lastReload = time.Now()
+		batch.lock.Unlock()
+		// Subscriptions closed during the window are skipped.
+		if open, found := s.subscriptions.Get(typeName); found {
+			for id := range pending {
+				if _, found := open.Get(id); !found {
+					delete(pending, id)
+				}
+			}
+		}
+		s.pushPool.push(pending)
+	})
+}
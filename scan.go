@@ -0,0 +1,169 @@
+package snek
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// QueryStats describes the execution of a Select, as reported to Options.QueryObserver.
+type QueryStats struct {
+	SQL    string
+	Params []any
+	// FullScans maps the tables SQLite scans without using an index to the number of rows in them.
+	FullScans    map[string]int
+	ReturnedRows int
+	Duration     time.Duration
+	// Err is the error of the Select, e.g. a ScanBudgetError if it was aborted before execution.
+	Err error
+}
+
+// ScannedRows returns an upper bound on the number of rows scanned without an index.
+func (q QueryStats) ScannedRows() int {
+	result := 0
+	for _, rows := range q.FullScans {
+		result += rows
+	}
+	return result
+}
+
+// QueryPlan describes how SQLite would execute a Select, as returned by View.Explain.
+type QueryPlan struct {
+	SQL    string
+	Params []any
+	// Steps are the rows of EXPLAIN QUERY PLAN for the SQL.
+	Steps []QueryPlanStep
+	// FullScans maps the tables SQLite would scan without using an index to the number of rows in them.
+	FullScans map[string]int
+}
+
+// QueryPlanStep is a row of EXPLAIN QUERY PLAN, e.g. "SCAN Message" for a full scan of a table, or
+// "SEARCH Message USING INDEX Message.Sender (Sender=?)" for a search using an index. Steps with a Parent
+// are part of the step with that ID, e.g. subqueries.
+type QueryPlanStep struct {
+	ID     int
+	Parent int
+	Detail string
+}
+
+// Explain returns the plan SQLite would use to execute a Select of the same type as structPointer using query,
+// after applying the default Set and query control like Select, without executing it.
+func (v *View) Explain(structPointer any, query *Query) (*QueryPlan, error) {
+	if query == nil {
+		query = &Query{}
+	}
+	typ := reflect.TypeOf(structPointer)
+	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return nil, &InvalidArgumentError{Allowed: "pointers to structs", Argument: typ}
+	}
+	queryCopy, err := v.prepareQuery(typ.Elem(), query)
+	if err != nil {
+		return nil, err
+	}
+	sql, params := queryCopy.toSelectStatement(v.snek.naming(), typ.Elem())
+	steps, err := v.queryPlan(sql, params)
+	if err != nil {
+		return nil, err
+	}
+	fullScans, err := v.countFullScans(queryCopy.tableAliases(v.snek.naming(), typ.Elem()), steps)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryPlan{SQL: sql, Params: params, Steps: steps, FullScans: fullScans}, nil
+}
+
+// queryPlan returns the rows of EXPLAIN QUERY PLAN for sql.
+func (v *View) queryPlan(sql string, params []any) ([]QueryPlanStep, error) {
+	plan := []struct {
+		ID      int    `db:"id"`
+		Parent  int    `db:"parent"`
+		NotUsed int    `db:"notused"`
+		Detail  string `db:"detail"`
+	}{}
+	if err := v.tx.SelectContext(v.ctx, &plan, "EXPLAIN QUERY PLAN "+sql, params...); err != nil {
+		return nil, err
+	}
+	result := make([]QueryPlanStep, len(plan))
+	for index, step := range plan {
+		result[index] = QueryPlanStep{ID: step.ID, Parent: step.Parent, Detail: step.Detail}
+	}
+	return result, nil
+}
+
+// tableAliases returns the names the select statement for structType refers to its tables as, mapped to the tables.
+// Since sibling Exists sets share aliases, an alias can refer to multiple tables.
+func (q *Query) tableAliases(n naming, structType reflect.Type) map[string][]string {
+	tableName := n.table(structType)
+	result := map[string][]string{tableName: {tableName}}
+	addExistsAliases(n, q.Set, tableName, result)
+	for joinIndex, join := range q.Joins {
+		joinName := joinAlias(joinIndex)
+		result[joinName] = append(result[joinName], n.table(join.typ))
+		addExistsAliases(n, join.set, joinName, result)
+	}
+	for _, order := range q.Order {
+		for _, orderCase := range order.Cases {
+			addExistsAliases(n, orderCase.Set, tableName, result)
+		}
+	}
+	if q.Recursion != nil {
+		addExistsAliases(n, q.Recursion.Start, tableName, result)
+	}
+	return result
+}
+
+func addExistsAliases(n naming, set Set, tablePrefix string, aliases map[string][]string) {
+	switch v := set.(type) {
+	case And:
+		for _, part := range v {
+			addExistsAliases(n, part, tablePrefix, aliases)
+		}
+	case Or:
+		for _, part := range v {
+			addExistsAliases(n, part, tablePrefix, aliases)
+		}
+	case existsSet:
+		alias := fmt.Sprintf("%s_exists", tablePrefix)
+		aliases[alias] = append(aliases[alias], n.table(v.typ))
+		addExistsAliases(n, v.set, alias, aliases)
+	}
+}
+
+// fullScans returns the tables the query plan for sql scans without using an index, mapped to the number of rows in them.
+func (v *View) fullScans(aliases map[string][]string, sql string, params []any) (map[string]int, error) {
+	plan, err := v.queryPlan(sql, params)
+	if err != nil {
+		return nil, err
+	}
+	return v.countFullScans(aliases, plan)
+}
+
+// countFullScans returns the tables the steps of plan scan without using an index, mapped to the number of rows in them.
+func (v *View) countFullScans(aliases map[string][]string, plan []QueryPlanStep) (map[string]int, error) {
+	result := map[string]int{}
+	for _, step := range plan {
+		// Full scans are described as `SCAN alias`, while index scans are `SCAN alias USING [COVERING] INDEX name`.
+		alias, isScan := strings.CutPrefix(step.Detail, "SCAN ")
+		if !isScan || strings.Contains(alias, " ") {
+			continue
+		}
+		for _, table := range aliases[alias] {
+			if _, found := result[table]; found {
+				continue
+			}
+			rows := 0
+			if err := v.tx.GetContext(v.ctx, &rows, fmt.Sprintf("SELECT COUNT(*) FROM \"%s\";", table)); err != nil {
+				return nil, err
+			}
+			result[table] = rows
+		}
+	}
+	return result, nil
+}
+
+func (v *View) observeQuery(stats *QueryStats) {
+	if v.snek.options.QueryObserver != nil {
+		v.snek.options.QueryObserver(*stats)
+	}
+}
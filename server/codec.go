@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// Codec defines how messages, and the data inside them, are serialized for a connection.
+// Clients select a codec by name using the "codec" query parameter when connecting, e.g. "/ws?codec=json".
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(b []byte, v any) error
+	// MessageType returns the WebSocket message type (websocket.BinaryMessage or websocket.TextMessage) to send.
+	MessageType() int
+}
+
+// StrictCodec is a Codec that can also unmarshal while rejecting fields unknown to the destination.
+// With Options.StrictDecoding set all codecs must be StrictCodecs.
+type StrictCodec interface {
+	Codec
+	UnmarshalStrict(b []byte, v any) error
+}
+
+// FieldNamer is a Codec encoding struct fields with other names than the names of the fields, e.g. from tags.
+// The maps of the fields projected by Subscribe.Fields use the names, so that they decode into the type like the structs do.
+// Codecs that aren't FieldNamers are assumed to encode fields with their names.
+type FieldNamer interface {
+	Codec
+	// FieldName returns the name field is encoded with, or false if the codec doesn't encode it.
+	FieldName(field reflect.StructField) (string, bool)
+}
+
+// tagFieldName returns the name of field in the first of the tags with the given keys it has, or the name of the field if it has none
+// of them, and false if the tag omits the field, the way encoding/json and github.com/fxamacker/cbor/v2 name fields.
+func tagFieldName(field reflect.StructField, keys ...string) (string, bool) {
+	for _, key := range keys {
+		tag, found := field.Tag.Lookup(key)
+		if !found {
+			continue
+		}
+		if tag == "-" {
+			return "", false
+		}
+		if name, _, _ := strings.Cut(tag, ","); name != "" {
+			return name, true
+		}
+		break
+	}
+	return field.Name, true
+}
+
+var (
+	strictCBORDecMode = func() cbor.DecMode {
+		mode, err := cbor.DecOptions{ExtraReturnErrors: cbor.ExtraDecErrorUnknownField}.DecMode()
+		if err != nil {
+			panic(err)
+		}
+		return mode
+	}()
+)
+
+// CBORCodec serializes using CBOR, and is the default codec.
+type CBORCodec struct{}
+
+func (c CBORCodec) Marshal(v any) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (c CBORCodec) Unmarshal(b []byte, v any) error {
+	return cbor.Unmarshal(b, v)
+}
+
+func (c CBORCodec) UnmarshalStrict(b []byte, v any) error {
+	return strictCBORDecMode.Unmarshal(b, v)
+}
+
+func (c CBORCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (c CBORCodec) FieldName(field reflect.StructField) (string, bool) {
+	return tagFieldName(field, "cbor", "json")
+}
+
+// JSONCodec serializes using JSON. Byte slices, like Data.Blob, are base64 encoded strings.
+type JSONCodec struct{}
+
+func (j JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (j JSONCodec) Unmarshal(b []byte, v any) error {
+	return json.Unmarshal(b, v)
+}
+
+func (j JSONCodec) UnmarshalStrict(b []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func (j JSONCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (j JSONCodec) FieldName(field reflect.StructField) (string, bool) {
+	return tagFieldName(field, "json")
+}
+
+const (
+	defaultCodecName = "cbor"
+)
+
+// DefaultCodecs returns the codecs available by default.
+func DefaultCodecs() map[string]Codec {
+	return map[string]Codec{
+		defaultCodecName: CBORCodec{},
+		"json":           JSONCodec{},
+	}
+}
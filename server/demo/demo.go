@@ -91,13 +91,22 @@ func queryControlMember(v *snek.View, query *snek.Query) error {
 
 // updateControlMember gatekeeps update access to Member instances.
 func updateControlMember(u *snek.Update, prev, next *Member) error {
+	var groupID snek.ID
 	if prev == nil && next != nil {
-		return snek.QueryHasResults(u.View, []Group{}, &snek.Query{Set: snek.And{snek.Cond{"ID", snek.EQ, next.GroupID}, snek.Cond{"OwnerID", snek.EQ, u.Caller().UserID()}}})
+		groupID = next.GroupID
 	} else if prev != nil && next == nil {
-		return snek.QueryHasResults(u.View, []Group{}, &snek.Query{Set: snek.And{snek.Cond{"ID", snek.EQ, prev.GroupID}, snek.Cond{"OwnerID", snek.EQ, u.Caller().UserID()}}})
+		groupID = prev.GroupID
 	} else {
 		return fmt.Errorf("can't update memberships")
 	}
+	group, found, err := snek.Load[Group](u.View, groupID)
+	if err != nil {
+		return err
+	}
+	if !found || !group.OwnerID.Equal(u.Caller().UserID()) {
+		return fmt.Errorf("can only add and remove members of owned groups")
+	}
+	return nil
 }
 
 // Message defines a chat message in a chat group.
@@ -110,7 +119,12 @@ type Message struct {
 
 // queryControlMessage gatekeeps view access to Message instances.
 func queryControlMessage(v *snek.View, query *snek.Query) error {
-	query.Joins = append(query.Joins, snek.NewJoin(&Member{}, snek.Cond{"UserID", snek.EQ, v.Caller().UserID()}, []snek.On{{"GroupID", snek.EQ, "GroupID"}}))
+	isMember := snek.Exists(&Member{}, []snek.On{{"GroupID", snek.EQ, "GroupID"}}, snek.Cond{"UserID", snek.EQ, v.Caller().UserID()})
+	if query.Set == nil {
+		query.Set = isMember
+	} else {
+		query.Set = snek.And{query.Set, isMember}
+	}
 	return nil
 }
 
@@ -169,13 +183,11 @@ func main() {
 		fmt.Fprint(w, html)
 	})
 	// Register the Member and Message types, along with the control methods to gatekeep them.
-	if err := server.Register(s, &Member{}, queryControlMember, updateControlMember); err != nil {
-		log.Fatal(err)
-	}
-	if err := server.Register(s, &Message{}, queryControlMessage, updateControlMessage); err != nil {
-		log.Fatal(err)
-	}
-	if err := server.Register(s, &Group{}, queryControlGroup, updateControlGroup); err != nil {
+	if err := server.RegisterAll(s,
+		server.NewRegistration(&Member{}, queryControlMember, updateControlMember),
+		server.NewRegistration(&Message{}, queryControlMessage, updateControlMessage),
+		server.NewRegistration(&Group{}, queryControlGroup, updateControlGroup),
+	); err != nil {
 		log.Fatal(err)
 	}
 	log.Printf("opened %q, will listen to %q", opts.Path, opts.Addr)
@@ -224,11 +236,8 @@ document.addEventListener('DOMContentLoaded', (ev) => {
   const newID = () => {
     const res = new Uint8Array(32);
 	window.crypto.getRandomValues(res);
-    const now = Date.now();
-    res[0] = now >> 24;
-    res[1] = (now >> 16) & 0xff;
-    res[2] = (now >> 8) & 0xff;
-    res[3] = now & 0xff;
+    // Like snek.NewID, start with the big endian creation time in nanoseconds.
+    new DataView(res.buffer).setBigUint64(0, BigInt(Date.now()) * 1000000n, false);
 	return res;
   };
   const log = (msg) => {
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errSlowClient   = errors.New("outbound queue full")
+	errClientClosed = errors.New("client closed")
+)
+
+// outbound is a Message waiting to be sent to a client, and the Message to record in its place.
+// Outbounds with latest set contain Data that only matters until the next Data of the same subscription, and can be
+// replaced by it when the queue is full.
+type outbound struct {
+	message  *Message
+	recorded *Message
+	latest   bool
+}
+
+// replaces returns whether o contains newer Data of the same subscription as other.
+func (o *outbound) replaces(other *outbound) bool {
+	return o.latest && other.latest &&
+		o.message.Data.CauseMessageID.Equal(other.message.Data.CauseMessageID) &&
+		o.message.Data.TypeName == other.message.Data.TypeName
+}
+
+// outboundQueue is a bounded queue of messages waiting to be written to a client, letting subscriptions and message
+// handlers continue without waiting for slow clients.
+type outboundQueue struct {
+	lock     sync.Mutex
+	size     int
+	coalesce bool
+	queue    []*outbound
+	// ready has room for a single notification, which is sent whenever the queue becomes non empty.
+	ready chan struct{}
+}
+
+func newOutboundQueue(size int, coalesce bool) *outboundQueue {
+	return &outboundQueue{
+		size:     size,
+		coalesce: coalesce,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push adds o to the queue, unless the queue is full, in which case it replaces queued Data of the same subscription
+// if coalescing, and otherwise returns errSlowClient.
+func (q *outboundQueue) push(o *outbound) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.queue) >= q.size {
+		if !q.coalesce {
+			return errSlowClient
+		}
+		replaced := -1
+		for index := len(q.queue) - 1; index >= 0; index-- {
+			if o.replaces(q.queue[index]) {
+				replaced = index
+				break
+			}
+		}
+		if replaced == -1 {
+			return errSlowClient
+		}
+		if q.queue[replaced].message.Data.Initial && !o.message.Data.Initial {
+			// The client hasn't received the initial Data yet, so the replacement becomes the initial Data.
+			message := *o.message
+			data := *message.Data
+			data.Initial = true
+			message.Data = &data
+			o = &outbound{message: &message, recorded: &message, latest: true}
+		}
+		// The replacement moves to the end of the queue, to keep the order between it and the messages queued before it.
+		q.queue = append(q.queue[:replaced], q.queue[replaced+1:]...)
+	}
+	q.queue = append(q.queue, o)
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop removes and returns the first queued message, or nil if the queue is empty.
+func (q *outboundQueue) pop() *outbound {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.queue) == 0 {
+		return nil
+	}
+	result := q.queue[0]
+	q.queue[0] = nil
+	q.queue = q.queue[1:]
+	return result
+}
+
+// enqueue queues o to be sent, or disconnects the client if its outbound queue is full.
+func (c *client) enqueue(o *outbound) error {
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return errClientClosed
+	}
+	if err := c.outbound.push(o); err != nil {
+		log.Printf("while sending %+v: %v, disconnecting slow client", o.message, err)
+		c.disconnect()
+		return err
+	}
+	return nil
+}
+
+// disconnect closes the connection, making readLoop close the subscriptions of the client.
+func (c *client) disconnect() {
+	atomic.StoreInt32(&c.closed, 1)
+	c.conn.Close()
+}
+
+// writeLoop writes the queued messages to the connection until the connection closes.
+func (c *client) writeLoop() {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.outbound.ready:
+		}
+		for o := c.outbound.pop(); o != nil; o = c.outbound.pop() {
+			b, err := c.codec.Marshal(o.message)
+			if err != nil {
+				log.Printf("while marshalling %+v: %v", o.message, err)
+				continue
+			}
+			if err := c.lock.Sync(func() error {
+				c.conn.SetWriteDeadline(time.Now().Add(c.server.opts.WriteWait))
+				return c.conn.WriteMessage(c.codec.MessageType(), b)
+			}); err != nil {
+				log.Printf("while sending %+v: %v", o.message, err)
+				c.disconnect()
+				return
+			}
+			log.Printf("-> sent message %+v", o.message)
+			c.record(o.recorded, false)
+		}
+	}
+}
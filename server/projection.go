@@ -0,0 +1,104 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// projection selects the fields named by a Subscribe from the structs sent to the client.
+type projection struct {
+	paths [][]string
+	// keys are the names codec encodes the fields in paths with.
+	keys [][]string
+}
+
+// newProjection returns a projection of the given fields of typ, encoded by codec, or an error if typ doesn't have one of them
+// or codec doesn't encode it. Fields are names of exported fields, with the names of nested fields joined by '.', e.g. "Author.Name".
+func newProjection(typ reflect.Type, fields []string, codec Codec) (*projection, error) {
+	result := &projection{}
+	namer, _ := codec.(FieldNamer)
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		keys := make([]string, len(path))
+		fieldType := typ
+		for index, part := range path {
+			for fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() != reflect.Struct {
+				return nil, fmt.Errorf("%s has no field %q", typ.Name(), field)
+			}
+			structField, found := fieldType.FieldByName(part)
+			if !found || !structField.IsExported() {
+				return nil, fmt.Errorf("%s has no field %q", typ.Name(), field)
+			}
+			keys[index] = part
+			if namer != nil {
+				if keys[index], found = namer.FieldName(structField); !found {
+					return nil, fmt.Errorf("%s.%s isn't encoded by the codec", typ.Name(), field)
+				}
+			}
+			fieldType = structField.Type
+		}
+		result.paths = append(result.paths, path)
+		result.keys = append(result.keys, keys)
+	}
+	return result, nil
+}
+
+// project returns v with the structs in it replaced by the projection, if there is one.
+func (p *projection) project(v any) any {
+	if p == nil {
+		return v
+	}
+	return p.apply(v)
+}
+
+// apply returns v, which is a struct, pointer to a struct, or slice of structs, with each struct replaced by a map containing
+// only the projected fields, named like the codec names them. Nested fields are put in nested maps, so that the maps decode into the original type.
+func (p *projection) apply(v any) any {
+	val := reflect.ValueOf(v)
+	if val.Kind() == reflect.Slice {
+		result := make([]map[string]any, val.Len())
+		for index := range result {
+			result[index] = p.applyStruct(val.Index(index))
+		}
+		return result
+	}
+	return p.applyStruct(val)
+}
+
+func (p *projection) applyStruct(val reflect.Value) map[string]any {
+	result := map[string]any{}
+	for pathIndex, path := range p.paths {
+		m := result
+		fieldVal := val
+		for index, part := range path {
+			key := p.keys[pathIndex][index]
+			for fieldVal.Kind() == reflect.Pointer && !fieldVal.IsNil() {
+				fieldVal = fieldVal.Elem()
+			}
+			if fieldVal.Kind() == reflect.Pointer {
+				// A nil pointer on the way to the field leaves the field out, like it's left out of the struct.
+				break
+			}
+			fieldVal = fieldVal.FieldByName(part)
+			if index == len(path)-1 {
+				m[key] = fieldVal.Interface()
+				break
+			}
+			nested, isMap := m[key].(map[string]any)
+			if !isMap {
+				if _, found := m[key]; found {
+					// The whole struct containing the field is already projected.
+					break
+				}
+				nested = map[string]any{}
+				m[key] = nested
+			}
+			m = nested
+		}
+	}
+	return result
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/zond/snek"
+)
+
+// RecordedMessage is a Message received (Inbound) or sent by a server with Options.RecordPath set.
+// ConnectionID identifies the connection, and Codec is the name of the codec it used, which the blobs inside the Message are encoded with.
+type RecordedMessage struct {
+	Time         time.Time
+	ConnectionID snek.ID
+	Codec        string
+	Inbound      bool
+	Message      *Message
+}
+
+// recorder appends RecordedMessages to a file, each as a 4 byte big endian length followed by that many bytes of CBOR.
+type recorder struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func newRecorder(path string) (*recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{file: file}, nil
+}
+
+func (r *recorder) close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Close()
+}
+
+func (r *recorder) record(m *RecordedMessage) error {
+	b, err := cbor.Marshal(m)
+	if err != nil {
+		return err
+	}
+	record := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(b)), uint32(len(b)))
+	record = append(record, b...)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// A single write per record keeps concurrent servers appending to the same file from interleaving records.
+	_, err = r.file.Write(record)
+	return err
+}
+
+// redacted returns m, or a copy of m without identity tokens if it contains any.
+func redacted(m *Message) *Message {
+	if m.Identity == nil {
+		return m
+	}
+	result := *m
+	result.Identity = &Identity{}
+	return &result
+}
+
+// withoutAux returns a copy of the Result message m without Aux, e.g. to avoid recording tokens returned by Identifiers.
+func withoutAux(m *Message) *Message {
+	result := *m
+	resultCopy := *m.Result
+	resultCopy.Aux = nil
+	result.Result = &resultCopy
+	return &result
+}
+
+// record records m as received (if inbound) or sent by c, if Options.RecordPath is set.
+func (c *client) record(m *Message, inbound bool) {
+	if c.server.recorder == nil {
+		return
+	}
+	if err := c.server.recorder.record(&RecordedMessage{
+		Time:         time.Now(),
+		ConnectionID: c.id,
+		Codec:        c.codecName,
+		Inbound:      inbound,
+		Message:      redacted(m),
+	}); err != nil {
+		log.Printf("while recording %+v: %v", m, err)
+	}
+}
+
+// ReadRecording returns the RecordedMessages in r, as written by a server with Options.RecordPath set.
+func ReadRecording(r io.Reader) ([]RecordedMessage, error) {
+	result := []RecordedMessage{}
+	length := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, length); errors.Is(err, io.EOF) {
+			return result, nil
+		} else if err != nil {
+			return nil, err
+		}
+		b := make([]byte, binary.BigEndian.Uint32(length))
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		m := RecordedMessage{}
+		if err := cbor.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+}
+
+// Replay reproduces the connections in records against the server with the WebSocket endpoint wsURL, e.g. a fresh server
+// with the same types registered, and returns the messages each connection received, mapped by the String of its ConnectionID.
+// Messages received after the response to the last message sent by a connection aren't included.
+//
+// Each recorded connection gets a new connection using the same codec, which must be one of the DefaultCodecs, and the inbound messages of all connections are sent
+// in recorded order, waiting for the response to each message before sending the next, to avoid the races the server would
+// otherwise have between messages handled concurrently. Since identity tokens are redacted in recordings, identify returns
+// the token to send in place of the token of each Identity message, e.g. a token of a test user.
+//
+// The responses are awaited until ctx is done, in which case the messages received so far are returned along with the error of ctx.
+func Replay(ctx context.Context, wsURL string, records []RecordedMessage, identify func(connectionID snek.ID) snek.ID) (map[string][]*Message, error) {
+	type replayConn struct {
+		conn     *websocket.Conn
+		codec    Codec
+		received chan *Message
+	}
+	conns := map[string]*replayConn{}
+	// done stops the goroutines reading from the connections, which may be blocked delivering messages nobody waits for.
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		for _, conn := range conns {
+			conn.conn.Close()
+		}
+	}()
+	result := map[string][]*Message{}
+	for _, record := range records {
+		if !record.Inbound {
+			continue
+		}
+		connID := record.ConnectionID.String()
+		conn, found := conns[connID]
+		if !found {
+			codec, found := DefaultCodecs()[record.Codec]
+			if !found {
+				return result, fmt.Errorf("unknown codec %q", record.Codec)
+			}
+			wsConn, _, err := websocket.DefaultDialer.DialContext(ctx, fmt.Sprintf("%s?codec=%s", wsURL, url.QueryEscape(record.Codec)), nil)
+			if err != nil {
+				return result, err
+			}
+			conn = &replayConn{conn: wsConn, codec: codec, received: make(chan *Message, 64)}
+			conns[connID] = conn
+			go func() {
+				defer close(conn.received)
+				for {
+					_, b, err := conn.conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					m := &Message{}
+					if err := conn.codec.Unmarshal(b, m); err != nil {
+						log.Printf("while unmarshalling replayed message: %v", err)
+						continue
+					}
+					select {
+					case conn.received <- m:
+					case <-done:
+						return
+					}
+				}
+			}()
+		}
+		m := record.Message
+		if m.Identity != nil {
+			m = &Message{ID: m.ID, Identity: &Identity{Token: identify(record.ConnectionID)}}
+		}
+		b, err := conn.codec.Marshal(m)
+		if err != nil {
+			return result, err
+		}
+		if err := conn.conn.WriteMessage(conn.codec.MessageType(), b); err != nil {
+			return result, err
+		}
+		for responded := false; !responded; {
+			select {
+			case <-ctx.Done():
+				return result, ctx.Err()
+			case received, ok := <-conn.received:
+				if !ok {
+					return result, fmt.Errorf("connection %s closed while waiting for the response to %+v", connID, m)
+				}
+				result[connID] = append(result[connID], received)
+				responded = (received.Result != nil && received.Result.CauseMessageID.Equal(m.ID)) ||
+					(received.Pong != nil && received.Pong.CauseMessageID.Equal(m.ID))
+			}
+		}
+	}
+	return result, nil
+}
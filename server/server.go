@@ -1,161 +1,362 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync/atomic"
 	"time"
 
-	"github.com/fxamacker/cbor/v2"
 	"github.com/gorilla/websocket"
 	"github.com/zond/snek"
 	"github.com/zond/snek/synch"
 )
 
 // Match represents a serializable snek.Set.
-type Match struct {
-	And  []Match    `sbor:",omitempty"`
-	Or   []Match    `sbor:",omitempty"`
-	Cond *snek.Cond `sbor:",omitempty"`
-}
-
-func (m *Match) String() string {
-	return fmt.Sprintf("%+v", *m)
-}
-
-func (m *Match) validate() error {
-	nonNilFields := 0
-	if len(m.And) > 0 {
-		nonNilFields++
-	}
-	if len(m.Or) > 0 {
-		nonNilFields++
-	}
-	if m.Cond != nil {
-		nonNilFields++
-	}
-	if nonNilFields > 1 {
-		return fmt.Errorf("at most one of the nullable fields of Match must be populated, not %+v", m)
-	}
-	return nil
-}
-
-func (m *Match) toSet() (snek.Set, error) {
-	if err := m.validate(); err != nil {
-		return nil, err
-	}
-	makeSubSet := func(subMatches []Match) ([]snek.Set, error) {
-		result := []snek.Set{}
-		for _, subMatch := range subMatches {
-			subSet, err := subMatch.toSet()
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, subSet)
-		}
-		return result, nil
-	}
-	switch {
-	case len(m.And) > 0:
-		subSet, err := makeSubSet(m.And)
-		return snek.And(subSet), err
-	case len(m.Or) > 0:
-		subSet, err := makeSubSet(m.And)
-		return snek.Or(subSet), err
-	case m.Cond != nil:
-		return m.Cond, nil
-	default:
-		return snek.All{}, nil
-	}
-}
+type Match = snek.Match
 
 // Sent from client to server. Represents a serializable snek.Query for a given type.
+// If Count is set, the Data Blobs contain the number of matching structs instead of the structs.
+// If MaxFrequency is set, at most that many Data per second are sent for changes to the matching structs,
+// as described by snek.Throttled.
+// If Fields is set, the structs in the Data Blobs (and the results of LoadMore) are replaced by maps containing only
+// the named fields, to save bandwidth for wide types. Nested fields are named like in conditions, e.g. "Author.Name",
+// and end up in nested maps, with the keys the codec encodes the fields with (see FieldNamer), so the maps still decode
+// into the type. Changes to fields outside the projection send no Data. Subscribing with a field the type doesn't have fails,
+// and so does combining Fields with Count.
+// If Tail is set, the Data Blobs only contain the structs created since the previous Data, after an initial Data with
+// the Backlog most recently created structs, as described by snek.Tail. Tail can't be combined with Count, Order, Limit, or Offset.
 type Subscribe struct {
-	TypeName string
-	Order    []snek.Order `sbor:",omitempty"`
-	Limit    uint         `sbor:",omitempty"`
-	Distinct bool         `sbor:",omitempty"`
-	Match    Match        `sbor:",omitempty"`
+	TypeName     string
+	Order        []snek.Order `sbor:",omitempty"`
+	Limit        uint         `sbor:",omitempty"`
+	Offset       uint         `sbor:",omitempty"`
+	Distinct     bool         `sbor:",omitempty"`
+	Match        Match        `sbor:",omitempty"`
+	Count        bool         `sbor:",omitempty"`
+	MaxFrequency float64      `sbor:",omitempty"`
+	Fields       []string     `sbor:",omitempty"`
+	Tail         bool         `sbor:",omitempty"`
+	Backlog      uint         `sbor:",omitempty"`
 }
 
 func (s *Subscribe) toQuery() (*snek.Query, error) {
-	set, err := s.Match.toSet()
-	if err != nil {
-		return nil, err
-	}
-	return &snek.Query{
-		Set:      set,
+	return (&snek.QuerySpec{
+		Order:    s.Order,
 		Limit:    s.Limit,
+		Offset:   s.Offset,
 		Distinct: s.Distinct,
-		Order:    s.Order,
-	}, nil
+		Match:    s.Match,
+	}).ToQuery()
 }
 
 func (s *Subscribe) String() string {
 	return fmt.Sprintf("%+v", *s)
 }
 
+// toProjection returns the projection of the Fields of the subscribed type encoded by codec, or nil if Fields isn't set.
+func (s *Subscribe) toProjection(typ reflect.Type, codec Codec) (*projection, error) {
+	if len(s.Fields) == 0 {
+		return nil, nil
+	}
+	if s.Count {
+		return nil, fmt.Errorf("Fields can't be combined with Count")
+	}
+	return newProjection(typ, s.Fields, codec)
+}
+
 var (
-	errType = reflect.TypeOf(new(error)).Elem()
-	anyType = reflect.TypeOf(new(any)).Elem()
+	errType  = reflect.TypeOf(new(error)).Elem()
+	anyType  = reflect.TypeOf(new(any)).Elem()
+	boolType = reflect.TypeOf(false)
 )
 
-func (s *Subscribe) execute(c *client, causeMessageID snek.ID) error {
+// toQuerySubscriber returns a query subscriber sending Data to the client, but not before ready is closed.
+func (s *Subscribe) toQuerySubscriber(c *client, causeMessageID snek.ID, ready <-chan struct{}) (snek.QuerySubscriber, error) {
 	typ, found := c.server.types[s.TypeName]
 	if !found {
-		return fmt.Errorf("%q not registered", s.TypeName)
+		return snek.QuerySubscriber{}, &snek.NotRegisteredError{TypeName: s.TypeName}
+	}
+	if s.MaxFrequency < 0 {
+		return snek.QuerySubscriber{}, fmt.Errorf("negative MaxFrequency %v", s.MaxFrequency)
 	}
 	query, err := s.toQuery()
 	if err != nil {
-		return err
+		return snek.QuerySubscriber{}, err
 	}
-	subscriptionFunc := reflect.MakeFunc(reflect.FuncOf([]reflect.Type{anyType, errType}, []reflect.Type{errType}, false), func(args []reflect.Value) []reflect.Value {
-		var err error
-		switch v := args[1].Interface().(type) {
-		case error:
-			err = v
-		}
+	projection, err := s.toProjection(typ, c.codec)
+	if err != nil {
+		return snek.QuerySubscriber{}, err
+	}
+	// lastModified is set by the subscription right before each successful delivery, in the same goroutine.
+	lastModified := time.Time{}
+	// lastHash is the hash of the last projected Blob sent, if hashed is set. The subscription only skips results
+	// that didn't change at all, so results where only fields outside the projection changed are skipped here.
+	lastHash := [sha256.Size]byte{}
+	hashed := false
+	sendData := func(result any, initial bool, err error) error {
 		b := []byte{}
 		if err == nil {
-			b, err = cbor.Marshal(args[0].Interface())
+			b, err = c.codec.Marshal(projection.project(result))
+		}
+		if projection != nil && !s.Tail {
+			if err != nil {
+				hashed = false
+			} else {
+				hash := sha256.Sum256(b)
+				if hashed && !initial && hash == lastHash {
+					return nil
+				}
+				lastHash, hashed = hash, true
+			}
 		}
+		<-ready
 		errString := ""
+		modifiedMillis := int64(0)
 		if err != nil {
 			errString = err.Error()
+		} else if !lastModified.IsZero() {
+			modifiedMillis = lastModified.UnixMilli()
 		}
-		msg := &Message{
+		m := &Message{
 			ID: c.server.Snek.NewID(),
 			Data: &Data{
 				CauseMessageID: causeMessageID,
+				TypeName:       s.TypeName,
+				Initial:        initial,
 				Error:          errString,
 				Blob:           b,
+				LastModified:   modifiedMillis,
 			},
 		}
-		if err := c.send(msg); err != nil {
+		if s.Tail {
+			// Tailed Data only contains the new structs, so it can't be replaced by later Data.
+			return c.send(m)
+		}
+		return c.sendLatest(m)
+	}
+	subscriptionFunc := reflect.MakeFunc(reflect.FuncOf([]reflect.Type{anyType, boolType, errType}, []reflect.Type{errType}, false), func(args []reflect.Value) []reflect.Value {
+		var err error
+		switch v := args[2].Interface().(type) {
+		case error:
+			err = v
+		}
+		if err := sendData(args[0].Interface(), args[1].Bool(), err); err != nil {
 			return []reflect.Value{reflect.ValueOf(err)}
 		}
 		return []reflect.Value{reflect.Zero(reflect.TypeOf((*error)(nil)).Elem())}
 	})
-	subscription, err := snek.Subscribe(c.server.Snek, c.caller.Get(), query, snek.AnySubscriber(typ, subscriptionFunc.Interface().(func(any, error) error)))
+	eventFunc := func(structPointer any) error {
+		b, err := c.codec.Marshal(projection.project(structPointer))
+		if err != nil {
+			return err
+		}
+		<-ready
+		return c.send(&Message{
+			ID: c.server.Snek.NewID(),
+			Data: &Data{
+				CauseMessageID: causeMessageID,
+				TypeName:       s.TypeName,
+				Event:          true,
+				Blob:           b,
+			},
+		})
+	}
+	subscriber := snek.WithEvents(snek.AnySnapshotSubscriber(typ, subscriptionFunc.Interface().(func(any, bool, error) error)), eventFunc)
+	if s.Count {
+		subscriber = snek.AnyCountSubscriber(typ, func(count int, initial bool, err error) error {
+			return sendData(count, initial, err)
+		})
+	}
+	subscriber = snek.WithLastModified(subscriber, func(modified time.Time) {
+		lastModified = modified
+	})
+	if s.Tail {
+		subscriber = snek.Tail(subscriber, s.Backlog)
+	}
+	if s.MaxFrequency > 0 {
+		subscriber = snek.Throttled(subscriber, time.Duration(float64(time.Second)/s.MaxFrequency))
+	}
+	return snek.QuerySubscriber{
+		Query:      query,
+		Subscriber: subscriber,
+	}, nil
+}
+
+func (s *Subscribe) execute(c *client, causeMessageID snek.ID, ready <-chan struct{}) error {
+	querySubscriber, err := s.toQuerySubscriber(c, causeMessageID, ready)
+	if err != nil {
+		return err
+	}
+	if err := c.reserveSubscription(causeMessageID); err != nil {
+		return err
+	}
+	subscription, err := snek.Subscribe(c.server.Snek, c.caller.Get(), querySubscriber.Query, querySubscriber.Subscriber)
 	if err != nil {
+		c.releaseSubscription(causeMessageID)
+		return err
+	}
+	c.addSubscription(causeMessageID, subscription, []Subscribe{*s})
+	return nil
+}
+
+// Sent from client to server. Represents multiple Subscribes, sharing the same Data CauseMessageID
+// (with the TypeName of the Data telling them apart), that are unsubscribed together.
+type SubscribeAll struct {
+	Subscribes []Subscribe
+}
+
+func (s *SubscribeAll) String() string {
+	return fmt.Sprintf("%+v", *s)
+}
+
+func (s *SubscribeAll) execute(c *client, causeMessageID snek.ID, ready <-chan struct{}) error {
+	querySubscribers := []snek.QuerySubscriber{}
+	for index := range s.Subscribes {
+		querySubscriber, err := s.Subscribes[index].toQuerySubscriber(c, causeMessageID, ready)
+		if err != nil {
+			return err
+		}
+		querySubscribers = append(querySubscribers, querySubscriber)
+	}
+	if err := c.reserveSubscription(causeMessageID); err != nil {
 		return err
 	}
-	idString := string(causeMessageID)
-	if sub, found := c.subscriptions[idString]; found {
-		sub.Close()
+	subscription, err := snek.SubscribeAll(c.server.Snek, c.caller.Get(), querySubscribers...)
+	if err != nil {
+		c.releaseSubscription(causeMessageID)
+		return err
 	}
-	c.subscriptions[idString] = subscription
+	c.addSubscription(causeMessageID, subscription, s.Subscribes)
 	return nil
 }
 
+// reserveSubscription makes room for a subscription with the given ID, unless that would exceed the subscription limits.
+// Replacing an existing subscription needs no more room.
+func (c *client) reserveSubscription(causeMessageID snek.ID) error {
+	return c.subscriptionLock.Sync(func() error {
+		idString := string(causeMessageID)
+		if _, found := c.subscriptions[idString]; found {
+			return nil
+		}
+		if max := c.server.opts.MaxClientSubscriptions; max > 0 && len(c.subscriptions) >= max {
+			return fmt.Errorf("too many subscriptions: connection already has the maximum %d", max)
+		}
+		if err := c.server.reserveSubscription(); err != nil {
+			return err
+		}
+		c.subscriptions[idString] = nil
+		return nil
+	})
+}
+
+// releaseSubscription releases a reservation that didn't result in a subscription.
+func (c *client) releaseSubscription(causeMessageID snek.ID) {
+	c.subscriptionLock.Sync(func() error {
+		idString := string(causeMessageID)
+		if sub, found := c.subscriptions[idString]; found && sub == nil {
+			delete(c.subscriptions, idString)
+			c.server.releaseSubscription()
+		}
+		return nil
+	})
+}
+
+func (c *client) addSubscription(causeMessageID snek.ID, subscription snek.Subscription, subscribes []Subscribe) {
+	c.subscriptionLock.Sync(func() error {
+		idString := string(causeMessageID)
+		if sub, found := c.subscriptions[idString]; found && sub != nil {
+			sub.Close()
+		}
+		c.subscriptions[idString] = subscription
+		c.subscribes[idString] = subscribes
+		return nil
+	})
+}
+
+// getSubscribe returns the Subscribe with the given type name (which can be empty if there's only one) that created the subscription with the given ID.
+func (c *client) getSubscribe(causeMessageID snek.ID, typeName string) (*Subscribe, error) {
+	var result *Subscribe
+	err := c.subscriptionLock.Sync(func() error {
+		subscribes, found := c.subscribes[string(causeMessageID)]
+		if !found {
+			return fmt.Errorf("subscription %v not found", causeMessageID)
+		}
+		for index := range subscribes {
+			if subscribes[index].TypeName == typeName || (typeName == "" && len(subscribes) == 1) {
+				result = &subscribes[index]
+				return nil
+			}
+		}
+		return fmt.Errorf("subscription %v has no subscription of %q", causeMessageID, typeName)
+	})
+	return result, err
+}
+
+// removeSubscription closes and removes the subscription with the given ID, and returns whether it was found.
+func (c *client) removeSubscription(causeMessageID snek.ID) bool {
+	found := false
+	c.subscriptionLock.Sync(func() error {
+		idString := string(causeMessageID)
+		if sub := c.subscriptions[idString]; sub != nil {
+			found = true
+			sub.Close()
+			delete(c.subscriptions, idString)
+			delete(c.subscribes, idString)
+			c.server.releaseSubscription()
+		}
+		return nil
+	})
+	return found
+}
+
+// pauseSubscription pauses, or resumes, the subscription with the given ID.
+func (c *client) pauseSubscription(causeMessageID snek.ID, pause bool) error {
+	return c.subscriptionLock.Sync(func() error {
+		sub := c.subscriptions[string(causeMessageID)]
+		if sub == nil {
+			return fmt.Errorf("subscription %v not found", causeMessageID)
+		}
+		if pause {
+			return sub.Pause()
+		}
+		return sub.Resume()
+	})
+}
+
+// closeSubscriptions closes and removes all subscriptions of the client.
+func (c *client) closeSubscriptions() {
+	c.subscriptionLock.Sync(func() error {
+		for idString, sub := range c.subscriptions {
+			if sub != nil {
+				sub.Close()
+				delete(c.subscriptions, idString)
+				delete(c.subscribes, idString)
+				c.server.releaseSubscription()
+			}
+		}
+		return nil
+	})
+}
+
 // Sent by server after initial Subscribe and every time the data matching set of data is modified.
+// Initial is true for the first Data sent for a subscription.
+// Event is true for Data containing a single struct published using Server.Publish, instead of all matching structs.
+// LastModified is the time the data was last changed, in milliseconds since the Unix epoch, as described by snek.WithLastModified.
+// It's zero for events, errors, and data that hasn't changed since the server started.
 type Data struct {
 	CauseMessageID snek.ID
+	TypeName       string
+	Initial        bool        `sbor:",omitempty"`
+	Event          bool        `sbor:",omitempty"`
 	Error          string      `sbor:",omitempty"`
 	Blob           PrettyBytes `sbor:",omitempty"`
+	LastModified   int64       `sbor:",omitempty"`
 }
 
 func (d *Data) String() string {
@@ -170,11 +371,16 @@ func (p PrettyBytes) String() string {
 }
 
 // Sent from client to server.
+// If Return is set, the Aux of the Result of an Insert or Update contains the struct as stored, including changes made by the
+// update control, normalizations (like text tagged with `snek:"nfc"`), and generated fields, so the client doesn't have to load
+// it again. The struct is read back for the caller, so it passes through the field control, and a caller not allowed to see it
+// gets an error even though it was stored. Return is ignored for Removes.
 type Update struct {
 	TypeName string
 	Insert   PrettyBytes `sbor:",omitempty"`
 	Update   PrettyBytes `sbor:",omitempty"`
 	Remove   PrettyBytes `sbor:",omitempty"`
+	Return   bool        `sbor:",omitempty"`
 }
 
 func (u *Update) String() string {
@@ -189,7 +395,7 @@ const (
 	remove updateOp = "remove"
 )
 
-func (u *Update) execute(c *client) error {
+func (u *Update) execute(c *client) (PrettyBytes, error) {
 	var op updateOp
 	var b []byte
 	nonNilFields := 0
@@ -209,17 +415,22 @@ func (u *Update) execute(c *client) error {
 		nonNilFields++
 	}
 	if nonNilFields != 1 {
-		return fmt.Errorf("exactly one of the nullable fields of Update must be populated, not %+v", u)
+		return nil, fmt.Errorf("exactly one of the nullable fields of Update must be populated, not %+v", u)
 	}
 	typ, found := c.server.types[u.TypeName]
 	if !found {
-		return fmt.Errorf("%q not registered", u.TypeName)
+		return nil, &snek.NotRegisteredError{TypeName: u.TypeName}
 	}
 	instance := reflect.New(typ).Interface()
-	if err := cbor.Unmarshal(b, instance); err != nil {
-		return err
+	if err := c.unmarshalData(b, instance); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", u.TypeName, err)
+	}
+	if op == insert {
+		if err := c.server.handleClientID(instance); err != nil {
+			return nil, err
+		}
 	}
-	return c.server.Snek.Update(c.caller.Get(), func(upd *snek.Update) error {
+	if err := c.server.Snek.Update(c.caller.Get(), func(upd *snek.Update) error {
 		switch op {
 		case insert:
 			return upd.Insert(instance)
@@ -228,7 +439,39 @@ func (u *Update) execute(c *client) error {
 		default:
 			return upd.Remove(instance)
 		}
-	})
+	}); err != nil {
+		return nil, err
+	}
+	if !u.Return || op == remove {
+		return nil, nil
+	}
+	// Reading it back in a View runs it through the field control of the caller, which the update didn't.
+	if err := c.server.Snek.View(c.caller.Get(), func(v *snek.View) error {
+		return v.Get(instance)
+	}); err != nil {
+		return nil, fmt.Errorf("%s was stored, but reading it back failed: %w", u.TypeName, err)
+	}
+	return c.codec.Marshal(instance)
+}
+
+// handleClientID checks or replaces the ID of the inserted structPointer, as decided by Options.ClientIDs.
+func (s *Server) handleClientID(structPointer any) error {
+	if s.opts.ClientIDs == TrustClientIDs {
+		return nil
+	}
+	idField := reflect.ValueOf(structPointer).Elem().FieldByName("ID")
+	if !idField.IsValid() || idField.Type() != reflect.TypeOf(snek.ID{}) {
+		return nil
+	}
+	if s.opts.ClientIDs == ReplaceClientIDs {
+		idField.Set(reflect.ValueOf(s.Snek.NewID()))
+		return nil
+	}
+	window := s.opts.ClientIDWindow
+	if window == 0 {
+		window = defaultClientIDWindow
+	}
+	return s.Snek.CheckID(idField.Interface().(snek.ID), window)
 }
 
 // Sent from server as response to every message from the client.
@@ -260,19 +503,177 @@ func (u *Unsubscribe) String() string {
 	return fmt.Sprintf("%+v", *u)
 }
 
+// Sent from client to server to pause the subscription whose Response message had the ID defined by SubscriptionID, e.g. while
+// the view showing its data is hidden. Paused subscriptions send no Data, including events, until resumed.
+type Pause struct {
+	SubscriptionID snek.ID
+}
+
+func (p *Pause) String() string {
+	return fmt.Sprintf("%+v", *p)
+}
+
+func (p *Pause) execute(c *client) error {
+	return c.pauseSubscription(p.SubscriptionID, true)
+}
+
+// Sent from client to server to resume a paused subscription, which then sends Data with the changes made while it was paused, if any.
+type Resume struct {
+	SubscriptionID snek.ID
+}
+
+func (r *Resume) String() string {
+	return fmt.Sprintf("%+v", *r)
+}
+
+func (r *Resume) execute(c *client) error {
+	return c.pauseSubscription(r.SubscriptionID, false)
+}
+
+// Sent from client to server to load a page of the results of a subscription outside its live window, e.g. older
+// messages in a chat. The page uses the query of the subscription, with Offset and (unless zero) Limit replaced.
+// TypeName is only needed for subscriptions created by SubscribeAll. The structs are returned in the Aux of the Result,
+// and aren't updated when they change.
+type LoadMore struct {
+	SubscriptionID snek.ID
+	TypeName       string `sbor:",omitempty"`
+	Offset         uint   `sbor:",omitempty"`
+	Limit          uint   `sbor:",omitempty"`
+}
+
+func (l *LoadMore) String() string {
+	return fmt.Sprintf("%+v", *l)
+}
+
+func (l *LoadMore) execute(c *client) (PrettyBytes, error) {
+	subscribe, err := c.getSubscribe(l.SubscriptionID, l.TypeName)
+	if err != nil {
+		return nil, err
+	}
+	typ, found := c.server.types[subscribe.TypeName]
+	if !found {
+		return nil, &snek.NotRegisteredError{TypeName: subscribe.TypeName}
+	}
+	query, err := subscribe.toQuery()
+	if err != nil {
+		return nil, err
+	}
+	projection, err := subscribe.toProjection(typ, c.codec)
+	if err != nil {
+		return nil, err
+	}
+	query.Offset = l.Offset
+	if l.Limit != 0 {
+		query.Limit = l.Limit
+	}
+	results := reflect.New(reflect.SliceOf(typ))
+	results.Elem().Set(reflect.MakeSlice(reflect.SliceOf(typ), 0, 0))
+	if err := c.server.Snek.View(c.caller.Get(), func(v *snek.View) error {
+		return v.Select(results.Interface(), query)
+	}); err != nil {
+		return nil, err
+	}
+	return c.codec.Marshal(projection.project(results.Elem().Interface()))
+}
+
+// Sent from client to server to run the handler registered with RegisterCommand under Name, e.g. for app specific
+// operations that don't fit Update. Params are decoded into the parameter type of the handler, and the value returned
+// by the handler is returned in the Aux of the Result.
+type Command struct {
+	Name   string
+	Params PrettyBytes `sbor:",omitempty"`
+}
+
+func (c *Command) String() string {
+	return fmt.Sprintf("%+v", *c)
+}
+
+func (c *Command) execute(cl *client) (PrettyBytes, error) {
+	handler, found := cl.server.commands[c.Name]
+	if !found {
+		return nil, fmt.Errorf("command %q not registered", c.Name)
+	}
+	return handler(cl, c.Params)
+}
+
+// Sent from client to server to get the plan SQLite would use to load the structs of Subscribe, as a snek.QueryPlan in the
+// Aux of the Result, e.g. to see whether the conditions of a query use indexes. Only the query of Subscribe is used.
+// Since plans reveal details of the schema, like the names of indexes, only system and admin callers may explain queries.
+type Explain struct {
+	Subscribe Subscribe
+}
+
+func (e *Explain) String() string {
+	return fmt.Sprintf("%+v", *e)
+}
+
+func (e *Explain) execute(c *client) (PrettyBytes, error) {
+	caller := c.caller.Get()
+	if !caller.IsSystem() && !caller.IsAdmin() {
+		return nil, fmt.Errorf("only system and admin callers can explain queries")
+	}
+	typ, found := c.server.types[e.Subscribe.TypeName]
+	if !found {
+		return nil, &snek.NotRegisteredError{TypeName: e.Subscribe.TypeName}
+	}
+	query, err := e.Subscribe.toQuery()
+	if err != nil {
+		return nil, err
+	}
+	var plan *snek.QueryPlan
+	if err := c.server.Snek.View(caller, func(v *snek.View) error {
+		plan, err = v.Explain(reflect.New(typ).Interface(), query)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return c.codec.Marshal(plan)
+}
+
+// Sent from client to server to measure the round trip time, and to confirm that the server is alive.
+// Timestamp is chosen by the client, e.g. the current time in milliseconds, and is echoed in the Pong sent in
+// response instead of a Result. Pings also extend the read deadline of the connection, like WebSocket pongs.
+type Ping struct {
+	Timestamp int64
+}
+
+func (p *Ping) String() string {
+	return fmt.Sprintf("%+v", *p)
+}
+
+// Sent from server as response to a Ping.
+// ServerTime is the time, in milliseconds since the Unix epoch, when the server received the Ping.
+type Pong struct {
+	CauseMessageID snek.ID
+	Timestamp      int64
+	ServerTime     int64
+}
+
+func (p *Pong) String() string {
+	return fmt.Sprintf("%+v", *p)
+}
+
 // Sent in both directions.
 type Message struct {
 	ID snek.ID
 
 	// From client to server.
-	Subscribe   *Subscribe   `sbor:",omitempty"`
-	Unsubscribe *Unsubscribe `sbor:",omitempty"`
-	Update      *Update      `sbor:",omitempty"`
-	Identity    *Identity    `sbor:",omitempty"`
+	Subscribe    *Subscribe    `sbor:",omitempty"`
+	SubscribeAll *SubscribeAll `sbor:",omitempty"`
+	Unsubscribe  *Unsubscribe  `sbor:",omitempty"`
+	Pause        *Pause        `sbor:",omitempty"`
+	Resume       *Resume       `sbor:",omitempty"`
+	Update       *Update       `sbor:",omitempty"`
+	Identity     *Identity     `sbor:",omitempty"`
+	LoadMore     *LoadMore     `sbor:",omitempty"`
+	Command      *Command      `sbor:",omitempty"`
+	Ping         *Ping         `sbor:",omitempty"`
+	Explain      *Explain      `sbor:",omitempty"`
 
 	// From server to client.
 	Data   *Data   `sbor:",omitempty"`
 	Result *Result `sbor:",omitempty"`
+	Pong   *Pong   `sbor:",omitempty"`
 }
 
 func (c *client) response(m *Message, aux PrettyBytes, err error) *Message {
@@ -297,9 +698,18 @@ func (m *Message) validate() error {
 	if m.Subscribe != nil {
 		nonNilFields++
 	}
+	if m.SubscribeAll != nil {
+		nonNilFields++
+	}
 	if m.Unsubscribe != nil {
 		nonNilFields++
 	}
+	if m.Pause != nil {
+		nonNilFields++
+	}
+	if m.Resume != nil {
+		nonNilFields++
+	}
 	if m.Data != nil {
 		nonNilFields++
 	}
@@ -312,6 +722,21 @@ func (m *Message) validate() error {
 	if m.Identity != nil {
 		nonNilFields++
 	}
+	if m.LoadMore != nil {
+		nonNilFields++
+	}
+	if m.Command != nil {
+		nonNilFields++
+	}
+	if m.Ping != nil {
+		nonNilFields++
+	}
+	if m.Explain != nil {
+		nonNilFields++
+	}
+	if m.Pong != nil {
+		nonNilFields++
+	}
 	if nonNilFields != 1 {
 		return fmt.Errorf("exactly one of the nullable fields of Message must be populated, not %+v", m)
 	}
@@ -319,12 +744,33 @@ func (m *Message) validate() error {
 }
 
 type client struct {
-	server        *Server
-	conn          *websocket.Conn
-	lock          synch.Lock
-	caller        *synch.S[snek.Caller]
-	closed        int32
-	subscriptions map[string]snek.Subscription
+	server *Server
+	// id identifies the connection in recordings.
+	id        snek.ID
+	conn      *websocket.Conn
+	codec     Codec
+	codecName string
+	lock      synch.Lock
+	// ctx carries the HTTP request of the connection, and is canceled when the connection closes.
+	ctx    context.Context
+	cancel context.CancelFunc
+	caller *synch.S[snek.Caller]
+	closed int32
+	// subscriptionLock protects subscriptions, where reserved but not yet created subscriptions are nil,
+	// and subscribes, containing the Subscribes that created each subscription.
+	subscriptionLock synch.Lock
+	subscriptions    map[string]snek.Subscription
+	subscribes       map[string][]Subscribe
+	// outbound contains the messages waiting to be written by writeLoop.
+	outbound *outboundQueue
+}
+
+// unmarshalData unmarshals data sent inside messages, strictly if Options.StrictDecoding is set.
+func (c *client) unmarshalData(b []byte, v any) error {
+	if c.server.opts.StrictDecoding {
+		return c.codec.(StrictCodec).UnmarshalStrict(b, v)
+	}
+	return c.codec.Unmarshal(b, v)
 }
 
 func (c *client) readLoop() {
@@ -340,11 +786,12 @@ func (c *client) readLoop() {
 		} else {
 			go func() {
 				message := &Message{}
-				if err := cbor.Unmarshal(b, message); err != nil {
+				if err := c.codec.Unmarshal(b, message); err != nil {
 					log.Printf("while unmarshalling message: %v", err)
 					c.send(c.response(nil, nil, fmt.Errorf("unable to parse message: %v", err)))
 					return
 				}
+				c.record(message, true)
 				if err := message.validate(); err != nil {
 					log.Printf("while validating message: %v", err)
 					c.send(c.response(message, nil, err))
@@ -354,18 +801,46 @@ func (c *client) readLoop() {
 
 				switch {
 				case message.Subscribe != nil:
-					c.send(c.response(message, nil, message.Subscribe.execute(c, message.ID)))
+					// Data for the subscription waits for ready, to guarantee that the Result arrives first.
+					ready := make(chan struct{})
+					c.send(c.response(message, nil, message.Subscribe.execute(c, message.ID, ready)))
+					close(ready)
+				case message.SubscribeAll != nil:
+					ready := make(chan struct{})
+					c.send(c.response(message, nil, message.SubscribeAll.execute(c, message.ID, ready)))
+					close(ready)
 				case message.Unsubscribe != nil:
-					stringID := string(message.Unsubscribe.SubscriptionID)
-					if sub, found := c.subscriptions[stringID]; found {
-						sub.Close()
-						delete(c.subscriptions, stringID)
+					if c.removeSubscription(message.Unsubscribe.SubscriptionID) {
 						c.send(c.response(message, nil, nil))
 					} else {
 						c.send(c.response(message, nil, fmt.Errorf("subscription %v not found", message.Unsubscribe.SubscriptionID)))
 					}
+				case message.Pause != nil:
+					c.send(c.response(message, nil, message.Pause.execute(c)))
+				case message.Resume != nil:
+					c.send(c.response(message, nil, message.Resume.execute(c)))
 				case message.Update != nil:
-					c.send(c.response(message, nil, message.Update.execute(c)))
+					aux, err := message.Update.execute(c)
+					c.send(c.response(message, aux, err))
+				case message.LoadMore != nil:
+					aux, err := message.LoadMore.execute(c)
+					c.send(c.response(message, aux, err))
+				case message.Command != nil:
+					aux, err := message.Command.execute(c)
+					c.send(c.response(message, aux, err))
+				case message.Explain != nil:
+					aux, err := message.Explain.execute(c)
+					c.send(c.response(message, aux, err))
+				case message.Ping != nil:
+					c.conn.SetReadDeadline(time.Now().Add(c.server.opts.PongWait))
+					c.send(&Message{
+						ID: c.server.Snek.NewID(),
+						Pong: &Pong{
+							CauseMessageID: message.ID,
+							Timestamp:      message.Ping.Timestamp,
+							ServerTime:     time.Now().UnixMilli(),
+						},
+					})
 				case message.Identity != nil:
 					caller, aux, err := c.server.opts.Identifier.Identify(message.Identity)
 					if err != nil {
@@ -373,8 +848,9 @@ func (c *client) readLoop() {
 						c.send(c.response(message, nil, err))
 					} else {
 						log.Printf("caller identified as %+v", caller)
-						c.caller.Set(caller)
-						c.send(c.response(message, aux, nil))
+						c.caller.Set(snek.WithContext(caller, c.ctx))
+						resp := c.response(message, aux, nil)
+						c.sendRecording(resp, withoutAux(resp))
 					}
 				default:
 					log.Printf("received unexpected message %+v", message)
@@ -382,25 +858,24 @@ func (c *client) readLoop() {
 			}()
 		}
 	}
+	c.closeSubscriptions()
+	c.cancel()
 	c.conn.Close()
 }
 
 func (c *client) send(m *Message) error {
-	b, err := cbor.Marshal(m)
-	if err != nil {
-		return err
-	}
-	err = c.lock.Sync(func() error {
-		c.conn.SetWriteDeadline(time.Now().Add(c.server.opts.WriteWait))
-		return c.conn.WriteMessage(websocket.BinaryMessage, b)
-	})
-	if err == nil {
-		log.Printf("-> sent message %+v", m)
-	} else {
-		log.Printf("while sending %+v: %v", m, err)
-		atomic.StoreInt32(&c.closed, 1)
-	}
-	return err
+	return c.sendRecording(m, m)
+}
+
+// sendRecording queues m to be sent, but records recorded instead if Options.RecordPath is set, e.g. to redact secrets in m.
+func (c *client) sendRecording(m *Message, recorded *Message) error {
+	return c.enqueue(&outbound{message: m, recorded: recorded})
+}
+
+// sendLatest queues the subscription Data in m to be sent, letting later Data of the same subscription replace it
+// if the client is too slow to receive it and Options.SlowClients is CoalesceSlowClients.
+func (c *client) sendLatest(m *Message) error {
+	return c.enqueue(&outbound{message: m, recorded: m, latest: true})
 }
 
 func (c *client) pingLoop() {
@@ -447,17 +922,97 @@ type Identifier interface {
 	Identify(*Identity) (snek.Caller, PrettyBytes, error)
 }
 
+// HTTPIdentifier is implemented by Identifiers that can also identify callers from the HTTP request
+// upgrading to a WebSocket, so that the connection is identified before any messages are sent.
+type HTTPIdentifier interface {
+	// IdentifyHTTP returns a nil caller if the request contains no credentials, in which case the
+	// connection starts out anonymous and can be identified using Identity messages.
+	IdentifyHTTP(*http.Request) (snek.Caller, error)
+}
+
+// AuthorizationIdentifier is an HTTPIdentifier that passes the token of "Authorization: Bearer <token>"
+// request headers to the wrapped Identifier.
+type AuthorizationIdentifier struct {
+	Identifier
+}
+
+func (a AuthorizationIdentifier) IdentifyHTTP(r *http.Request) (snek.Caller, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil, nil
+	}
+	caller, _, err := a.Identify(&Identity{Token: snek.ID(token)})
+	return caller, err
+}
+
 // Options contains server configuration.
 type Options struct {
 	Path        string
 	Addr        string
 	SnekOptions snek.Options
-	WriteWait   time.Duration
-	PongWait    time.Duration
-	PingPeriod  time.Duration
-	Identifier  Identifier
+	// WriteWait is how long writes to connections may take, and connections whose writes don't finish within it are always closed.
+	WriteWait  time.Duration
+	PongWait   time.Duration
+	PingPeriod time.Duration
+	Identifier Identifier
+	// Codecs defines the codecs clients can select when connecting.
+	Codecs map[string]Codec
+
+	// MaxSubscriptions limits the number of subscriptions of the whole server, and MaxClientSubscriptions limits the
+	// number of subscriptions of each connection. Zero means unlimited.
+	MaxSubscriptions       int
+	MaxClientSubscriptions int
+	// StrictDecoding makes the server reject structs in Updates with fields unknown to their type, instead of ignoring
+	// the unknown fields, to catch schema drift between clients and server early.
+	StrictDecoding bool
+	// RecordPath, if set, makes the server append every Message it receives and sends, with the time and the connection,
+	// to the file at RecordPath, for debugging using ReadRecording and Replay. Identity tokens, and the Aux of the Results
+	// of Identity messages, are redacted, but the rest of the messages, including the data in them, is recorded as is.
+	RecordPath string
+	// ClientIDs decides what happens to the IDs of structs clients insert using Update messages, see ClientIDPolicy.
+	ClientIDs ClientIDPolicy
+	// ClientIDWindow is how far from the current time the IDs may claim to be created when checked, one minute if zero.
+	ClientIDWindow time.Duration
+	// OutboundQueueSize is the number of messages that can wait to be sent to each connection, 256 if zero.
+	OutboundQueueSize int
+	// SlowClients decides what happens to connections too slow to keep their queue from filling up, see SlowClientPolicy.
+	SlowClients SlowClientPolicy
 }
 
+// ClientIDPolicy decides how the server treats the IDs of structs inserted by clients, which create their own IDs to
+// know them before the inserts are acknowledged. Structs without ID fields of type snek.ID are always inserted as is.
+type ClientIDPolicy int
+
+const (
+	// TrustClientIDs inserts structs with the IDs the clients created.
+	TrustClientIDs ClientIDPolicy = iota
+	// CheckClientIDs rejects inserts of structs whose IDs couldn't have been created by snek.Snek.NewID within
+	// Options.ClientIDWindow of now, i.e. with the wrong length or a creation time too far from now, as described by
+	// snek.Snek.CheckID. Inserts with IDs of existing structs fail like any other insert would.
+	CheckClientIDs
+	// ReplaceClientIDs replaces the IDs the clients created with new IDs created by the server before inserting the structs.
+	// Clients learn the new IDs using Update.Return.
+	ReplaceClientIDs
+)
+
+// SlowClientPolicy decides what happens when a message is sent to a connection whose outbound queue is full, because
+// the client doesn't receive the messages as fast as the server sends them.
+type SlowClientPolicy int
+
+const (
+	// DisconnectSlowClients closes the connection, and all its subscriptions.
+	DisconnectSlowClients SlowClientPolicy = iota
+	// CoalesceSlowClients replaces Data waiting to be sent with newer Data of the same subscription, so that slow clients
+	// only receive the latest results of their subscriptions. Tailed Data, events, and other messages can't be replaced,
+	// and close the connection like DisconnectSlowClients if the queue has no room for them.
+	CoalesceSlowClients
+)
+
+const (
+	defaultClientIDWindow    = time.Minute
+	defaultOutboundQueueSize = 256
+)
+
 // DefaultOptions returns default options for the given interface address, database path, and identifier.
 func DefaultOptions(addr string, path string, identifier Identifier) Options {
 	snekOpts := snek.DefaultOptions(path)
@@ -469,6 +1024,7 @@ func DefaultOptions(addr string, path string, identifier Identifier) Options {
 		PongWait:    60 * time.Second,
 		PingPeriod:  50 * time.Second,
 		Identifier:  identifier,
+		Codecs:      DefaultCodecs(),
 	}
 }
 
@@ -480,6 +1036,31 @@ type Server struct {
 	mux        *http.ServeMux
 	httpServer *http.Server
 	Upgrader   *websocket.Upgrader
+
+	subscriptionLock  synch.Lock
+	subscriptionCount int
+
+	commands map[string]func(c *client, params []byte) (PrettyBytes, error)
+
+	// recorder records the messages of all connections, if Options.RecordPath is set.
+	recorder *recorder
+}
+
+func (s *Server) reserveSubscription() error {
+	return s.subscriptionLock.Sync(func() error {
+		if max := s.opts.MaxSubscriptions; max > 0 && s.subscriptionCount >= max {
+			return fmt.Errorf("too many subscriptions: server already has the maximum %d", max)
+		}
+		s.subscriptionCount++
+		return nil
+	})
+}
+
+func (s *Server) releaseSubscription() {
+	s.subscriptionLock.Sync(func() error {
+		s.subscriptionCount--
+		return nil
+	})
 }
 
 // Open returns a server using the provided options.
@@ -488,38 +1069,101 @@ func (o Options) Open() (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	if o.Codecs == nil {
+		o.Codecs = DefaultCodecs()
+	}
+	if o.StrictDecoding {
+		for name, codec := range o.Codecs {
+			if _, ok := codec.(StrictCodec); !ok {
+				s.Close()
+				return nil, fmt.Errorf("codec %q doesn't support strict decoding", name)
+			}
+		}
+	}
 	result := &Server{
-		Snek:  s,
-		opts:  o,
-		types: map[string]reflect.Type{},
-		mux:   http.NewServeMux(),
+		Snek:     s,
+		opts:     o,
+		types:    map[string]reflect.Type{},
+		commands: map[string]func(*client, []byte) (PrettyBytes, error){},
+		mux:      http.NewServeMux(),
 		Upgrader: &websocket.Upgrader{
 			EnableCompression: true,
 		},
 	}
+	if o.RecordPath != "" {
+		if result.recorder, err = newRecorder(o.RecordPath); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
 	result.httpServer = &http.Server{
 		Addr:    o.Addr,
 		Handler: result.mux,
 	}
 	result.mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		codecName := r.URL.Query().Get("codec")
+		if codecName == "" {
+			codecName = defaultCodecName
+		}
+		codec, found := o.Codecs[codecName]
+		if !found {
+			http.Error(w, fmt.Sprintf("unknown codec %q", codecName), http.StatusBadRequest)
+			return
+		}
+		var caller snek.Caller = snek.AnonCaller{}
+		if httpIdentifier, ok := o.Identifier.(HTTPIdentifier); ok {
+			httpCaller, err := httpIdentifier.IdentifyHTTP(r)
+			if err != nil {
+				log.Printf("caller failed to identify: %v", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if httpCaller != nil {
+				log.Printf("caller identified as %+v", httpCaller)
+				caller = httpCaller
+			}
+		}
 		conn, err := result.Upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Printf("while upgrading %+v, %+v: %v", w, r, err)
 			return
 		}
+		outboundQueueSize := o.OutboundQueueSize
+		if outboundQueueSize == 0 {
+			outboundQueueSize = defaultOutboundQueueSize
+		}
+		// The request context is canceled when the handler returns, so the connection gets its own.
+		ctx, cancel := context.WithCancel(context.WithValue(context.WithoutCancel(r.Context()), httpRequestKey{}, r))
 		c := &client{
+			id:            result.Snek.NewID(),
 			conn:          conn,
+			codec:         codec,
+			codecName:     codecName,
 			server:        result,
+			ctx:           ctx,
+			cancel:        cancel,
 			subscriptions: map[string]snek.Subscription{},
-			caller:        synch.New[snek.Caller](snek.AnonCaller{}),
+			subscribes:    map[string][]Subscribe{},
+			caller:        synch.New[snek.Caller](snek.WithContext(caller, ctx)),
+			outbound:      newOutboundQueue(outboundQueueSize, o.SlowClients == CoalesceSlowClients),
 		}
 		go c.pingLoop()
+		go c.writeLoop()
 		go c.readLoop()
 		log.Printf("%v connected", conn.RemoteAddr())
 	})
 	return result, nil
 }
 
+type httpRequestKey struct{}
+
+// HTTPRequest returns the HTTP request of the connection a View.Context or Update.Context belongs to,
+// e.g. to audit the remote address, or nil if the context doesn't belong to a connection.
+func HTTPRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(httpRequestKey{}).(*http.Request)
+	return r
+}
+
 // Mux returns the mux for this server.
 func (s *Server) Mux() *http.ServeMux {
 	return s.mux
@@ -536,7 +1180,96 @@ func Register[T any](s *Server, structPointer *T, queryControl snek.QueryControl
 	return nil
 }
 
+// Registration bundles a type with its controls, for registration using RegisterAll. Create them using NewRegistration.
+type Registration interface {
+	register(s *Server) error
+}
+
+type registration[T any] struct {
+	structPointer *T
+	queryControl  snek.QueryControl
+	updateControl snek.UpdateControl[T]
+}
+
+func (r *registration[T]) register(s *Server) error {
+	return Register(s, r.structPointer, r.queryControl, r.updateControl)
+}
+
+// NewRegistration returns a Registration of the type of the example structPointer with the given controls.
+func NewRegistration[T any](structPointer *T, queryControl snek.QueryControl, updateControl snek.UpdateControl[T]) Registration {
+	return &registration[T]{
+		structPointer: structPointer,
+		queryControl:  queryControl,
+		updateControl: updateControl,
+	}
+}
+
+// RegisterAll registers the types of registrations, in order, like Register, and returns the first error.
+func RegisterAll(s *Server, registrations ...Registration) error {
+	for _, registration := range registrations {
+		if err := registration.register(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterCommand registers handler to run, in an Update with the caller of the client, when a client sends a Command named name.
+// The Params of the Command are decoded into a P, and the value returned by handler (unless nil) is encoded into the Aux of the Result.
+// If handler returns an error, the Update is rolled back.
+func RegisterCommand[P any](s *Server, name string, handler func(u *snek.Update, params *P) (any, error)) error {
+	if _, found := s.commands[name]; found {
+		return fmt.Errorf("command %q already registered", name)
+	}
+	s.commands[name] = func(c *client, b []byte) (PrettyBytes, error) {
+		params := new(P)
+		if len(b) > 0 {
+			if err := c.unmarshalData(b, params); err != nil {
+				return nil, fmt.Errorf("decoding params of %q: %w", name, err)
+			}
+		}
+		var result any
+		if err := s.Snek.Update(c.caller.Get(), func(u *snek.Update) error {
+			var err error
+			result, err = handler(u, params)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if result == nil {
+			return nil, nil
+		}
+		return c.codec.Marshal(result)
+	}
+	return nil
+}
+
+// Publish sends structPointer to all subscriptions of its type that match it, whose callers pass filter (if not nil),
+// without storing it. Useful for ephemeral events like typing indicators.
+func (s *Server) Publish(structPointer any, filter func(snek.Caller) bool) error {
+	typ := reflect.TypeOf(structPointer)
+	if typ.Kind() != reflect.Ptr || s.types[typ.Elem().Name()] != typ.Elem() {
+		return &snek.NotRegisteredError{TypeName: typ.String()}
+	}
+	return s.Snek.Publish(structPointer, filter)
+}
+
 // Run starts the server.
 func (s *Server) Run() error {
 	return s.httpServer.ListenAndServe()
 }
+
+// Close stops the server started by Run, and closes its store and the recording file, if Options.RecordPath is set.
+// The server can't be used after it's closed.
+func (s *Server) Close() error {
+	err := s.httpServer.Close()
+	if snekErr := s.Snek.Close(); err == nil {
+		err = snekErr
+	}
+	if s.recorder != nil {
+		if recorderErr := s.recorder.close(); err == nil {
+			err = recorderErr
+		}
+	}
+	return err
+}
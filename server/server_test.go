@@ -1,11 +1,22 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/zond/snek"
 )
 
 func TestNestedCBOR(t *testing.T) {
@@ -51,3 +62,1191 @@ func TestJSCBOR(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func withServer(t *testing.T, f func(s *Server, wsURL string)) {
+	withModifiedServer(t, func(*Options) {}, f)
+}
+
+func withModifiedServer(t *testing.T, optFunc func(*Options), f func(s *Server, wsURL string)) {
+	dir, err := os.MkdirTemp(os.TempDir(), "snek_server_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions("", filepath.Join(dir, "sqlite.db"), AnonymousIdentifier{})
+	optFunc(&opts)
+	s, err := opts.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	httpServer := httptest.NewServer(s.Mux())
+	defer httpServer.Close()
+	f(s, "ws"+strings.TrimPrefix(httpServer.URL, "http")+"/ws")
+}
+
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions("", filepath.Join(dir, "sqlite.db"), AnonymousIdentifier{})
+	opts.RecordPath = filepath.Join(dir, "recording")
+	s, err := opts.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snek.View(snek.SystemCaller{}, func(v *snek.View) error { return nil }); err == nil {
+		t.Errorf("wanted the store to be closed")
+	}
+	if err := s.recorder.record(&RecordedMessage{}); err == nil {
+		t.Errorf("wanted the recording file to be closed")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		for name, codec := range DefaultCodecs() {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?codec="+name, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := codec.Marshal(&Message{ID: snek.ID("id"), Identity: &Identity{}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.WriteMessage(codec.MessageType(), b); err != nil {
+				t.Fatal(err)
+			}
+			messageType, b, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messageType != codec.MessageType() {
+				t.Errorf("got message type %v, want %v", messageType, codec.MessageType())
+			}
+			resp := &Message{}
+			if err := codec.Unmarshal(b, resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Result == nil || string(resp.Result.CauseMessageID) != "id" || resp.Result.Error != "" {
+				t.Errorf("got %+v, wanted successful result caused by id", resp)
+			}
+			conn.Close()
+		}
+		if _, _, err := websocket.DefaultDialer.Dial(wsURL+"?codec=unknown", nil); err == nil {
+			t.Errorf("got nil, wanted error for unknown codec")
+		}
+	})
+}
+
+func TestMatchValidatesCond(t *testing.T) {
+	if _, err := (&Match{Cond: &snek.Cond{Field: "A", Comparator: "~=", Value: 1}}).ToSet(); err == nil {
+		t.Errorf("got nil, wanted error for unknown comparator")
+	}
+	set, err := (&Match{Cond: &snek.Cond{Field: "A", Comparator: snek.EQ, Value: 1}}).ToSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (snek.Cond{Field: "A", Comparator: snek.EQ, Value: 1}); !reflect.DeepEqual(set, want) {
+		t.Errorf("got %+v, want %+v", set, want)
+	}
+}
+
+type testClient struct {
+	t     *testing.T
+	conn  *websocket.Conn
+	codec Codec
+}
+
+func dial(t *testing.T, wsURL string) *testClient {
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{t: t, conn: conn, codec: CBORCodec{}}
+}
+
+func (c *testClient) send(m *Message) {
+	c.t.Helper()
+	b, err := c.codec.Marshal(m)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteMessage(c.codec.MessageType(), b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testClient) receive() *Message {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, b, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m := &Message{}
+	if err := c.codec.Unmarshal(b, m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// receiveResult returns the next Result, skipping any Data.
+func (c *testClient) receiveResult() *Result {
+	c.t.Helper()
+	for {
+		if m := c.receive(); m.Result != nil {
+			return m.Result
+		}
+	}
+}
+
+type testStruct struct {
+	ID     snek.ID
+	String string
+}
+
+type otherTestStruct struct {
+	ID  snek.ID
+	Int int
+}
+
+func TestSubscribeAll(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		if err := Register(s, &otherTestStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&otherTestStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("sub"), SubscribeAll: &SubscribeAll{Subscribes: []Subscribe{{TypeName: "testStruct"}, {TypeName: "otherTestStruct"}}}})
+		typeNames := map[string]bool{}
+		for len(typeNames) < 2 {
+			m := c.receive()
+			switch {
+			case m.Result != nil:
+				if m.Result.Error != "" {
+					t.Fatalf("got %+v, wanted no error", m.Result)
+				}
+			case m.Data != nil:
+				if string(m.Data.CauseMessageID) != "sub" {
+					t.Errorf("got %+v, wanted data caused by sub", m.Data)
+				}
+				typeNames[m.Data.TypeName] = true
+			}
+		}
+		if !typeNames["testStruct"] || !typeNames["otherTestStruct"] {
+			t.Errorf("got %+v, wanted data for both types", typeNames)
+		}
+	})
+}
+
+func TestSubscribeResultBeforeData(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		for i := 0; i < 10; i++ {
+			id := snek.ID(fmt.Sprintf("sub%d", i))
+			c.send(&Message{ID: id, Subscribe: &Subscribe{TypeName: "testStruct"}})
+			if m := c.receive(); m.Result == nil || !m.Result.CauseMessageID.Equal(id) {
+				t.Errorf("got %+v, wanted result for %s", m, id)
+			}
+			if m := c.receive(); m.Data == nil || !m.Data.CauseMessageID.Equal(id) || !m.Data.Initial {
+				t.Errorf("got %+v, wanted initial data for %s", m, id)
+			}
+		}
+	})
+}
+
+func TestSubscriptionLimits(t *testing.T) {
+	withModifiedServer(t, func(opts *Options) {
+		opts.MaxSubscriptions = 3
+		opts.MaxClientSubscriptions = 2
+	}, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		subscribe := func(c *testClient, id string, wantErr bool) {
+			t.Helper()
+			c.send(&Message{ID: snek.ID(id), Subscribe: &Subscribe{TypeName: "testStruct"}})
+			if res := c.receiveResult(); (res.Error != "") != wantErr {
+				t.Errorf("subscribing %s got %+v, wanted error: %v", id, res, wantErr)
+			}
+		}
+		c1 := dial(t, wsURL)
+		defer c1.conn.Close()
+		subscribe(c1, "sub1", false)
+		subscribe(c1, "sub2", false)
+		subscribe(c1, "sub3", true)
+		// Replacing a subscription doesn't need more room.
+		subscribe(c1, "sub1", false)
+		c1.send(&Message{ID: snek.ID("unsub"), Unsubscribe: &Unsubscribe{SubscriptionID: snek.ID("sub1")}})
+		if res := c1.receiveResult(); res.Error != "" {
+			t.Errorf("got %+v, wanted no error", res)
+		}
+		subscribe(c1, "sub3", false)
+
+		c2 := dial(t, wsURL)
+		defer c2.conn.Close()
+		subscribe(c2, "sub1", false)
+		subscribe(c2, "sub2", true)
+
+		// Closing a connection releases its subscriptions.
+		c1.conn.Close()
+		for i := 0; ; i++ {
+			c2.send(&Message{ID: snek.ID("sub2"), Subscribe: &Subscribe{TypeName: "testStruct"}})
+			if res := c2.receiveResult(); res.Error == "" {
+				break
+			} else if i > 100 {
+				t.Fatalf("got %+v, wanted subscriptions of closed connections to be released", res)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+type testCaller struct {
+	userID  snek.ID
+	isAdmin bool
+}
+
+func (t testCaller) UserID() snek.ID {
+	return t.userID
+}
+
+func (t testCaller) IsAdmin() bool {
+	return t.isAdmin
+}
+
+func (t testCaller) IsSystem() bool {
+	return false
+}
+
+type testIdentifier struct{}
+
+func (t testIdentifier) Identify(i *Identity) (snek.Caller, PrettyBytes, error) {
+	if string(i.Token) == "bad" {
+		return nil, nil, fmt.Errorf("bad token")
+	}
+	return testCaller{userID: i.Token, isAdmin: string(i.Token) == "admin"}, nil, nil
+}
+
+func TestAuthorizationIdentifier(t *testing.T) {
+	withModifiedServer(t, func(opts *Options) {
+		opts.Identifier = AuthorizationIdentifier{testIdentifier{}}
+	}, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, func(v *snek.View, q *snek.Query) error {
+			if string(v.Caller().UserID()) != "user" {
+				return fmt.Errorf("only user can query")
+			}
+			return nil
+		}, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			header     string
+			wantDialOK bool
+			wantSubOK  bool
+		}{
+			{header: "", wantDialOK: true, wantSubOK: false},
+			{header: "Bearer user", wantDialOK: true, wantSubOK: true},
+			{header: "Bearer other", wantDialOK: true, wantSubOK: false},
+			{header: "Bearer bad", wantDialOK: false},
+		} {
+			header := http.Header{}
+			if tc.header != "" {
+				header.Set("Authorization", tc.header)
+			}
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+			if (err == nil) != tc.wantDialOK {
+				t.Errorf("%q: got %v, wanted successful dial: %v", tc.header, err, tc.wantDialOK)
+			}
+			if err != nil {
+				continue
+			}
+			c := &testClient{t: t, conn: conn, codec: CBORCodec{}}
+			c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct"}})
+			for {
+				if m := c.receive(); m.Data != nil {
+					if (m.Data.Error == "") != tc.wantSubOK {
+						t.Errorf("%q: got %+v, wanted successful subscription: %v", tc.header, m.Data, tc.wantSubOK)
+					}
+					break
+				}
+			}
+			conn.Close()
+		}
+	})
+}
+
+func TestPublish(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct"}})
+		if m := c.receive(); m.Result == nil || m.Result.Error != "" {
+			t.Fatalf("got %+v, wanted successful result", m)
+		}
+		if m := c.receive(); m.Data == nil || !m.Data.Initial {
+			t.Fatalf("got %+v, wanted initial data", m)
+		}
+		if err := s.Publish(&otherTestStruct{ID: snek.ID("other")}, nil); err == nil {
+			t.Errorf("got nil, wanted error publishing unregistered type")
+		}
+		want := &testStruct{ID: snek.ID("typing"), String: "typing"}
+		if err := s.Publish(want, nil); err != nil {
+			t.Fatal(err)
+		}
+		m := c.receive()
+		if m.Data == nil || !m.Data.Event || string(m.Data.CauseMessageID) != "sub" {
+			t.Fatalf("got %+v, wanted event data caused by sub", m)
+		}
+		got := &testStruct{}
+		if err := c.codec.Unmarshal(m.Data.Blob, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+	})
+}
+
+func TestSubscribeCount(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+			return u.Insert(&testStruct{ID: snek.ID("id")})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct", Count: true}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		m := c.receive()
+		if m.Data == nil || m.Data.Error != "" {
+			t.Fatalf("got %+v, wanted data", m)
+		}
+		count := 0
+		if err := c.codec.Unmarshal(m.Data.Blob, &count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("got %v, wanted 1", count)
+		}
+	})
+}
+
+func TestLoadMore(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+			for _, str := range []string{"a", "b", "c", "d", "e"} {
+				if err := u.Insert(&testStruct{ID: snek.ID(str), String: str}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct", Order: []snek.Order{{Field: "String", Desc: true}}, Limit: 2}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		for _, tc := range []struct {
+			loadMore *LoadMore
+			want     []string
+			wantErr  bool
+		}{
+			{loadMore: &LoadMore{SubscriptionID: snek.ID("sub"), Offset: 2}, want: []string{"c", "b"}},
+			{loadMore: &LoadMore{SubscriptionID: snek.ID("sub"), Offset: 2, Limit: 3}, want: []string{"c", "b", "a"}},
+			{loadMore: &LoadMore{SubscriptionID: snek.ID("sub"), Offset: 4}, want: []string{"a"}},
+			{loadMore: &LoadMore{SubscriptionID: snek.ID("sub"), TypeName: "otherTestStruct"}, wantErr: true},
+			{loadMore: &LoadMore{SubscriptionID: snek.ID("unknown")}, wantErr: true},
+		} {
+			c.send(&Message{ID: snek.ID("load"), LoadMore: tc.loadMore})
+			res := c.receiveResult()
+			if (res.Error != "") != tc.wantErr {
+				t.Errorf("%+v: got %+v, wanted error: %v", tc.loadMore, res, tc.wantErr)
+			}
+			if tc.wantErr {
+				continue
+			}
+			structs := []testStruct{}
+			if err := c.codec.Unmarshal(res.Aux, &structs); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, ts := range structs {
+				got = append(got, ts.String)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("%+v: got %v, wanted %v", tc.loadMore, got, tc.want)
+			}
+		}
+	})
+}
+
+func TestStrictDecoding(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		withModifiedServer(t, func(opts *Options) {
+			opts.StrictDecoding = strict
+		}, func(s *Server, wsURL string) {
+			if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+				t.Fatal(err)
+			}
+			c := dial(t, wsURL)
+			b, err := cbor.Marshal(map[string]any{
+				"ID":      []byte(s.Snek.NewID()),
+				"String":  "string",
+				"Unknown": "unknown",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.send(&Message{ID: snek.ID("insert"), Update: &Update{TypeName: "testStruct", Insert: b}})
+			if res := c.receiveResult(); (res.Error != "") != strict {
+				t.Errorf("got %+v with strict %v, wanted error exactly when strict", res, strict)
+			}
+		})
+	}
+}
+
+type commandParams struct {
+	String string
+}
+
+func TestCommand(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterCommand(s, "insert", func(u *snek.Update, params *commandParams) (any, error) {
+			if params.String == "" {
+				return nil, fmt.Errorf("empty string")
+			}
+			if err := u.Insert(&testStruct{ID: s.Snek.NewID(), String: params.String}); err != nil {
+				return nil, err
+			}
+			return u.Count(&testStruct{}, nil)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterCommand(s, "insert", func(u *snek.Update, params *commandParams) (any, error) { return nil, nil }); err == nil {
+			t.Errorf("wanted error registering command twice")
+		}
+		c := dial(t, wsURL)
+		params, err := cbor.Marshal(commandParams{String: "string"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(&Message{ID: snek.ID("command"), Command: &Command{Name: "insert", Params: params}})
+		res := c.receiveResult()
+		if res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		count := 0
+		if err := cbor.Unmarshal(res.Aux, &count); err != nil || count != 1 {
+			t.Errorf("got %v, %v, wanted 1", count, err)
+		}
+		c.send(&Message{ID: snek.ID("empty"), Command: &Command{Name: "insert"}})
+		if res := c.receiveResult(); res.Error == "" {
+			t.Errorf("got %+v, wanted error from handler", res)
+		}
+		c.send(&Message{ID: snek.ID("missing"), Command: &Command{Name: "missing"}})
+		if res := c.receiveResult(); res.Error == "" {
+			t.Errorf("got %+v, wanted error for unregistered command", res)
+		}
+	})
+}
+
+func TestControlContext(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		remoteAddrs := []string{}
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, func(u *snek.Update, prev, next *testStruct) error {
+			if r := HTTPRequest(u.Context()); r != nil {
+				remoteAddrs = append(remoteAddrs, r.RemoteAddr)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		b, err := cbor.Marshal(&testStruct{ID: s.Snek.NewID()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(&Message{ID: snek.ID("insert"), Update: &Update{TypeName: "testStruct", Insert: b}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		if len(remoteAddrs) != 1 || remoteAddrs[0] == "" {
+			t.Errorf("got %v, wanted one remote address", remoteAddrs)
+		}
+	})
+}
+
+func TestPing(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		c := dial(t, wsURL)
+		before := time.Now().UnixMilli()
+		c.send(&Message{ID: snek.ID("ping"), Ping: &Ping{Timestamp: 17}})
+		m := c.receive()
+		if m.Pong == nil || !m.Pong.CauseMessageID.Equal(snek.ID("ping")) || m.Pong.Timestamp != 17 || m.Pong.ServerTime < before || m.Pong.ServerTime > time.Now().UnixMilli() {
+			t.Errorf("got %+v, wanted Pong echoing 17", m)
+		}
+		c.send(&Message{ID: snek.ID("pong"), Pong: &Pong{}, Ping: &Ping{}})
+		if res := c.receiveResult(); res.Error == "" {
+			t.Errorf("got %+v, wanted error for multiple fields", res)
+		}
+	})
+}
+
+func TestSubscribeMaxFrequency(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("negative"), Subscribe: &Subscribe{TypeName: "testStruct", Count: true, MaxFrequency: -1}})
+		if res := c.receiveResult(); res.Error == "" {
+			t.Errorf("got %+v, wanted error for negative MaxFrequency", res)
+		}
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct", Count: true, MaxFrequency: 5}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		receiveCount := func() int {
+			m := c.receive()
+			if m.Data == nil || m.Data.Error != "" {
+				t.Fatalf("got %+v, wanted data", m)
+			}
+			count := 0
+			if err := c.codec.Unmarshal(m.Data.Blob, &count); err != nil {
+				t.Fatal(err)
+			}
+			return count
+		}
+		if count := receiveCount(); count != 0 {
+			t.Errorf("got %v, wanted 0", count)
+		}
+		for i := 0; i < 5; i++ {
+			if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+				return u.Insert(&testStruct{ID: s.Snek.NewID()})
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		deliveries := 1
+		for count := receiveCount(); count != 5; count = receiveCount() {
+			deliveries++
+		}
+		if deliveries > 2 {
+			t.Errorf("got %v deliveries of 5 changes, wanted them coalesced", deliveries)
+		}
+	})
+}
+
+type noIDTestStruct struct {
+	String string
+}
+
+func TestRegisterAll(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := RegisterAll(s,
+			NewRegistration(&testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})),
+			NewRegistration(&otherTestStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&otherTestStruct{})),
+		); err != nil {
+			t.Fatal(err)
+		}
+		for _, typeName := range []string{"testStruct", "otherTestStruct"} {
+			if _, found := s.types[typeName]; !found {
+				t.Errorf("%s not registered", typeName)
+			}
+		}
+		if err := RegisterAll(s,
+			NewRegistration(&noIDTestStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&noIDTestStruct{})),
+			NewRegistration(&testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})),
+		); err == nil {
+			t.Errorf("wanted error for type without ID")
+		}
+		if _, found := s.types["noIDTestStruct"]; found {
+			t.Errorf("wanted failed registration to not register the type")
+		}
+	})
+}
+
+func TestSubscribeFields(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+			for _, str := range []string{"a", "b", "c"} {
+				if err := u.Insert(&testStruct{ID: snek.ID(str), String: str}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		for _, subscribe := range []*Subscribe{
+			{TypeName: "testStruct", Fields: []string{"Missing"}},
+			{TypeName: "testStruct", Fields: []string{"String.Missing"}},
+			{TypeName: "testStruct", Fields: []string{"String"}, Count: true},
+		} {
+			c.send(&Message{ID: snek.ID("invalid"), Subscribe: subscribe})
+			if res := c.receiveResult(); res.Error == "" {
+				t.Errorf("got %+v, wanted error for %+v", res, subscribe)
+			}
+		}
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct", Order: []snek.Order{{Field: "String"}}, Limit: 2, Fields: []string{"String"}}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		m := c.receive()
+		if m.Data == nil || m.Data.Error != "" {
+			t.Fatalf("got %+v, wanted data", m)
+		}
+		rows := []map[string]any{}
+		if err := c.codec.Unmarshal(m.Data.Blob, &rows); err != nil {
+			t.Fatal(err)
+		}
+		if want := []map[string]any{{"String": "a"}, {"String": "b"}}; !reflect.DeepEqual(rows, want) {
+			t.Errorf("got %+v, wanted %+v", rows, want)
+		}
+		c.send(&Message{ID: snek.ID("load"), LoadMore: &LoadMore{SubscriptionID: snek.ID("sub"), Offset: 2}})
+		res := c.receiveResult()
+		if res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		// Projected rows still decode into the type.
+		structs := []testStruct{}
+		if err := c.codec.Unmarshal(res.Aux, &structs); err != nil {
+			t.Fatal(err)
+		}
+		if want := []testStruct{{String: "c"}}; !reflect.DeepEqual(structs, want) {
+			t.Errorf("got %+v, wanted %+v", structs, want)
+		}
+	})
+}
+
+type taggedTestStruct struct {
+	ID    snek.ID
+	Name  string `json:"name" cbor:"n"`
+	Other int
+}
+
+func TestSubscribeFieldsCodecNames(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &taggedTestStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&taggedTestStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		tagged := &taggedTestStruct{ID: snek.ID("id"), Name: "name"}
+		update := func() {
+			if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+				return u.Update(tagged)
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+			return u.Insert(tagged)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for codecName, codec := range map[string]Codec{"cbor": CBORCodec{}, "json": JSONCodec{}} {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?codec="+codecName, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &testClient{t: t, conn: conn, codec: codec}
+			c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "taggedTestStruct", Fields: []string{"Name"}}})
+			if res := c.receiveResult(); res.Error != "" {
+				t.Fatalf("got %+v, wanted no error", res)
+			}
+			receive := func(wantKey string, want taggedTestStruct) {
+				t.Helper()
+				m := c.receive()
+				if m.Data == nil || m.Data.Error != "" {
+					t.Fatalf("got %+v, wanted data", m)
+				}
+				rows := []map[string]any{}
+				if err := codec.Unmarshal(m.Data.Blob, &rows); err != nil {
+					t.Fatal(err)
+				}
+				if len(rows) != 1 || rows[0][wantKey] != want.Name {
+					t.Errorf("got %+v with %s, wanted the Name %q as %q", rows, codecName, want.Name, wantKey)
+				}
+				structs := []taggedTestStruct{}
+				if err := codec.Unmarshal(m.Data.Blob, &structs); err != nil {
+					t.Fatal(err)
+				}
+				if len(structs) != 1 || !reflect.DeepEqual(structs[0], want) {
+					t.Errorf("got %+v with %s, wanted [%+v]", structs, codecName, want)
+				}
+			}
+			receive(map[string]string{"cbor": "n", "json": "name"}[codecName], taggedTestStruct{Name: tagged.Name})
+			// Changes outside the projection send no Data.
+			tagged.Other++
+			update()
+			tagged.Name += "!"
+			update()
+			receive(map[string]string{"cbor": "n", "json": "name"}[codecName], taggedTestStruct{Name: tagged.Name})
+			conn.Close()
+		}
+	})
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	recordPath := filepath.Join(t.TempDir(), "recording")
+	records := []RecordedMessage{}
+	withModifiedServer(t, func(opts *Options) {
+		opts.RecordPath = recordPath
+	}, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("identity"), Identity: &Identity{Token: snek.ID("secret")}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct"}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		b, err := c.codec.Marshal(&testStruct{ID: snek.ID("id"), String: "recorded"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(&Message{ID: snek.ID("insert"), Update: &Update{TypeName: "testStruct", Insert: b}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		// Messages are recorded after they are sent, so the last Result may not be recorded yet.
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			f, err := os.Open(recordPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			records, err = ReadRecording(f)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorded := false
+			for _, record := range records {
+				recorded = recorded || (record.Message.Result != nil && string(record.Message.Result.CauseMessageID) == "insert")
+			}
+			if recorded {
+				break
+			}
+		}
+	})
+	contents, err := os.ReadFile(recordPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "secret") {
+		t.Errorf("got identity token in recording")
+	}
+	inbound := []string{}
+	for _, record := range records {
+		if record.Inbound {
+			inbound = append(inbound, string(record.Message.ID))
+		}
+		if record.Codec != defaultCodecName || record.ConnectionID == nil || record.Time.IsZero() {
+			t.Errorf("got %+v, wanted codec, connection ID, and time", record)
+		}
+	}
+	if want := []string{"identity", "sub", "insert"}; !reflect.DeepEqual(inbound, want) {
+		t.Errorf("got inbound messages %v, wanted %v", inbound, want)
+	}
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		received, err := Replay(ctx, wsURL, records, func(snek.ID) snek.ID {
+			return snek.ID("token")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(received) != 1 {
+			t.Fatalf("got %v connections, wanted 1", len(received))
+		}
+		for _, messages := range received {
+			results := 0
+			for _, m := range messages {
+				if m.Result != nil {
+					results++
+					if m.Result.Error != "" {
+						t.Errorf("got %+v, wanted no error", m.Result)
+					}
+				}
+			}
+			if results != 3 {
+				t.Errorf("got %v results, wanted 3", results)
+			}
+		}
+		got := &testStruct{ID: snek.ID("id")}
+		if err := s.Snek.View(snek.SystemCaller{}, func(v *snek.View) error {
+			return v.Get(got)
+		}); err != nil || got.String != "recorded" {
+			t.Errorf("got %+v, %v, wanted the replayed insert", got, err)
+		}
+	})
+}
+
+func TestUpdateReturn(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, func(u *snek.Update, prev, next *testStruct) error {
+			if next != nil {
+				next.String = strings.ToUpper(next.String)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		b, err := c.codec.Marshal(&testStruct{ID: snek.ID("id"), String: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(&Message{ID: snek.ID("insert"), Update: &Update{TypeName: "testStruct", Insert: b}})
+		if res := c.receiveResult(); res.Error != "" || len(res.Aux) != 0 {
+			t.Errorf("got %+v, wanted no error and no Aux", res)
+		}
+		b, err = c.codec.Marshal(&testStruct{ID: snek.ID("id"), String: "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(&Message{ID: snek.ID("update"), Update: &Update{TypeName: "testStruct", Update: b, Return: true}})
+		res := c.receiveResult()
+		if res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		got := &testStruct{}
+		if err := c.codec.Unmarshal(res.Aux, got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (&testStruct{ID: snek.ID("id"), String: "B"}); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+		if err := snek.RegisterFieldControl(s.Snek, func(v *snek.View, structPointer *testStruct) error {
+			structPointer.String = "hidden"
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		c.send(&Message{ID: snek.ID("hidden"), Update: &Update{TypeName: "testStruct", Update: b, Return: true}})
+		if res = c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		got = &testStruct{}
+		if err := c.codec.Unmarshal(res.Aux, got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (&testStruct{ID: snek.ID("id"), String: "hidden"}); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+		c.send(&Message{ID: snek.ID("remove"), Update: &Update{TypeName: "testStruct", Remove: b, Return: true}})
+		if res := c.receiveResult(); res.Error != "" || len(res.Aux) != 0 {
+			t.Errorf("got %+v, wanted no error and no Aux", res)
+		}
+	})
+}
+
+func TestExplain(t *testing.T) {
+	withModifiedServer(t, func(opts *Options) {
+		opts.Identifier = testIdentifier{}
+	}, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		explain := &Explain{Subscribe: Subscribe{TypeName: "testStruct", Match: Match{Cond: &snek.Cond{Field: "String", Comparator: snek.EQ, Value: "a"}}}}
+		c.send(&Message{ID: snek.ID("anon"), Explain: explain})
+		if res := c.receiveResult(); res.Error == "" {
+			t.Errorf("got %+v, wanted error for anonymous caller", res)
+		}
+		c.send(&Message{ID: snek.ID("identity"), Identity: &Identity{Token: snek.ID("admin")}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		c.send(&Message{ID: snek.ID("admin"), Explain: explain})
+		res := c.receiveResult()
+		if res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		plan := &snek.QueryPlan{}
+		if err := c.codec.Unmarshal(res.Aux, plan); err != nil {
+			t.Fatal(err)
+		}
+		if rows, found := plan.FullScans["testStruct"]; !found || rows != 0 || len(plan.Steps) == 0 {
+			t.Errorf("got %+v, wanted a full scan of the empty testStruct table", plan)
+		}
+	})
+}
+
+func TestSubscribeTail(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		insert := func(strs ...string) {
+			if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+				for _, str := range strs {
+					if err := u.Insert(&testStruct{ID: snek.ID(str), String: str}); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		insert("a", "b")
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("invalid"), Subscribe: &Subscribe{TypeName: "testStruct", Tail: true, Count: true}})
+		if res := c.receiveResult(); res.Error == "" {
+			t.Errorf("got %+v, wanted error for tailed count", res)
+		}
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct", Tail: true, Backlog: 1}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		receiveStrings := func() []string {
+			m := c.receive()
+			if m.Data == nil || m.Data.Error != "" {
+				t.Fatalf("got %+v, wanted data", m)
+			}
+			structs := []testStruct{}
+			if err := c.codec.Unmarshal(m.Data.Blob, &structs); err != nil {
+				t.Fatal(err)
+			}
+			result := []string{}
+			for _, ts := range structs {
+				result = append(result, ts.String)
+			}
+			return result
+		}
+		if got, want := receiveStrings(), []string{"b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+		insert("c", "d")
+		if got, want := receiveStrings(), []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+	})
+}
+
+func TestClientIDs(t *testing.T) {
+	insert := func(c *testClient, id snek.ID) *Result {
+		b, err := c.codec.Marshal(&testStruct{ID: id, String: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.send(&Message{ID: snek.ID("insert"), Update: &Update{TypeName: "testStruct", Insert: b, Return: true}})
+		return c.receiveResult()
+	}
+	withModifiedServer(t, func(opts *Options) {
+		opts.ClientIDs = CheckClientIDs
+	}, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		if res := insert(c, snek.ID("id")); res.Error == "" {
+			t.Errorf("got %+v, wanted an error for a malformed ID", res)
+		}
+		old := s.Snek.NewID()
+		binary.BigEndian.PutUint64(old, uint64(time.Now().Add(-time.Hour).UnixNano()))
+		if res := insert(c, old); res.Error == "" {
+			t.Errorf("got %+v, wanted an error for an ID created an hour ago", res)
+		}
+		if res := insert(c, s.Snek.NewID()); res.Error != "" {
+			t.Errorf("got %+v, wanted no error", res)
+		}
+	})
+	withModifiedServer(t, func(opts *Options) {
+		opts.ClientIDs = ReplaceClientIDs
+	}, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		res := insert(c, snek.ID("id"))
+		if res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		got := &testStruct{}
+		if err := c.codec.Unmarshal(res.Aux, got); err != nil {
+			t.Fatal(err)
+		}
+		if got.ID.Equal(snek.ID("id")) || s.Snek.CheckID(got.ID, time.Minute) != nil {
+			t.Errorf("got %+v, wanted a new ID created by the server", got)
+		}
+	})
+}
+
+func TestDataLastModified(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct"}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		if m := c.receive(); m.Data == nil || m.Data.LastModified != 0 {
+			t.Errorf("got %+v, wanted initial data without last modified time", m)
+		}
+		before := time.Now()
+		if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+			return u.Insert(&testStruct{ID: s.Snek.NewID(), String: "a"})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if m := c.receive(); m.Data == nil || m.Data.LastModified < before.UnixMilli() || m.Data.LastModified > time.Now().UnixMilli() {
+			t.Errorf("got %+v, wanted data last modified after %v", m, before)
+		}
+	})
+}
+
+func TestOutboundQueue(t *testing.T) {
+	data := func(causeMessageID string, initial bool, blob string) *outbound {
+		m := &Message{ID: snek.ID(blob), Data: &Data{CauseMessageID: snek.ID(causeMessageID), TypeName: "testStruct", Initial: initial, Blob: []byte(blob)}}
+		return &outbound{message: m, recorded: m, latest: true}
+	}
+	result := func(id string) *outbound {
+		m := &Message{ID: snek.ID(id), Result: &Result{}}
+		return &outbound{message: m, recorded: m}
+	}
+	popAll := func(q *outboundQueue) []string {
+		got := []string{}
+		for o := q.pop(); o != nil; o = q.pop() {
+			id := string(o.message.ID)
+			if o.message.Data != nil && o.message.Data.Initial {
+				id += "(initial)"
+			}
+			got = append(got, id)
+		}
+		return got
+	}
+	disconnecting := newOutboundQueue(2, false)
+	for _, o := range []*outbound{data("a", true, "a1"), data("a", false, "a2")} {
+		if err := disconnecting.push(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := disconnecting.push(data("a", false, "a3")); err != errSlowClient {
+		t.Errorf("got %v, wanted errSlowClient", err)
+	}
+	if got, want := popAll(disconnecting), []string{"a1(initial)", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, wanted %+v", got, want)
+	}
+	coalescing := newOutboundQueue(3, true)
+	for _, o := range []*outbound{data("a", true, "a1"), result("r1"), data("b", false, "b1")} {
+		if err := coalescing.push(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, o := range []*outbound{data("a", false, "a2"), data("b", false, "b2"), data("a", false, "a3")} {
+		if err := coalescing.push(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := coalescing.push(result("r2")); err != errSlowClient {
+		t.Errorf("got %v, wanted errSlowClient for a message that can't be coalesced", err)
+	}
+	if err := coalescing.push(data("c", false, "c1")); err != errSlowClient {
+		t.Errorf("got %v, wanted errSlowClient for data of a subscription without queued data", err)
+	}
+	if got, want := popAll(coalescing), []string{"r1", "b2", "a3(initial)"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, wanted %+v", got, want)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	withServer(t, func(s *Server, wsURL string) {
+		if err := Register(s, &testStruct{}, snek.UncontrolledQueries, snek.UncontrolledUpdates(&testStruct{})); err != nil {
+			t.Fatal(err)
+		}
+		insert := func(str string) {
+			if err := s.Snek.Update(snek.SystemCaller{}, func(u *snek.Update) error {
+				return u.Insert(&testStruct{ID: s.Snek.NewID(), String: str})
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c := dial(t, wsURL)
+		defer c.conn.Close()
+		c.send(&Message{ID: snek.ID("pause"), Pause: &Pause{SubscriptionID: snek.ID("missing")}})
+		if res := c.receiveResult(); res.Error == "" {
+			t.Errorf("got %+v, wanted error pausing a missing subscription", res)
+		}
+		c.send(&Message{ID: snek.ID("sub"), Subscribe: &Subscribe{TypeName: "testStruct"}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		if m := c.receive(); m.Data == nil || !m.Data.Initial {
+			t.Fatalf("got %+v, wanted initial data", m)
+		}
+		c.send(&Message{ID: snek.ID("pause"), Pause: &Pause{SubscriptionID: snek.ID("sub")}})
+		if res := c.receiveResult(); res.Error != "" {
+			t.Fatalf("got %+v, wanted no error", res)
+		}
+		insert("a")
+		insert("b")
+		c.send(&Message{ID: snek.ID("resume"), Resume: &Resume{SubscriptionID: snek.ID("sub")}})
+		// Nothing is sent while paused, so the first message after the insert is the Result of the Resume.
+		if m := c.receive(); m.Result == nil || m.Result.Error != "" {
+			t.Fatalf("got %+v, wanted a successful Result", m)
+		}
+		m := c.receive()
+		if m.Data == nil {
+			t.Fatalf("got %+v, wanted data", m)
+		}
+		structs := []testStruct{}
+		if err := c.codec.Unmarshal(m.Data.Blob, &structs); err != nil {
+			t.Fatal(err)
+		}
+		if len(structs) != 2 {
+			t.Errorf("got %+v, wanted both structs inserted while paused", structs)
+		}
+	})
+}
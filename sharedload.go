@@ -0,0 +1,126 @@
+package snek
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/minio/highwayhash"
+)
+
+// sharedLoad is a subscription load whose results are shared by all subscriptions loading the same effective query.
+// done is closed when the load is finished, after which rows, hash, and err are set.
+type sharedLoad struct {
+	done chan struct{}
+	rows reflect.Value
+	hash [highwayhash.Size]byte
+	err  error
+}
+
+// sharedLoads deduplicates the loads of subscriptions of identical effective queries, keyed by the generated SQL and parameters.
+//
+// Since the generated SQL includes everything the query control added for the caller, subscriptions only share loads
+// if their callers are allowed to see exactly the same structs. Like the query cache, all loads are forgotten when an
+// Update commits changes, and loads of subscriptions that began before such a commit aren't shared, since they may have
+// been pushed by it and must see its changes.
+type sharedLoads struct {
+	lock       sync.Mutex
+	generation uint64
+	loads      map[string]*sharedLoad
+}
+
+func newSharedLoads() *sharedLoads {
+	return &sharedLoads{
+		loads: map[string]*sharedLoad{},
+	}
+}
+
+func (l *sharedLoads) currentGeneration() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.generation
+}
+
+// join returns the load of key, and whether it was created by this call, making the caller responsible for finishing it.
+// If the loads have been invalidated since generation, it returns nil.
+func (l *sharedLoads) join(generation uint64, key string) (*sharedLoad, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if generation != l.generation {
+		return nil, false
+	}
+	if load, found := l.loads[key]; found {
+		return load, false
+	}
+	load := &sharedLoad{done: make(chan struct{})}
+	l.loads[key] = load
+	return load, true
+}
+
+// finish sets the results of the load of key, and forgets it if it failed, since the error may be specific to the loading subscription (e.g. a canceled context).
+func (l *sharedLoads) finish(key string, load *sharedLoad, rows reflect.Value, hash [highwayhash.Size]byte, err error) {
+	load.rows, load.hash, load.err = rows, hash, err
+	close(load.done)
+	if err != nil {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if l.loads[key] == load {
+			delete(l.loads, key)
+		}
+	}
+}
+
+// invalidate forgets all loads, unless no types were changed.
+func (l *sharedLoads) invalidate(types map[reflect.Type]bool, all bool) {
+	if !all && len(types) == 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.generation++
+	l.loads = map[string]*sharedLoad{}
+}
+
+// loadShared loads the results of a subscription delivering structs, sharing the load with other subscriptions with the same effective query.
+func (s *subscription) loadShared() (any, [highwayhash.Size]byte, error) {
+	var emptyHash [highwayhash.Size]byte
+	generation := s.snek.sharedLoads.currentGeneration()
+	results := s.subscriber.prepareResult()
+	sliceVal := reflect.ValueOf(results).Elem()
+	structType := s.subscriber.getType()
+	key := ""
+	var load *sharedLoad
+	leader := false
+	err := s.snek.View(WithContext(s.caller, s.ctx), func(v *View) error {
+		queryCopy, err := v.prepareQuery(structType, s.query)
+		if err != nil {
+			return err
+		}
+		sql, params := queryCopy.toSelectStatement(v.snek.naming(), structType)
+		key = queryCacheKey(sql, params)
+		if load, leader = s.snek.sharedLoads.join(generation, key); load != nil && !leader {
+			return nil
+		}
+		return v.selectPrepared(results, structType, nil, queryCopy)
+	})
+	if load != nil && !leader {
+		select {
+		case <-load.done:
+		case <-s.ctx.Done():
+			return results, emptyHash, s.ctx.Err()
+		}
+		if load.err == nil && load.rows.Type() == sliceVal.Type() {
+			sliceVal.Set(reflect.AppendSlice(reflect.MakeSlice(sliceVal.Type(), 0, load.rows.Len()), load.rows))
+			return results, load.hash, nil
+		}
+		// The shared load failed, or loaded another slice type, so load alone instead.
+		return s.loadAlone()
+	}
+	hash := emptyHash
+	if err == nil {
+		hash, err = resultHash(results)
+	}
+	if leader {
+		s.snek.sharedLoads.finish(key, load, reflect.AppendSlice(reflect.MakeSlice(sliceVal.Type(), 0, sliceVal.Len()), sliceVal), hash, err)
+	}
+	return results, hash, err
+}
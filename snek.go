@@ -3,11 +3,15 @@ package snek
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
+	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/zond/snek/synch"
@@ -41,19 +45,60 @@ func (i ID) String() string {
 	return hex.EncodeToString(i)
 }
 
+// ParseID returns the ID whose String is s.
+func ParseID(s string) (ID, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("parsing ID %q: %w", s, err)
+	}
+	return ID(b), nil
+}
+
+// Base64 returns the standard, padded, base64 encoding of the ID, like encoding/json and JavaScript's btoa use for binary data.
+func (i ID) Base64() string {
+	return base64.StdEncoding.EncodeToString(i)
+}
+
+// ParseBase64ID returns the ID whose Base64 is s.
+func ParseBase64ID(s string) (ID, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("parsing base64 ID %q: %w", s, err)
+	}
+	return ID(b), nil
+}
+
 // Equal returns if this ID is equal to another ID.
 func (i ID) Equal(other ID) bool {
 	return bytes.Compare(i, other) == 0
 }
 
+// Time returns the time an ID created by NewID was created, or the zero time if the ID is too short to contain one.
+// For IDs created elsewhere, e.g. by clients, it's whatever time the first 8 bytes happen to encode.
+func (i ID) Time() time.Time {
+	if len(i) < 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(i)))
+}
+
 var (
 	idType = reflect.TypeOf(ID{})
 )
 
+// Subscription is created by Subscribe or SubscribeAll.
+//
+// Pause stops deliveries to the subscriber, without closing the subscription, until Resume is called, e.g. while the view
+// showing the results is hidden. Deliveries already in progress aren't interrupted. If the store changed in ways that might
+// affect the results while paused, Resume loads the results once, and delivers them unless they are unchanged since the last
+// delivery. Structs published using Publish while paused are never delivered.
 type Subscription interface {
 	push()
+	publish(structPointer any, filter func(Caller) bool)
 	matches(reflect.Value) bool
 	Close() error
+	Pause() error
+	Resume() error
 }
 
 type subscriptionSet map[string]Subscription
@@ -76,6 +121,11 @@ func (s subscriptionSet) merge(other subscriptionSet) subscriptionSet {
 type permissions struct {
 	queryControl  func(*View, *Query) error
 	updateControl func(*Update, any, any) error
+	defaultSet    func(Caller) Set
+	fieldControl  func(*View, any) error
+	history       bool
+	// key is the primary key of the type, validated at Register.
+	key []string
 }
 
 // Snek maintains a persistent, subscribable, and access controlled data store.
@@ -83,9 +133,27 @@ type Snek struct {
 	ctx           context.Context
 	db            *sqlx.DB
 	options       Options
-	rng           *rand.Rand
+	ids           *synch.S[*idGenerator]
 	subscriptions *synch.SMap[string, *synch.SMap[string, Subscription]]
-	permissions   map[string]permissions
+	// correlatedSubscriptions maps type names to the subscriptions of other types whose queries read them, e.g. using Exists.
+	// Since changes can't be matched against such queries, the subscriptions are pushed for every change of the types.
+	correlatedSubscriptions *synch.SMap[string, *synch.SMap[string, *subscription]]
+	permissions             map[string]permissions
+	queryCache              *queryCache
+	// readDB is the pool used by Views, the same as db unless Options.ReadPath is set.
+	readDB   *sqlx.DB
+	watchers *synch.SMap[string, *synch.SMap[string, watcher]]
+	// reloadBatches maps the names of types with Options.ReloadWindows to their pending subscription pushes.
+	reloadBatches *synch.SMap[string, *reloadBatch]
+	// pushPool pushes subscriptions if Options.PushWorkers is set, and is nil otherwise.
+	pushPool *pushPool
+	// sharedLoads shares the loads of subscriptions with identical effective queries if Options.ShareLoads is set, and is nil otherwise.
+	sharedLoads *sharedLoads
+	// commitTimes maps the names of types to the times of the last Updates committing changes to them, with the empty name
+	// mapping to the time of the last Update changing all types, e.g. by executing raw SQL.
+	commitTimes *synch.SMap[string, time.Time]
+	// watchLock is held while Updates with changes to deliver to watchers commit and deliver them, to deliver them in commit order.
+	watchLock sync.Mutex
 }
 
 type SystemCaller struct{}
@@ -144,14 +212,32 @@ func (u UpdateControl[T]) call(update *Update, prev, next any) error {
 }
 
 // Register registers the type of the example structPointer in the store and ensures there is a table for the type.
+// If Options.NoAutoMigrate is set the schema is left untouched, and using a type without a table fails.
+// Types with unrecognized `snek` tag options, tag options their fields don't support, or Uniquer combinations of fields
+// they don't store, can't be registered, and neither can types failing Options.ValidateType.
 func Register[T any](s *Snek, structPointer *T, queryControl QueryControl, updateControl UpdateControl[T]) error {
 	info, err := getValueInfo(reflect.ValueOf(structPointer))
 	if err != nil {
 		return err
 	}
-	s.permissions[info.typ.Name()] = permissions{
+	if err := validateType(info.typ); err != nil {
+		return err
+	}
+	if s.options.ValidateType != nil {
+		if err := s.options.ValidateType(info.typ); err != nil {
+			return err
+		}
+	}
+	if fieldNames := encryptedFields(info.typ); len(fieldNames) > 0 && s.options.Encryption == nil {
+		return fmt.Errorf("%s has encrypted fields %v, but no encryption is configured", info.typ.Name(), fieldNames)
+	}
+	perms := permissions{
 		queryControl: queryControl,
-		updateControl: func(update *Update, prev, next any) error {
+		key:          info.key,
+	}
+	// Like a nil query control, a nil update control makes updates fail with a NotRegisteredError.
+	if updateControl != nil {
+		perms.updateControl = func(update *Update, prev, next any) error {
 			var realPrev, realNext *T
 			switch v := prev.(type) {
 			case *T:
@@ -162,10 +248,138 @@ func Register[T any](s *Snek, structPointer *T, queryControl QueryControl, updat
 				realNext = v
 			}
 			return updateControl(update, realPrev, realNext)
-		},
+		}
+	}
+	s.permissions[info.typ.Name()] = perms
+	if s.options.NoAutoMigrate {
+		return nil
 	}
 	return s.Update(SystemCaller{}, func(u *Update) error {
-		return u.exec(info.toCreateStatement())
+		return u.exec(info.toCreateStatement(s.naming()))
+	})
+}
+
+// RegisterDefaultSet makes every Select, Count, and Get of type T AND the Set returned by defaultSet for the caller
+// into the query, before the query control runs. A nil Set leaves the query untouched.
+// T must already be registered, and registering T again removes the default Set.
+func RegisterDefaultSet[T any](s *Snek, defaultSet func(Caller) Set) error {
+	typ := reflect.TypeOf(*new(T))
+	perms, found := s.permissions[typ.Name()]
+	if !found {
+		return &NotRegisteredError{TypeName: typ.Name()}
+	}
+	perms.defaultSet = defaultSet
+	s.permissions[typ.Name()] = perms
+	return nil
+}
+
+// FieldControl modifies each struct of type T loaded by a View before it's returned, e.g. to zero the fields the caller isn't allowed to see,
+// like the email of a user whose public profile is visible to everyone. Use View#Caller to examine the caller identity.
+// Returning an error fails the load.
+//
+// Since structs in query cache hits, published events, and watched changes are shallow copies of the same structs, FieldControl
+// must replace fields instead of modifying what pointers, slices, or maps in them point to.
+type FieldControl[T any] func(v *View, structPointer *T) error
+
+// RegisterFieldControl makes every struct of type T returned by Select, Get, AsOf, SelectJoinCounts, subscriptions, watches, and the
+// Return of server Updates, or published using Publish, pass through fieldControl, after AfterLoad. Unlike the query control, which decides which structs the caller sees, it decides what the caller sees of them.
+// Structs loaded in Updates aren't modified, since updating them would store the modifications, and SelectInto, GroupCount, GroupCountSubscriber, and Aggregate
+// fail for T unless the caller bypasses the control.
+//
+// The field control doesn't restrict queries, so callers can still infer hidden values using Cond and Order on the hidden fields, e.g. by
+// selecting users with a given email. Query controls should reject such queries if the values are secret.
+// T must already be registered, and registering T again removes the field control.
+func RegisterFieldControl[T any](s *Snek, fieldControl FieldControl[T]) error {
+	typ := reflect.TypeOf(*new(T))
+	perms, found := s.permissions[typ.Name()]
+	if !found {
+		return &NotRegisteredError{TypeName: typ.Name()}
+	}
+	perms.fieldControl = func(v *View, structPointer any) error {
+		return fieldControl(v, structPointer.(*T))
+	}
+	s.permissions[typ.Name()] = perms
+	return nil
+}
+
+// TypeRegistration describes how a type is registered in a store.
+type TypeRegistration struct {
+	Name string
+	// QueryControl and UpdateControl are whether the type has query and update control functions.
+	// Callers not bypassing the control (see Options.SystemRunsControl) can't query or update types without them.
+	QueryControl  bool
+	UpdateControl bool
+	// DefaultSet is whether the type has a default Set registered using RegisterDefaultSet.
+	DefaultSet bool
+	// FieldControl is whether the type has a field control registered using RegisterFieldControl.
+	FieldControl bool
+	// History is whether the type records history, see RegisterHistory.
+	History bool
+}
+
+// RegisteredTypes returns the sorted names of the registered types.
+func (s *Snek) RegisteredTypes() []string {
+	result := make([]string, 0, len(s.permissions))
+	for name := range s.permissions {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Registration returns how the type named name is registered, and whether it's registered at all.
+func (s *Snek) Registration(name string) (TypeRegistration, bool) {
+	perms, found := s.permissions[name]
+	if !found {
+		return TypeRegistration{}, false
+	}
+	return TypeRegistration{
+		Name:          name,
+		QueryControl:  perms.queryControl != nil,
+		UpdateControl: perms.updateControl != nil,
+		DefaultSet:    perms.defaultSet != nil,
+		FieldControl:  perms.fieldControl != nil,
+		History:       perms.history,
+	}, true
+}
+
+// Publish delivers structPointer to the subscriptions of its type created with WithEvents, without storing it.
+// Only subscriptions whose callers pass filter (if not nil), and whose Set, combined with the default Set (see RegisterDefaultSet)
+// and query control, matches structPointer, get it.
+// Since structPointer isn't stored, subscriptions whose query control adds Joins or Recursion never get it.
+// This is useful for ephemeral events, like presence or typing indicators.
+func (s *Snek) Publish(structPointer any, filter func(Caller) bool) error {
+	val := reflect.ValueOf(structPointer)
+	if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+		return &InvalidArgumentError{Allowed: "pointers to structs", Argument: fmt.Sprintf("%T", structPointer)}
+	}
+	s.getSubscriptions(val.Elem().Type()).Each(func(_ string, sub Subscription) {
+		go sub.publish(structPointer, filter)
+	})
+	return nil
+}
+
+// Truncate removes all structs of type T in a single statement, and notifies all subscriptions of type T.
+// Since it bypasses the update control, only system and admin callers are allowed to use it.
+func Truncate[T any](s *Snek, caller Caller) error {
+	if !caller.IsAdmin() && !caller.IsSystem() {
+		return fmt.Errorf("only system and admin callers can truncate")
+	}
+	typ := reflect.TypeOf(*new(T))
+	if _, found := s.permissions[typ.Name()]; !found {
+		return &NotRegisteredError{TypeName: typ.Name()}
+	}
+	return s.Update(caller, func(u *Update) error {
+		if err := u.exec(fmt.Sprintf("DELETE FROM \"%s\";", s.naming().table(typ))); err != nil {
+			return err
+		}
+		u.changedTypes[typ] = true
+		subs := u.subscriptionsOf(typ)
+		s.getSubscriptions(typ).Each(func(id string, sub Subscription) {
+			subs[id] = sub
+		})
+		u.addCorrelatedSubscriptions(typ)
+		return nil
 	})
 }
 
@@ -179,18 +393,175 @@ func (s *Snek) getSubscriptionsFor(val reflect.Value) subscriptionSet {
 	return result
 }
 
+// getValueInfo returns the getValueInfo of val, but uses the primary key cached at Register if the type val points to is registered.
+func (s *Snek) getValueInfo(val reflect.Value) (*valueInfo, error) {
+	if val.Kind() == reflect.Ptr {
+		if perms, found := s.permissions[val.Type().Elem().Name()]; found {
+			return getKeyedValueInfo(val, perms.key)
+		}
+	}
+	return getValueInfo(val)
+}
+
 func (s *Snek) getSubscriptions(typ reflect.Type) *synch.SMap[string, Subscription] {
 	result, _ := s.subscriptions.SetIfMissing(typ.Name(), synch.NewSMap[string, Subscription]())
 	return result
 }
 
-// NewID returns a pseudo unique ID based on current time + 3 random uint64s.
+func (s *Snek) getCorrelatedSubscriptions(typ reflect.Type) *synch.SMap[string, *subscription] {
+	result, _ := s.correlatedSubscriptions.SetIfMissing(typ.Name(), synch.NewSMap[string, *subscription]())
+	return result
+}
+
+// idGenerator creates the random parts of IDs, and remembers the most recently created IDs if Options.CheckIDCollisions is set.
+type idGenerator struct {
+	rng *rand.Rand
+	// recent is a ring buffer of the most recently created IDs, and next is the index of the oldest of them.
+	recent    []string
+	next      int
+	recentSet map[string]bool
+}
+
+func newIDGenerator(seed int64, checkCollisions int) *idGenerator {
+	return &idGenerator{
+		rng:       rand.New(rand.NewSource(seed)),
+		recent:    make([]string, 0, checkCollisions),
+		recentSet: map[string]bool{},
+	}
+}
+
+// check panics if id is one of the remembered IDs, and otherwise remembers it.
+func (g *idGenerator) check(id ID) {
+	if cap(g.recent) == 0 {
+		return
+	}
+	key := string(id)
+	if g.recentSet[key] {
+		panic(fmt.Errorf("NewID created %v twice within %v IDs", id, cap(g.recent)))
+	}
+	if len(g.recent) < cap(g.recent) {
+		g.recent = append(g.recent, key)
+	} else {
+		delete(g.recentSet, g.recent[g.next])
+		g.recent[g.next] = key
+		g.next = (g.next + 1) % len(g.recent)
+	}
+	g.recentSet[key] = true
+}
+
+// CheckID returns an InvalidIDError unless id could have been created by NewID within window of now, i.e. it's
+// Options.IDBytes long, and its Time is at most window before or after Options.Now. It's meant for validating IDs
+// created by untrusted clients, and can't tell whether the rest of the ID is random.
+func (s *Snek) CheckID(id ID, window time.Duration) error {
+	if len(id) != s.options.IDBytes {
+		return &InvalidIDError{ID: id, Reason: fmt.Sprintf("%v bytes long instead of %v", len(id), s.options.IDBytes)}
+	}
+	if diff := id.Time().Sub(s.Now()); diff > window || diff < -window {
+		return &InvalidIDError{ID: id, Reason: fmt.Sprintf("created at %v, more than %v from now", id.Time(), window)}
+	}
+	return nil
+}
+
+// NewID returns a pseudo unique ID of Options.IDBytes bytes, based on current time followed by random uint64s.
+// The time is big endian, so IDs created later compare (and sort in queries) as greater.
 func (s *Snek) NewID() ID {
-	result := make(ID, 32)
-	*(*[4]uint64)(unsafe.Pointer(&result[0])) = [4]uint64{uint64(time.Now().UnixNano()), s.rng.Uint64(), s.rng.Uint64(), s.rng.Uint64()}
+	b := make([]byte, (s.options.IDBytes+7)/8*8)
+	binary.BigEndian.PutUint64(b, uint64(s.Now().UnixNano()))
+	var result ID
+	// rand.Rand isn't safe for concurrent use.
+	s.ids.Write(func(g *idGenerator) {
+		for index := 8; index < len(b); index += 8 {
+			binary.NativeEndian.PutUint64(b[index:], g.rng.Uint64())
+		}
+		result = b[:s.options.IDBytes:s.options.IDBytes]
+		g.check(result)
+	})
 	return result
 }
 
+// Now returns the current time according to Options.Now.
+func (s *Snek) Now() time.Time {
+	return s.options.Now()
+}
+
+const (
+	migrationsTableName = "snek_migrations"
+)
+
+// Migrate runs f in a system caller Update, unless a migration with the same name has already been run successfully.
+// Successful migrations are recorded in the snek_migrations table, in the same transaction as the migration itself.
+func (s *Snek) Migrate(name string, f func(*Update) error) error {
+	return s.Update(SystemCaller{}, func(u *Update) error {
+		if err := u.exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS \"%s\" (\n  \"Name\" TEXT PRIMARY KEY,\n  \"Applied\" TEXT);", migrationsTableName)); err != nil {
+			return err
+		}
+		applied := 0
+		if err := u.tx.GetContext(s.ctx, &applied, fmt.Sprintf("SELECT COUNT(*) FROM \"%s\" WHERE \"Name\" = ?;", migrationsTableName), name); err != nil {
+			return err
+		}
+		if applied > 0 {
+			return nil
+		}
+		if err := f(u); err != nil {
+			return err
+		}
+		return u.exec(fmt.Sprintf("INSERT INTO \"%s\" (\"Name\", \"Applied\") VALUES (?, ?);", migrationsTableName), name, ToText(s.Now()))
+	})
+}
+
+func (s *Snek) execMaintenance(sql string) error {
+	started := time.Now()
+	_, err := s.db.ExecContext(s.ctx, sql)
+	duration := time.Since(started)
+	s.logIf(s.shouldLogSQL(duration), "SQL (%v) => %v\n  %s", duration, err, sql)
+	return err
+}
+
+// Close closes the subscriptions of the store, and its database connections. The store can't be used after it's closed.
+func (s *Snek) Close() error {
+	for _, subs := range s.subscriptions.Clone() {
+		for _, sub := range subs.Clone() {
+			sub.Close()
+		}
+	}
+	err := s.db.Close()
+	if s.readDB != s.db {
+		if readErr := s.readDB.Close(); err == nil {
+			err = readErr
+		}
+	}
+	return err
+}
+
+// Vacuum rebuilds the database file, reclaiming unused space and defragmenting it.
+// It can't run inside a transaction, and blocks other writers while running.
+func (s *Snek) Vacuum() error {
+	return s.execMaintenance("VACUUM;")
+}
+
+// Analyze refreshes the statistics used by the SQLite query planner.
+func (s *Snek) Analyze() error {
+	return s.execMaintenance("ANALYZE;")
+}
+
+// Checkpoint moves all content of the write-ahead log into the database file and truncates the log.
+// It is a no-op unless the database uses WAL journaling.
+func (s *Snek) Checkpoint() error {
+	return s.execMaintenance("PRAGMA wal_checkpoint(TRUNCATE);")
+}
+
+func (s *Snek) naming() naming {
+	return naming(s.options.NameMapper)
+}
+
+// shouldLogSQL returns whether a statement that took duration should be logged.
+func (s *Snek) shouldLogSQL(duration time.Duration) bool {
+	if s.options.SlowQueryThreshold > 0 {
+		return duration >= s.options.SlowQueryThreshold
+	}
+	return s.options.LogSQL
+}
+
 func (s *Snek) logIf(condition bool, format string, params ...any) {
 	if condition && s.options.Logger != nil {
 		s.options.Logger.Printf(format, params...)
@@ -1,13 +1,29 @@
 package snek
 
 import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"math/big"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/zond/snek/synch"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
@@ -105,6 +121,10 @@ func mustUnavail[T any](t *testing.T, c chan T) {
 }
 
 func withSnek(t *testing.T, f func(s *testSnek)) {
+	withModifiedSnek(t, func(*Options) {}, f)
+}
+
+func withModifiedSnek(t *testing.T, modifier func(opts *Options), f func(s *testSnek)) {
 	dir, err := os.MkdirTemp(os.TempDir(), "snek_test")
 	if err != nil {
 		t.Fatal(err)
@@ -114,6 +134,7 @@ func withSnek(t *testing.T, f func(s *testSnek)) {
 	if Verbose {
 		opts.LogSQL = true
 	}
+	modifier(&opts)
 	s, err := opts.Open()
 	defer func() {
 		os.RemoveAll(dir)
@@ -121,6 +142,7 @@ func withSnek(t *testing.T, f func(s *testSnek)) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer s.Close()
 	f(&testSnek{
 		Snek: s,
 		t:    t,
@@ -312,17 +334,17 @@ func TestSelect(t *testing.T) {
 			mustContain(t, res, []ID{ts1.ID, ts2.ID, ts3.ID, ts4.ID})
 			s.must(v.Select(&res, &Query{
 				Limit: 2,
-				Order: []Order{{"Int", true}},
+				Order: []Order{{Field: "Int", Desc: true}},
 				Set:   Cond{"Int", GT, 0}}))
 			mustList(t, res, []ID{ts4.ID, ts3.ID})
 			s.must(v.Select(&res, &Query{
 				Limit: 2,
-				Order: []Order{{"Int", false}},
+				Order: []Order{{Field: "Int", Desc: false}},
 				Set:   Cond{"Int", GT, 0}}))
 			mustList(t, res, []ID{ts1.ID, ts2.ID})
 			s.must(v.Select(&res, &Query{
 				Limit: 2,
-				Order: []Order{{"Inner.Float", true}, {"Int", false}},
+				Order: []Order{{Field: "Inner.Float", Desc: true}, {Field: "Int", Desc: false}},
 				Set:   Cond{"Int", LE, 3}}))
 			mustList(t, res, []ID{ts3.ID, ts1.ID})
 			return nil
@@ -759,3 +781,4329 @@ func TestJoin(t *testing.T) {
 		}
 	})
 }
+
+func TestJoinOrder(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		ts1 := &testStruct{ID: s.NewID(), Int: 7, String: "a"}
+		ts2 := &testStruct{ID: s.NewID(), Int: 9, String: "a"}
+		ts3 := &testStruct{ID: s.NewID(), Int: 8, String: "b"}
+		ts4 := &testStruct{ID: s.NewID(), Int: 10, String: "b"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, ts := range []*testStruct{ts1, ts2, ts3, ts4} {
+				if err := u.Insert(ts); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		selfJoin := func() []Join {
+			return []Join{NewJoin(&testStruct{}, All{}, []On{{"String", EQ, "String"}, {"ID", NE, "ID"}})}
+		}
+		got := []testStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Order: []Order{{Field: "Int"}}, Joins: selfJoin()})
+		}))
+		mustList(t, got, []ID{ts1.ID, ts3.ID, ts2.ID, ts4.ID})
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Order: []Order{{Field: JoinField(0, "Int")}}, Joins: selfJoin()})
+		}))
+		mustList(t, got, []ID{ts2.ID, ts4.ID, ts1.ID, ts3.ID})
+		s.mustNot(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Order: []Order{{Field: JoinField(1, "Int")}}, Joins: selfJoin()})
+		}))
+	})
+}
+
+func TestSnapshotSubscriber(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		type delivery struct {
+			res     []testStruct
+			initial bool
+		}
+		inc := make(chan delivery)
+		s.mustAny(Subscribe(s.Snek, AnonCaller{}, &Query{}, TypedSnapshotSubscriber(func(res []testStruct, initial bool, err error) error {
+			if err != nil {
+				t.Fatal(err)
+			}
+			inc <- delivery{res: res, initial: initial}
+			return nil
+		})))
+		if got := <-inc; len(got.res) != 0 || !got.initial {
+			t.Errorf("got %+v, wanted initial delivery without results", got)
+		}
+		ts := &testStruct{ID: s.NewID()}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		if got := <-inc; len(got.res) != 1 || got.initial {
+			t.Errorf("got %+v, wanted non initial delivery with one result", got)
+		}
+	})
+}
+
+type treeTestStruct struct {
+	ID       ID
+	ParentID ID `snek:"index"`
+	Text     string
+}
+
+func TestRecursion(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &treeTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&treeTestStruct{})))
+		root := &treeTestStruct{ID: s.NewID(), ParentID: ID{}, Text: "root"}
+		child1 := &treeTestStruct{ID: s.NewID(), ParentID: root.ID, Text: "child"}
+		child2 := &treeTestStruct{ID: s.NewID(), ParentID: root.ID, Text: "child"}
+		grandChild := &treeTestStruct{ID: s.NewID(), ParentID: child1.ID, Text: "grand child"}
+		otherRoot := &treeTestStruct{ID: s.NewID(), ParentID: ID{}, Text: "root"}
+		otherChild := &treeTestStruct{ID: s.NewID(), ParentID: otherRoot.ID, Text: "child"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, tts := range []*treeTestStruct{root, child1, child2, grandChild, otherRoot, otherChild} {
+				if err := u.Insert(tts); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		got := []treeTestStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.SelectTree(&got, root.ID, "ParentID")
+		}))
+		mustContain(t, got, []ID{root.ID, child1.ID, child2.ID, grandChild.ID})
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.SelectTree(&got, child1.ID, "ParentID")
+		}))
+		mustContain(t, got, []ID{child1.ID, grandChild.ID})
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{
+				Set:       Cond{"Text", EQ, "child"},
+				Recursion: &Recursion{ParentField: "ParentID", Start: Cond{"Text", EQ, "root"}},
+			})
+		}))
+		mustContain(t, got, []ID{child1.ID, child2.ID, otherChild.ID})
+	})
+}
+
+func TestIsolation(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.ViewIsolation = sql.LevelReadCommitted
+		opts.UpdateIsolation = sql.LevelDefault
+	}, func(s *testSnek) {
+		ts := &testStruct{ID: s.NewID(), String: "string"}
+		s.must(Register(s.Snek, ts, UncontrolledQueries, UncontrolledUpdates(ts)))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		found := &testStruct{ID: ts.ID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(found)
+		}))
+		if found.String != ts.String {
+			t.Errorf("got %v, want %v", found.String, ts.String)
+		}
+	})
+}
+
+func TestUpdateFields(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		ts := &testStruct{ID: s.NewID(), Int: 1, String: "string", Inner: innerTestStruct{Float: 1}}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		partial := &testStruct{ID: ts.ID, Int: 2, Inner: innerTestStruct{Float: 2}}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(partial, "Int", "Inner.Float")
+		}))
+		if partial.String != "string" {
+			t.Errorf("got %v, wanted string", partial.String)
+		}
+		found := &testStruct{ID: ts.ID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(found)
+		}))
+		if found.Int != 2 || found.String != "string" || found.Inner.Float != 2 {
+			t.Errorf("got %+v, wanted Int 2, String string, Inner.Float 2", found)
+		}
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(partial, "Missing")
+		}))
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(partial, "ID")
+		}))
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(partial)
+		}))
+	})
+	// Changes the update control makes to other fields are stored along with the named fields.
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, func(u *Update, prev, next *testStruct) error {
+			if next != nil {
+				next.String = fmt.Sprintf("Int %v", next.Int)
+			}
+			return nil
+		}))
+		ts := &testStruct{ID: s.NewID(), Int: 1}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		partial := &testStruct{ID: ts.ID, Int: 2, Bool: true}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(partial, "Int")
+		}))
+		found := &testStruct{ID: ts.ID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(found)
+		}))
+		if !reflect.DeepEqual(found, partial) || found.String != "Int 2" || found.Bool {
+			t.Errorf("got %+v stored and %+v returned, wanted both to have Int 2, String \"Int 2\", and Bool false", found, partial)
+		}
+	})
+}
+
+func TestSnakeCase(t *testing.T) {
+	for input, want := range map[string]string{
+		"ID":         "id",
+		"OwnerID":    "owner_id",
+		"HTTPServer": "http_server",
+		"Float":      "float",
+		"already_ok": "already_ok",
+	} {
+		if got := SnakeCase(input); got != want {
+			t.Errorf("SnakeCase(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestNameMapper(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.NameMapper = SnakeCase
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		columns := []string{}
+		s.must(s.db.Select(&columns, "SELECT name FROM pragma_table_info('test_struct') ORDER BY name;"))
+		if want := []string{"bool", "id", "inner.float", "int", "string"}; !reflect.DeepEqual(columns, want) {
+			t.Errorf("got %+v, want %+v", columns, want)
+		}
+		ts1 := &testStruct{ID: s.NewID(), Int: 1, String: "a", Inner: innerTestStruct{Float: 2}}
+		ts2 := &testStruct{ID: s.NewID(), Int: 2, String: "a", Inner: innerTestStruct{Float: 1}}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(ts1); err != nil {
+				return err
+			}
+			return u.Insert(ts2)
+		}))
+		ts1.Int = 3
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts1)
+		}))
+		found := &testStruct{ID: ts1.ID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(found)
+		}))
+		if found.Int != 3 || found.Inner.Float != 2 {
+			t.Errorf("got %+v, want %+v", found, ts1)
+		}
+		got := []testStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Set: Cond{"String", EQ, "a"}, Order: []Order{{Field: "Inner.Float"}}})
+		}))
+		mustList(t, got, []ID{ts2.ID, ts1.ID})
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Order: []Order{{Field: JoinField(0, "Int")}}, Joins: []Join{NewJoin(&testStruct{}, All{}, []On{{"String", EQ, "String"}, {"ID", NE, "ID"}})}})
+		}))
+		mustList(t, got, []ID{ts1.ID, ts2.ID})
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(ts1)
+		}))
+	})
+}
+
+func TestOrderExpression(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		ids := []ID{}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for i := 1; i < 5; i++ {
+				ts := &testStruct{ID: s.NewID(), Int: int32(i)}
+				ids = append(ids, ts.ID)
+				if err := u.Insert(ts); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		query := &Query{Order: []Order{{Expression: "\"testStruct\".\"Int\" % 2"}, {Field: "Int"}}}
+		got := []testStruct{}
+		s.mustNot(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, query)
+		}))
+		s.must(s.View(testCaller{isAdmin: true}, func(v *View) error {
+			return v.Select(&got, query)
+		}))
+		mustList(t, got, []ID{ids[1], ids[3], ids[0], ids[2]})
+	})
+}
+
+func TestDeterministicIDs(t *testing.T) {
+	frozen := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	ids := [][]ID{}
+	for run := 0; run < 2; run++ {
+		withModifiedSnek(t, func(opts *Options) {
+			opts.RandomSeed = 7
+			opts.Now = func() time.Time {
+				return frozen
+			}
+		}, func(s *testSnek) {
+			if got := s.Now(); !got.Equal(frozen) {
+				t.Errorf("got %v, want %v", got, frozen)
+			}
+			ids = append(ids, []ID{s.NewID(), s.NewID()})
+		})
+	}
+	for index := range ids[0] {
+		if !ids[0][index].Equal(ids[1][index]) {
+			t.Errorf("got %v, want %v", ids[1][index], ids[0][index])
+		}
+	}
+}
+
+func TestRandomIDs(t *testing.T) {
+	frozen := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	ids := []ID{}
+	for run := 0; run < 2; run++ {
+		withModifiedSnek(t, func(opts *Options) {
+			opts.Now = func() time.Time {
+				return frozen
+			}
+		}, func(s *testSnek) {
+			ids = append(ids, s.NewID())
+		})
+	}
+	if ids[0].Equal(ids[1]) {
+		t.Errorf("got %v twice, wanted stores with zero RandomSeed to create different IDs", ids[0])
+	}
+}
+
+func TestCheckIDCollisions(t *testing.T) {
+	// IDs contain random bytes, so collisions are checked by feeding the generator repeated IDs directly.
+	g := newIDGenerator(1, 2)
+	for _, id := range []string{"0", "1", "2", "0"} {
+		g.check(ID(id))
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("wanted a panic when creating a recently created ID")
+		}
+	}()
+	g.check(ID("0"))
+}
+
+func TestOrInCondition(t *testing.T) {
+	sql, params := Or{Cond{"A", EQ, 1}, &Cond{"A", EQ, 2}, Cond{"A", EQ, 3}}.toWhereCondition(nil, "T")
+	if want := "\"T\".\"A\" IN (?, ?, ?)"; sql != want {
+		t.Errorf("got %q, want %q", sql, want)
+	}
+	if want := []any{1, 2, 3}; !reflect.DeepEqual(params, want) {
+		t.Errorf("got %+v, want %+v", params, want)
+	}
+	for _, or := range []Or{
+		{Cond{"A", EQ, 1}},
+		{Cond{"A", EQ, 1}, Cond{"B", EQ, 2}},
+		{Cond{"A", EQ, 1}, Cond{"A", NE, 2}},
+		{Cond{"A", EQ, 1}, And{Cond{"A", EQ, 2}}},
+	} {
+		if sql, _ := or.toWhereCondition(nil, "T"); strings.Contains(sql, " IN ") {
+			t.Errorf("got %q for %+v, wanted no IN condition", sql, or)
+		}
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		ts := &testStruct{ID: s.NewID()}
+		s.must(Register(s.Snek, ts, UncontrolledQueries, UncontrolledUpdates(ts)))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		s.must(s.Vacuum())
+		s.must(s.Analyze())
+		s.must(s.Checkpoint())
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(ts)
+		}))
+	})
+}
+
+func TestSubscriptionWindow(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		ts1 := &testStruct{ID: s.NewID(), Int: 10, String: "in"}
+		ts2 := &testStruct{ID: s.NewID(), Int: 20, String: "in"}
+		ts3 := &testStruct{ID: s.NewID(), Int: 30, String: "in"}
+		ts4 := &testStruct{ID: s.NewID(), Int: 40, String: "in"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, ts := range []*testStruct{ts1, ts2, ts3, ts4} {
+				if err := u.Insert(ts); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		inc := make(chan []testStruct)
+		s.mustAny(Subscribe(s.Snek, AnonCaller{}, &Query{Set: Cond{"String", EQ, "in"}, Limit: 2, Offset: 1, Order: []Order{{Field: "Int"}}}, TypedSubscriber(func(res []testStruct, err error) error {
+			if err != nil {
+				t.Fatal(err)
+			}
+			inc <- res
+			return nil
+		})))
+		got := <-inc
+		mustContain(t, got, []ID{ts2.ID, ts3.ID})
+		// A new struct before the window shifts it.
+		ts0 := &testStruct{ID: s.NewID(), Int: 0, String: "in"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts0)
+		}))
+		got = <-inc
+		mustContain(t, got, []ID{ts1.ID, ts2.ID})
+		// A struct outside the set doesn't affect the window.
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID(), Int: 1, String: "out"})
+		}))
+		mustUnavail(t, inc)
+		// A struct leaving the set before the window shifts it back.
+		ts0.String = "out"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts0)
+		}))
+		got = <-inc
+		mustContain(t, got, []ID{ts2.ID, ts3.ID})
+		// A removed struct before the window shifts it.
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(ts1)
+		}))
+		got = <-inc
+		mustContain(t, got, []ID{ts3.ID, ts4.ID})
+		// A change after the window doesn't affect it.
+		ts5 := &testStruct{ID: s.NewID(), Int: 50, String: "in"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts5)
+		}))
+		mustUnavail(t, inc)
+	})
+}
+
+func TestLimitedSubscriptionMatrix(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  Set
+	}{
+		{name: "all", set: All{}},
+		{name: "cond", set: Cond{"Int", GT, -100}},
+		{name: "nested cond", set: Cond{"Inner.Float", GE, 0.0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withSnek(t, func(s *testSnek) {
+				s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+				ts1 := &testStruct{ID: s.NewID(), Int: 1}
+				ts2 := &testStruct{ID: s.NewID(), Int: 2}
+				ts3 := &testStruct{ID: s.NewID(), Int: 3}
+				s.must(s.Update(AnonCaller{}, func(u *Update) error {
+					for _, ts := range []*testStruct{ts1, ts2, ts3} {
+						if err := u.Insert(ts); err != nil {
+							return err
+						}
+					}
+					return nil
+				}))
+				inc := make(chan []testStruct)
+				s.mustAny(Subscribe(s.Snek, AnonCaller{}, &Query{Set: tc.set, Limit: 2, Order: []Order{{Field: "Int"}}}, TypedSubscriber(func(res []testStruct, err error) error {
+					if err != nil {
+						t.Fatal(err)
+					}
+					inc <- res
+					return nil
+				})))
+				mustList(t, <-inc, []ID{ts1.ID, ts2.ID})
+				update := func(f func(u *Update) error) {
+					t.Helper()
+					s.must(s.Update(AnonCaller{}, f))
+				}
+				// Updating an out of window struct without moving it.
+				ts3.String = "changed"
+				update(func(u *Update) error { return u.Update(ts3) })
+				mustUnavail(t, inc)
+				// Updating an out of window struct into the window.
+				ts3.Int = 0
+				update(func(u *Update) error { return u.Update(ts3) })
+				mustList(t, <-inc, []ID{ts3.ID, ts1.ID})
+				// Updating an in window struct without moving it.
+				ts1.String = "changed"
+				update(func(u *Update) error { return u.Update(ts1) })
+				got := <-inc
+				mustList(t, got, []ID{ts3.ID, ts1.ID})
+				if got[1].String != "changed" {
+					t.Errorf("got %+v, wanted updated content", got[1])
+				}
+				// Updating an in window struct out of the window.
+				ts3.Int = 4
+				update(func(u *Update) error { return u.Update(ts3) })
+				mustList(t, <-inc, []ID{ts1.ID, ts2.ID})
+				// Inserting an out of window struct.
+				ts4 := &testStruct{ID: s.NewID(), Int: 5}
+				update(func(u *Update) error { return u.Insert(ts4) })
+				mustUnavail(t, inc)
+				// Inserting an in window struct.
+				ts5 := &testStruct{ID: s.NewID(), Int: 1}
+				update(func(u *Update) error { return u.Insert(ts5) })
+				got = <-inc
+				if len(got) != 2 || got[0].Int != 1 || got[1].Int != 1 {
+					t.Errorf("got %+v, wanted two structs with Int 1", got)
+				}
+				// Removing an out of window struct.
+				update(func(u *Update) error { return u.Remove(ts4) })
+				mustUnavail(t, inc)
+				// Removing an in window struct.
+				update(func(u *Update) error { return u.Remove(ts5) })
+				mustList(t, <-inc, []ID{ts1.ID, ts2.ID})
+			})
+		})
+	}
+}
+
+func TestNewCond(t *testing.T) {
+	for _, valid := range []Cond{
+		{"A", EQ, 1},
+		{"A", NE, uint(1)},
+		{"A", GT, 1.5},
+		{"A", GE, "a"},
+		{"A", LT, true},
+		{"A", LE, ID{1}},
+	} {
+		if got, err := NewCond(valid.Field, valid.Comparator, valid.Value); err != nil || !reflect.DeepEqual(got, valid) {
+			t.Errorf("got %+v, %v, wanted %+v, nil", got, err, valid)
+		}
+	}
+	for _, invalid := range []Cond{
+		{"", EQ, 1},
+		{"A", "~=", 1},
+		{"A", EQ, nil},
+		{"A", EQ, struct{}{}},
+		{"A", EQ, []string{}},
+	} {
+		if _, err := NewCond(invalid.Field, invalid.Comparator, invalid.Value); err == nil {
+			t.Errorf("got nil, wanted error for %+v", invalid)
+		}
+	}
+}
+
+type bigIntTestStruct struct {
+	ID         ID
+	Big        BigInt
+	BigPointer *BigInt
+}
+
+func TestBigInt(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &bigIntTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&bigIntTestStruct{})))
+		huge, _ := new(big.Int).SetString("100000000000000000000000000000000000000000000000000", 10)
+		hugeNegative := new(big.Int).Neg(huge)
+		b1 := &bigIntTestStruct{ID: s.NewID(), Big: NewBigInt(-5)}
+		b2 := &bigIntTestStruct{ID: s.NewID(), Big: NewBigInt(3)}
+		b3 := &bigIntTestStruct{ID: s.NewID(), Big: BigInt{huge}, BigPointer: &BigInt{hugeNegative}}
+		b4 := &bigIntTestStruct{ID: s.NewID(), Big: BigInt{hugeNegative}}
+		b5 := &bigIntTestStruct{ID: s.NewID()}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, b := range []*bigIntTestStruct{b1, b2, b3, b4, b5} {
+				if err := u.Insert(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		found := &bigIntTestStruct{ID: b3.ID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(found)
+		}))
+		if found.Big.Cmp(huge) != 0 || found.BigPointer == nil || found.BigPointer.Cmp(hugeNegative) != 0 {
+			t.Errorf("got %+v, want %+v", found, b3)
+		}
+		got := []bigIntTestStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Order: []Order{{Field: "Big"}}})
+		}))
+		mustList(t, got, []ID{b4.ID, b1.ID, b5.ID, b2.ID, b3.ID})
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Set: Cond{"Big", GT, NewBigInt(0)}})
+		}))
+		mustContain(t, got, []ID{b2.ID, b3.ID})
+		for _, set := range []Set{
+			Cond{"Big", GT, "p0"},
+			Cond{"BigPointer", EQ, "a"},
+			Cond{"Big", GT, 0},
+			Cond{"ID", EQ, NewBigInt(0)},
+		} {
+			if err := s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&got, &Query{Set: set})
+			}); !errors.As(err, new(*IncompatibleCondError)) {
+				t.Errorf("got %v for %v, wanted IncompatibleCondError", err, set)
+			}
+		}
+		s.mustTrue(Cond{"Big", GT, NewBigInt(-6)}.matches(reflect.ValueOf(*b1)))
+		s.mustFalse(Cond{"Big", GT, -5}.matches(reflect.ValueOf(*b1)))
+		s.mustTrue(Cond{"Big", EQ, 0}.matches(reflect.ValueOf(*b5)))
+		tooBig := new(big.Int).Exp(big.NewInt(10), big.NewInt(100), nil)
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&bigIntTestStruct{ID: s.NewID(), Big: BigInt{tooBig}})
+		}))
+	})
+}
+
+func TestNoAutoMigrate(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.NoAutoMigrate = true
+	}, func(s *testSnek) {
+		ts := &testStruct{ID: s.NewID()}
+		s.must(Register(s.Snek, ts, UncontrolledQueries, UncontrolledUpdates(ts)))
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		info, err := getValueInfo(reflect.ValueOf(ts))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.db.Exec(info.toCreateStatement(s.naming()))
+		s.must(err)
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+	})
+}
+
+func TestPrefixMatch(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		structs := map[string]*testStruct{}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, str := range []string{"ab", "abc", "abd", "ac", "b", "a\xff", "a\xff\xff", "b\x00", "\xff\xff"} {
+				structs[str] = &testStruct{ID: s.NewID(), String: str}
+				if err := u.Insert(structs[str]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		for prefix, want := range map[string][]string{
+			"ab":    {"ab", "abc", "abd"},
+			"abc":   {"abc"},
+			"a\xff": {"a\xff", "a\xff\xff"},
+			"\xff":  {"\xff\xff"},
+			"b":     {"b", "b\x00"},
+			"":      {"ab", "abc", "abd", "ac", "b", "a\xff", "a\xff\xff", "b\x00", "\xff\xff"},
+		} {
+			wantIDs := []ID{}
+			for _, str := range want {
+				wantIDs = append(wantIDs, structs[str].ID)
+			}
+			got := []testStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&got, &Query{Set: PrefixMatch("String", prefix)})
+			}))
+			mustContain(t, got, wantIDs)
+			for str, ts := range structs {
+				matches, err := PrefixMatch("String", prefix).matches(reflect.ValueOf(*ts))
+				s.must(err)
+				if matches != strings.HasPrefix(str, prefix) {
+					t.Errorf("got %v for %q matching prefix %q", matches, str, prefix)
+				}
+			}
+		}
+	})
+}
+
+func TestSubscribeAll(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(Register(s.Snek, &treeTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&treeTestStruct{})))
+		testStructs := make(chan []testStruct)
+		treeTestStructs := make(chan []treeTestStruct)
+		sub, err := SubscribeAll(s.Snek, AnonCaller{}, QuerySubscriber{
+			Query: &Query{},
+			Subscriber: TypedSubscriber(func(res []testStruct, err error) error {
+				if err != nil {
+					t.Fatal(err)
+				}
+				testStructs <- res
+				return nil
+			}),
+		}, QuerySubscriber{
+			Query: &Query{},
+			Subscriber: TypedSubscriber(func(res []treeTestStruct, err error) error {
+				if err != nil {
+					t.Fatal(err)
+				}
+				treeTestStructs <- res
+				return nil
+			}),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		mustContain(t, <-testStructs, []ID{})
+		mustContain(t, <-treeTestStructs, []ID{})
+		ts := &testStruct{ID: s.NewID()}
+		tts := &treeTestStruct{ID: s.NewID(), ParentID: ID{}}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(ts); err != nil {
+				return err
+			}
+			return u.Insert(tts)
+		}))
+		mustContain(t, <-testStructs, []ID{ts.ID})
+		mustContain(t, <-treeTestStructs, []ID{tts.ID})
+		s.must(sub.Close())
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Remove(ts); err != nil {
+				return err
+			}
+			return u.Remove(tts)
+		}))
+		mustUnavail(t, testStructs)
+		mustUnavail(t, treeTestStructs)
+		if _, err := SubscribeAll(s.Snek, AnonCaller{}, QuerySubscriber{
+			Query:      &Query{},
+			Subscriber: TypedSubscriber(func(res []testStruct, err error) error { return nil }),
+		}, QuerySubscriber{
+			Query:      &Query{Joins: []Join{NewJoin(&testStruct{}, All{}, nil)}},
+			Subscriber: TypedSubscriber(func(res []testStruct, err error) error { return nil }),
+		}); err == nil {
+			t.Errorf("got nil, wanted error for join subscription")
+		}
+	})
+}
+
+func TestSlowQueryThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		threshold time.Duration
+		wantLogs  bool
+	}{
+		{threshold: time.Hour, wantLogs: false},
+		{threshold: time.Nanosecond, wantLogs: true},
+	} {
+		buf := &bytes.Buffer{}
+		withModifiedSnek(t, func(opts *Options) {
+			opts.Logger = log.New(buf, "", 0)
+			opts.LogSQL = true
+			opts.SlowQueryThreshold = tc.threshold
+		}, func(s *testSnek) {
+			ts := &testStruct{ID: s.NewID()}
+			s.must(Register(s.Snek, ts, UncontrolledQueries, UncontrolledUpdates(ts)))
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&[]testStruct{}, &Query{})
+			}))
+		})
+		if gotLogs := strings.Contains(buf.String(), "SELECT"); gotLogs != tc.wantLogs {
+			t.Errorf("with threshold %v got logs %q, wanted logs: %v", tc.threshold, buf.String(), tc.wantLogs)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		runs := 0
+		migration := func(u *Update) error {
+			runs++
+			return u.Exec("CREATE TABLE \"migrated\" (\"ID\" BLOB PRIMARY KEY);")
+		}
+		s.must(s.Migrate("create migrated", migration))
+		s.must(s.Migrate("create migrated", migration))
+		if runs != 1 {
+			t.Errorf("got %v runs, wanted 1", runs)
+		}
+		s.mustNot(s.Migrate("failing", func(u *Update) error {
+			runs++
+			return fmt.Errorf("failed")
+		}))
+		s.must(s.Migrate("failing", func(u *Update) error {
+			runs++
+			return nil
+		}))
+		if runs != 3 {
+			t.Errorf("got %v runs, wanted 3", runs)
+		}
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Exec("DROP TABLE \"migrated\";")
+		}))
+	})
+}
+
+func TestBitComparators(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		ts5 := &testStruct{ID: s.NewID(), Int: 5}
+		ts2 := &testStruct{ID: s.NewID(), Int: 2}
+		ts7 := &testStruct{ID: s.NewID(), Int: 7}
+		s.must(Register(s.Snek, ts5, UncontrolledQueries, UncontrolledUpdates(ts5)))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			for _, ts := range []*testStruct{ts5, ts2, ts7} {
+				if err := u.Insert(ts); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		for _, tc := range []struct {
+			cond Cond
+			want []testStruct
+		}{
+			{cond: Cond{"Int", HASBIT, 5}, want: []testStruct{*ts5, *ts7}},
+			{cond: Cond{"Int", ANYBIT, 2}, want: []testStruct{*ts2, *ts7}},
+			{cond: Cond{"Int", ANYBIT, 8}, want: nil},
+		} {
+			res := []testStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&res, &Query{Set: tc.cond, Order: []Order{{Field: "Int"}}})
+			}))
+			if len(res) != len(tc.want) || (len(res) > 0 && !reflect.DeepEqual(res, tc.want)) {
+				t.Errorf("%+v got %+v, wanted %+v", tc.cond, res, tc.want)
+			}
+			for _, ts := range []*testStruct{ts5, ts2, ts7} {
+				wantMatch := false
+				for _, w := range tc.want {
+					wantMatch = wantMatch || w.ID.Equal(ts.ID)
+				}
+				if matches, err := tc.cond.matches(reflect.ValueOf(*ts)); err != nil || matches != wantMatch {
+					t.Errorf("%+v.matches(%+v) got %v, %v, wanted %v", tc.cond, ts, matches, err, wantMatch)
+				}
+			}
+		}
+		if _, err := NewCond("String", HASBIT, "a"); err == nil {
+			t.Errorf("got nil, wanted error for string bitwise value")
+		}
+		if inc, err := (Cond{"Int", HASBIT, 1}).Includes(Cond{"Int", EQ, 1}); err != nil || inc {
+			t.Errorf("got %v, %v, wanted false, nil", inc, err)
+		}
+	})
+}
+
+func TestQueryCloneIsDeep(t *testing.T) {
+	id := ID{1, 2, 3}
+	orig := &Query{
+		Set:       And{Cond{"ID", EQ, id}, Or{&Cond{"Int", GT, 1}, Cond{"Int", LT, -1}}},
+		Joins:     []Join{NewJoin(&testStruct{}, And{Cond{"Int", EQ, 1}}, []On{{"ID", EQ, "ID"}})},
+		Recursion: &Recursion{ParentField: "ParentID", Start: And{Cond{"ID", EQ, id}}},
+	}
+	want := &Query{
+		Set:       And{Cond{"ID", EQ, ID{1, 2, 3}}, Or{&Cond{"Int", GT, 1}, Cond{"Int", LT, -1}}},
+		Joins:     []Join{NewJoin(&testStruct{}, And{Cond{"Int", EQ, 1}}, []On{{"ID", EQ, "ID"}})},
+		Recursion: &Recursion{ParentField: "ParentID", Start: And{Cond{"ID", EQ, ID{1, 2, 3}}}},
+	}
+	cpy := orig.clone()
+	cpy.Set.(And)[0].(Cond).Value.(ID)[0] = 0
+	cpy.Set.(And)[1].(Or)[0].(*Cond).Value = 2
+	cpy.Set.(And)[1] = None{}
+	cpy.Joins[0].set.(And)[0] = None{}
+	cpy.Joins[0].on[0].MainField = "Int"
+	cpy.Recursion.Start.(And)[0].(Cond).Value.(ID)[0] = 0
+	if !reflect.DeepEqual(orig, want) {
+		t.Errorf("got %+v, wanted %+v", orig, want)
+	}
+}
+
+func TestExists(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		ts1 := &testStruct{ID: s.NewID(), Int: 1}
+		ts2 := &testStruct{ID: s.NewID(), Int: 2}
+		s.must(Register(s.Snek, ts1, UncontrolledQueries, UncontrolledUpdates(ts1)))
+		tts := &treeTestStruct{ID: s.NewID(), ParentID: ID{}}
+		s.must(Register(s.Snek, tts, UncontrolledQueries, UncontrolledUpdates(tts)))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			if err := u.Insert(ts1); err != nil {
+				return err
+			}
+			if err := u.Insert(ts2); err != nil {
+				return err
+			}
+			for _, text := range []string{"a", "b"} {
+				if err := u.Insert(&treeTestStruct{ID: s.NewID(), ParentID: ts1.ID, Text: text}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		hasChild := Exists(&treeTestStruct{}, []On{{"ID", EQ, "ParentID"}}, Cond{"Text", NE, ""})
+		hasNoChild, err := hasChild.Invert()
+		s.must(err)
+		for _, tc := range []struct {
+			set  Set
+			want []testStruct
+		}{
+			{set: hasChild, want: []testStruct{*ts1}},
+			{set: hasNoChild, want: []testStruct{*ts2}},
+			{set: And{Cond{"Int", EQ, 2}, hasChild}, want: nil},
+		} {
+			res := []testStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&res, &Query{Set: tc.set})
+			}))
+			if len(res) != len(tc.want) || (len(res) > 0 && !reflect.DeepEqual(res, tc.want)) {
+				t.Errorf("%+v got %+v, wanted %+v", tc.set, res, tc.want)
+			}
+		}
+		if _, err := hasChild.matches(reflect.ValueOf(*ts1)); err == nil {
+			t.Errorf("got nil, wanted error when matching without database")
+		}
+		if matches, err := (And{Cond{"Int", EQ, 2}, hasChild}).matches(reflect.ValueOf(*ts1)); err != nil || matches {
+			t.Errorf("got %v, %v, wanted false, nil", matches, err)
+		}
+	})
+}
+
+func TestLoadAndHasResults(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		ts := &testStruct{ID: s.NewID(), Int: 3}
+		tts := &treeTestStruct{ID: s.NewID(), ParentID: ID{}}
+		s.must(Register(s.Snek, ts, UncontrolledQueries, UncontrolledUpdates(ts)))
+		// Only allow tree structs whose parent is an existing testStruct.
+		s.must(Register(s.Snek, tts, UncontrolledQueries, func(u *Update, prev, next *treeTestStruct) error {
+			if _, found, err := Load[testStruct](u.View, next.ParentID); err != nil {
+				return err
+			} else if !found {
+				return fmt.Errorf("no parent %v", next.ParentID)
+			}
+			return nil
+		}))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&treeTestStruct{ID: s.NewID(), ParentID: s.NewID()})
+		}))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&treeTestStruct{ID: s.NewID(), ParentID: ts.ID})
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			loaded, found, err := Load[testStruct](v, ts.ID)
+			if err != nil || !found || !reflect.DeepEqual(loaded, ts) {
+				t.Errorf("got %+v, %v, %v, wanted %+v", loaded, found, err, ts)
+			}
+			for _, tc := range []struct {
+				set  Set
+				want bool
+			}{
+				{set: Cond{"Int", EQ, 3}, want: true},
+				{set: Cond{"Int", EQ, 4}, want: false},
+			} {
+				if has, err := HasResults[testStruct](v, &Query{Set: tc.set}); err != nil || has != tc.want {
+					t.Errorf("%+v got %v, %v, wanted %v", tc.set, has, err, tc.want)
+				}
+			}
+			return nil
+		}))
+	})
+}
+
+func TestNumericAffinity(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		structs := []testStruct{}
+		for i := 1; i <= 3; i++ {
+			structs = append(structs, testStruct{ID: s.NewID(), Int: int32(i), Inner: innerTestStruct{Float: float64(i) + 0.5}})
+		}
+		s.must(Register(s.Snek, &structs[0], UncontrolledQueries, UncontrolledUpdates(&structs[0])))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			for i := range structs {
+				if err := u.Insert(&structs[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		for _, tc := range []struct {
+			set      Set
+			wantInts []int32
+		}{
+			{set: Cond{"Int", GT, 1.5}, wantInts: []int32{2, 3}},
+			{set: Cond{"Int", GE, 1.5}, wantInts: []int32{2, 3}},
+			{set: Cond{"Int", LT, 2.5}, wantInts: []int32{1, 2}},
+			{set: Cond{"Int", LE, 2.5}, wantInts: []int32{1, 2}},
+			{set: Cond{"Int", EQ, 2.0}, wantInts: []int32{2}},
+			{set: Cond{"Int", EQ, 2.5}, wantInts: []int32{}},
+			{set: Cond{"Int", NE, 2.5}, wantInts: []int32{1, 2, 3}},
+			{set: Cond{"Inner.Float", GT, 2}, wantInts: []int32{2, 3}},
+		} {
+			res := []testStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&res, &Query{Set: tc.set, Order: []Order{{Field: "Int"}}})
+			}))
+			gotInts := []int32{}
+			for _, ts := range res {
+				gotInts = append(gotInts, ts.Int)
+			}
+			if !reflect.DeepEqual(gotInts, tc.wantInts) {
+				t.Errorf("%+v got %v, wanted %v", tc.set, gotInts, tc.wantInts)
+			}
+			normalized := normalizeSet(tc.set, (&valueInfo{typ: reflect.TypeOf(testStruct{})}).fields(false))
+			matchedInts := []int32{}
+			for _, ts := range structs {
+				matches, err := normalized.matches(reflect.ValueOf(ts))
+				s.must(err)
+				if matches {
+					matchedInts = append(matchedInts, ts.Int)
+				}
+			}
+			if !reflect.DeepEqual(matchedInts, tc.wantInts) {
+				t.Errorf("%+v matched %v, wanted %v", tc.set, matchedInts, tc.wantInts)
+			}
+		}
+	})
+}
+
+type hookTestStruct struct {
+	ID     ID
+	Name   string
+	length int
+}
+
+func (h *hookTestStruct) BeforeSave() error {
+	if h.Name == "" {
+		return fmt.Errorf("empty name")
+	}
+	h.Name = strings.TrimSpace(h.Name)
+	return nil
+}
+
+func (h *hookTestStruct) AfterLoad() error {
+	h.length = len(h.Name)
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		hts := &hookTestStruct{ID: s.NewID(), Name: " name "}
+		s.must(Register(s.Snek, hts, UncontrolledQueries, UncontrolledUpdates(hts)))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(hts)
+		}))
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&hookTestStruct{ID: s.NewID()})
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			loaded := &hookTestStruct{ID: hts.ID}
+			if err := v.Get(loaded); err != nil {
+				return err
+			}
+			if loaded.Name != "name" || loaded.length != 4 {
+				t.Errorf("got %+v, wanted trimmed name with derived length", loaded)
+			}
+			return nil
+		}))
+		hts.Name = " longer name "
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(hts)
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			res := []hookTestStruct{}
+			if err := v.Select(&res, &Query{}); err != nil {
+				return err
+			}
+			if len(res) != 1 || res[0].Name != "longer name" || res[0].length != 11 {
+				t.Errorf("got %+v, wanted trimmed name with derived length", res)
+			}
+			return nil
+		}))
+	})
+}
+
+type encryptedTestStruct struct {
+	ID     ID
+	Secret string `snek:"encrypt"`
+	Data   []byte `snek:"encrypt"`
+}
+
+func TestEncryption(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		if err := Register(s.Snek, &encryptedTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&encryptedTestStruct{})); err == nil {
+			t.Errorf("got nil, wanted error registering encrypted fields without encryption")
+		}
+	})
+	block, err := aes.NewCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withModifiedSnek(t, func(opts *Options) {
+		opts.Encryption = aead
+	}, func(s *testSnek) {
+		ets := &encryptedTestStruct{ID: s.NewID(), Secret: "secret", Data: []byte("data")}
+		s.must(Register(s.Snek, ets, UncontrolledQueries, UncontrolledUpdates(ets)))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ets)
+		}))
+		if ets.Secret != "secret" {
+			t.Errorf("got %q, wanted inserted struct to remain unencrypted", ets.Secret)
+		}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			raw := []byte{}
+			if err := v.tx.Get(&raw, "SELECT \"Secret\" FROM \"encryptedTestStruct\";"); err != nil {
+				return err
+			}
+			if bytes.Contains(raw, []byte("secret")) {
+				t.Errorf("got %q stored, wanted ciphertext", raw)
+			}
+			loaded := &encryptedTestStruct{ID: ets.ID}
+			if err := v.Get(loaded); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(loaded, ets) {
+				t.Errorf("got %+v, wanted %+v", loaded, ets)
+			}
+			return nil
+		}))
+		ets.Secret = "other secret"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ets)
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			res := []encryptedTestStruct{}
+			if err := v.Select(&res, &Query{}); err != nil {
+				return err
+			}
+			if len(res) != 1 || !reflect.DeepEqual(res[0], *ets) {
+				t.Errorf("got %+v, wanted [%+v]", res, *ets)
+			}
+			if err := v.Select(&res, &Query{Set: Cond{"Secret", EQ, "other secret"}}); err == nil {
+				t.Errorf("got nil, wanted error for condition on encrypted field")
+			}
+			for _, query := range []*Query{
+				{Set: Exists(&encryptedTestStruct{}, []On{{"ID", EQ, "ID"}}, Cond{"Secret", EQ, "other secret"})},
+				{Set: Exists(&encryptedTestStruct{}, []On{{"Secret", EQ, "Secret"}}, All{})},
+				{Joins: []Join{NewJoin(&encryptedTestStruct{}, Cond{"Secret", EQ, "other secret"}, []On{{"ID", EQ, "ID"}})}},
+				{Joins: []Join{NewJoin(&encryptedTestStruct{}, All{}, []On{{"ID", EQ, "Data"}})}},
+			} {
+				if err := v.Select(&res, query); err == nil {
+					t.Errorf("got nil, wanted error for condition on encrypted field in %+v", query)
+				}
+			}
+			// Fields selected into other types are decrypted as fields of the source type.
+			secrets, err := SelectInto[struct {
+				Secret string `snek:"encrypt"`
+			}](v, reflect.TypeOf(encryptedTestStruct{}), nil)
+			if err != nil {
+				return err
+			}
+			if len(secrets) != 1 || secrets[0].Secret != ets.Secret {
+				t.Errorf("got %+v, wanted the Secret %q", secrets, ets.Secret)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestPublish(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		snapshots := make(chan []testStruct, 10)
+		events := make(chan *testStruct, 10)
+		s.mustAny(Subscribe(s.Snek, AnonCaller{}, &Query{Set: Cond{"Int", EQ, 1}}, WithEvents(TypedSubscriber(func(res []testStruct, err error) error {
+			s.must(err)
+			snapshots <- res
+			return nil
+		}), func(structPointer any) error {
+			events <- structPointer.(*testStruct)
+			return nil
+		})))
+		<-snapshots
+		s.must(s.Publish(&testStruct{ID: s.NewID(), Int: 2}, nil))
+		s.must(s.Publish(&testStruct{ID: s.NewID(), Int: 1}, func(c Caller) bool { return c.IsAdmin() }))
+		want := &testStruct{ID: s.NewID(), Int: 1}
+		s.must(s.Publish(want, func(c Caller) bool { return !c.IsAdmin() }))
+		if got := <-events; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+		select {
+		case got := <-events:
+			t.Errorf("got %+v, wanted no more events", got)
+		case got := <-snapshots:
+			t.Errorf("got %+v, wanted no snapshots for published structs", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+		s.mustNot(s.Publish(testStruct{}, nil))
+		stored := []testStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&stored, &Query{})
+		}))
+		if len(stored) != 0 {
+			t.Errorf("got %+v, wanted published structs not to be stored", stored)
+		}
+	})
+}
+
+func TestCount(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		counts := make(chan int)
+		s.mustAny(Subscribe(s.Snek, AnonCaller{}, &Query{Set: Cond{"Int", GT, 0}}, CountSubscriber[testStruct](func(count int, initial bool, err error) error {
+			s.must(err)
+			counts <- count
+			return nil
+		})))
+		if got := <-counts; got != 0 {
+			t.Errorf("got %v, wanted 0", got)
+		}
+		for i := 1; i <= 3; i++ {
+			s.must(s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(&testStruct{ID: s.NewID(), Int: int32(i)})
+			}))
+			if got := <-counts; got != i {
+				t.Errorf("got %v, wanted %v", got, i)
+			}
+		}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			for _, tc := range []struct {
+				query *Query
+				want  int
+			}{
+				{query: nil, want: 3},
+				{query: &Query{Set: Cond{"Int", GE, 2}}, want: 2},
+				{query: &Query{Limit: 2}, want: 2},
+				{query: &Query{Offset: 2}, want: 1},
+			} {
+				if got, err := v.Count(&testStruct{}, tc.query); err != nil || got != tc.want {
+					t.Errorf("%+v got %v, %v, wanted %v", tc.query, got, err, tc.want)
+				}
+			}
+			return nil
+		}))
+	})
+}
+
+func TestStructuredErrors(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			notRegistered := &NotRegisteredError{}
+			if err := v.Select(&[]testStruct{}, &Query{}); !errors.As(err, &notRegistered) || notRegistered.TypeName != "testStruct" || notRegistered.Control != "query" {
+				t.Errorf("got %v, wanted NotRegisteredError for testStruct query control", err)
+			}
+			invalidArgument := &InvalidArgumentError{}
+			if err := v.Select(&testStruct{}, &Query{}); !errors.As(err, &invalidArgument) {
+				t.Errorf("got %v, wanted InvalidArgumentError", err)
+			}
+			return nil
+		}))
+		invalidArgument := &InvalidArgumentError{}
+		if err := Register(s.Snek, &struct{ A int }{}, UncontrolledQueries, nil); !errors.As(err, &invalidArgument) {
+			t.Errorf("got %v, wanted InvalidArgumentError", err)
+		}
+	})
+}
+
+func TestListAll(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		ts1 := &testStruct{ID: s.NewID(), Int: 1}
+		ts2 := &testStruct{ID: s.NewID(), Int: 2}
+		s.must(Register(s.Snek, ts1, UncontrolledQueries, UncontrolledUpdates(ts1)))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			if err := u.Insert(ts1); err != nil {
+				return err
+			}
+			return u.Insert(ts2)
+		}))
+		if _, err := ListAll[testStruct](s.Snek, AnonCaller{}); err == nil {
+			t.Errorf("got nil, wanted error for anonymous caller")
+		}
+		for _, caller := range []Caller{testCaller{isAdmin: true}, SystemCaller{}} {
+			res, err := ListAll[testStruct](s.Snek, caller)
+			s.must(err)
+			if len(res) != 2 {
+				t.Errorf("got %+v, wanted two results", res)
+			}
+		}
+	})
+}
+
+func TestOrderCases(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		structs := []*testStruct{}
+		for i := 1; i <= 4; i++ {
+			structs = append(structs, &testStruct{ID: s.NewID(), Int: int32(i), Bool: i%2 == 0})
+		}
+		s.must(Register(s.Snek, structs[0], UncontrolledQueries, UncontrolledUpdates(structs[0])))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			for _, ts := range structs {
+				if err := u.Insert(ts); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		for _, tc := range []struct {
+			order    []Order
+			wantInts []int32
+		}{
+			{
+				order:    []Order{{Cases: []OrderCase{{Set: Cond{"Bool", EQ, true}, Rank: 0}}}, {Field: "Int"}},
+				wantInts: []int32{2, 4, 1, 3},
+			},
+			{
+				order:    []Order{{Cases: []OrderCase{{Set: Cond{"Int", EQ, 3}, Rank: 1}, {Set: Cond{"Int", GE, 2}, Rank: 0}}}, {Field: "Int", Desc: true}},
+				wantInts: []int32{4, 2, 3, 1},
+			},
+		} {
+			res := []testStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&res, &Query{Set: Cond{"Int", GT, 0}, Order: tc.order})
+			}))
+			gotInts := []int32{}
+			for _, ts := range res {
+				gotInts = append(gotInts, ts.Int)
+			}
+			if !reflect.DeepEqual(gotInts, tc.wantInts) {
+				t.Errorf("%+v got %v, wanted %v", tc.order, gotInts, tc.wantInts)
+			}
+		}
+		s.mustNot(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&[]testStruct{}, &Query{Order: []Order{{Field: "Int", Cases: []OrderCase{{Set: All{}}}}}})
+		}))
+	})
+}
+
+func TestTruncate(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			for i := 0; i < 3; i++ {
+				if err := u.Insert(&testStruct{ID: s.NewID()}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		counts := make(chan int)
+		s.mustAny(Subscribe(s.Snek, AnonCaller{}, &Query{}, CountSubscriber[testStruct](func(count int, _ bool, err error) error {
+			s.must(err)
+			counts <- count
+			return nil
+		})))
+		if got := <-counts; got != 3 {
+			t.Errorf("got %v, wanted 3", got)
+		}
+		s.mustNot(Truncate[testStruct](s.Snek, AnonCaller{}))
+		s.mustNot(Truncate[treeTestStruct](s.Snek, SystemCaller{}))
+		s.must(Truncate[testStruct](s.Snek, testCaller{isAdmin: true}))
+		if got := <-counts; got != 0 {
+			t.Errorf("got %v, wanted 0", got)
+		}
+	})
+}
+
+type excludedFieldTestStruct struct {
+	ID    ID
+	Text  string
+	Cache string          `snek:"-"`
+	Inner innerTestStruct `snek:"-"`
+}
+
+func TestExcludedFields(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		efts := &excludedFieldTestStruct{ID: s.NewID(), Text: "text", Cache: "cache", Inner: innerTestStruct{Float: 1}}
+		s.must(Register(s.Snek, efts, UncontrolledQueries, UncontrolledUpdates(efts)))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(efts)
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			columns := []string{}
+			if err := v.tx.Select(&columns, "SELECT \"name\" FROM pragma_table_info('excludedFieldTestStruct') ORDER BY \"name\";"); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(columns, []string{"ID", "Text"}) {
+				t.Errorf("got columns %v, wanted [ID Text]", columns)
+			}
+			loaded := &excludedFieldTestStruct{ID: efts.ID}
+			if err := v.Get(loaded); err != nil {
+				return err
+			}
+			if want := (&excludedFieldTestStruct{ID: efts.ID, Text: "text"}); !reflect.DeepEqual(loaded, want) {
+				t.Errorf("got %+v, wanted %+v", loaded, want)
+			}
+			return nil
+		}))
+		efts.Text = "other text"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(efts)
+		}))
+	})
+}
+
+type uniqueTestStruct struct {
+	ID       ID
+	Email    string `snek:"unique"`
+	Username string
+	Domain   string
+}
+
+func (u uniqueTestStruct) Unique() [][]string {
+	return [][]string{{"Domain", "Username"}}
+}
+
+func TestUniqueConstraintError(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		uts := &uniqueTestStruct{ID: s.NewID(), Email: "a@b", Username: "a", Domain: "b"}
+		s.must(Register(s.Snek, uts, UncontrolledQueries, UncontrolledUpdates(uts)))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(uts)
+		}))
+		for _, tc := range []struct {
+			uts        *uniqueTestStruct
+			wantFields []string
+		}{
+			{uts: &uniqueTestStruct{ID: s.NewID(), Email: "a@b", Username: "c", Domain: "d"}, wantFields: []string{"Email"}},
+			{uts: &uniqueTestStruct{ID: s.NewID(), Email: "c@d", Username: "a", Domain: "b"}, wantFields: []string{"Domain", "Username"}},
+			{uts: &uniqueTestStruct{ID: uts.ID, Email: "e@f"}, wantFields: []string{"ID"}},
+		} {
+			err := s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(tc.uts)
+			})
+			uniqueErr := &UniqueConstraintError{}
+			if !errors.As(err, &uniqueErr) || uniqueErr.TypeName != "uniqueTestStruct" || !reflect.DeepEqual(uniqueErr.Fields, tc.wantFields) {
+				t.Errorf("%+v: got %v, wanted UniqueConstraintError for %v", tc.uts, err, tc.wantFields)
+			}
+		}
+	})
+}
+
+func TestNestedTransactions(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		for _, tc := range []struct {
+			name    string
+			outer   func(func(context.Context) error) error
+			inner   func(context.Context) error
+			wantErr bool
+		}{
+			{
+				name: "view in view",
+				outer: func(f func(context.Context) error) error {
+					return s.View(AnonCaller{}, func(v *View) error { return f(v.Context()) })
+				},
+				inner: func(ctx context.Context) error {
+					return s.View(WithContext(AnonCaller{}, ctx), func(*View) error { return nil })
+				},
+			},
+			{
+				name: "update in view",
+				outer: func(f func(context.Context) error) error {
+					return s.View(AnonCaller{}, func(v *View) error { return f(v.Context()) })
+				},
+				inner: func(ctx context.Context) error {
+					return s.Update(WithContext(AnonCaller{}, ctx), func(*Update) error { return nil })
+				},
+				wantErr: true,
+			},
+			{
+				name: "view in update",
+				outer: func(f func(context.Context) error) error {
+					return s.Update(AnonCaller{}, func(u *Update) error { return f(u.Context()) })
+				},
+				inner: func(ctx context.Context) error {
+					return s.View(WithContext(AnonCaller{}, ctx), func(*View) error { return nil })
+				},
+				wantErr: true,
+			},
+			{
+				name: "update in update",
+				outer: func(f func(context.Context) error) error {
+					return s.Update(AnonCaller{}, func(u *Update) error { return f(u.Context()) })
+				},
+				inner: func(ctx context.Context) error {
+					return s.Update(WithContext(AnonCaller{}, ctx), func(*Update) error { return nil })
+				},
+				wantErr: true,
+			},
+			{
+				name: "update in view in view",
+				outer: func(f func(context.Context) error) error {
+					return s.View(AnonCaller{}, func(v *View) error { return f(v.Context()) })
+				},
+				inner: func(ctx context.Context) error {
+					return s.View(WithContext(AnonCaller{}, ctx), func(v *View) error {
+						return s.Update(WithContext(AnonCaller{}, v.Context()), func(*Update) error { return nil })
+					})
+				},
+				wantErr: true,
+			},
+		} {
+			var innerErr error
+			s.must(tc.outer(func(ctx context.Context) error {
+				innerErr = tc.inner(ctx)
+				return nil
+			}))
+			if gotErr := errors.Is(innerErr, ErrNestedTransaction); gotErr != tc.wantErr {
+				t.Errorf("%s: got %v, wanted ErrNestedTransaction: %v", tc.name, innerErr, tc.wantErr)
+			}
+		}
+		// Contexts outliving their transactions can start new transactions.
+		var outerCtx context.Context
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			outerCtx = u.Context()
+			return nil
+		}))
+		s.must(s.Update(WithContext(AnonCaller{}, outerCtx), func(*Update) error { return nil }))
+	})
+}
+
+func TestDefaultSet(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.mustNot(RegisterDefaultSet[testStruct](s.Snek, func(Caller) Set { return nil }))
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(RegisterDefaultSet[testStruct](s.Snek, func(caller Caller) Set {
+			if caller.IsSystem() {
+				return nil
+			}
+			return Cond{"Bool", EQ, true}
+		}))
+		visible := &testStruct{ID: s.NewID(), Int: 1, Bool: true}
+		hidden := &testStruct{ID: s.NewID(), Int: 1}
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			if err := u.Insert(visible); err != nil {
+				return err
+			}
+			return u.Insert(hidden)
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			res := []testStruct{}
+			if err := v.Select(&res, &Query{Set: Cond{"Int", EQ, 1}}); err != nil {
+				return err
+			}
+			if len(res) != 1 || res[0].ID.String() != visible.ID.String() {
+				t.Errorf("got %+v, wanted only %+v", res, visible)
+			}
+			if count, err := v.Count(&testStruct{}, nil); err != nil || count != 1 {
+				t.Errorf("got %v, %v, wanted 1, nil", count, err)
+			}
+			if err := v.Get(&testStruct{ID: visible.ID}); err != nil {
+				return err
+			}
+			if err := v.Get(&testStruct{ID: hidden.ID}); err == nil {
+				t.Errorf("wanted error getting struct outside default set")
+			}
+			return nil
+		}))
+		s.must(s.View(SystemCaller{}, func(v *View) error {
+			if count, err := v.Count(&testStruct{}, nil); err != nil || count != 2 {
+				t.Errorf("got %v, %v, wanted 2, nil", count, err)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestSystemRunsControl(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.SystemRunsControl = true
+	}, func(s *testSnek) {
+		queries, updates := 0, 0
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			queries++
+			return nil
+		}, func(u *Update, prev, next *testStruct) error {
+			updates++
+			if next != nil && next.Bool && !u.Caller().IsSystem() {
+				return fmt.Errorf("only system callers can set Bool")
+			}
+			return nil
+		}))
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID(), Bool: true})
+		}))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID(), Bool: true})
+		}))
+		s.must(s.View(SystemCaller{}, func(v *View) error {
+			return v.Select(&[]testStruct{}, &Query{})
+		}))
+		if queries != 1 || updates != 2 {
+			t.Errorf("got %v queries and %v updates controlled, wanted 1 and 2", queries, updates)
+		}
+	})
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			return fmt.Errorf("no queries")
+		}, func(u *Update, prev, next *testStruct) error {
+			return fmt.Errorf("no updates")
+		}))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID()})
+		}))
+		s.must(s.View(SystemCaller{}, func(v *View) error {
+			return v.Select(&[]testStruct{}, &Query{})
+		}))
+	})
+	// Options not created by DefaultOptions let system callers skip the control too.
+	withModifiedSnek(t, func(opts *Options) {
+		*opts = Options{Path: opts.Path}
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			return fmt.Errorf("no queries")
+		}, func(u *Update, prev, next *testStruct) error {
+			return fmt.Errorf("no updates")
+		}))
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID()})
+		}))
+	})
+}
+
+func TestInsertIfAbsent(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.Path += "?_txlock=immediate&_busy_timeout=10000"
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		wg := sync.WaitGroup{}
+		inserted := make(chan bool, 20)
+		for i := 0; i < cap(inserted); i++ {
+			wg.Add(1)
+			ts := &testStruct{ID: s.NewID(), String: "group"}
+			go func() {
+				defer wg.Done()
+				s.must(s.Update(AnonCaller{}, func(u *Update) error {
+					didInsert, err := u.InsertIfAbsent(ts, &Query{Set: Cond{"String", EQ, "group"}})
+					inserted <- didInsert
+					return err
+				}))
+			}()
+		}
+		wg.Wait()
+		close(inserted)
+		insertions := 0
+		for didInsert := range inserted {
+			if didInsert {
+				insertions++
+			}
+		}
+		if insertions != 1 {
+			t.Errorf("got %v insertions, wanted 1", insertions)
+		}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			if count, err := v.Count(&testStruct{}, nil); err != nil || count != 1 {
+				t.Errorf("got %v, %v, wanted 1, nil", count, err)
+			}
+			return nil
+		}))
+	})
+}
+
+type ipTestStruct struct {
+	ID ID
+	IP net.IP
+}
+
+func TestIP(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &ipTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&ipTestStruct{})))
+		i1 := &ipTestStruct{ID: s.NewID(), IP: net.IP{10, 0, 0, 1}}
+		i2 := &ipTestStruct{ID: s.NewID(), IP: net.ParseIP("10.0.0.255")}
+		i3 := &ipTestStruct{ID: s.NewID(), IP: net.IP{9, 255, 255, 255}}
+		i4 := &ipTestStruct{ID: s.NewID(), IP: net.ParseIP("2001:db8::1")}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, i := range []*ipTestStruct{i1, i2, i3, i4} {
+				if err := u.Insert(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		found := &ipTestStruct{ID: i1.ID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(found)
+		}))
+		if !found.IP.Equal(i1.IP) {
+			t.Errorf("got %v, wanted %v", found.IP, i1.IP)
+		}
+		got := []ipTestStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Order: []Order{{Field: "IP"}}})
+		}))
+		mustList(t, got, []ID{i3.ID, i1.ID, i2.ID, i4.ID})
+		_, network, err := net.ParseCIDR("10.0.0.0/24")
+		s.must(err)
+		cidr, err := CIDR("IP", network)
+		s.must(err)
+		got = []ipTestStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Set: cidr, Order: []Order{{Field: "IP"}}})
+		}))
+		if len(got) != 2 {
+			t.Errorf("got %+v, wanted 2 results", got)
+		}
+		mustList(t, got, []ID{i1.ID, i2.ID})
+		got = []ipTestStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Set: Cond{"IP", EQ, net.IP{10, 0, 0, 255}}})
+		}))
+		if len(got) != 1 {
+			t.Errorf("got %+v, wanted 1 result", got)
+		}
+		mustList(t, got, []ID{i2.ID})
+		if matches, err := cidr.matches(reflect.ValueOf(*i1)); err != nil || !matches {
+			t.Errorf("got %v, %v, wanted %v to match %v", matches, err, i1.IP, network)
+		}
+		if matches, err := cidr.matches(reflect.ValueOf(*i3)); err != nil || matches {
+			t.Errorf("got %v, %v, wanted %v to not match %v", matches, err, i3.IP, network)
+		}
+		for _, invalid := range []*net.IPNet{nil, {IP: net.IP{10, 0, 0, 0}.To4(), Mask: net.CIDRMask(64, 128)}} {
+			if _, err := CIDR("IP", invalid); err == nil {
+				t.Errorf("got nil, wanted an error for the network %v", invalid)
+			}
+		}
+	})
+}
+
+func TestQueryCache(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.QueryCacheSize = 10
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(Register(s.Snek, &treeTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&treeTestStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID(), String: "a"})
+		}))
+		countWith := func(query *Query) int {
+			got := []testStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&got, query)
+			}))
+			return len(got)
+		}
+		mustStats := func(wantHits, wantMisses uint64) {
+			t.Helper()
+			if stats := s.QueryCacheStats(); stats.Hits != wantHits || stats.Misses != wantMisses {
+				t.Errorf("got %+v, wanted %v hits and %v misses", stats, wantHits, wantMisses)
+			}
+		}
+		joinQuery := &Query{Joins: []Join{NewJoin(&treeTestStruct{}, All{}, []On{{"String", EQ, "Text"}})}}
+		if got := countWith(&Query{}); got != 1 {
+			t.Errorf("got %v, wanted 1", got)
+		}
+		mustStats(0, 1)
+		if got := countWith(&Query{}); got != 1 {
+			t.Errorf("got %v, wanted 1", got)
+		}
+		mustStats(1, 1)
+		if got := countWith(joinQuery); got != 0 {
+			t.Errorf("got %v, wanted 0", got)
+		}
+		mustStats(1, 2)
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&treeTestStruct{ID: s.NewID(), Text: "a"})
+		}))
+		if got := countWith(&Query{}); got != 1 {
+			t.Errorf("got %v, wanted 1", got)
+		}
+		mustStats(2, 2)
+		if got := countWith(joinQuery); got != 1 {
+			t.Errorf("got %v, wanted 1", got)
+		}
+		mustStats(2, 3)
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID(), String: "b"})
+		}))
+		if got := countWith(&Query{}); got != 2 {
+			t.Errorf("got %v, wanted 2", got)
+		}
+		mustStats(2, 4)
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			return u.Exec("DELETE FROM \"testStruct\"")
+		}))
+		if got := countWith(&Query{}); got != 0 {
+			t.Errorf("got %v, wanted 0", got)
+		}
+		mustStats(2, 5)
+	})
+}
+
+func TestScanBudget(t *testing.T) {
+	observed := []QueryStats{}
+	withModifiedSnek(t, func(opts *Options) {
+		opts.MaxScanRows = 3
+		opts.QueryObserver = func(stats QueryStats) {
+			observed = append(observed, stats)
+		}
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for i := 0; i < 5; i++ {
+				if err := u.Insert(&testStruct{ID: s.NewID(), Int: int32(i)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			got := []testStruct{}
+			if err := v.Select(&got, &Query{Set: Cond{"Int", EQ, 2}}); err != nil {
+				return err
+			}
+			if len(observed) != 1 || observed[0].ScannedRows() != 0 || observed[0].ReturnedRows != 1 || observed[0].Err != nil {
+				t.Errorf("got %+v, wanted one observed indexed query returning one row", observed)
+			}
+			budgetErr := &ScanBudgetError{}
+			if err := v.Select(&got, &Query{Set: Cond{"String", EQ, "x"}}); !errors.As(err, &budgetErr) {
+				t.Errorf("got %v, wanted a ScanBudgetError", err)
+			} else if budgetErr.FullScans["testStruct"] != 5 || budgetErr.Max != 3 {
+				t.Errorf("got %+v, wanted 5 rows of testStruct scanned with max 3", budgetErr)
+			}
+			if len(observed) != 2 || observed[1].ScannedRows() != 5 || !errors.As(observed[1].Err, &budgetErr) {
+				t.Errorf("got %+v, wanted the aborted query to be observed", observed)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestSubscriptionSurvivesLoadErrors(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		denied := synch.S[bool]{}
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			if denied.Get() {
+				return fmt.Errorf("temporarily denied")
+			}
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		type delivery struct {
+			count   int
+			initial bool
+			err     error
+		}
+		deliveries := make(chan delivery)
+		s.mustAny(Subscribe(s.Snek, AnonCaller{}, &Query{}, TypedSnapshotSubscriber(func(res []testStruct, initial bool, err error) error {
+			deliveries <- delivery{count: len(res), initial: initial, err: err}
+			return nil
+		})))
+		if got := <-deliveries; got.err != nil || got.count != 0 || !got.initial {
+			t.Errorf("got %+v, wanted initial empty delivery", got)
+		}
+		denied.Set(true)
+		ts := &testStruct{ID: s.NewID()}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		if got := <-deliveries; got.err == nil {
+			t.Errorf("got %+v, wanted error delivery", got)
+		}
+		denied.Set(false)
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			ts.String = "changed"
+			return u.Update(ts)
+		}))
+		if got := <-deliveries; got.err != nil || got.count != 1 || got.initial {
+			t.Errorf("got %+v, wanted non initial delivery of one struct", got)
+		}
+		if subs := s.getSubscriptions(reflect.TypeOf(testStruct{})).Len(); subs != 1 {
+			t.Errorf("got %v subscriptions, wanted 1", subs)
+		}
+	})
+}
+
+func TestIDBytes(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.IDBytes = 16
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		ts := &testStruct{ID: s.NewID(), String: "short"}
+		if len(ts.ID) != 16 {
+			t.Errorf("got %v bytes, wanted 16", len(ts.ID))
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		found := &testStruct{ID: ts.ID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(found)
+		}))
+		if found.String != ts.String {
+			t.Errorf("got %+v, wanted %+v", found, ts)
+		}
+	})
+	withSnek(t, func(s *testSnek) {
+		if id := s.NewID(); len(id) != 32 {
+			t.Errorf("got %v bytes, wanted 32", len(id))
+		}
+	})
+	opts := DefaultOptions(":memory:")
+	for _, idBytes := range []int{4, 8, 15} {
+		opts.IDBytes = idBytes
+		if _, err := opts.Open(); err == nil {
+			t.Errorf("wanted error for %v byte IDs", idBytes)
+		}
+	}
+}
+
+func TestViewExists(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(Register(s.Snek, &treeTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&treeTestStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(&testStruct{ID: s.NewID(), Int: 1, String: "a"}); err != nil {
+				return err
+			}
+			if err := u.Insert(&testStruct{ID: s.NewID(), Int: 2, String: "b"}); err != nil {
+				return err
+			}
+			return u.Insert(&treeTestStruct{ID: s.NewID(), Text: "a"})
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			for _, tc := range []struct {
+				query *Query
+				want  bool
+			}{
+				{nil, true},
+				{&Query{Set: Cond{"Int", EQ, 1}}, true},
+				{&Query{Set: Cond{"Int", EQ, 3}}, false},
+				{&Query{Set: Cond{"Int", EQ, 1}, Joins: []Join{NewJoin(&treeTestStruct{}, All{}, []On{{"String", EQ, "Text"}})}}, true},
+				{&Query{Set: Cond{"Int", EQ, 2}, Joins: []Join{NewJoin(&treeTestStruct{}, All{}, []On{{"String", EQ, "Text"}})}}, false},
+			} {
+				if got, err := v.Exists(&testStruct{}, tc.query); err != nil || got != tc.want {
+					t.Errorf("got %v, %v for %+v, wanted %v", got, err, tc.query, tc.want)
+				}
+			}
+			if _, err := v.Exists(testStruct{}, nil); err == nil {
+				t.Errorf("wanted error for non pointer")
+			}
+			return nil
+		}))
+	})
+}
+
+type nullableTestStruct struct {
+	ID  ID
+	Int *int32
+}
+
+func TestNullPlacement(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &nullableTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&nullableTestStruct{})))
+		one, two := int32(1), int32(2)
+		n1 := &nullableTestStruct{ID: s.NewID(), Int: &one}
+		n2 := &nullableTestStruct{ID: s.NewID(), Int: &two}
+		nNil := &nullableTestStruct{ID: s.NewID()}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, n := range []*nullableTestStruct{n1, n2, nNil} {
+				if err := u.Insert(n); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		for _, tc := range []struct {
+			order Order
+			want  []ID
+		}{
+			{Order{Field: "Int"}, []ID{nNil.ID, n1.ID, n2.ID}},
+			{Order{Field: "Int", Desc: true}, []ID{n2.ID, n1.ID, nNil.ID}},
+			{Order{Field: "Int", Nulls: NullsLast}, []ID{n1.ID, n2.ID, nNil.ID}},
+			{Order{Field: "Int", Desc: true, Nulls: NullsFirst}, []ID{nNil.ID, n2.ID, n1.ID}},
+		} {
+			got := []nullableTestStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&got, &Query{Order: []Order{tc.order}})
+			}))
+			if len(got) != len(tc.want) {
+				t.Errorf("got %+v for %+v, wanted %v results", got, tc.order, len(tc.want))
+			}
+			mustList(t, got, tc.want)
+		}
+		s.mustNot(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&[]nullableTestStruct{}, &Query{Order: []Order{{Field: "Int", Nulls: "MIDDLE"}}})
+		}))
+	})
+}
+
+func TestGroupCount(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		deliveries := make(chan []GroupCount)
+		s.mustAny(Subscribe(s.Snek, AnonCaller{}, &Query{Set: Cond{"Bool", EQ, true}}, GroupCountSubscriber[testStruct]("String", func(groupCounts []GroupCount, _ bool, err error) error {
+			s.must(err)
+			deliveries <- groupCounts
+			return nil
+		})))
+		if got := <-deliveries; len(got) != 0 {
+			t.Errorf("got %+v, wanted no groups", got)
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, group := range []string{"b", "a", "b"} {
+				if err := u.Insert(&testStruct{ID: s.NewID(), String: group, Bool: true}); err != nil {
+					return err
+				}
+			}
+			return u.Insert(&testStruct{ID: s.NewID(), String: "c"})
+		}))
+		want := []GroupCount{{"a", 1}, {"b", 2}}
+		if got := <-deliveries; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			got, err := v.GroupCount(&testStruct{}, "Bool", nil)
+			if err != nil {
+				return err
+			}
+			if want := []GroupCount{{false, 1}, {true, 3}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, wanted %+v", got, want)
+			}
+			if _, err := v.GroupCount(&testStruct{}, "Missing", nil); err == nil {
+				t.Errorf("wanted error grouping by missing field")
+			}
+			return nil
+		}))
+	})
+}
+
+func TestReadYourWritesInUpdate(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.QueryCacheSize = 10
+	}, func(s *testSnek) {
+		ts := &testStruct{ID: s.NewID(), String: "before"}
+		other := &testStruct{ID: s.NewID(), String: "other"}
+		// The update control of removals requires the remaining structs to be visible, to verify that control functions see earlier writes.
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, func(u *Update, prev, next *testStruct) error {
+			if next == nil {
+				count, err := u.Count(&testStruct{}, nil)
+				if err != nil {
+					return err
+				}
+				if count < 2 {
+					return fmt.Errorf("can't remove the last struct")
+				}
+			}
+			return nil
+		}))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(other)
+		}))
+		// Populate the query cache, to verify that Updates don't use it.
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&[]testStruct{}, &Query{})
+		}))
+		mustSee := func(u *Update, wantCount int, wantString string) {
+			t.Helper()
+			got := []testStruct{}
+			s.must(u.Select(&got, &Query{}))
+			if len(got) != wantCount {
+				t.Errorf("got %+v, wanted %v structs", got, wantCount)
+			}
+			if count, err := u.Count(&testStruct{}, nil); err != nil || count != wantCount {
+				t.Errorf("got %v, %v, wanted %v", count, err, wantCount)
+			}
+			found := &testStruct{ID: ts.ID}
+			err := u.Get(found)
+			if wantString == "" {
+				if !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("got %v, wanted sql.ErrNoRows", err)
+				}
+			} else if err != nil || found.String != wantString {
+				t.Errorf("got %+v, %v, wanted %q", found, err, wantString)
+			}
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			mustSee(u, 1, "")
+			if err := u.Insert(ts); err != nil {
+				return err
+			}
+			mustSee(u, 2, "before")
+			ts.String = "after"
+			if err := u.Update(ts); err != nil {
+				return err
+			}
+			mustSee(u, 2, "after")
+			if err := u.UpdateFields(&testStruct{ID: ts.ID, String: "fields"}, "String"); err != nil {
+				return err
+			}
+			mustSee(u, 2, "fields")
+			if err := u.Remove(&testStruct{ID: ts.ID}); err != nil {
+				return err
+			}
+			mustSee(u, 1, "")
+			if err := u.Remove(&testStruct{ID: other.ID}); err == nil {
+				t.Errorf("wanted the update control to see the earlier removal")
+			}
+			return nil
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			got := []testStruct{}
+			if err := v.Select(&got, &Query{}); err != nil {
+				return err
+			}
+			mustList(t, got, []ID{other.ID})
+			if len(got) != 1 {
+				t.Errorf("got %+v, wanted only %+v", got, other)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestQuerySpec(t *testing.T) {
+	spec := &QuerySpec{
+		Limit: 2,
+		Order: []Order{{Field: "Int"}},
+		Match: Match{And: []Match{
+			{Cond: &Cond{"Bool", EQ, true}},
+			{Or: []Match{{Cond: &Cond{"Int", EQ, 1}}, {Cond: &Cond{"Int", EQ, 2}}}},
+		}},
+	}
+	query, err := spec.ToQuery()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSet := And{Cond{"Bool", EQ, true}, Or{Cond{"Int", EQ, 1}, Cond{"Int", EQ, 2}}}
+	if !reflect.DeepEqual(query.Set, wantSet) || query.Limit != 2 || !reflect.DeepEqual(query.Order, spec.Order) {
+		t.Errorf("got %+v, wanted set %+v", query, wantSet)
+	}
+	if _, err := (&QuerySpec{Match: Match{Cond: &Cond{"Int", EQ, 1}, Or: []Match{{}}}}).ToQuery(); err == nil {
+		t.Errorf("wanted error for Match with multiple fields")
+	}
+	if set, err := (&Match{}).ToSet(); err != nil || !reflect.DeepEqual(set, All{}) {
+		t.Errorf("got %+v, %v, wanted All", set, err)
+	}
+}
+
+type contextKey struct{}
+
+func TestCallerContext(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		traces := []any{}
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			if _, ok := v.Caller().(testCaller); !ok {
+				return fmt.Errorf("got caller %+v, wanted a testCaller", v.Caller())
+			}
+			traces = append(traces, v.Context().Value(contextKey{}))
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		caller := WithContext(testCaller{userID: s.NewID()}, context.WithValue(context.Background(), contextKey{}, "trace"))
+		s.must(s.View(caller, func(v *View) error {
+			return v.Select(&[]testStruct{}, &Query{})
+		}))
+		s.must(s.View(testCaller{}, func(v *View) error {
+			return v.Select(&[]testStruct{}, &Query{})
+		}))
+		if len(traces) != 2 || traces[0] != "trace" || traces[1] != nil {
+			t.Errorf("got %v, wanted [trace <nil>]", traces)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		s.mustNot(s.Update(WithContext(testCaller{}, ctx), func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID()})
+		}))
+	})
+}
+
+type diffTestStruct struct {
+	ID      ID
+	String  string
+	Inner   innerTestStruct
+	Pointer *innerTestStruct
+	Big     BigInt
+}
+
+func TestDiff(t *testing.T) {
+	id := ID("id")
+	for _, tc := range []struct {
+		prev, next any
+		want       []string
+	}{
+		{prev: &diffTestStruct{ID: id, Big: NewBigInt(1)}, next: &diffTestStruct{ID: id, Big: NewBigInt(1)}, want: []string{}},
+		{prev: &diffTestStruct{ID: id}, next: &diffTestStruct{ID: id, String: "a", Big: NewBigInt(0)}, want: []string{"String"}},
+		{prev: &diffTestStruct{ID: id}, next: &diffTestStruct{ID: id, Inner: innerTestStruct{Float: 1}}, want: []string{"Inner.Float"}},
+		{prev: &diffTestStruct{ID: id}, next: &diffTestStruct{ID: id, Pointer: &innerTestStruct{}}, want: []string{"Pointer.Float"}},
+		{prev: &diffTestStruct{ID: id, Pointer: &innerTestStruct{Float: 1}}, next: &diffTestStruct{ID: ID("other"), Pointer: &innerTestStruct{Float: 1}, Big: NewBigInt(2)}, want: []string{"Big", "ID"}},
+		{prev: nil, next: &diffTestStruct{ID: id}, want: []string{"Big", "ID", "Inner.Float", "Pointer.Float", "String"}},
+		{prev: &diffTestStruct{ID: id}, next: (*diffTestStruct)(nil), want: []string{"Big", "ID", "Inner.Float", "Pointer.Float", "String"}},
+	} {
+		got, err := Diff(tc.prev, tc.next)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Diff(%+v, %+v) got %v, %v, wanted %v", tc.prev, tc.next, got, err, tc.want)
+		}
+	}
+	if _, err := Diff(&diffTestStruct{}, &testStruct{}); err == nil {
+		t.Errorf("wanted error for different types")
+	}
+	if _, err := Diff(nil, nil); err == nil {
+		t.Errorf("wanted error for nil structs")
+	}
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, func(u *Update, prev, next *testStruct) error {
+			if prev == nil || next == nil {
+				return nil
+			}
+			changed, err := Diff(prev, next)
+			if err != nil {
+				return err
+			}
+			for _, field := range changed {
+				if field != "String" {
+					return fmt.Errorf("only String may change, not %v", changed)
+				}
+			}
+			return nil
+		}))
+		ts := &testStruct{ID: s.NewID()}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		ts.String = "changed"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts)
+		}))
+		ts.Inner.Float = 1
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts)
+		}))
+	})
+}
+
+type immutableTestStruct struct {
+	ID      ID
+	OwnerID ID `snek:"index,immutable"`
+	Inner   struct {
+		CreatedAt int64 `snek:"immutable"`
+	}
+	String string
+}
+
+func TestImmutableFields(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		controlled := 0
+		s.must(Register(s.Snek, &immutableTestStruct{}, UncontrolledQueries, func(u *Update, prev, next *immutableTestStruct) error {
+			controlled++
+			return nil
+		}))
+		ts := &immutableTestStruct{ID: s.NewID(), OwnerID: s.NewID(), String: "a"}
+		ts.Inner.CreatedAt = 1
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		ts.String = "b"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts)
+		}))
+		changed := *ts
+		changed.OwnerID = s.NewID()
+		immutableErr := &ImmutableFieldError{}
+		if err := s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(&changed)
+		}); !errors.As(err, &immutableErr) || immutableErr.Field != "OwnerID" {
+			t.Errorf("got %v, wanted ImmutableFieldError for OwnerID", err)
+		}
+		changed = *ts
+		changed.Inner.CreatedAt = 2
+		if err := s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(&changed, "Inner.CreatedAt")
+		}); !errors.As(err, &immutableErr) || immutableErr.Field != "Inner.CreatedAt" {
+			t.Errorf("got %v, wanted ImmutableFieldError for Inner.CreatedAt", err)
+		}
+		if controlled != 2 {
+			t.Errorf("got %v controlled updates, wanted 2", controlled)
+		}
+		got := &immutableTestStruct{ID: ts.ID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(got)
+		}))
+		if !reflect.DeepEqual(got, ts) {
+			t.Errorf("got %+v, wanted %+v", got, ts)
+		}
+		indexed := 0
+		s.must(s.View(SystemCaller{}, func(v *View) error {
+			return v.tx.Get(&indexed, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'immutableTestStruct.OwnerID';")
+		}))
+		if indexed != 1 {
+			t.Errorf("wanted index on OwnerID")
+		}
+	})
+}
+
+type relationGroup struct {
+	ID ID
+}
+
+func (r relationGroup) Relations() []Relation {
+	return []Relation{
+		{Type: &relationBan{}, Field: "GroupID", Policy: Restrict},
+		{Type: &relationMember{}, Field: "GroupID", Policy: Cascade},
+	}
+}
+
+type relationMember struct {
+	ID       ID
+	GroupID  ID `snek:"index"`
+	Readonly bool
+}
+
+type relationBan struct {
+	ID      ID
+	GroupID ID
+}
+
+type relationNode struct {
+	ID       ID
+	ParentID ID
+}
+
+func (r *relationNode) Relations() []Relation {
+	return []Relation{{Type: &relationNode{}, Field: "ParentID", Policy: Cascade}}
+}
+
+func TestRelations(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &relationGroup{}, UncontrolledQueries, UncontrolledUpdates(&relationGroup{})))
+		removedMembers := 0
+		s.must(Register(s.Snek, &relationMember{}, UncontrolledQueries, func(u *Update, prev, next *relationMember) error {
+			if next == nil {
+				if prev.Readonly {
+					return fmt.Errorf("readonly member")
+				}
+				removedMembers++
+			}
+			return nil
+		}))
+		s.must(Register(s.Snek, &relationBan{}, UncontrolledQueries, UncontrolledUpdates(&relationBan{})))
+		s.must(Register(s.Snek, &relationNode{}, UncontrolledQueries, UncontrolledUpdates(&relationNode{})))
+		count := func(structPointer any) int {
+			result := 0
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				var err error
+				result, err = v.Count(structPointer, nil)
+				return err
+			}))
+			return result
+		}
+
+		group := &relationGroup{ID: s.NewID()}
+		otherGroup := &relationGroup{ID: s.NewID()}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, structPointer := range []any{
+				group,
+				otherGroup,
+				&relationMember{ID: s.NewID(), GroupID: group.ID},
+				&relationMember{ID: s.NewID(), GroupID: group.ID},
+				&relationMember{ID: s.NewID(), GroupID: otherGroup.ID},
+			} {
+				if err := u.Insert(structPointer); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(group)
+		}))
+		if removedMembers != 2 || count(&relationGroup{}) != 1 || count(&relationMember{}) != 1 {
+			t.Errorf("got %v removed members, %v groups, and %v members, wanted 2, 1, and 1", removedMembers, count(&relationGroup{}), count(&relationMember{}))
+		}
+
+		ban := &relationBan{ID: s.NewID(), GroupID: otherGroup.ID}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ban)
+		}))
+		restrictedErr := &RestrictedRemoveError{}
+		if err := s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(otherGroup)
+		}); !errors.As(err, &restrictedErr) || restrictedErr.ReferringTypeName != "relationBan" {
+			t.Errorf("got %v, wanted RestrictedRemoveError", err)
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Remove(ban); err != nil {
+				return err
+			}
+			return u.Insert(&relationMember{ID: s.NewID(), GroupID: otherGroup.ID, Readonly: true})
+		}))
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(otherGroup)
+		}))
+		if count(&relationGroup{}) != 1 || count(&relationMember{}) != 2 {
+			t.Errorf("got %v groups and %v members, wanted failed removal to roll back", count(&relationGroup{}), count(&relationMember{}))
+		}
+
+		root := &relationNode{ID: s.NewID(), ParentID: s.NewID()}
+		child := &relationNode{ID: s.NewID(), ParentID: root.ID}
+		grandChild := &relationNode{ID: s.NewID(), ParentID: child.ID}
+		cycleA := &relationNode{ID: s.NewID()}
+		cycleB := &relationNode{ID: s.NewID(), ParentID: cycleA.ID}
+		cycleA.ParentID = cycleB.ID
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, node := range []*relationNode{root, child, grandChild, cycleA, cycleB} {
+				if err := u.Insert(node); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(root)
+		}))
+		if got := count(&relationNode{}); got != 2 {
+			t.Errorf("got %v nodes, wanted 2", got)
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(cycleA)
+		}))
+		if got := count(&relationNode{}); got != 0 {
+			t.Errorf("got %v nodes, wanted 0", got)
+		}
+	})
+}
+
+func TestThrottledSubscription(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		events := make(chan *testStruct, 10)
+		withEvents := func(subscriber Subscriber) Subscriber {
+			return WithEvents(subscriber, func(structPointer any) error {
+				events <- structPointer.(*testStruct)
+				return nil
+			})
+		}
+		// Throttling works whether or not it's wrapped by WithEvents.
+		for _, wrap := range []func(Subscriber) Subscriber{
+			func(subscriber Subscriber) Subscriber { return Throttled(subscriber, 200*time.Millisecond) },
+			func(subscriber Subscriber) Subscriber { return withEvents(Throttled(subscriber, 200*time.Millisecond)) },
+		} {
+			counts := make(chan int, 100)
+			sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{}, wrap(CountSubscriber[testStruct](func(count int, initial bool, err error) error {
+				if err != nil {
+					return err
+				}
+				counts <- count
+				return nil
+			})))
+			s.must(err)
+			initialCount := <-counts
+			for i := 0; i < 10; i++ {
+				s.must(s.Update(AnonCaller{}, func(u *Update) error {
+					return u.Insert(&testStruct{ID: s.NewID()})
+				}))
+			}
+			started := time.Now()
+			deliveries := 0
+			for count := initialCount; count != initialCount+10; {
+				select {
+				case count = <-counts:
+					deliveries++
+				case <-time.After(time.Second):
+					t.Fatalf("got %v deliveries, the last with count %v, wanted the final count %v", deliveries, count, initialCount+10)
+				}
+			}
+			if deliveries > 2 {
+				t.Errorf("got %v deliveries of 10 changes, wanted them coalesced", deliveries)
+			}
+			if elapsed := time.Since(started); elapsed < 100*time.Millisecond {
+				t.Errorf("got the final count after %v, wanted it throttled", elapsed)
+			}
+			sub.Close()
+		}
+		sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{}, withEvents(Throttled(CountSubscriber[testStruct](func(int, bool, error) error { return nil }), time.Second)))
+		s.must(err)
+		defer sub.Close()
+		published := &testStruct{ID: s.NewID()}
+		s.must(s.Publish(published, nil))
+		select {
+		case got := <-events:
+			if !got.ID.Equal(published.ID) {
+				t.Errorf("got %+v, wanted %+v", got, published)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("got no event")
+		}
+	})
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	withModifiedSnek(t, func(opts *Options) {
+		opts.Now = func() time.Time {
+			return now
+		}
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			query.Set = And{query.Set, Cond{"String", NE, "secret"}}
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		ts := &testStruct{ID: s.NewID(), String: "a"}
+		if _, err := AsOf[testStruct](s.Snek, AnonCaller{}, ts.ID, now); err == nil {
+			t.Errorf("wanted error for type without history")
+		}
+		s.must(RegisterHistory[testStruct](s.Snek))
+		inserted := now
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		now = now.Add(time.Hour)
+		updated := now
+		ts.String = "b"
+		ts.Inner.Float = 1
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts)
+		}))
+		now = now.Add(time.Hour)
+		fieldsUpdated := now
+		ts.Int = 3
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(ts, "Int")
+		}))
+		// Versions written at the same time are ordered by when they were written.
+		ts.String = "secret"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts)
+		}))
+		now = now.Add(time.Hour)
+		removed := now
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(ts)
+		}))
+		for _, tc := range []struct {
+			at         time.Time
+			wantString string
+			wantInt    int32
+			wantFloat  float64
+		}{
+			{at: inserted, wantString: "a"},
+			{at: updated.Add(-time.Millisecond), wantString: "a"},
+			{at: updated, wantString: "b", wantFloat: 1},
+			{at: fieldsUpdated.Add(-time.Minute).In(time.FixedZone("east", 3600)), wantString: "b", wantFloat: 1},
+		} {
+			got, err := AsOf[testStruct](s.Snek, AnonCaller{}, ts.ID, tc.at)
+			if err != nil || got.String != tc.wantString || got.Int != tc.wantInt || got.Inner.Float != tc.wantFloat {
+				t.Errorf("AsOf(%v) got %+v, %v, wanted String %q, Int %v, and Float %v", tc.at, got, err, tc.wantString, tc.wantInt, tc.wantFloat)
+			}
+		}
+		for _, at := range []time.Time{inserted.Add(-time.Second), fieldsUpdated, removed} {
+			if got, err := AsOf[testStruct](s.Snek, AnonCaller{}, ts.ID, at); !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("AsOf(%v) got %+v, %v, wanted sql.ErrNoRows", at, got, err)
+			}
+		}
+		got, err := AsOf[testStruct](s.Snek, SystemCaller{}, ts.ID, fieldsUpdated)
+		if err != nil || got.String != "secret" || got.Int != 3 {
+			t.Errorf("got %+v, %v, wanted the secret version for the system caller", got, err)
+		}
+	})
+}
+
+func TestInterpolateSQL(t *testing.T) {
+	bigIntValue, err := NewBigInt(-1).Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		query  string
+		params []any
+		want   string
+	}{
+		{query: `SELECT * FROM "a?" WHERE "x" = ? AND "y" = ?;`, params: []any{"it's", ID{1, 171}}, want: `SELECT * FROM "a?" WHERE "x" = 'it''s' AND "y" = X'01ab';`},
+		{query: `VALUES (?, ?, ?, ?, ?)`, params: []any{nil, true, int32(-3), 1.5, NewBigInt(-1)}, want: fmt.Sprintf("VALUES (NULL, TRUE, -3, 1.5, '%s')", bigIntValue)},
+		{query: `SELECT '?', ?`, params: []any{false}, want: `SELECT '?', FALSE`},
+		{query: `SELECT ?, ?`, params: []any{1}, want: `SELECT 1, ?`},
+	} {
+		if got := interpolateSQL(tc.query, tc.params); got != tc.want {
+			t.Errorf("interpolateSQL(%q, %+v) got %q, wanted %q", tc.query, tc.params, got, tc.want)
+		}
+	}
+	buf := &bytes.Buffer{}
+	withModifiedSnek(t, func(opts *Options) {
+		opts.Logger = log.New(buf, "", 0)
+		opts.LogSQL = true
+		opts.LogInterpolatedSQL = true
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		ts := &testStruct{ID: s.NewID(), String: "it's"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		buf.Reset()
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&[]testStruct{}, &Query{Set: And{Cond{"String", EQ, "it's"}, Cond{"ID", EQ, ts.ID}}})
+		}))
+		_, interpolated, found := strings.Cut(buf.String(), "Interpolated:\n")
+		if !found {
+			t.Fatalf("got %q, wanted interpolated SQL", buf.String())
+		}
+		// The interpolated SQL is copy-pasteable, and selects the same structs.
+		got := []testStruct{}
+		s.must(s.db.Select(&got, interpolated))
+		if len(got) != 1 || !got[0].ID.Equal(ts.ID) {
+			t.Errorf("got %+v, wanted %+v", got, ts)
+		}
+	})
+}
+
+type normalizedTestStruct struct {
+	ID     ID
+	Name   string `snek:"nfc,unique"`
+	Handle string `snek:"casefold"`
+	Plain  string
+}
+
+func TestTextNormalization(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &normalizedTestStruct{}, UncontrolledQueries, func(u *Update, prev, next *normalizedTestStruct) error {
+			if next != nil && next.Name != norm.NFC.String(next.Name) {
+				return fmt.Errorf("update control got unnormalized %q", next.Name)
+			}
+			return nil
+		}))
+		decomposed, composed := "Jose\u0301", "Jos\u00e9"
+		ts := &normalizedTestStruct{ID: s.NewID(), Name: decomposed, Handle: "Straße", Plain: decomposed}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		if ts.Name != composed || ts.Handle != "strasse" || ts.Plain != decomposed {
+			t.Errorf("got %+v, wanted Name and Handle normalized", ts)
+		}
+		uniqueErr := &UniqueConstraintError{}
+		if err := s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&normalizedTestStruct{ID: s.NewID(), Name: composed})
+		}); !errors.As(err, &uniqueErr) {
+			t.Errorf("got %v, wanted UniqueConstraintError", err)
+		}
+		for _, set := range []Set{
+			Cond{"Name", EQ, decomposed},
+			Cond{"Name", EQ, composed},
+			Cond{"Handle", EQ, "STRASSE"},
+			And{Cond{"Handle", GE, "Strasse"}, Cond{"Plain", EQ, decomposed}},
+		} {
+			got := []normalizedTestStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&got, &Query{Set: set})
+			}))
+			if len(got) != 1 || !reflect.DeepEqual(&got[0], ts) {
+				t.Errorf("selecting %+v got %+v, wanted %+v", set, got, ts)
+			}
+		}
+		got := []normalizedTestStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&got, &Query{Set: Cond{"Plain", EQ, composed}})
+		}))
+		if len(got) != 0 {
+			t.Errorf("got %+v, wanted untagged fields to be compared unnormalized", got)
+		}
+		ts.Handle = "ÅSA"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(ts, "Handle")
+		}))
+		if ts.Handle != "åsa" {
+			t.Errorf("got %q, wanted åsa", ts.Handle)
+		}
+		// Combined normalizations are applied consistently, with case folding winning.
+		s.must(Register(s.Snek, &combinedNormalizationTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&combinedNormalizationTestStruct{})))
+		for i := 0; i < 20; i++ {
+			combined := &combinedNormalizationTestStruct{ID: s.NewID(), Name: "ABC"}
+			s.must(s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(combined)
+			}))
+			if combined.Name != "abc" {
+				t.Fatalf("got %q, wanted abc", combined.Name)
+			}
+		}
+	})
+}
+
+type combinedNormalizationTestStruct struct {
+	ID   ID
+	Name string `snek:"nfc,casefold"`
+}
+
+func TestReadPath(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.ReadPath = fmt.Sprintf("file:%s?mode=ro", opts.Path)
+		opts.Path = fmt.Sprintf("file:%s?_journal_mode=WAL", opts.Path)
+	}, func(s *testSnek) {
+		if s.readDB == s.db {
+			t.Fatalf("wanted separate read pool")
+		}
+		if _, err := s.readDB.Exec("CREATE TABLE \"written\" (\"ID\" BLOB PRIMARY KEY);"); err == nil {
+			t.Errorf("wanted read pool to be read-only")
+		}
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		counts := make(chan int, 10)
+		sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{}, CountSubscriber[testStruct](func(count int, initial bool, err error) error {
+			if err != nil {
+				return err
+			}
+			counts <- count
+			return nil
+		}))
+		s.must(err)
+		defer sub.Close()
+		if count := <-counts; count != 0 {
+			t.Errorf("got %v, wanted 0", count)
+		}
+		// With WAL journaling an open View doesn't block Updates, and keeps its snapshot.
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			before, err := v.Count(&testStruct{}, nil)
+			if err != nil {
+				return err
+			}
+			updated := make(chan error)
+			go func() {
+				updated <- s.Update(AnonCaller{}, func(u *Update) error {
+					return u.Insert(&testStruct{ID: s.NewID()})
+				})
+			}()
+			if err := <-updated; err != nil {
+				return err
+			}
+			after, err := v.Count(&testStruct{}, nil)
+			if err != nil {
+				return err
+			}
+			if before != 0 || after != 0 {
+				t.Errorf("got %v and %v, wanted the View to keep its snapshot", before, after)
+			}
+			return nil
+		}))
+		if count := <-counts; count != 1 {
+			t.Errorf("got %v, wanted 1", count)
+		}
+	})
+}
+
+func TestWatch(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			if !v.Caller().IsAdmin() {
+				query.Set = And{query.Set, Cond{"Bool", EQ, true}}
+			}
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		all, closeAll := Watch[testStruct](s.Snek, testCaller{isAdmin: true}, 10)
+		visible, closeVisible := Watch[testStruct](s.Snek, testCaller{}, 10)
+		defer closeVisible()
+		receive := func(changes <-chan Change[testStruct], wantPrev, wantNext *testStruct) {
+			t.Helper()
+			select {
+			case change, ok := <-changes:
+				if !ok || !reflect.DeepEqual(change.Prev, wantPrev) || !reflect.DeepEqual(change.Next, wantNext) {
+					t.Errorf("got %+v, %v, wanted %+v => %+v", change, ok, wantPrev, wantNext)
+				}
+			default:
+				t.Errorf("got no change, wanted %+v => %+v", wantPrev, wantNext)
+			}
+		}
+		ts := &testStruct{ID: s.NewID(), String: "a"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		inserted := *ts
+		receive(all, nil, &inserted)
+		ts.Bool = true
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts)
+		}))
+		updated := *ts
+		receive(all, &inserted, &updated)
+		receive(visible, nil, &updated)
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Remove(ts); err != nil {
+				return err
+			}
+			return fmt.Errorf("rolled back")
+		}))
+		ts.String = "b"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(ts, "String")
+		}))
+		fieldsUpdated := *ts
+		receive(all, &updated, &fieldsUpdated)
+		receive(visible, &updated, &fieldsUpdated)
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(ts)
+		}))
+		receive(all, &fieldsUpdated, nil)
+		receive(visible, &fieldsUpdated, nil)
+		if len(all) != 0 || len(visible) != 0 {
+			t.Errorf("got %v and %v more changes, wanted none", len(all), len(visible))
+		}
+		closeAll()
+		if _, ok := <-all; ok {
+			t.Errorf("wanted closed channel")
+		}
+		closeAll()
+
+		slow, closeSlow := Watch[testStruct](s.Snek, testCaller{isAdmin: true}, 1)
+		defer closeSlow()
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(&testStruct{ID: s.NewID()}); err != nil {
+				return err
+			}
+			return u.Insert(&testStruct{ID: s.NewID()})
+		}))
+		if _, ok := <-slow; !ok {
+			t.Errorf("wanted the buffered change")
+		}
+		if _, ok := <-slow; ok {
+			t.Errorf("wanted the watch closed after its buffer filled")
+		}
+	})
+}
+
+func TestIncompatibleCond(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID(), String: "1", Int: 1})
+		}))
+		for _, set := range []Set{
+			Cond{"String", EQ, 1},
+			Cond{"String", EQ, NewBigInt(1)},
+			Cond{"Int", EQ, "1"},
+			Cond{"Bool", EQ, 1},
+			Cond{"ID", EQ, "id"},
+			Cond{"Int", HASBIT, 1.5},
+			Or{Cond{"Int", EQ, 1}, And{Cond{"Inner.Float", GT, "0"}}},
+		} {
+			res := []testStruct{}
+			err := s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&res, &Query{Set: set})
+			})
+			incompatible := &IncompatibleCondError{}
+			if !errors.As(err, &incompatible) {
+				t.Errorf("got %v for %v, wanted IncompatibleCondError", err, set)
+			}
+		}
+		res := []testStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&res, &Query{Set: And{Cond{"String", EQ, "1"}, Cond{"Int", LT, 1.5}, Cond{"Inner.Float", LT, 1}}})
+		}))
+		if len(res) != 1 {
+			t.Errorf("got %+v, wanted one match", res)
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.Path = fmt.Sprintf("file:%s?_journal_mode=WAL", opts.Path)
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		insert := func() error {
+			updated := make(chan error)
+			go func() {
+				updated <- s.Update(AnonCaller{}, func(u *Update) error {
+					return u.Insert(&testStruct{ID: s.NewID()})
+				})
+			}()
+			return <-updated
+		}
+		// A View reads the snapshot of its first query, so it sees commits made before that.
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			if err := insert(); err != nil {
+				return err
+			}
+			count, err := v.Count(&testStruct{}, nil)
+			if err != nil {
+				return err
+			}
+			if count != 1 {
+				t.Errorf("got %v, wanted 1", count)
+			}
+			return nil
+		}))
+		// A Snapshot reads the snapshot of when it started, so it sees no commits made after that.
+		s.must(s.Snapshot(AnonCaller{}, func(v *View) error {
+			if err := insert(); err != nil {
+				return err
+			}
+			before, err := v.Count(&testStruct{}, nil)
+			if err != nil {
+				return err
+			}
+			if err := insert(); err != nil {
+				return err
+			}
+			after, err := v.Count(&testStruct{}, nil)
+			if err != nil {
+				return err
+			}
+			if before != 1 || after != 1 {
+				t.Errorf("got %v and %v, wanted 1 and 1", before, after)
+			}
+			return nil
+		}))
+		s.must(s.Snapshot(AnonCaller{}, func(v *View) error {
+			count, err := v.Count(&testStruct{}, nil)
+			if err != nil {
+				return err
+			}
+			if count != 3 {
+				t.Errorf("got %v, wanted 3", count)
+			}
+			return nil
+		}))
+	})
+}
+
+type testStructSummary struct {
+	ID     ID
+	String string
+	Inner  innerTestStruct
+}
+
+func TestSelectInto(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			query.Set = And{query.Set, Cond{"Bool", EQ, true}}
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		visible := &testStruct{ID: s.NewID(), Int: 1, String: "visible", Bool: true, Inner: innerTestStruct{Float: 1.5}}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(visible); err != nil {
+				return err
+			}
+			return u.Insert(&testStruct{ID: s.NewID(), Int: 2, String: "hidden"})
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			res, err := SelectInto[testStructSummary](v, reflect.TypeOf(testStruct{}), &Query{Set: Cond{"Int", GT, 0}})
+			if err != nil {
+				return err
+			}
+			want := []testStructSummary{{ID: visible.ID, String: "visible", Inner: innerTestStruct{Float: 1.5}}}
+			if !reflect.DeepEqual(res, want) {
+				t.Errorf("got %+v, wanted %+v", res, want)
+			}
+			if _, err := SelectInto[struct{ Missing string }](v, reflect.TypeOf(testStruct{}), nil); err == nil {
+				t.Errorf("wanted an error for fields missing in the source type")
+			}
+			if _, err := SelectInto[struct{ Int string }](v, reflect.TypeOf(testStruct{}), nil); err == nil {
+				t.Errorf("wanted an error for fields stored differently in the source type")
+			}
+			return nil
+		}))
+	})
+}
+
+type readOnlyTestStruct struct {
+	ID ID
+}
+
+func TestRegisteredTypes(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		if got := s.RegisteredTypes(); len(got) != 0 {
+			t.Errorf("got %v, wanted no types", got)
+		}
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(Register(s.Snek, &readOnlyTestStruct{}, UncontrolledQueries, nil))
+		s.must(RegisterHistory[testStruct](s.Snek))
+		if got, want := s.RegisteredTypes(), []string{"readOnlyTestStruct", "testStruct"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, found := s.Registration("testStruct"); !found || !reflect.DeepEqual(got, TypeRegistration{Name: "testStruct", QueryControl: true, UpdateControl: true, History: true}) {
+			t.Errorf("got %+v, %v", got, found)
+		}
+		if got, found := s.Registration("readOnlyTestStruct"); !found || !reflect.DeepEqual(got, TypeRegistration{Name: "readOnlyTestStruct", QueryControl: true}) {
+			t.Errorf("got %+v, %v", got, found)
+		}
+		if err := s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&readOnlyTestStruct{})
+		}); !errors.As(err, new(*NotRegisteredError)) {
+			t.Errorf("got %v, wanted NotRegisteredError", err)
+		}
+		if _, found := s.Registration("otherTestStruct"); found {
+			t.Errorf("wanted otherTestStruct not to be registered")
+		}
+	})
+}
+
+type testLink struct {
+	GroupID ID
+	UserID  ID
+	Role    string
+}
+
+func (t testLink) PrimaryKey() []string {
+	return []string{"GroupID", "UserID"}
+}
+
+type hookedTestLink struct {
+	GroupID ID
+	UserID  ID
+	Role    string
+	Name    string `snek:"casefold"`
+}
+
+func (h hookedTestLink) PrimaryKey() []string {
+	return []string{"GroupID", "UserID"}
+}
+
+func (h *hookedTestLink) BeforeSave() error {
+	h.Role = strings.ToUpper(h.Role)
+	return nil
+}
+
+func TestCompositePrimaryKey(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		// Changes made before storing are stored for composite keys too.
+		s.must(Register(s.Snek, &hookedTestLink{}, UncontrolledQueries, UncontrolledUpdates(&hookedTestLink{})))
+		hooked := &hookedTestLink{GroupID: s.NewID(), UserID: s.NewID(), Role: "member", Name: "Name"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(hooked)
+		}))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(&hookedTestLink{GroupID: hooked.GroupID, UserID: hooked.UserID, Role: "owner", Name: "HELLO"})
+		}))
+		storedLink := &hookedTestLink{GroupID: hooked.GroupID, UserID: hooked.UserID}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(storedLink)
+		}))
+		if storedLink.Role != "OWNER" || storedLink.Name != "hello" {
+			t.Errorf("got %+v, wanted Role OWNER and Name hello", storedLink)
+		}
+
+		s.must(Register(s.Snek, &testLink{}, UncontrolledQueries, UncontrolledUpdates(&testLink{})))
+		group, user1, user2 := s.NewID(), s.NewID(), s.NewID()
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(&testLink{GroupID: group, UserID: user1, Role: "owner"}); err != nil {
+				return err
+			}
+			return u.Insert(&testLink{GroupID: group, UserID: user2, Role: "member"})
+		}))
+		if err := s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&testLink{GroupID: group, UserID: user1})
+		}); !errors.As(err, new(*UniqueConstraintError)) {
+			t.Errorf("got %v, wanted UniqueConstraintError", err)
+		}
+		get := func(userID ID) *testLink {
+			result := &testLink{GroupID: group, UserID: userID}
+			if err := s.View(AnonCaller{}, func(v *View) error {
+				return v.Get(result)
+			}); err != nil {
+				return nil
+			}
+			return result
+		}
+		if got := get(user2); got == nil || got.Role != "member" {
+			t.Errorf("got %+v, wanted member", got)
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(&testLink{GroupID: group, UserID: user2, Role: "admin"})
+		}))
+		if got := get(user2); got == nil || got.Role != "admin" {
+			t.Errorf("got %+v, wanted admin", got)
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(&testLink{GroupID: group, UserID: user2, Role: "member"}, "Role")
+		}))
+		if got := get(user2); got == nil || got.Role != "member" {
+			t.Errorf("got %+v, wanted member", got)
+		}
+		if got := get(user1); got == nil || got.Role != "owner" {
+			t.Errorf("got %+v, wanted owner to be unaffected", got)
+		}
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(&testLink{GroupID: group, UserID: user2}, "UserID")
+		}))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(&testLink{GroupID: group, UserID: user1})
+		}))
+		if got := get(user1); got != nil {
+			t.Errorf("got %+v, wanted it removed", got)
+		}
+		if got := get(user2); got == nil {
+			t.Errorf("wanted the other link to remain")
+		}
+		s.mustNot(RegisterHistory[testLink](s.Snek))
+	})
+}
+
+func TestSelectJoinCounts(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(Register(s.Snek, &testLink{}, func(v *View, query *Query) error {
+			query.Set = And{query.Set, Cond{"Role", NE, "hidden"}}
+			return nil
+		}, UncontrolledUpdates(&testLink{})))
+		groups := []*testStruct{{ID: s.NewID(), String: "a"}, {ID: s.NewID(), String: "b"}, {ID: s.NewID(), String: "c"}, {ID: s.NewID(), String: "d"}}
+		links := []*testLink{
+			{GroupID: groups[1].ID, UserID: s.NewID(), Role: "member"},
+			{GroupID: groups[1].ID, UserID: s.NewID(), Role: "member"},
+			{GroupID: groups[1].ID, UserID: s.NewID(), Role: "banned"},
+			{GroupID: groups[2].ID, UserID: s.NewID(), Role: "member"},
+			{GroupID: groups[2].ID, UserID: s.NewID(), Role: "hidden"},
+			{GroupID: groups[3].ID, UserID: s.NewID(), Role: "member"},
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, group := range groups {
+				if err := u.Insert(group); err != nil {
+					return err
+				}
+			}
+			for _, link := range links {
+				if err := u.Insert(link); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			res, err := SelectJoinCounts[testStruct](v, NewJoin(&testLink{}, Cond{"Role", NE, "banned"}, []On{{"ID", EQ, "GroupID"}}), &Query{Order: []Order{{Field: "String"}}}, true)
+			if err != nil {
+				return err
+			}
+			got := []string{}
+			for _, count := range res {
+				got = append(got, fmt.Sprintf("%s:%d", count.Struct.String, count.Count))
+			}
+			if want := []string{"b:2", "c:1", "d:1", "a:0"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			if !res[0].Struct.ID.Equal(groups[1].ID) {
+				t.Errorf("got %+v, wanted %+v", res[0].Struct, groups[1])
+			}
+			res, err = SelectJoinCounts[testStruct](v, NewJoin(&testLink{}, nil, []On{{"ID", EQ, "GroupID"}}), &Query{Set: Cond{"String", NE, "b"}, Order: []Order{{Field: "String", Desc: true}}, Limit: 2}, false)
+			if err != nil {
+				return err
+			}
+			got = []string{}
+			for _, count := range res {
+				got = append(got, fmt.Sprintf("%s:%d", count.Struct.String, count.Count))
+			}
+			if want := []string{"a:0", "d:1"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestReloadWindows(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.ReloadWindows = map[string]time.Duration{"testStruct": 200 * time.Millisecond}
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		counts := []chan int{make(chan int, 100), make(chan int, 100)}
+		for _, loopCounts := range counts {
+			counts := loopCounts
+			sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{}, CountSubscriber[testStruct](func(count int, initial bool, err error) error {
+				if err != nil {
+					return err
+				}
+				counts <- count
+				return nil
+			}))
+			s.must(err)
+			defer sub.Close()
+			if count := <-counts; count != 0 {
+				t.Errorf("got %v, wanted 0", count)
+			}
+		}
+		for i := 0; i < 50; i++ {
+			s.must(s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(&testStruct{ID: s.NewID()})
+			}))
+		}
+		for _, counts := range counts {
+			deliveries := 0
+			for count := 0; count != 50; {
+				select {
+				case count = <-counts:
+					deliveries++
+				case <-time.After(time.Second):
+					t.Fatalf("got %v deliveries, the last with count %v, wanted the final count 50", deliveries, count)
+				}
+			}
+			if deliveries > 3 {
+				t.Errorf("got %v deliveries of 50 updates, wanted them coalesced", deliveries)
+			}
+		}
+	})
+}
+
+func TestIndexedBy(t *testing.T) {
+	stats := []QueryStats{}
+	withModifiedSnek(t, func(opts *Options) {
+		opts.QueryObserver = func(s QueryStats) {
+			stats = append(stats, s)
+		}
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(&testStruct{ID: s.NewID(), Int: 1, String: "a"}); err != nil {
+				return err
+			}
+			return u.Insert(&testStruct{ID: s.NewID(), Int: 2, String: "b"})
+		}))
+		res := []testStruct{}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&res, &Query{Set: Cond{"String", EQ, "b"}})
+		}))
+		if len(stats) != 1 || len(stats[0].FullScans) != 1 {
+			t.Errorf("got %+v, wanted a full scan without a hint", stats)
+		}
+		stats = nil
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&res, &Query{Set: Cond{"String", EQ, "b"}, IndexedBy: "testStruct.Int"})
+		}))
+		if len(res) != 1 || res[0].Int != 2 {
+			t.Errorf("got %+v, wanted the struct with Int 2", res)
+		}
+		if len(stats) != 1 || len(stats[0].FullScans) != 0 || !strings.Contains(stats[0].SQL, `INDEXED BY "testStruct.Int"`) {
+			t.Errorf("got %+v, wanted the index to be used", stats)
+		}
+		if err := s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&res, &Query{IndexedBy: "testStruct.String"})
+		}); err == nil {
+			t.Errorf("wanted an error for a missing index")
+		}
+	})
+}
+
+type generatedTestStruct struct {
+	ID         ID
+	Name       string
+	LowerName  string `snek:"index"`
+	NameLength int
+}
+
+func (g generatedTestStruct) GeneratedColumns() map[string]string {
+	return map[string]string{
+		"LowerName":  `lower("Name")`,
+		"NameLength": `length("Name")`,
+	}
+}
+
+type badGeneratedTestStruct struct {
+	ID ID
+}
+
+func (b badGeneratedTestStruct) GeneratedColumns() map[string]string {
+	return map[string]string{"Missing": "1"}
+}
+
+func TestGeneratedColumns(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.mustNot(Register(s.Snek, &badGeneratedTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&badGeneratedTestStruct{})))
+		s.must(Register(s.Snek, &generatedTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&generatedTestStruct{})))
+		s.must(RegisterHistory[generatedTestStruct](s.Snek))
+		results := make(chan []generatedTestStruct, 10)
+		sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{Set: Cond{"LowerName", EQ, "hello"}}, TypedSubscriber(func(res []generatedTestStruct, err error) error {
+			results <- res
+			return err
+		}))
+		s.must(err)
+		defer sub.Close()
+		if res := <-results; len(res) != 0 {
+			t.Errorf("got %+v, wanted no results", res)
+		}
+		short := &generatedTestStruct{ID: s.NewID(), Name: "HeLLo", LowerName: "ignored"}
+		long := &generatedTestStruct{ID: s.NewID(), Name: "Goodbye"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(long); err != nil {
+				return err
+			}
+			return u.Insert(short)
+		}))
+		if short.LowerName != "hello" || short.NameLength != 5 {
+			t.Errorf("got %+v, wanted the generated fields computed after insert", short)
+		}
+		// Subscriptions are matched against the computed values.
+		select {
+		case res := <-results:
+			if len(res) != 1 || res[0].Name != "HeLLo" {
+				t.Errorf("got %+v, wanted %+v", res, short)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got no delivery for a struct matching a condition on a generated field")
+		}
+		selectNames := func(query *Query) []string {
+			res := []generatedTestStruct{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&res, query)
+			}))
+			names := []string{}
+			for _, r := range res {
+				names = append(names, fmt.Sprintf("%s/%s/%d", r.Name, r.LowerName, r.NameLength))
+			}
+			return names
+		}
+		if got, want := selectNames(&Query{Set: Cond{"LowerName", EQ, "hello"}}), []string{"HeLLo/hello/5"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := selectNames(&Query{Order: []Order{{Field: "NameLength", Desc: true}}}), []string{"Goodbye/goodbye/7", "HeLLo/hello/5"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(&generatedTestStruct{ID: short.ID, Name: "Hi"}, "Name")
+		}))
+		if got, want := selectNames(&Query{Set: Cond{"NameLength", LT, 5}}), []string{"Hi/hi/2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		s.mustNot(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(&generatedTestStruct{ID: short.ID, LowerName: "x"}, "LowerName")
+		}))
+		version, err := AsOf[generatedTestStruct](s.Snek, AnonCaller{}, short.ID, time.Now())
+		s.must(err)
+		if version == nil || version.LowerName != "hi" {
+			t.Errorf("got %+v, wanted the generated field in the history", version)
+		}
+	})
+}
+
+func TestCloseInterruptsLoad(t *testing.T) {
+	loads := make(chan QueryStats, 10)
+	withModifiedSnek(t, func(opts *Options) {
+		opts.QueryObserver = func(stats QueryStats) {
+			loads <- stats
+		}
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID()})
+		}))
+		// Ordering by an expensive expression makes the load take many seconds.
+		slow := Order{Expression: "(WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c LIMIT 1000000000) SELECT COUNT(*) FROM c)"}
+		delivered := make(chan error, 1)
+		sub, err := Subscribe(s.Snek, testCaller{isAdmin: true}, &Query{Order: []Order{slow}}, TypedSubscriber(func(res []testStruct, err error) error {
+			delivered <- err
+			return nil
+		}))
+		s.must(err)
+		time.Sleep(50 * time.Millisecond)
+		s.must(sub.Close())
+		select {
+		case stats := <-loads:
+			if stats.Err == nil {
+				t.Errorf("got %+v, wanted the load interrupted", stats)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("wanted the load interrupted when the subscription closed")
+		}
+		select {
+		case err := <-delivered:
+			t.Errorf("got delivery %v, wanted nothing delivered after closing", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestIn(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testLink{}, UncontrolledQueries, UncontrolledUpdates(&testLink{})))
+		group1, group2, user1, user2 := s.NewID(), s.NewID(), s.NewID(), s.NewID()
+		links := []*testLink{
+			{GroupID: group1, UserID: user1, Role: "a"},
+			{GroupID: group1, UserID: user2, Role: "b"},
+			{GroupID: group2, UserID: user1, Role: "c"},
+			{GroupID: group2, UserID: user2, Role: "d"},
+		}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, link := range links {
+				if err := u.Insert(link); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		in := In{Fields: []string{"GroupID", "UserID"}, Values: [][]any{{group1, user2}, {group2, user1}}}
+		notIn, err := in.Invert()
+		s.must(err)
+		for _, tc := range []struct {
+			set   Set
+			roles string
+		}{
+			{set: in, roles: "bc"},
+			{set: notIn, roles: "ad"},
+			{set: In{Fields: []string{"GroupID", "UserID"}}, roles: ""},
+			{set: And{In{Fields: []string{"UserID"}, Values: [][]any{{user1}}}, Cond{"Role", NE, "a"}}, roles: "c"},
+		} {
+			got := []testLink{}
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&got, &Query{Set: tc.set, Order: []Order{{Field: "Role"}}})
+			}))
+			roles := ""
+			for _, link := range got {
+				roles += link.Role
+			}
+			if roles != tc.roles {
+				t.Errorf("got %q with %+v, wanted %q", roles, tc.set, tc.roles)
+			}
+			matched := ""
+			for _, link := range links {
+				if matches, err := tc.set.Matches(*link); err != nil {
+					t.Fatal(err)
+				} else if matches {
+					matched += link.Role
+				}
+			}
+			if matched != tc.roles {
+				t.Errorf("matched %q with %+v, wanted %q", matched, tc.set, tc.roles)
+			}
+		}
+		if err := s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&[]testLink{}, &Query{Set: In{Fields: []string{"GroupID", "UserID"}, Values: [][]any{{group1}}}})
+		}); !errors.As(err, new(*InvalidArgumentError)) {
+			t.Errorf("got %v, wanted InvalidArgumentError for short tuple", err)
+		}
+		if err := s.View(AnonCaller{}, func(v *View) error {
+			return v.Select(&[]testLink{}, &Query{Set: In{Fields: []string{"GroupID", "Role"}, Values: [][]any{{group1, 1}}}})
+		}); !errors.As(err, new(*IncompatibleCondError)) {
+			t.Errorf("got %v, wanted IncompatibleCondError", err)
+		}
+	})
+}
+
+func TestNonFiniteFloats(t *testing.T) {
+	get := func(s *testSnek, id ID) *testStruct {
+		result := &testStruct{ID: id}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			return v.Get(result)
+		}))
+		return result
+	}
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+			if err := s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(&testStruct{ID: s.NewID(), Inner: innerTestStruct{Float: f}})
+			}); !errors.As(err, new(*NonFiniteFloatError)) {
+				t.Errorf("got %v inserting %v, wanted NonFiniteFloatError", err, f)
+			}
+		}
+		ts := &testStruct{ID: s.NewID(), String: "a"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		ts.Inner.Float = math.NaN()
+		if err := s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(ts, "Inner.Float")
+		}); !errors.As(err, new(*NonFiniteFloatError)) {
+			t.Errorf("got %v, wanted NonFiniteFloatError", err)
+		}
+		// Fields that aren't updated aren't checked.
+		ts.String = "b"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.UpdateFields(ts, "String")
+		}))
+		if got := get(s, ts.ID); got.String != "b" || got.Inner.Float != 0 {
+			t.Errorf("got %+v, wanted String b and Float 0", got)
+		}
+	})
+	withModifiedSnek(t, func(opts *Options) {
+		opts.NonFiniteFloats = AllowInfiniteFloats
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		ts := &testStruct{ID: s.NewID(), Inner: innerTestStruct{Float: math.Inf(-1)}}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		if got := get(s, ts.ID); !math.IsInf(got.Inner.Float, -1) {
+			t.Errorf("got %v, wanted -Inf", got.Inner.Float)
+		}
+		ts.Inner.Float = math.NaN()
+		if err := s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(ts)
+		}); !errors.As(err, new(*NonFiniteFloatError)) {
+			t.Errorf("got %v, wanted NonFiniteFloatError", err)
+		}
+	})
+	withModifiedSnek(t, func(opts *Options) {
+		opts.NonFiniteFloats = CoerceNonFiniteFloats
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		for _, tc := range []struct {
+			f    float64
+			want float64
+		}{
+			{f: math.NaN(), want: 0},
+			{f: math.Inf(1), want: math.MaxFloat64},
+			{f: math.Inf(-1), want: -math.MaxFloat64},
+		} {
+			ts := &testStruct{ID: s.NewID(), Inner: innerTestStruct{Float: tc.f}}
+			s.must(s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(ts)
+			}))
+			if ts.Inner.Float != tc.want {
+				t.Errorf("got %v in the inserted struct, wanted %v", ts.Inner.Float, tc.want)
+			}
+			if got := get(s, ts.ID); got.Inner.Float != tc.want {
+				t.Errorf("got %v, wanted %v", got.Inner.Float, tc.want)
+			}
+		}
+	})
+}
+
+func TestSetImplicationBoundaries(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		// No integers are greater than math.MaxInt64, so the empty set is included in, and excludes, anything.
+		s.mustTrue(Cond{"A", GT, math.MaxInt64}.Includes(Cond{"A", GE, math.MaxInt64}))
+		s.mustTrue(Cond{"A", GT, math.MaxInt64}.Excludes(Cond{"A", LT, math.MaxInt64}))
+		s.mustTrue(Cond{"A", LT, 1}.Excludes(Cond{"A", GT, math.MaxInt64}))
+		s.mustTrue(Cond{"A", LT, 0}.Includes(Cond{"A", LE, math.MaxInt64}))
+
+		s.mustTrue(Cond{"A", GT, math.MaxInt64 - 1}.Includes(Cond{"A", GE, math.MaxInt64}))
+		s.mustTrue(Cond{"A", GT, math.MaxInt64 - 1}.Excludes(Cond{"A", LT, math.MaxInt64}))
+		s.mustFalse(Cond{"A", GT, math.MaxInt64 - 2}.Excludes(Cond{"A", LT, math.MaxInt64}))
+		s.mustFalse(Cond{"A", GT, math.MaxInt64 - 2}.Includes(Cond{"A", GE, math.MaxInt64}))
+		s.mustFalse(Cond{"A", LT, math.MaxInt64}.Excludes(Cond{"A", GT, math.MaxInt64 - 2}))
+		s.mustFalse(Cond{"A", GE, math.MinInt64}.Excludes(Cond{"A", LE, math.MinInt64}))
+	})
+}
+
+func TestPushWorkers(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.PushWorkers = 2
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		lock := &sync.Mutex{}
+		concurrent, maxConcurrent := 0, 0
+		counts := []chan int{}
+		for i := 0; i < 6; i++ {
+			loopCounts := make(chan int, 100)
+			counts = append(counts, loopCounts)
+			sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{}, CountSubscriber[testStruct](func(count int, initial bool, err error) error {
+				if err != nil {
+					return err
+				}
+				lock.Lock()
+				concurrent++
+				if concurrent > maxConcurrent {
+					maxConcurrent = concurrent
+				}
+				lock.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				lock.Lock()
+				concurrent--
+				lock.Unlock()
+				loopCounts <- count
+				return nil
+			}))
+			s.must(err)
+			defer sub.Close()
+			if count := <-loopCounts; count != 0 {
+				t.Errorf("got %v, wanted 0", count)
+			}
+		}
+		for i := 0; i < 20; i++ {
+			s.must(s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(&testStruct{ID: s.NewID()})
+			}))
+		}
+		for _, counts := range counts {
+			for count := 0; count != 20; {
+				select {
+				case count = <-counts:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("got count %v, wanted the final count 20", count)
+				}
+			}
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if maxConcurrent > 2 {
+			t.Errorf("got %v concurrent deliveries, wanted at most 2", maxConcurrent)
+		}
+	})
+}
+
+type blockingSubscription struct {
+	pushes  chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingSubscription) push() {
+	b.pushes <- struct{}{}
+	<-b.release
+}
+
+func (b *blockingSubscription) publish(any, func(Caller) bool) {}
+
+func (b *blockingSubscription) matches(reflect.Value) bool {
+	return true
+}
+
+func (b *blockingSubscription) Close() error {
+	return nil
+}
+
+func (b *blockingSubscription) Pause() error {
+	return nil
+}
+
+func (b *blockingSubscription) Resume() error {
+	return nil
+}
+
+func TestPushPoolCoalesces(t *testing.T) {
+	pool := newPushPool(1)
+	sub := &blockingSubscription{pushes: make(chan struct{}, 10), release: make(chan struct{})}
+	pool.push(subscriptionSet{"sub": sub})
+	<-sub.pushes
+	// While the only worker is busy pushing the subscription, pushing it again queues it once.
+	for i := 0; i < 5; i++ {
+		pool.push(subscriptionSet{"sub": sub})
+	}
+	sub.release <- struct{}{}
+	<-sub.pushes
+	sub.release <- struct{}{}
+	select {
+	case <-sub.pushes:
+		t.Errorf("got a third push, wanted the queued pushes coalesced")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestExplain(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(&testStruct{ID: s.NewID(), Int: 1, String: "a"})
+		}))
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			plan, err := v.Explain(&testStruct{}, &Query{Set: Cond{"Int", EQ, 1}})
+			if err != nil {
+				return err
+			}
+			if len(plan.Steps) == 0 || !strings.Contains(plan.Steps[0].Detail, "INDEX") || len(plan.FullScans) != 0 {
+				t.Errorf("got %+v, wanted a search using an index", plan)
+			}
+			if !strings.Contains(plan.SQL, "SELECT") || !reflect.DeepEqual(plan.Params, []any{1}) {
+				t.Errorf("got %+v, wanted the SQL and params of the Select", plan)
+			}
+			plan, err = v.Explain(&testStruct{}, &Query{Set: Cond{"String", EQ, "a"}})
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(plan.FullScans, map[string]int{"testStruct": 1}) {
+				t.Errorf("got %+v, wanted a full scan of testStruct", plan)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestShareLoads(t *testing.T) {
+	lock := &sync.Mutex{}
+	selects := 0
+	withModifiedSnek(t, func(opts *Options) {
+		opts.ShareLoads = true
+		opts.QueryObserver = func(stats QueryStats) {
+			lock.Lock()
+			defer lock.Unlock()
+			selects++
+		}
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			if !v.Caller().IsAdmin() {
+				query.Set = And{query.Set, Cond{"String", NE, "secret"}}
+			}
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		callers := []Caller{testCaller{isAdmin: true}}
+		for i := 0; i < 5; i++ {
+			callers = append(callers, AnonCaller{})
+		}
+		deliveries := []chan []testStruct{}
+		for _, caller := range callers {
+			loopDeliveries := make(chan []testStruct, 10)
+			deliveries = append(deliveries, loopDeliveries)
+			sub, err := Subscribe(s.Snek, caller, &Query{Order: []Order{{Field: "Int"}}}, TypedSubscriber(func(res []testStruct, err error) error {
+				if err != nil {
+					return err
+				}
+				loopDeliveries <- res
+				return nil
+			}))
+			s.must(err)
+			defer sub.Close()
+		}
+		receive := func(index int) []testStruct {
+			select {
+			case res := <-deliveries[index]:
+				return res
+			case <-time.After(5 * time.Second):
+				t.Fatalf("subscription %v got no delivery", index)
+			}
+			return nil
+		}
+		for index := range callers {
+			if res := receive(index); len(res) != 0 {
+				t.Errorf("got %+v, wanted no structs", res)
+			}
+		}
+		lock.Lock()
+		if selects != 2 {
+			t.Errorf("got %v selects, wanted one per effective query", selects)
+		}
+		selects = 0
+		lock.Unlock()
+		secret := &testStruct{ID: s.NewID(), Int: 1, String: "secret"}
+		public := &testStruct{ID: s.NewID(), Int: 2, String: "public"}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			if err := u.Insert(secret); err != nil {
+				return err
+			}
+			return u.Insert(public)
+		}))
+		if res := receive(0); len(res) != 2 || !res[0].ID.Equal(secret.ID) || !res[1].ID.Equal(public.ID) {
+			t.Errorf("got %+v, wanted %+v and %+v", res, secret, public)
+		}
+		for index := 1; index < len(callers); index++ {
+			if res := receive(index); len(res) != 1 || !res[0].ID.Equal(public.ID) {
+				t.Errorf("got %+v, wanted only %+v", res, public)
+			}
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if selects != 2 {
+			t.Errorf("got %v selects, wanted one per effective query", selects)
+		}
+	})
+}
+
+func TestTail(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		insert := func(ts ...*testStruct) {
+			s.must(s.Update(AnonCaller{}, func(u *Update) error {
+				for _, t := range ts {
+					if err := u.Insert(t); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+		// early gets its ID before all other structs, but is inserted last.
+		early := &testStruct{ID: s.NewID(), Int: 1}
+		old := []*testStruct{}
+		for i := 0; i < 3; i++ {
+			old = append(old, &testStruct{ID: s.NewID(), Int: 1})
+		}
+		insert(old...)
+		if _, err := Subscribe(s.Snek, AnonCaller{}, &Query{Limit: 1}, Tail(TypedSubscriber(func([]testStruct, error) error { return nil }), 0)); err == nil {
+			t.Errorf("wanted an error for a tailed query with Limit")
+		}
+		if _, err := Subscribe(s.Snek, AnonCaller{}, &Query{}, Tail(CountSubscriber[testStruct](func(int, bool, error) error { return nil }), 0)); err == nil {
+			t.Errorf("wanted an error for a tailed count subscriber")
+		}
+		type delivery struct {
+			res     []testStruct
+			initial bool
+		}
+		subscribe := func(backlog uint) chan delivery {
+			deliveries := make(chan delivery, 10)
+			sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{Set: Cond{"Int", EQ, 1}}, Tail(TypedSnapshotSubscriber(func(res []testStruct, initial bool, err error) error {
+				if err != nil {
+					return err
+				}
+				deliveries <- delivery{res: res, initial: initial}
+				return nil
+			}), backlog))
+			s.must(err)
+			t.Cleanup(func() { sub.Close() })
+			return deliveries
+		}
+		receive := func(deliveries chan delivery, initial bool, want ...*testStruct) {
+			t.Helper()
+			select {
+			case got := <-deliveries:
+				if got.initial != initial || len(got.res) != len(want) {
+					t.Fatalf("got %+v, wanted %v structs with initial %v", got, len(want), initial)
+				}
+				for index := range want {
+					if !got.res[index].ID.Equal(want[index].ID) {
+						t.Errorf("got %+v, wanted %+v", got.res, want)
+					}
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got no delivery")
+			}
+		}
+		empty := subscribe(0)
+		backlogged := subscribe(2)
+		receive(empty, true)
+		receive(backlogged, true, old[1], old[2])
+		// Changes to old structs and structs not matching the query aren't delivered.
+		old[0].String = "changed"
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Update(old[0])
+		}))
+		insert(&testStruct{ID: s.NewID(), Int: 2})
+		newer := []*testStruct{{ID: s.NewID(), Int: 1}, {ID: s.NewID(), Int: 1}}
+		insert(newer...)
+		receive(empty, false, newer...)
+		receive(backlogged, false, newer...)
+		newest := &testStruct{ID: s.NewID(), Int: 1}
+		insert(newest)
+		receive(empty, false, newest)
+		receive(backlogged, false, newest)
+		// Structs are delivered in the order they were inserted, not by ID.
+		latest := &testStruct{ID: s.NewID(), Int: 1}
+		insert(latest, early)
+		receive(empty, false, latest, early)
+		receive(backlogged, false, latest, early)
+		select {
+		case got := <-empty:
+			t.Errorf("got unexpected delivery %+v", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestFieldControl(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.QueryCacheSize = 10
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(RegisterFieldControl(s.Snek, func(v *View, ts *testStruct) error {
+			if !v.Caller().IsAdmin() {
+				ts.String = ""
+			}
+			return nil
+		}))
+		if reg, _ := s.Registration("testStruct"); !reg.FieldControl {
+			t.Errorf("got %+v, wanted field control", reg)
+		}
+		admin := testCaller{isAdmin: true}
+		user := testCaller{userID: s.NewID()}
+		changes, closeWatch := Watch[testStruct](s.Snek, user, 10)
+		defer closeWatch()
+		ts := &testStruct{ID: s.NewID(), Int: 1, String: "secret"}
+		s.must(s.Update(user, func(u *Update) error {
+			return u.Insert(ts)
+		}))
+		if change := <-changes; change.Next == nil || change.Next.String != "" {
+			t.Errorf("got %+v, wanted the String hidden", change)
+		}
+		// Each caller gets its own version of the cached results.
+		for _, caller := range []testCaller{user, admin, user} {
+			found := []testStruct{}
+			s.must(s.View(caller, func(v *View) error {
+				return v.Select(&found, &Query{})
+			}))
+			if want := map[bool]string{true: "secret", false: ""}[caller.isAdmin]; len(found) != 1 || found[0].String != want {
+				t.Errorf("got %+v for %+v, wanted String %q", found, caller, want)
+			}
+		}
+		got := &testStruct{ID: ts.ID}
+		s.must(s.View(user, func(v *View) error {
+			return v.Get(got)
+		}))
+		if got.String != "" {
+			t.Errorf("got %+v, wanted the String hidden", got)
+		}
+		// Updates see the stored values, to avoid storing the hidden ones.
+		s.must(s.Update(user, func(u *Update) error {
+			if err := u.Get(got); err != nil {
+				return err
+			}
+			if got.String != "secret" {
+				t.Errorf("got %+v in update, wanted String %q", got, "secret")
+			}
+			return nil
+		}))
+		s.must(s.View(user, func(v *View) error {
+			if _, err := SelectInto[struct{ String string }](v, reflect.TypeOf(testStruct{}), nil); err == nil {
+				t.Errorf("wanted an error selecting a field controlled type into another type")
+			}
+			if groupCounts, err := v.GroupCount(&testStruct{}, "String", nil); err == nil {
+				t.Errorf("got %+v, wanted an error grouping a field controlled type", groupCounts)
+			}
+			return nil
+		}))
+		s.must(s.View(SystemCaller{}, func(v *View) error {
+			_, err := v.GroupCount(&testStruct{}, "String", nil)
+			return err
+		}))
+		results := make(chan []testStruct, 1)
+		sub, err := Subscribe(s.Snek, user, &Query{}, TypedSubscriber(func(res []testStruct, err error) error {
+			results <- res
+			return err
+		}))
+		s.must(err)
+		defer sub.Close()
+		if res := <-results; len(res) != 1 || res[0].String != "" {
+			t.Errorf("got %+v, wanted the String hidden", res)
+		}
+	})
+}
+
+func TestCheckID(t *testing.T) {
+	now := time.Now()
+	withModifiedSnek(t, func(opts *Options) {
+		opts.Now = func() time.Time { return now }
+	}, func(s *testSnek) {
+		id := s.NewID()
+		if !id.Time().Equal(now) {
+			t.Errorf("got %v, wanted %v", id.Time(), now)
+		}
+		s.must(s.CheckID(id, time.Second))
+		invalidIDError := &InvalidIDError{}
+		if err := s.CheckID(id[:16], time.Second); !errors.As(err, &invalidIDError) {
+			t.Errorf("got %v, wanted an InvalidIDError for a short ID", err)
+		}
+		for _, diff := range []time.Duration{-time.Minute, time.Minute} {
+			shifted := append(ID{}, id...)
+			binary.BigEndian.PutUint64(shifted, uint64(now.Add(diff).UnixNano()))
+			if err := s.CheckID(shifted, time.Second); !errors.As(err, &invalidIDError) {
+				t.Errorf("got %v, wanted an InvalidIDError for an ID created %v from now", err, diff)
+			}
+			s.must(s.CheckID(shifted, 2*time.Minute))
+		}
+		if got := ID("short").Time(); !got.IsZero() {
+			t.Errorf("got %v, wanted the zero time", got)
+		}
+	})
+}
+
+func TestParseID(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		id := s.NewID()
+		parsed, err := ParseID(id.String())
+		s.must(err)
+		if !parsed.Equal(id) {
+			t.Errorf("got %v, wanted %v", parsed, id)
+		}
+		parsed, err = ParseBase64ID(id.Base64())
+		s.must(err)
+		if !parsed.Equal(id) {
+			t.Errorf("got %v, wanted %v", parsed, id)
+		}
+		// Base64 matches how encoding/json encodes IDs.
+		b, err := json.Marshal(id)
+		s.must(err)
+		if want := fmt.Sprintf("%q", id.Base64()); string(b) != want {
+			t.Errorf("got %s, wanted %s", b, want)
+		}
+		for _, invalid := range []string{"0", "zz"} {
+			if _, err := ParseID(invalid); err == nil {
+				t.Errorf("wanted an error parsing %q", invalid)
+			}
+		}
+		if _, err := ParseBase64ID("!"); err == nil {
+			t.Errorf("wanted an error parsing invalid base64")
+		}
+		if parsed, err := ParseID(""); err != nil || len(parsed) != 0 {
+			t.Errorf("got %v, %v, wanted an empty ID", parsed, err)
+		}
+	})
+}
+
+func TestUnregisteredJoins(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		for _, query := range []*Query{
+			{Joins: []Join{NewJoin(&testLink{}, All{}, []On{{"ID", EQ, "GroupID"}})}},
+			{Set: Exists(&testLink{}, []On{{"ID", EQ, "GroupID"}}, All{})},
+		} {
+			got := []testStruct{}
+			notRegisteredError := &NotRegisteredError{}
+			if err := s.View(AnonCaller{}, func(v *View) error {
+				return v.Select(&got, query)
+			}); !errors.As(err, &notRegisteredError) || notRegisteredError.TypeName != "testLink" {
+				t.Errorf("got %v, wanted a NotRegisteredError for testLink", err)
+			}
+		}
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			// Hidden structs aren't aggregated.
+			query.Set = And{query.Set, Cond{"String", NE, "hidden"}}
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for index, i := range []int32{1, 2, 2, 3} {
+				if err := u.Insert(&testStruct{ID: s.NewID(), Int: i, Bool: i == 2, Inner: innerTestStruct{Float: float64(index) / 2}}); err != nil {
+					return err
+				}
+			}
+			return u.Insert(&testStruct{ID: s.NewID(), Int: 100, String: "hidden"})
+		}))
+		for _, tc := range []struct {
+			query     *Query
+			aggregate Aggregate
+			want      float64
+		}{
+			{nil, Aggregate{Function: CountDistinct, Field: "Int"}, 3},
+			{nil, Aggregate{Function: Sum, Field: "Int"}, 8},
+			{nil, Aggregate{Function: Avg, Field: "Int"}, 2},
+			{nil, Aggregate{Function: Min, Field: "Int"}, 1},
+			{nil, Aggregate{Function: Max, Field: "Int"}, 3},
+			{nil, Aggregate{Function: Sum, Field: "Bool"}, 2},
+			{nil, Aggregate{Function: Max, Field: "Inner.Float"}, 1.5},
+			{&Query{Set: Cond{"Int", GT, 1}}, Aggregate{Function: Sum, Field: "Int"}, 7},
+			{&Query{Order: []Order{{Field: "Int"}}, Limit: 2}, Aggregate{Function: Sum, Field: "Int"}, 3},
+			{&Query{Set: Cond{"Int", GT, 3}}, Aggregate{Function: Sum, Field: "Int"}, 0},
+		} {
+			var got float64
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				var err error
+				got, err = v.Aggregate(&testStruct{}, tc.query, tc.aggregate)
+				return err
+			}))
+			if got != tc.want {
+				t.Errorf("got %v for %+v with %+v, wanted %v", got, tc.aggregate, tc.query, tc.want)
+			}
+		}
+		for _, aggregate := range []Aggregate{{Function: Sum, Field: "String"}, {Function: Max, Field: "Missing"}, {Function: "MEDIAN", Field: "Int"}} {
+			s.must(s.View(AnonCaller{}, func(v *View) error {
+				if _, err := v.Aggregate(&testStruct{}, nil, aggregate); err == nil {
+					t.Errorf("wanted an error for %+v", aggregate)
+				}
+				return nil
+			}))
+		}
+	})
+}
+
+func TestFilteredAggregates(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			for _, i := range []int32{1, 2, 3, 4, 5} {
+				if err := u.Insert(&testStruct{ID: s.NewID(), Int: i, Bool: i%2 == 0, String: "a"}); err != nil {
+					return err
+				}
+			}
+			return u.Insert(&testStruct{ID: s.NewID(), Int: 6, String: "b"})
+		}))
+		var got []float64
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			var err error
+			got, err = v.Aggregates(&testStruct{}, &Query{Set: Cond{"String", EQ, "a"}},
+				Aggregate{Function: Count},
+				Aggregate{Function: Count, Filter: Cond{"Bool", EQ, true}},
+				Aggregate{Function: Sum, Field: "Int", Filter: Or{Cond{"Int", LT, 2}, Cond{"Int", GT, 4}}},
+				Aggregate{Function: Max, Field: "Int", Filter: Cond{"Bool", EQ, false}},
+				Aggregate{Function: CountDistinct, Field: "Bool", Filter: Cond{"Int", GT, 3}},
+				Aggregate{Function: Avg, Field: "Int", Filter: None{}},
+			)
+			return err
+		}))
+		if want := []float64{5, 2, 6, 5, 2, 0}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, wanted %v", got, want)
+		}
+		s.must(s.View(AnonCaller{}, func(v *View) error {
+			if _, err := v.Aggregates(&testStruct{}, nil, Aggregate{Function: Count, Filter: Cond{"Missing", EQ, 1}}); err == nil {
+				t.Errorf("wanted an error for a filter on a missing field")
+			}
+			if _, err := v.Aggregates(&testStruct{}, nil, Aggregate{Function: Sum}); err == nil {
+				t.Errorf("wanted an error for a Sum without a field")
+			}
+			return nil
+		}))
+	})
+}
+
+type typoTestStruct struct {
+	ID  ID
+	Int int32 `snek:"indexed"`
+}
+
+type innerTypoTestStruct struct {
+	Name string `snek:"index,imutable"`
+}
+
+type nestedTypoTestStruct struct {
+	ID    ID
+	Inner innerTypoTestStruct
+}
+
+type encryptedIntTestStruct struct {
+	ID  ID
+	Int int32 `snek:"encrypt"`
+}
+
+type missingUniqueTestStruct struct {
+	ID   ID
+	Name string
+}
+
+func (m missingUniqueTestStruct) Unique() [][]string {
+	return [][]string{{"Name", "Missing"}}
+}
+
+func TestRegisterValidation(t *testing.T) {
+	withModifiedSnek(t, func(opts *Options) {
+		opts.ValidateType = func(typ reflect.Type) error {
+			if _, found := typ.FieldByName("String"); !found {
+				return fmt.Errorf("%s has no String field", typ.Name())
+			}
+			return nil
+		}
+	}, func(s *testSnek) {
+		for _, err := range []error{
+			Register(s.Snek, &typoTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&typoTestStruct{})),
+			Register(s.Snek, &nestedTypoTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&nestedTypoTestStruct{})),
+			Register(s.Snek, &encryptedIntTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&encryptedIntTestStruct{})),
+			Register(s.Snek, &missingUniqueTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&missingUniqueTestStruct{})),
+			Register(s.Snek, &testLink{}, UncontrolledQueries, UncontrolledUpdates(&testLink{})),
+		} {
+			if err == nil {
+				t.Errorf("wanted an error")
+			}
+		}
+		if err := Register(s.Snek, &nestedTypoTestStruct{}, UncontrolledQueries, UncontrolledUpdates(&nestedTypoTestStruct{})); err == nil || !strings.Contains(err.Error(), "nestedTypoTestStruct.Inner.Name") {
+			t.Errorf("got %v, wanted an error naming the nested field", err)
+		}
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		if _, found := s.Registration("typoTestStruct"); found {
+			t.Errorf("wanted typoTestStruct not to be registered")
+		}
+	})
+}
+
+func TestLastModified(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	withModifiedSnek(t, func(opts *Options) {
+		opts.Now = func() time.Time {
+			return now
+		}
+	}, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		type delivery struct {
+			res          []testStruct
+			lastModified time.Time
+		}
+		deliveries := make(chan delivery, 10)
+		lastModified := time.Time{}
+		sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{Set: Cond{"Int", EQ, 1}}, WithLastModified(TypedSubscriber(func(res []testStruct, err error) error {
+			if err != nil {
+				return err
+			}
+			deliveries <- delivery{res: res, lastModified: lastModified}
+			return nil
+		}), func(modified time.Time) {
+			lastModified = modified
+		}))
+		s.must(err)
+		defer sub.Close()
+		receive := func(wantLen int, wantModified time.Time) {
+			t.Helper()
+			select {
+			case got := <-deliveries:
+				if len(got.res) != wantLen || !got.lastModified.Equal(wantModified) {
+					t.Fatalf("got %+v, wanted %v structs last modified %v", got, wantLen, wantModified)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got no delivery")
+			}
+		}
+		receive(0, time.Time{})
+		insert := func(ts *testStruct) {
+			s.must(s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(ts)
+			}))
+		}
+		now = now.Add(time.Hour)
+		first := now
+		insert(&testStruct{ID: s.NewID(), Int: 1})
+		receive(1, first)
+		// Changes not affecting the results aren't delivered, and don't change the last modified time.
+		now = now.Add(time.Hour)
+		insert(&testStruct{ID: s.NewID(), Int: 2})
+		now = now.Add(time.Hour)
+		third := now
+		insert(&testStruct{ID: s.NewID(), Int: 1})
+		receive(2, third)
+	})
+}
+
+func TestPauseResume(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		deliveries := make(chan []testStruct, 10)
+		sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{}, TypedSubscriber(func(res []testStruct, err error) error {
+			if err != nil {
+				return err
+			}
+			deliveries <- res
+			return nil
+		}))
+		s.must(err)
+		receive := func(wantLen int) {
+			t.Helper()
+			select {
+			case got := <-deliveries:
+				if len(got) != wantLen {
+					t.Fatalf("got %+v, wanted %v structs", got, wantLen)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got no delivery")
+			}
+		}
+		receiveNothing := func() {
+			t.Helper()
+			select {
+			case got := <-deliveries:
+				t.Fatalf("got %+v, wanted no delivery", got)
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+		insert := func() {
+			s.must(s.Update(AnonCaller{}, func(u *Update) error {
+				return u.Insert(&testStruct{ID: s.NewID()})
+			}))
+		}
+		receive(0)
+		s.must(sub.Pause())
+		insert()
+		insert()
+		receiveNothing()
+		s.must(sub.Resume())
+		receive(2)
+		receiveNothing()
+		// Resuming without changes while paused delivers nothing.
+		s.must(sub.Pause())
+		s.must(sub.Resume())
+		receiveNothing()
+		insert()
+		receive(3)
+		s.must(sub.Close())
+		if err := sub.Pause(); err == nil {
+			t.Errorf("wanted an error pausing a closed subscription")
+		}
+	})
+}
+
+func TestPublishJoinControl(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		// Callers only see the testStructs of groups they are linked to.
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			query.Joins = append(query.Joins, NewJoin(&testLink{}, Cond{"UserID", EQ, v.Caller().UserID()}, []On{{"String", EQ, "GroupID"}}))
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		s.must(Register(s.Snek, &testLink{}, UncontrolledQueries, UncontrolledUpdates(&testLink{})))
+		caller := testCaller{userID: s.NewID()}
+		events := make(chan *testStruct, 10)
+		sub, err := Subscribe(s.Snek, caller, &Query{}, WithEvents(TypedSubscriber(func([]testStruct, error) error { return nil }), func(structPointer any) error {
+			events <- structPointer.(*testStruct)
+			return nil
+		}))
+		s.must(err)
+		defer sub.Close()
+		s.must(s.Publish(&testStruct{ID: s.NewID(), String: "other group"}, nil))
+		select {
+		case got := <-events:
+			t.Errorf("got %+v, wanted no events for a join controlled subscription", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestHistoryJoinControl(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		// Callers only see the testStructs they are linked to.
+		s.must(Register(s.Snek, &testStruct{}, func(v *View, query *Query) error {
+			query.Joins = append(query.Joins, NewJoin(&testLink{}, Cond{"UserID", EQ, v.Caller().UserID()}, []On{{"ID", EQ, "GroupID"}}))
+			return nil
+		}, UncontrolledUpdates(&testStruct{})))
+		s.must(Register(s.Snek, &testLink{}, UncontrolledQueries, UncontrolledUpdates(&testLink{})))
+		s.must(RegisterHistory[testStruct](s.Snek))
+		member := testCaller{userID: s.NewID()}
+		outsider := testCaller{userID: s.NewID()}
+		ts := &testStruct{ID: s.NewID()}
+		s.must(s.Update(SystemCaller{}, func(u *Update) error {
+			if err := u.Insert(&testLink{GroupID: ts.ID, UserID: member.userID}); err != nil {
+				return err
+			}
+			return u.Insert(ts)
+		}))
+		if got, err := AsOf[testStruct](s.Snek, member, ts.ID, time.Now()); err != nil || !got.ID.Equal(ts.ID) {
+			t.Errorf("got %+v, %v, wanted %+v for a linked caller", got, err, ts)
+		}
+		if got, err := AsOf[testStruct](s.Snek, outsider, ts.ID, time.Now()); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("got %+v, %v, wanted sql.ErrNoRows for a caller not linked", got, err)
+		}
+	})
+}
+
+func TestPublishDefaultSet(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(RegisterDefaultSet[testStruct](s.Snek, func(caller Caller) Set {
+			return Cond{"Bool", EQ, true}
+		}))
+		events := make(chan *testStruct, 10)
+		sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{}, WithEvents(TypedSubscriber(func([]testStruct, error) error { return nil }), func(structPointer any) error {
+			events <- structPointer.(*testStruct)
+			return nil
+		}))
+		s.must(err)
+		defer sub.Close()
+		s.must(s.Publish(&testStruct{ID: s.NewID()}, nil))
+		want := &testStruct{ID: s.NewID(), Bool: true}
+		s.must(s.Publish(want, nil))
+		if got := <-events; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, wanted %+v", got, want)
+		}
+		select {
+		case got := <-events:
+			t.Errorf("got %+v, wanted no events outside the default Set", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+func TestSelectJoinCountsJoinControl(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		// Callers only see the links of groups they are linked to themselves.
+		s.must(Register(s.Snek, &testLink{}, func(v *View, query *Query) error {
+			query.Joins = append(query.Joins, NewJoin(&testLink{}, Cond{"UserID", EQ, v.Caller().UserID()}, []On{{"GroupID", EQ, "GroupID"}}))
+			return nil
+		}, UncontrolledUpdates(&testLink{})))
+		s.must(s.View(testCaller{userID: s.NewID()}, func(v *View) error {
+			if counts, err := SelectJoinCounts[testStruct](v, NewJoin(&testLink{}, All{}, []On{{"ID", EQ, "GroupID"}}), nil, false); err == nil {
+				t.Errorf("got %+v, wanted an error counting a join controlled by Joins", counts)
+			}
+			return nil
+		}))
+	})
+}
+
+func TestExistsSubscription(t *testing.T) {
+	withSnek(t, func(s *testSnek) {
+		s.must(Register(s.Snek, &testStruct{}, UncontrolledQueries, UncontrolledUpdates(&testStruct{})))
+		s.must(Register(s.Snek, &testLink{}, UncontrolledQueries, UncontrolledUpdates(&testLink{})))
+		group := &testStruct{ID: s.NewID()}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(group)
+		}))
+		results := make(chan []testStruct, 10)
+		sub, err := Subscribe(s.Snek, AnonCaller{}, &Query{Set: Exists(&testLink{}, []On{{"ID", EQ, "GroupID"}}, All{})}, TypedSubscriber(func(res []testStruct, err error) error {
+			results <- res
+			return err
+		}))
+		s.must(err)
+		receive := func(wantLen int) {
+			t.Helper()
+			select {
+			case res := <-results:
+				if len(res) != wantLen {
+					t.Errorf("got %+v, wanted %v structs", res, wantLen)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got no delivery")
+			}
+		}
+		receive(0)
+		// Changes of the correlated type reload the subscription.
+		link := &testLink{GroupID: group.ID, UserID: s.NewID()}
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Insert(link)
+		}))
+		receive(1)
+		s.must(s.Update(AnonCaller{}, func(u *Update) error {
+			return u.Remove(link)
+		}))
+		receive(0)
+		s.must(sub.Close())
+		if subs, found := s.correlatedSubscriptions.Get("testLink"); found && subs.Len() != 0 {
+			t.Errorf("got %v correlated subscriptions, wanted none after closing", subs.Len())
+		}
+	})
+}
@@ -0,0 +1,90 @@
+// Package snektest contains helpers for testing code using snek against real stores.
+package snektest
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/zond/snek"
+)
+
+// WithSnek runs f with a store using snek.DefaultOptions in a temporary directory, closed and removed when the test finishes.
+func WithSnek(t testing.TB, f func(s *snek.Snek)) {
+	t.Helper()
+	WithModifiedSnek(t, func(*snek.Options) {}, f)
+}
+
+// WithModifiedSnek is like WithSnek, but lets modifier change the options before the store is opened.
+func WithModifiedSnek(t testing.TB, modifier func(opts *snek.Options), f func(s *snek.Snek)) {
+	t.Helper()
+	opts := snek.DefaultOptions(filepath.Join(t.TempDir(), "sqlite.db"))
+	modifier(&opts)
+	s, err := opts.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("closing store: %v", err)
+		}
+	})
+	f(s)
+}
+
+// Must fails the test if err is not nil.
+func Must(t testing.TB, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("got %v, wanted no error", err)
+	}
+}
+
+// MustNot fails the test if err is nil.
+func MustNot(t testing.TB, err error) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("got nil, wanted some error")
+	}
+}
+
+// Select returns the structs of type T the query selects for caller, and fails the test if it can't.
+func Select[T any](t testing.TB, s *snek.Snek, caller snek.Caller, query *snek.Query) []T {
+	t.Helper()
+	result := []T{}
+	Must(t, s.View(caller, func(v *snek.View) error {
+		return v.Select(&result, query)
+	}))
+	return result
+}
+
+// MustContain fails the test unless the query selects structs equal to each of want for caller.
+func MustContain[T any](t testing.TB, s *snek.Snek, caller snek.Caller, query *snek.Query, want ...T) {
+	t.Helper()
+	got := Select[T](t, s, caller, query)
+	for _, wanted := range want {
+		if !contains(got, wanted) {
+			t.Errorf("got %+v, wanted it to contain %+v", got, wanted)
+		}
+	}
+}
+
+// MustNotContain fails the test if the query selects a struct equal to any of unwanted for caller.
+func MustNotContain[T any](t testing.TB, s *snek.Snek, caller snek.Caller, query *snek.Query, unwanted ...T) {
+	t.Helper()
+	got := Select[T](t, s, caller, query)
+	for _, unwanted := range unwanted {
+		if contains(got, unwanted) {
+			t.Errorf("got %+v, wanted it not to contain %+v", got, unwanted)
+		}
+	}
+}
+
+func contains[T any](haystack []T, needle T) bool {
+	for _, candidate := range haystack {
+		if reflect.DeepEqual(candidate, needle) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,49 @@
+package snektest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/zond/snek"
+)
+
+type testStruct struct {
+	ID     snek.ID
+	String string
+}
+
+func TestWithSnek(t *testing.T) {
+	WithSnek(t, func(s *snek.Snek) {
+		Must(t, snek.Register(s, &testStruct{}, func(v *snek.View, query *snek.Query) error {
+			query.Set = snek.And{query.Set, snek.Cond{Field: "String", Comparator: snek.NE, Value: "hidden"}}
+			return nil
+		}, snek.UncontrolledUpdates(&testStruct{})))
+		visible := testStruct{ID: s.NewID(), String: "visible"}
+		hidden := testStruct{ID: s.NewID(), String: "hidden"}
+		Must(t, s.Update(snek.AnonCaller{}, func(u *snek.Update) error {
+			if err := u.Insert(&visible); err != nil {
+				return err
+			}
+			return u.Insert(&hidden)
+		}))
+		MustContain(t, s, snek.AnonCaller{}, &snek.Query{}, visible)
+		MustNotContain(t, s, snek.AnonCaller{}, &snek.Query{}, hidden)
+		MustNot(t, s.Update(snek.AnonCaller{}, func(u *snek.Update) error {
+			return u.Insert(&visible)
+		}))
+	})
+}
+
+func TestWithSnekCloses(t *testing.T) {
+	// The database outlives the subtest, so only closing the store makes it unusable.
+	path := filepath.Join(t.TempDir(), "sqlite.db")
+	var store *snek.Snek
+	t.Run("open", func(t *testing.T) {
+		WithModifiedSnek(t, func(opts *snek.Options) {
+			opts.Path = path
+		}, func(s *snek.Snek) {
+			store = s
+		})
+	})
+	MustNot(t, store.View(snek.AnonCaller{}, func(*snek.View) error { return nil }))
+}
@@ -1,10 +1,13 @@
 package snek
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
+	"time"
 
 	"github.com/minio/highwayhash"
 	"github.com/zond/snek/synch"
@@ -15,20 +18,23 @@ var (
 )
 
 // Subscriber handles data from subscriptions.
-// Create subscribers by calling TypedSubscriber or AnySubscriber.
+// Errors loading the data are delivered to the subscriber without closing the subscription, while errors returned
+// by the subscriber close it.
+// Create subscribers by calling TypedSubscriber, AnySubscriber, TypedSnapshotSubscriber, AnySnapshotSubscriber, CountSubscriber, AnyCountSubscriber,
+// GroupCountSubscriber, or AnyGroupCountSubscriber, and extend them using WithEvents, Tail, WithLastModified, or Throttled.
 type Subscriber interface {
-	handleResults(structSlicePointer any, err error) error
+	handleResults(structSlicePointer any, initial bool, err error) error
 	prepareResult() (structSlicePointer any)
 	getType() (structType reflect.Type)
 }
 
 type typedSubscriber[T any] struct {
-	handler    func([]T, error) error
+	handler    func([]T, bool, error) error
 	structType reflect.Type
 }
 
-func (s *typedSubscriber[T]) handleResults(structSlicePointer any, err error) error {
-	return s.handler(*(structSlicePointer.(*[]T)), err)
+func (s *typedSubscriber[T]) handleResults(structSlicePointer any, initial bool, err error) error {
+	return s.handler(*(structSlicePointer.(*[]T)), initial, err)
 }
 
 func (s *typedSubscriber[T]) prepareResult() any {
@@ -41,13 +47,13 @@ func (s *typedSubscriber[T]) getType() reflect.Type {
 }
 
 type anySubscriber struct {
-	handler    func(structSlice any, err error) error
+	handler    func(structSlice any, initial bool, err error) error
 	structType reflect.Type
 	sliceType  reflect.Type
 }
 
-func (a *anySubscriber) handleResults(structSlicePointer any, err error) error {
-	return a.handler(reflect.ValueOf(structSlicePointer).Elem().Interface(), err)
+func (a *anySubscriber) handleResults(structSlicePointer any, initial bool, err error) error {
+	return a.handler(reflect.ValueOf(structSlicePointer).Elem().Interface(), initial, err)
 }
 
 func (a *anySubscriber) prepareResult() any {
@@ -62,6 +68,13 @@ func (a *anySubscriber) getType() reflect.Type {
 
 // AnySubscriber returns a subscriber handling untyped results. The results are still slices of structs.
 func AnySubscriber(structType reflect.Type, handler func(structSlice any, err error) error) Subscriber {
+	return AnySnapshotSubscriber(structType, func(structSlice any, _ bool, err error) error {
+		return handler(structSlice, err)
+	})
+}
+
+// AnySnapshotSubscriber returns a subscriber handling untyped results, that is told whether each delivery is the initial snapshot or a change driven update.
+func AnySnapshotSubscriber(structType reflect.Type, handler func(structSlice any, initial bool, err error) error) Subscriber {
 	return &anySubscriber{
 		handler:    handler,
 		structType: structType,
@@ -71,12 +84,158 @@ func AnySubscriber(structType reflect.Type, handler func(structSlice any, err er
 
 // TypedSubscriber returns a subscriber handling typed results, which might be more convenient.
 func TypedSubscriber[T any](handler func([]T, error) error) Subscriber {
+	return TypedSnapshotSubscriber(func(res []T, _ bool, err error) error {
+		return handler(res, err)
+	})
+}
+
+// TypedSnapshotSubscriber returns a subscriber handling typed results, that is told whether each delivery is the initial snapshot or a change driven update.
+func TypedSnapshotSubscriber[T any](handler func(res []T, initial bool, err error) error) Subscriber {
 	return &typedSubscriber[T]{
 		handler:    handler,
 		structType: reflect.TypeOf(*new(T)),
 	}
 }
 
+type eventSubscriber struct {
+	Subscriber
+	handler func(structPointer any) error
+}
+
+// WithEvents returns subscriber extended to also handle structs delivered using Publish.
+func WithEvents(subscriber Subscriber, handler func(structPointer any) error) Subscriber {
+	return &eventSubscriber{
+		Subscriber: subscriber,
+		handler:    handler,
+	}
+}
+
+type countSubscriber struct {
+	handler    func(count int, initial bool, err error) error
+	structType reflect.Type
+}
+
+func (c *countSubscriber) handleResults(countPointer any, initial bool, err error) error {
+	return c.handler(*(countPointer.(*int)), initial, err)
+}
+
+func (c *countSubscriber) prepareResult() any {
+	return new(int)
+}
+
+func (c *countSubscriber) getType() reflect.Type {
+	return c.structType
+}
+
+// CountSubscriber returns a subscriber handling the number of matching structs instead of the structs themselves,
+// which is much cheaper when only the number is interesting.
+func CountSubscriber[T any](handler func(count int, initial bool, err error) error) Subscriber {
+	return AnyCountSubscriber(reflect.TypeOf(*new(T)), handler)
+}
+
+// AnyCountSubscriber returns a CountSubscriber for the given struct type.
+func AnyCountSubscriber(structType reflect.Type, handler func(count int, initial bool, err error) error) Subscriber {
+	return &countSubscriber{
+		handler:    handler,
+		structType: structType,
+	}
+}
+
+type groupCountSubscriber struct {
+	handler    func(groupCounts []GroupCount, initial bool, err error) error
+	structType reflect.Type
+	field      string
+}
+
+func (g *groupCountSubscriber) handleResults(groupCountsPointer any, initial bool, err error) error {
+	return g.handler(*(groupCountsPointer.(*[]GroupCount)), initial, err)
+}
+
+func (g *groupCountSubscriber) prepareResult() any {
+	return &[]GroupCount{}
+}
+
+func (g *groupCountSubscriber) getType() reflect.Type {
+	return g.structType
+}
+
+// GroupCountSubscriber returns a subscriber handling the number of matching structs per value of field, as returned by View#GroupCount.
+// Like other subscribers, it only gets the counts when they have changed.
+func GroupCountSubscriber[T any](field string, handler func(groupCounts []GroupCount, initial bool, err error) error) Subscriber {
+	return AnyGroupCountSubscriber(reflect.TypeOf(*new(T)), field, handler)
+}
+
+// AnyGroupCountSubscriber returns a GroupCountSubscriber for the given struct type.
+func AnyGroupCountSubscriber(structType reflect.Type, field string, handler func(groupCounts []GroupCount, initial bool, err error) error) Subscriber {
+	return &groupCountSubscriber{
+		handler:    handler,
+		structType: structType,
+		field:      field,
+	}
+}
+
+type throttledSubscriber struct {
+	Subscriber
+	interval time.Duration
+}
+
+// Throttled returns subscriber extended to load and deliver results at most once per interval, e.g. to avoid overwhelming
+// slow clients with rapidly changing data. Changes during the interval are coalesced into a single delivery at its end,
+// and since that delivery loads the results after the changes, the latest state is always eventually delivered.
+// Throttled can wrap or be wrapped by WithEvents, Tail, and WithLastModified.
+// Structs delivered using Publish aren't throttled.
+func Throttled(subscriber Subscriber, interval time.Duration) Subscriber {
+	return &throttledSubscriber{
+		Subscriber: subscriber,
+		interval:   interval,
+	}
+}
+
+type tailSubscriber struct {
+	Subscriber
+	backlog uint
+}
+
+// Tail returns subscriber extended to only get the structs created after it subscribed, e.g. for chat messages or other
+// append-only feeds where resending all results for each new struct would be wasteful.
+//
+// The initial delivery contains the backlog structs inserted last at the time of subscription (none if backlog is zero),
+// and each following delivery contains only the matching structs inserted since the previous load, in the order they were inserted.
+// Since SQLite serializes writes, this is the order their inserts committed, regardless of their IDs.
+// Changes to already delivered structs, and removals, aren't delivered.
+//
+// The insertion order is the rowid SQLite gives each row, which is one greater than the greatest rowid in the table.
+// Removing the struct inserted last before inserting another makes the rowid be reused, and Vacuum may renumber the rowids,
+// so structs inserted right after those may not be delivered.
+//
+// Tail only works for subscribers delivering structs with an ID field, and queries without Order, Limit, Offset, or Recursion.
+// Like Throttled it can wrap or be wrapped by WithEvents, Throttled, and WithLastModified.
+func Tail(subscriber Subscriber, backlog uint) Subscriber {
+	return &tailSubscriber{
+		Subscriber: subscriber,
+		backlog:    backlog,
+	}
+}
+
+type lastModifiedSubscriber struct {
+	Subscriber
+	handler func(lastModified time.Time)
+}
+
+// WithLastModified returns subscriber extended to call handler with the time the delivered results were last modified, right before
+// each delivery of results, e.g. to show how long ago a live view last changed.
+//
+// The time is the commit time (according to Options.Now) of the last Update changing the types involved in the query committed before the
+// results were loaded, as of the last time the results changed, so deliveries of unchanged results (after load errors) keep the time.
+// Since commit times aren't persisted, results that haven't changed since the store was opened are delivered with the zero time.
+// Like Throttled it can wrap or be wrapped by WithEvents, Throttled, and Tail.
+func WithLastModified(subscriber Subscriber, handler func(lastModified time.Time)) Subscriber {
+	return &lastModifiedSubscriber{
+		Subscriber: subscriber,
+		handler:    handler,
+	}
+}
+
 type subscription struct {
 	id           ID
 	query        *Query
@@ -84,69 +243,463 @@ type subscription struct {
 	subscriber   Subscriber
 	caller       Caller
 	lastPushHash [highwayhash.Size]byte
+	pushed       bool
 	lock         synch.Lock
+	// interval is the minimum time between loads, set using Throttled.
+	interval time.Duration
+	// throttleLock protects lastLoad, the time of the last load, and pending, which is set while a delayed
+	// load is scheduled, coalescing any pushes before it.
+	throttleLock synch.Lock
+	lastLoad     time.Time
+	pending      bool
+	// tail is set using Tail, and makes the subscription only deliver structs with rowids greater than tailFrom, the
+	// greatest rowid in the table at the last delivery, after an initial delivery of the backlog structs with the greatest rowids.
+	tail     bool
+	backlog  uint
+	tailFrom int64
+	// lastModified is the commit time of the last change to the delivered results, delivered to lastModifiedHandler if set using WithLastModified,
+	// and modifiedHash is the hash of the results when they last changed, which unlike lastPushHash isn't forgotten when loads fail.
+	lastModified        time.Time
+	modifiedHash        [highwayhash.Size]byte
+	lastModifiedHandler func(time.Time)
+	// correlatedTypes are the other types read by the query, e.g. using Exists, whose changes push the subscription.
+	correlatedTypes []reflect.Type
+	// pauseLock protects paused, set using Pause, and dirty, set when a delivery is skipped while paused.
+	pauseLock synch.Lock
+	paused    bool
+	dirty     bool
+	// ctx is used by loads, and canceled when the subscription is closed or removed, to interrupt any load in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
+// Close removes the subscription, and interrupts any load in flight.
 func (s *subscription) Close() error {
+	if !s.unregister() {
+		return fmt.Errorf("not open")
+	}
+	return nil
+}
+
+// unregister removes the subscription from the store, interrupts any load in flight, and returns whether it was registered.
+func (s *subscription) unregister() bool {
 	_, found := s.snek.getSubscriptions(s.subscriber.getType()).Del(string(s.id))
-	if !found {
+	for _, typ := range s.correlatedTypes {
+		s.snek.getCorrelatedSubscriptions(typ).Del(string(s.id))
+	}
+	s.cancel()
+	return found
+}
+
+// Pause stops deliveries until Resume is called.
+func (s *subscription) Pause() error {
+	if _, found := s.snek.getSubscriptions(s.subscriber.getType()).Get(string(s.id)); !found {
 		return fmt.Errorf("not open")
 	}
+	return s.pauseLock.Sync(func() error {
+		s.paused = true
+		return nil
+	})
+}
+
+// Resume restarts deliveries, and delivers the changes skipped while paused.
+func (s *subscription) Resume() error {
+	if _, found := s.snek.getSubscriptions(s.subscriber.getType()).Get(string(s.id)); !found {
+		return fmt.Errorf("not open")
+	}
+	dirty := false
+	s.pauseLock.Sync(func() error {
+		dirty = s.dirty
+		s.paused = false
+		s.dirty = false
+		return nil
+	})
+	if dirty {
+		s.snek.pushPool.push(subscriptionSet{string(s.id): s})
+	}
 	return nil
 }
 
+// isPaused returns whether the subscription is paused, and if so remembers that a delivery was skipped if skipped is set.
+func (s *subscription) isPaused(skipped bool) bool {
+	paused := false
+	s.pauseLock.Sync(func() error {
+		paused = s.paused
+		if paused && skipped {
+			s.dirty = true
+		}
+		return nil
+	})
+	return paused
+}
+
+// matches returns true if a change of val might affect the results of the subscription.
+// For limited, offset, or ordered queries (live windows) this is still the case exactly when
+// val matches the Set of the query: a changed struct not in the Set can't enter the window,
+// nor shift other structs into or out of it, while any changed struct in the Set might.
+// Since Update and Remove also check the value before the change, structs leaving the Set
+// are detected as well.
 func (s *subscription) matches(val reflect.Value) bool {
 	if s.subscriber.getType() != val.Type() {
 		return false
 	}
+	if s.query.Recursion != nil {
+		// Whether a change affects a tree can't be computed from the changed value alone.
+		return true
+	}
 	matches, err := s.query.Set.matches(val)
-	if err != nil {
-		query, _ := s.query.Set.toWhereCondition(s.subscriber.getType().Name())
+	if errors.Is(err, errNeedsDatabase) {
+		return true
+	} else if err != nil {
+		query, _ := s.query.Set.toWhereCondition(s.snek.naming(), s.snek.naming().table(s.subscriber.getType()))
 		log.Printf("while matching %+v to %q: %v", val.Interface(), query, err)
-		return false
+		// Better to reload needlessly than to miss a change.
+		return true
 	}
 	return matches
 }
 
 func (s *subscription) load() (any, [highwayhash.Size]byte, error) {
+	// Field controls modify the results for each caller, so they can't be shared.
+	if s.snek.sharedLoads != nil && s.snek.permissions[s.subscriber.getType().Name()].fieldControl == nil {
+		switch s.subscriber.(type) {
+		case *countSubscriber, *groupCountSubscriber:
+		default:
+			return s.loadShared()
+		}
+	}
+	return s.loadAlone()
+}
+
+func (s *subscription) loadAlone() (any, [highwayhash.Size]byte, error) {
 	results := s.subscriber.prepareResult()
-	err := s.snek.View(s.caller, func(v *View) error {
+	err := s.snek.View(WithContext(s.caller, s.ctx), func(v *View) error {
+		if countPointer, isCount := results.(*int); isCount {
+			count, err := v.count(s.subscriber.getType(), s.query)
+			*countPointer = count
+			return err
+		}
+		if groupCountSubscriber, isGroupCount := s.subscriber.(*groupCountSubscriber); isGroupCount {
+			groupCounts, err := v.groupCount(s.subscriber.getType(), groupCountSubscriber.field, s.query)
+			*(results.(*[]GroupCount)) = groupCounts
+			return err
+		}
 		return v.Select(results, s.query)
 	})
-	var emptyHash [highwayhash.Size]byte
 	if err != nil {
+		var emptyHash [highwayhash.Size]byte
 		return results, emptyHash, err
 	}
+	hash, err := resultHash(results)
+	return results, hash, err
+}
+
+// resultHash returns the hash used to detect whether results have changed since the last delivery.
+func resultHash(results any) ([highwayhash.Size]byte, error) {
 	b, err := json.Marshal(results)
 	if err != nil {
-		return results, emptyHash, err
+		var emptyHash [highwayhash.Size]byte
+		return emptyHash, err
 	}
-	hash := highwayhash.Sum(b, highwayHashKey)
-	return results, hash, nil
+	return highwayhash.Sum(b, highwayHashKey), nil
 }
 
 func (s *subscription) push() {
+	if s.interval == 0 {
+		s.deliver()
+		return
+	}
+	deliverNow := false
+	delay := time.Duration(0)
+	s.throttleLock.Sync(func() error {
+		if s.pending {
+			return nil
+		}
+		if elapsed := time.Since(s.lastLoad); elapsed < s.interval {
+			s.pending = true
+			delay = s.interval - elapsed
+			return nil
+		}
+		s.lastLoad = time.Now()
+		deliverNow = true
+		return nil
+	})
+	if deliverNow {
+		s.deliver()
+	} else if delay > 0 {
+		time.AfterFunc(delay, func() {
+			s.throttleLock.Sync(func() error {
+				s.pending = false
+				s.lastLoad = time.Now()
+				return nil
+			})
+			if _, found := s.snek.getSubscriptions(s.subscriber.getType()).Get(string(s.id)); found {
+				s.deliver()
+			}
+		})
+	}
+}
+
+// deliver loads the results and delivers them to the subscriber, unless they are unchanged since the last delivery.
+func (s *subscription) deliver() {
+	if s.isPaused(true) {
+		return
+	}
 	// It might seem crazy to hold a lock through not one but _two_ I/O operations (load from DB and send to a likely WebSocket),
 	// but since this is unique per subscription it's fine - no client is really interested in multiple parallel deliveries of
 	// data from the same subscription anyway.
 	s.lock.Sync(func() error {
+		modified := s.snek.lastCommit(s.query.types(s.subscriber.getType()))
+		if s.tail {
+			s.deliverTail(modified)
+			return nil
+		}
 		results, hash, loadErr := s.load()
-		if hash != s.lastPushHash || loadErr != nil {
-			pushErr := s.subscriber.handleResults(results, loadErr)
-			if pushErr != nil {
-				subs := s.snek.getSubscriptions(s.subscriber.getType())
-				subs.Del(string(s.id))
+		if s.ctx.Err() != nil {
+			// The subscription was closed, and the load may have been interrupted.
+			return nil
+		}
+		if loadErr != nil {
+			// Load errors, e.g. from the caller temporarily failing the query control, are delivered but don't close the subscription.
+			// Forgetting the last pushed hash makes sure the next successful load is delivered, even if the results didn't change.
+			if err := s.subscriber.handleResults(results, !s.pushed, loadErr); err != nil {
+				s.remove()
 			} else {
-				s.lastPushHash = hash
+				s.lastPushHash = [highwayhash.Size]byte{}
 			}
+			return nil
+		}
+		if hash == s.lastPushHash && s.pushed {
+			return nil
+		}
+		if hash != s.modifiedHash || !s.pushed {
+			s.lastModified = modified
+			s.modifiedHash = hash
+		}
+		if err := s.handleResults(results); err != nil {
+			s.remove()
+			return nil
+		}
+		s.pushed = true
+		s.lastPushHash = hash
+		return nil
+	})
+}
+
+// loadTail loads the structs a Tail subscription hasn't delivered yet, and returns them along with the greatest rowid in the table when loading them.
+func (s *subscription) loadTail() (any, int64, error) {
+	results := s.subscriber.prepareResult()
+	structType := s.subscriber.getType()
+	query := s.query.clone()
+	initial := !s.pushed
+	if initial {
+		query.Order = []Order{{rowID: true, Desc: true}}
+		query.Limit = s.backlog
+	} else {
+		query.Set = And{query.Set, rowIDSet{after: s.tailFrom}}
+		query.Order = []Order{{rowID: true}}
+	}
+	from := s.tailFrom
+	if err := s.snek.View(WithContext(s.caller, s.ctx), func(v *View) error {
+		// Loading the greatest rowid in the same transaction as the structs makes the next load start right after this one.
+		sql := fmt.Sprintf("SELECT COALESCE(MAX(rowid), 0) FROM \"%s\";", s.snek.naming().table(structType))
+		started := time.Now()
+		err := v.tx.GetContext(v.ctx, &from, sql)
+		v.logSQL(sql, nil, nil, started, err)
+		if err != nil || (initial && s.backlog == 0) {
+			return err
+		}
+		return v.Select(results, query)
+	}); err != nil {
+		return results, s.tailFrom, err
+	}
+	if initial {
+		sliceVal := reflect.ValueOf(results).Elem()
+		backlog := reflect.MakeSlice(sliceVal.Type(), 0, sliceVal.Len())
+		for index := sliceVal.Len() - 1; index >= 0; index-- {
+			backlog = reflect.Append(backlog, sliceVal.Index(index))
+		}
+		sliceVal.Set(backlog)
+	}
+	return results, from, nil
+}
+
+// handleResults delivers successfully loaded results, and their last modified time if the subscriber wants it.
+func (s *subscription) handleResults(results any) error {
+	if s.lastModifiedHandler != nil {
+		s.lastModifiedHandler(s.lastModified)
+	}
+	return s.subscriber.handleResults(results, !s.pushed, nil)
+}
+
+// deliverTail is deliver for Tail subscriptions, which only deliver new structs instead of the results of the query when they change.
+func (s *subscription) deliverTail(modified time.Time) {
+	results, from, loadErr := s.loadTail()
+	if s.ctx.Err() != nil {
+		return
+	}
+	if loadErr != nil {
+		if err := s.subscriber.handleResults(results, !s.pushed, loadErr); err != nil {
+			s.remove()
+		}
+		return
+	}
+	if s.pushed && reflect.ValueOf(results).Elem().Len() == 0 {
+		return
+	}
+	s.lastModified = modified
+	if err := s.handleResults(results); err != nil {
+		s.remove()
+		return
+	}
+	s.pushed = true
+	s.tailFrom = from
+}
+
+// remove removes the subscription after its subscriber failed to handle a delivery.
+func (s *subscription) remove() {
+	s.unregister()
+}
+
+func (s *subscription) publish(structPointer any, filter func(Caller) bool) {
+	eventSub, ok := s.subscriber.(*eventSubscriber)
+	if !ok || s.isPaused(false) {
+		return
+	}
+	if filter != nil && !filter(unwrapCaller(s.caller)) {
+		return
+	}
+	val := reflect.ValueOf(structPointer).Elem()
+	visible := false
+	if err := s.snek.View(s.caller, func(v *View) error {
+		query := s.query.clone()
+		v.applyDefaultSet(val.Type(), query)
+		if err := v.queryControl(val.Type(), query); err != nil {
+			return err
+		}
+		if len(query.Joins) > 0 || query.Recursion != nil {
+			// Published structs aren't in the store, so they can't be checked against joins or trees.
+			return fmt.Errorf("controlled query has Joins or Recursion, which published structs can't be matched against")
+		}
+		var err error
+		if visible, err = getSet(query.Set, All{}).matches(val); err != nil || !visible {
+			return err
+		}
+		if v.hasFieldControl(val.Type()) {
+			// Each subscription gets its own copy, modified for its caller.
+			structPointer = copyStruct(structPointer)
+			return v.fieldControl(val.Type(), structPointer)
+		}
+		return nil
+	}); err != nil {
+		// Since published structs bypass the store, we can't know if the caller is allowed to see them.
+		log.Printf("while checking if %+v is visible to %+v: %v", val.Interface(), s.caller, err)
+		return
+	}
+	if !visible {
+		return
+	}
+	s.lock.Sync(func() error {
+		if err := eventSub.handler(structPointer); err != nil {
+			s.remove()
 		}
 		return nil
 	})
 }
 
+// QuerySubscriber combines a query with the subscriber handling its results.
+type QuerySubscriber struct {
+	Query      *Query
+	Subscriber Subscriber
+}
+
+type multiSubscription []Subscription
+
+func (m multiSubscription) push() {
+	for _, sub := range m {
+		sub.push()
+	}
+}
+
+func (m multiSubscription) publish(structPointer any, filter func(Caller) bool) {
+	for _, sub := range m {
+		sub.publish(structPointer, filter)
+	}
+}
+
+func (m multiSubscription) matches(val reflect.Value) bool {
+	for _, sub := range m {
+		if sub.matches(val) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiSubscription) Close() error {
+	var result error
+	for _, sub := range m {
+		if err := sub.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (m multiSubscription) Pause() error {
+	var result error
+	for _, sub := range m {
+		if err := sub.Pause(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (m multiSubscription) Resume() error {
+	var result error
+	for _, sub := range m {
+		if err := sub.Resume(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// SubscribeAll subscribes to all the queries, each delivering to its own subscriber, and returns
+// a single Subscription closing, pausing, and resuming all of them. If any subscription fails, the already created ones are closed.
+func SubscribeAll(s *Snek, caller Caller, querySubscribers ...QuerySubscriber) (Subscription, error) {
+	result := multiSubscription{}
+	for _, querySubscriber := range querySubscribers {
+		sub, err := Subscribe(s, caller, querySubscriber.Query, querySubscriber.Subscriber)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+		result = append(result, sub)
+	}
+	return result, nil
+}
+
+// validateTail returns an error unless subscriber and query can be used by a Tail subscription.
+func validateTail(subscriber Subscriber, query *Query) error {
+	structType := subscriber.getType()
+	if reflect.TypeOf(subscriber.prepareResult()) != reflect.PointerTo(reflect.SliceOf(structType)) {
+		return fmt.Errorf("only subscribers delivering structs can be tailed")
+	}
+	if idField, found := structType.FieldByName("ID"); !found || idField.Type != idType {
+		return fmt.Errorf("%s has no ID field of type ID to tail", structType.Name())
+	}
+	if len(query.Order) > 0 || query.Limit > 0 || query.Offset > 0 || query.Recursion != nil {
+		return fmt.Errorf("tailed queries can't have Order, Limit, Offset, or Recursion")
+	}
+	return nil
+}
+
 // Subscribe creates a subscription of the data in the store matching
 // the query, and asynchronously sends the current content and the
 // content post any update of the store to the subscriber.
+// If loading the content fails the subscriber gets the error, and the subscription is retried at the next update.
 // If the subscriber returns an error it will be cleaned up and removed.
 func Subscribe(s *Snek, caller Caller, query *Query, subscriber Subscriber) (Subscription, error) {
 	if len(query.Joins) > 0 {
@@ -155,17 +708,56 @@ func Subscribe(s *Snek, caller Caller, query *Query, subscriber Subscriber) (Sub
 	if query.Set == nil {
 		query.Set = All{}
 	}
+	query.normalize(subscriber.getType())
+	ctx, cancel := context.WithCancel(s.callerContext(caller))
 	sub := &subscription{
 		id:         s.NewID(),
 		snek:       s,
 		query:      query,
 		subscriber: subscriber,
 		caller:     caller,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	// Throttled, Tail, and WithLastModified configure the subscription itself, so their wrappers are removed in whatever order they wrap each other.
+	// WithEvents may wrap them as well, so its wrapper is removed too, and wraps the remaining subscriber again afterwards.
+	var events *eventSubscriber
+	for unwrapped := false; !unwrapped; {
+		switch wrapper := sub.subscriber.(type) {
+		case *eventSubscriber:
+			sub.subscriber = wrapper.Subscriber
+			if events == nil {
+				events = wrapper
+			}
+		case *throttledSubscriber:
+			sub.subscriber = wrapper.Subscriber
+			sub.interval = wrapper.interval
+		case *tailSubscriber:
+			if err := validateTail(wrapper.Subscriber, query); err != nil {
+				cancel()
+				return nil, err
+			}
+			sub.subscriber = wrapper.Subscriber
+			sub.tail = true
+			sub.backlog = wrapper.backlog
+		case *lastModifiedSubscriber:
+			sub.subscriber = wrapper.Subscriber
+			sub.lastModifiedHandler = wrapper.handler
+		default:
+			unwrapped = true
+		}
+	}
+	if events != nil {
+		sub.subscriber = &eventSubscriber{Subscriber: sub.subscriber, handler: events.handler}
 	}
 	subs := s.getSubscriptions(sub.subscriber.getType())
 	subs.Set(string(sub.id), sub)
-	go func() {
-		sub.push()
-	}()
+	for typ := range query.types(sub.subscriber.getType()) {
+		if typ != sub.subscriber.getType() {
+			sub.correlatedTypes = append(sub.correlatedTypes, typ)
+			s.getCorrelatedSubscriptions(typ).Set(string(sub.id), sub)
+		}
+	}
+	s.pushPool.push(subscriptionSet{string(sub.id): sub})
 	return sub, nil
 }
@@ -0,0 +1,44 @@
+package snek
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// textNormalizations maps the `snek` tag options normalizing text to their normalizations.
+//
+// Fields of string type tagged with `snek:"nfc"` are normalized to Unicode Normalization Form C, and fields
+// tagged with `snek:"casefold"` are also case folded, before being stored. Values compared to them in conditions
+// are normalized the same way, so that e.g. visually identical usernames entered using different forms are equal.
+//
+// Since the normalization happens in the structs being inserted or updated, before the update control is
+// consulted, the stored (and returned) text differs from the text given. Values stored before the tag
+// was added aren't normalized, so the choice should be made before production data exists.
+var textNormalizations = map[string]func(string) string{
+	"nfc": norm.NFC.String,
+	"casefold": func(s string) string {
+		// Casers are stateful, and can't be shared between goroutines.
+		return norm.NFC.String(cases.Fold().String(s))
+	},
+}
+
+// textNormalizationOrder is the order in which fields tagged with several text normalizations check for them, where
+// later normalizations replace earlier ones. Since case folding includes NFC, `snek:"nfc,casefold"` case folds.
+var textNormalizationOrder = []string{"nfc", "casefold"}
+
+// normalizeText replaces the text fields of the struct in info tagged with text normalizations with their normalized forms.
+func normalizeText(info *valueInfo) error {
+	for fieldName, field := range info.fields(false) {
+		if field.normalizeText == nil {
+			continue
+		}
+		fieldVal, err := fieldByName(info.val, fieldName)
+		if err != nil {
+			return err
+		}
+		if fieldVal.IsValid() {
+			fieldVal.SetString(field.normalizeText(fieldVal.String()))
+		}
+	}
+	return nil
+}
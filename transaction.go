@@ -1,11 +1,16 @@
 package snek
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -14,8 +19,14 @@ import (
 type View struct {
 	tx        *sqlx.Tx
 	snek      *Snek
+	ctx       context.Context
 	caller    Caller
 	isControl bool
+	// isUpdate is set for the Views of Updates.
+	isUpdate bool
+	// cacheable is set for Views that aren't part of Updates, and cacheGeneration is the query cache generation when they began.
+	cacheable       bool
+	cacheGeneration uint64
 }
 
 // Caller returns the caller of this view.
@@ -23,38 +34,134 @@ func (v *View) Caller() Caller {
 	return v.caller
 }
 
+// Context returns the context of the caller of this view, if it carries one, and otherwise a background context.
+// The statements of the view are executed using the context, so they fail once it's canceled.
+func (v *View) Context() context.Context {
+	return v.ctx
+}
+
 func (v *View) queryControl(typ reflect.Type, query *Query) error {
-	if v.caller.IsSystem() || v.isControl {
+	if (v.caller.IsSystem() && !v.snek.options.SystemRunsControl) || v.isControl {
 		return nil
 	}
 	perms, found := v.snek.permissions[typ.Name()]
 	if !found || perms.queryControl == nil {
-		return fmt.Errorf("%s not registered with query control", typ.Name())
+		return &NotRegisteredError{TypeName: typ.Name(), Control: "query"}
 	}
 	v.isControl = true
 	defer func() { v.isControl = false }()
 	return perms.queryControl(v, query)
 }
 
+// hasFieldControl returns whether structs of typ loaded in this view pass through a field control.
+func (v *View) hasFieldControl(typ reflect.Type) bool {
+	if (v.caller.IsSystem() && !v.snek.options.SystemRunsControl) || v.isControl || v.isUpdate {
+		return false
+	}
+	return v.snek.permissions[typ.Name()].fieldControl != nil
+}
+
+// fieldControl passes the struct structPointer points to, or each element if it's a pointer to a slice, through the field control of typ, if it has one.
+func (v *View) fieldControl(typ reflect.Type, structPointer any) error {
+	if !v.hasFieldControl(typ) {
+		return nil
+	}
+	control := v.snek.permissions[typ.Name()].fieldControl
+	v.isControl = true
+	defer func() { v.isControl = false }()
+	val := reflect.ValueOf(structPointer)
+	if val.Elem().Kind() != reflect.Slice {
+		return control(v, structPointer)
+	}
+	for index := 0; index < val.Elem().Len(); index++ {
+		if err := control(v, val.Elem().Index(index).Addr().Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *View) applyDefaultSet(typ reflect.Type, query *Query) {
+	perms, found := v.snek.permissions[typ.Name()]
+	if !found || perms.defaultSet == nil {
+		return
+	}
+	defaultSet := perms.defaultSet(v.caller)
+	if defaultSet == nil {
+		return
+	}
+	if query.Set == nil {
+		query.Set = defaultSet
+	} else {
+		query.Set = And{query.Set, defaultSet}
+	}
+}
+
 // Update represents a read/write transaction.
+// Reads in an Update, including those of control functions, see the writes made earlier in it, and never use the query cache.
 type Update struct {
 	*View
-	subscriptions subscriptionSet
+	// subscriptions maps type names to the subscriptions to push after the update commits.
+	subscriptions map[string]subscriptionSet
+	changedTypes  map[reflect.Type]bool
+	changedAll    bool
+	// removing contains the removal keys of the structs being removed, to avoid removing them again when relations are cyclic.
+	removing map[string]bool
+	// changes are the changes to deliver to watchers after the update commits.
+	changes []pendingChange
+}
+
+// addSubscriptionsFor adds the subscriptions matching val to the update, and notes that the type of val changed.
+func (u *Update) addSubscriptionsFor(val reflect.Value) {
+	u.subscriptionsOf(val.Type()).merge(u.snek.getSubscriptionsFor(val))
+	u.addCorrelatedSubscriptions(val.Type())
+	u.changedTypes[val.Type()] = true
+}
+
+// addCorrelatedSubscriptions adds the subscriptions of other types whose queries read typ to the update.
+func (u *Update) addCorrelatedSubscriptions(typ reflect.Type) {
+	u.snek.getCorrelatedSubscriptions(typ).Each(func(id string, sub *subscription) {
+		u.subscriptionsOf(sub.subscriber.getType())[id] = sub
+	})
+}
+
+func (u *Update) subscriptionsOf(typ reflect.Type) subscriptionSet {
+	result, found := u.subscriptions[typ.Name()]
+	if !found {
+		result = subscriptionSet{}
+		u.subscriptions[typ.Name()] = result
+	}
+	return result
 }
 
 func (u *Update) updateControl(typ reflect.Type, prev, next any) error {
-	if u.View.caller.IsSystem() || u.View.isControl {
+	if (u.View.caller.IsSystem() && !u.snek.options.SystemRunsControl) || u.View.isControl {
 		return nil
 	}
 	perms, found := u.snek.permissions[typ.Name()]
 	if !found || perms.updateControl == nil {
-		return fmt.Errorf("%s not registered with update control", typ.Name())
+		return &NotRegisteredError{TypeName: typ.Name(), Control: "update"}
 	}
 	u.View.isControl = true
 	defer func() { u.View.isControl = false }()
 	return perms.updateControl(u, prev, next)
 }
 
+// immutableControl returns an ImmutableFieldError if next has a different value than prev for any `snek:"immutable"` field.
+func (u *Update) immutableControl(info *valueInfo, prev, next any) error {
+	changed, err := Diff(prev, next)
+	if err != nil {
+		return err
+	}
+	fields := info.fields(false)
+	for _, field := range changed {
+		if fields[field].immutable {
+			return &ImmutableFieldError{TypeName: info.typ.Name(), Field: field}
+		}
+	}
+	return nil
+}
+
 // Caller identifies the caller of a function.
 type Caller interface {
 	UserID() ID
@@ -62,25 +169,130 @@ type Caller interface {
 	IsSystem() bool
 }
 
+// ContextCaller is implemented by callers carrying the context of their request, e.g. a trace ID or the remote address,
+// which is then available to control functions via View.Context.
+type ContextCaller interface {
+	Caller
+	Context() context.Context
+}
+
+type contextCaller struct {
+	Caller
+	ctx context.Context
+}
+
+func (c contextCaller) Context() context.Context {
+	return c.ctx
+}
+
+// WithContext returns a caller carrying ctx. Views and Updates for the returned caller report the wrapped caller as their caller.
+func WithContext(caller Caller, ctx context.Context) Caller {
+	return contextCaller{Caller: unwrapCaller(caller), ctx: ctx}
+}
+
+func unwrapCaller(caller Caller) Caller {
+	if wrapped, ok := caller.(contextCaller); ok {
+		return wrapped.Caller
+	}
+	return caller
+}
+
+// callerContext returns the context carried by caller, or the context of the store if it carries none.
+func (s *Snek) callerContext(caller Caller) context.Context {
+	if contextCaller, ok := caller.(ContextCaller); ok {
+		if ctx := contextCaller.Context(); ctx != nil {
+			return ctx
+		}
+	}
+	return s.ctx
+}
+
+// ErrNestedTransaction is returned when starting an Update inside another transaction, or a View inside an Update.
+// Since SQLite only allows one writer at a time, and the nested transaction would neither see nor be
+// seen by the outer transaction, it would at best be confusing, and at worst block until timing out.
+// Use the View or Update already provided to the outer function instead.
+//
+// Transactions are detected as nested when the caller carries the context of an open transaction, e.g. WithContext(caller, v.Context()).
+var ErrNestedTransaction = errors.New("nested transactions not allowed, use the outer transaction instead")
+
+// transactionKey is the context key of the openTransaction a transaction context belongs to.
+type transactionKey struct{}
+
+// openTransaction marks the context of a transaction. Since the context may outlive the transaction, e.g. in subscriptions
+// created inside it, done is set when the transaction is over.
+type openTransaction struct {
+	update bool
+	done   atomic.Bool
+}
+
+// enterTransaction returns the context of a transaction for caller, marked as belonging to it, and a function marking the transaction as over.
+// Views inside Views are allowed, since they can't block each other.
+func (s *Snek) enterTransaction(caller Caller, update bool) (context.Context, func(), error) {
+	ctx := s.callerContext(caller)
+	if outer, found := ctx.Value(transactionKey{}).(*openTransaction); found && !outer.done.Load() && (update || outer.update) {
+		return nil, nil, ErrNestedTransaction
+	}
+	transaction := &openTransaction{update: update}
+	return context.WithValue(ctx, transactionKey{}, transaction), func() {
+		transaction.done.Store(true)
+	}, nil
+}
+
 // View executs f in the context of a read-only transaction.
 func (s *Snek) View(caller Caller, f func(*View) error) error {
-	tx, err := s.db.BeginTxx(s.ctx, &sql.TxOptions{
-		Isolation: sql.LevelSerializable,
+	return s.view(caller, s.options.ViewIsolation, false, f)
+}
+
+// Snapshot executes f in the context of a read-only transaction reading from a snapshot of the store taken when Snapshot is called,
+// instead of using the isolation level in Options.ViewIsolation. It's meant for long analytics reads.
+//
+// SQLite transactions are deferred, i.e. they don't read a snapshot until their first query, so a View sees commits made
+// between its start and its first query. Snapshot starts reading immediately, so it never sees commits made after it was called,
+// even in the middle of a scan. If the database uses WAL journaling (e.g. via "?_journal_mode=WAL" in the path) the snapshot
+// neither blocks nor gets blocked by concurrent Updates, but it prevents checkpoints from completing while open, so the WAL grows
+// until it's done. Without WAL journaling it blocks Updates from committing like any other reader.
+func (s *Snek) Snapshot(caller Caller, f func(*View) error) error {
+	return s.view(caller, sql.LevelSnapshot, true, f)
+}
+
+func (s *Snek) view(caller Caller, isolation sql.IsolationLevel, startSnapshot bool, f func(*View) error) error {
+	ctx, leave, err := s.enterTransaction(caller, false)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	tx, err := s.readDB.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: isolation,
 		ReadOnly:  true,
 	})
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
-	return f(&View{
+	if startSnapshot {
+		// Reading anything makes SQLite acquire the read snapshot for the rest of the transaction.
+		var tables int
+		if err := tx.GetContext(ctx, &tables, "SELECT COUNT(*) FROM sqlite_master;"); err != nil {
+			return err
+		}
+	}
+	view := &View{
 		tx:     tx,
 		snek:   s,
-		caller: caller,
-	})
+		ctx:    ctx,
+		caller: unwrapCaller(caller),
+		// Cached results may be newer than the snapshot.
+		cacheable: s.queryCache != nil && !startSnapshot,
+	}
+	if view.cacheable {
+		view.cacheGeneration = s.queryCache.currentGeneration()
+	}
+	return f(view)
 }
 
-func (v *View) logSQL(query string, params []any, structSlicePointer any, err error) {
-	if !v.snek.options.LogSQL {
+func (v *View) logSQL(query string, params []any, structSlicePointer any, started time.Time, err error) {
+	duration := time.Since(started)
+	if !v.snek.shouldLogSQL(duration) {
 		return
 	}
 	indentedQuery := strings.Join(strings.Split(query, "\n"), "\n  ")
@@ -107,6 +319,10 @@ func (v *View) logSQL(query string, params []any, structSlicePointer any, err er
 		}
 		paramString = fmt.Sprintf("\nParameters: %s", strings.Join(paramParts, ", "))
 	}
+	interpolated := ""
+	if v.snek.options.LogInterpolatedSQL {
+		interpolated = fmt.Sprintf("\nInterpolated:\n  %s", strings.Join(strings.Split(interpolateSQL(query, params), "\n"), "\n  "))
+	}
 	res := ""
 	if structSlicePointer != nil {
 		res = fmt.Sprintf("(%d results), ", reflect.ValueOf(structSlicePointer).Elem().Len())
@@ -115,7 +331,122 @@ func (v *View) logSQL(query string, params []any, structSlicePointer any, err er
 	if v.isControl {
 		acl = "[ACL] "
 	}
-	v.snek.logIf(v.snek.options.LogSQL, "%sSQL => %s%v\n  %s%s", acl, res, err, indentedQuery, paramString)
+	v.snek.logIf(true, "%sSQL (%v) => %s%v\n  %s%s%s", acl, duration, res, err, indentedQuery, paramString, interpolated)
+}
+
+// prepareQuery returns a copy of query restricted by the query control of structType, validated, and normalized.
+func (v *View) prepareQuery(structType reflect.Type, query *Query) (*Query, error) {
+	queryCopy := query.clone()
+	v.applyDefaultSet(structType, queryCopy)
+	if err := v.queryControl(structType, queryCopy); err != nil {
+		return nil, err
+	}
+	if err := queryCopy.validate(v.caller, structType); err != nil {
+		return nil, err
+	}
+	// Types without tables would otherwise fail with opaque SQLite errors.
+	for typ := range queryCopy.types(structType) {
+		if _, found := v.snek.permissions[typ.Name()]; !found {
+			return nil, &NotRegisteredError{TypeName: typ.Name()}
+		}
+	}
+	if queryCopy.IndexedBy != "" {
+		if err := v.validateIndex(structType, queryCopy.IndexedBy); err != nil {
+			return nil, err
+		}
+	}
+	queryCopy.normalize(structType)
+	return queryCopy, nil
+}
+
+// validateIndex returns an error unless the table of structType has an index named index.
+func (v *View) validateIndex(structType reflect.Type, index string) error {
+	sql := "SELECT COUNT(*) FROM sqlite_master WHERE \"type\" = 'index' AND \"name\" = ? AND \"tbl_name\" = ?;"
+	params := []any{index, v.snek.naming().table(structType)}
+	found := 0
+	started := time.Now()
+	err := v.tx.GetContext(v.ctx, &found, sql, params...)
+	v.logSQL(sql, params, nil, started, err)
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return fmt.Errorf("%s has no index %q", structType.Name(), index)
+	}
+	return nil
+}
+
+// Count returns the number of structs of the same type as structPointer that the query would select.
+func (v *View) Count(structPointer any, query *Query) (int, error) {
+	if query == nil {
+		query = &Query{}
+	}
+	typ := reflect.TypeOf(structPointer)
+	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return 0, &InvalidArgumentError{Allowed: "pointers to structs", Argument: typ}
+	}
+	return v.count(typ.Elem(), query)
+}
+
+// GroupCount returns the number of structs of the same type as structPointer that the query would select, grouped by the value of field
+// and ordered by that value.
+func (v *View) GroupCount(structPointer any, field string, query *Query) ([]GroupCount, error) {
+	if query == nil {
+		query = &Query{}
+	}
+	typ := reflect.TypeOf(structPointer)
+	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct {
+		return nil, &InvalidArgumentError{Allowed: "pointers to structs", Argument: typ}
+	}
+	return v.groupCount(typ.Elem(), field, query)
+}
+
+func (v *View) groupCount(structType reflect.Type, field string, query *Query) ([]GroupCount, error) {
+	fieldInfo, found := (&valueInfo{typ: structType}).fields(false)[field]
+	if !found {
+		return nil, fmt.Errorf("%s has no field %q", structType.Name(), field)
+	}
+	if fieldInfo.encrypted {
+		return nil, fmt.Errorf("%s.%s is encrypted, and can't be grouped by", structType.Name(), field)
+	}
+	if v.hasFieldControl(structType) {
+		// The group values would reveal the fields the control hides.
+		return nil, fmt.Errorf("%s has a field control, and can't be grouped by", structType.Name())
+	}
+	queryCopy, err := v.prepareQuery(structType, query)
+	if err != nil {
+		return nil, err
+	}
+	sql, params := queryCopy.toGroupCountStatement(v.snek.naming(), structType, field)
+	started := time.Now()
+	result := []GroupCount{}
+	err = v.tx.SelectContext(v.ctx, &result, sql, params...)
+	v.logSQL(sql, params, nil, started, err)
+	return result, err
+}
+
+// Exists returns whether the query would select any structs of the same type as structPointer.
+func (v *View) Exists(structPointer any, query *Query) (bool, error) {
+	if query == nil {
+		query = &Query{}
+	}
+	limited := query.clone()
+	limited.Limit = 1
+	count, err := v.Count(structPointer, limited)
+	return count > 0, err
+}
+
+func (v *View) count(structType reflect.Type, query *Query) (int, error) {
+	queryCopy, err := v.prepareQuery(structType, query)
+	if err != nil {
+		return 0, err
+	}
+	sql, params := queryCopy.toCountStatement(v.snek.naming(), structType)
+	started := time.Now()
+	result := 0
+	err = v.tx.GetContext(v.ctx, &result, sql, params...)
+	v.logSQL(sql, params, nil, started, err)
+	return result, err
 }
 
 // Select executs the query and puts the results in structSlicePointer.
@@ -125,69 +456,322 @@ func (v *View) Select(structSlicePointer any, query *Query) error {
 	}
 	typ := reflect.TypeOf(structSlicePointer)
 	if typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Slice || typ.Elem().Elem().Kind() != reflect.Struct {
-		return fmt.Errorf("only pointers to slices of structs allowed, not %v", typ)
+		return &InvalidArgumentError{Allowed: "pointers to slices of structs", Argument: typ}
 	}
-	structType := typ.Elem().Elem()
-	queryCopy := query.clone()
-	if err := v.queryControl(structType, queryCopy); err != nil {
+	return v.selectFields(structSlicePointer, typ.Elem().Elem(), nil, query)
+}
+
+// SelectInto returns the structs of sourceType that the query selects, scanned into structs of type D, e.g. to avoid loading
+// large fields, or to decouple read models from the stored types.
+//
+// Only the columns of the fields of D are selected, and every field of D must have a field with the same name and column type
+// in sourceType. The query, including the query control and default Set of sourceType, is applied as if selecting sourceType.
+func SelectInto[D any](v *View, sourceType reflect.Type, query *Query) ([]D, error) {
+	if query == nil {
+		query = &Query{}
+	}
+	for sourceType != nil && sourceType.Kind() == reflect.Pointer {
+		sourceType = sourceType.Elem()
+	}
+	destType := reflect.TypeOf(*new(D))
+	if sourceType == nil || sourceType.Kind() != reflect.Struct || destType.Kind() != reflect.Struct {
+		return nil, &InvalidArgumentError{Allowed: "struct types", Argument: sourceType}
+	}
+	if v.hasFieldControl(sourceType) {
+		// The field control only knows how to modify structs of sourceType.
+		return nil, fmt.Errorf("%s has a field control, and can't be selected into other types", sourceType.Name())
+	}
+	sourceFields := (&valueInfo{typ: sourceType}).fields(false)
+	fields := []string{}
+	for fieldName, destField := range (&valueInfo{typ: destType}).fields(false) {
+		sourceField, found := sourceFields[fieldName]
+		if !found {
+			return nil, fmt.Errorf("%s.%s isn't a field of %s", destType.Name(), fieldName, sourceType.Name())
+		}
+		if sourceField.columnType != destField.columnType || sourceField.encrypted != destField.encrypted {
+			return nil, fmt.Errorf("%s.%s isn't stored like %s.%s", destType.Name(), fieldName, sourceType.Name(), fieldName)
+		}
+		fields = append(fields, fieldName)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%s has no stored fields", destType.Name())
+	}
+	sort.Strings(fields)
+	result := []D{}
+	if err := v.selectFields(&result, sourceType, fields, query); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// JoinCount is a struct selected by SelectJoinCounts, and the number of structs of the join type related to it.
+type JoinCount[T any] struct {
+	Struct T
+	Count  int
+}
+
+// SelectJoinCounts returns the structs of type T that the query selects, each with the number of structs of the type of join
+// that are in the Set of join and relate to it as defined by the On conditions of join, e.g. the number of members of each group.
+//
+// The results are ordered by the count, descending if desc is set, before the Order of the query, and structs without related
+// structs are included with a zero count. Only structs visible through the query control (and default Set) of the join type are counted,
+// and join types whose query control adds Joins or Recursion can't be counted.
+func SelectJoinCounts[T any](v *View, join Join, query *Query, desc bool) ([]JoinCount[T], error) {
+	if query == nil {
+		query = &Query{}
+	}
+	structType := reflect.TypeOf(*new(T))
+	if structType.Kind() != reflect.Struct || join.typ == nil || join.typ.Kind() != reflect.Struct {
+		return nil, &InvalidArgumentError{Allowed: "struct types", Argument: structType}
+	}
+	if len(join.on) == 0 {
+		return nil, fmt.Errorf("counted joins need On conditions")
+	}
+	queryCopy, err := v.prepareQuery(structType, query)
+	if err != nil {
+		return nil, err
+	}
+	joinSet := join.set
+	if joinSet == nil {
+		joinSet = All{}
+	}
+	joinQuery, err := v.prepareQuery(join.typ, &Query{Set: joinSet})
+	if err != nil {
+		return nil, err
+	}
+	if len(joinQuery.Joins) > 0 || joinQuery.Recursion != nil {
+		// Only the Set of the controlled query is applied to the counted structs, so counting would include structs the control hides.
+		return nil, fmt.Errorf("the query control of %s adds Joins or Recursion, which counted joins don't support", join.typ.Name())
+	}
+	join.set = joinQuery.Set
+	sql, params := queryCopy.toJoinCountStatement(v.snek.naming(), structType, join, desc)
+	result := []JoinCount[T]{}
+	started := time.Now()
+	err = v.tx.SelectContext(v.ctx, &result, sql, params...)
+	v.logSQL(sql, params, &result, started, err)
+	if err != nil {
+		return nil, err
+	}
+	for index := range result {
+		if err := v.snek.decrypt(&result[index].Struct); err != nil {
+			return nil, err
+		}
+		if err := afterLoad(&result[index].Struct); err != nil {
+			return nil, err
+		}
+		if err := v.fieldControl(structType, &result[index].Struct); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// selectFields selects structs of structType using query, scanning the columns of fields (or all columns if fields is nil) into structSlicePointer.
+func (v *View) selectFields(structSlicePointer any, structType reflect.Type, fields []string, query *Query) error {
+	queryCopy, err := v.prepareQuery(structType, query)
+	if err != nil {
 		return err
 	}
-	sql, params := queryCopy.toSelectStatement(structType)
-	err := v.tx.SelectContext(v.snek.ctx, structSlicePointer, sql, params...)
-	v.logSQL(sql, params, structSlicePointer, err)
-	return err
+	return v.selectPrepared(structSlicePointer, structType, fields, queryCopy)
+}
+
+// selectPrepared is selectFields for a query already prepared by prepareQuery.
+func (v *View) selectPrepared(structSlicePointer any, structType reflect.Type, fields []string, queryCopy *Query) error {
+	sql, params := queryCopy.toSelectFieldsStatement(v.snek.naming(), structType, fields)
+	sliceVal := reflect.ValueOf(structSlicePointer).Elem()
+	cacheKey := ""
+	if v.cacheable {
+		cacheKey = queryCacheKey(sql, params)
+		if rows, found := v.snek.queryCache.get(cacheKey, sliceVal.Type()); found {
+			sliceVal.Set(reflect.AppendSlice(reflect.MakeSlice(sliceVal.Type(), 0, rows.Len()), rows))
+			if err := afterLoad(structSlicePointer); err != nil {
+				return err
+			}
+			return v.fieldControl(structType, structSlicePointer)
+		}
+	}
+	var stats *QueryStats
+	if v.snek.options.MaxScanRows > 0 || v.snek.options.QueryObserver != nil {
+		fullScans, err := v.fullScans(queryCopy.tableAliases(v.snek.naming(), structType), sql, params)
+		if err != nil {
+			return err
+		}
+		stats = &QueryStats{SQL: sql, Params: params, FullScans: fullScans}
+		if maxRows := v.snek.options.MaxScanRows; maxRows > 0 && stats.ScannedRows() > maxRows {
+			stats.Err = &ScanBudgetError{FullScans: fullScans, Max: maxRows}
+			v.observeQuery(stats)
+			return stats.Err
+		}
+	}
+	started := time.Now()
+	err := v.tx.SelectContext(v.ctx, structSlicePointer, sql, params...)
+	v.logSQL(sql, params, structSlicePointer, started, err)
+	if stats != nil {
+		stats.Duration = time.Since(started)
+		stats.ReturnedRows = sliceVal.Len()
+		stats.Err = err
+		v.observeQuery(stats)
+	}
+	if err != nil {
+		return err
+	}
+	if err := v.snek.decryptAs(structSlicePointer, structType); err != nil {
+		return err
+	}
+	if v.cacheable {
+		rows := reflect.AppendSlice(reflect.MakeSlice(sliceVal.Type(), 0, sliceVal.Len()), sliceVal)
+		v.snek.queryCache.put(v.cacheGeneration, cacheKey, queryCopy.types(structType), rows)
+	}
+	if err := afterLoad(structSlicePointer); err != nil {
+		return err
+	}
+	return v.fieldControl(structType, structSlicePointer)
+}
+
+// SelectTree puts the struct with ID rootID, and recursively all structs whose parentField is the ID of an already selected struct, in structSlicePointer.
+func (v *View) SelectTree(structSlicePointer any, rootID ID, parentField string) error {
+	return v.Select(structSlicePointer, &Query{
+		Recursion: &Recursion{
+			ParentField: parentField,
+			Start:       Cond{"ID", EQ, rootID},
+		},
+	})
 }
 
 func (v *View) get(structPointer any, info *valueInfo) error {
-	sql, params := info.toGetStatement()
-	err := v.tx.GetContext(v.snek.ctx, structPointer, sql, params...)
-	v.logSQL(sql, params, nil, err)
-	return err
+	sql, params := info.toGetStatement(v.snek.naming())
+	started := time.Now()
+	err := v.tx.GetContext(v.ctx, structPointer, sql, params...)
+	v.logSQL(sql, params, nil, started, err)
+	if err != nil {
+		return err
+	}
+	if err := v.snek.decrypt(structPointer); err != nil {
+		return err
+	}
+	return afterLoad(structPointer)
 }
 
 // Get populates structPointer with the data at structPointer.ID in the store.
 func (v *View) Get(structPointer any) error {
-	info, err := getValueInfo(reflect.ValueOf(structPointer))
+	info, err := v.snek.getValueInfo(reflect.ValueOf(structPointer))
 	if err != nil {
 		return err
 	}
-	query := &Query{Set: &Cond{"ID", EQ, info.id}}
+	query := &Query{Set: info.keySet()}
+	v.applyDefaultSet(info.typ, query)
 	if err := v.queryControl(info.typ, query); err != nil {
 		return err
 	}
-	sql, params := query.toSelectStatement(info.typ)
-	err = v.tx.GetContext(v.snek.ctx, structPointer, sql, params...)
-	v.logSQL(sql, params, nil, err)
-	return err
+	sql, params := query.toSelectStatement(v.snek.naming(), info.typ)
+	started := time.Now()
+	err = v.tx.GetContext(v.ctx, structPointer, sql, params...)
+	v.logSQL(sql, params, nil, started, err)
+	if err != nil {
+		return err
+	}
+	if err := v.snek.decrypt(structPointer); err != nil {
+		return err
+	}
+	if err := afterLoad(structPointer); err != nil {
+		return err
+	}
+	return v.fieldControl(info.typ, structPointer)
 }
 
 // Update executs f in the context of a read/write transaction.
 func (s *Snek) Update(caller Caller, f func(*Update) error) error {
-	tx, err := s.db.BeginTxx(s.ctx, &sql.TxOptions{
-		Isolation: sql.LevelSerializable,
+	ctx, leave, err := s.enterTransaction(caller, true)
+	if err != nil {
+		return err
+	}
+	defer leave()
+	tx, err := s.db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: s.options.UpdateIsolation,
 		ReadOnly:  false,
 	})
 	if err != nil {
 		return err
 	}
-	subscriptions := subscriptionSet{}
-	if err := f(&Update{
+	update := &Update{
 		View: &View{
-			tx:     tx,
-			snek:   s,
-			caller: caller,
+			tx:       tx,
+			snek:     s,
+			ctx:      ctx,
+			caller:   unwrapCaller(caller),
+			isUpdate: true,
 		},
-		subscriptions: subscriptions,
-	}); err != nil {
-		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+		subscriptions: map[string]subscriptionSet{},
+		changedTypes:  map[reflect.Type]bool{},
+		removing:      map[string]bool{},
+	}
+	if err := f(update); err != nil {
+		// Transactions are rolled back automatically when their context is canceled.
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
 			log.Fatal(rollbackErr)
 		}
 		return err
 	}
+	if len(update.changes) > 0 {
+		s.watchLock.Lock()
+		defer s.watchLock.Unlock()
+	}
 	if err := tx.Commit(); err != nil {
 		return err
 	}
-	subscriptions.push()
+	update.deliverChanges()
+	if s.queryCache != nil {
+		s.queryCache.invalidate(update.changedTypes, update.changedAll)
+	}
+	if s.sharedLoads != nil {
+		s.sharedLoads.invalidate(update.changedTypes, update.changedAll)
+	}
+	s.recordCommit(update.changedTypes, update.changedAll)
+	for typeName, subs := range update.subscriptions {
+		s.pushSubscriptions(typeName, subs)
+	}
+	return nil
+}
+
+// recordCommit records the current time as the commit time of the changes to types, or all types if all is set.
+func (s *Snek) recordCommit(types map[reflect.Type]bool, all bool) {
+	if !all && len(types) == 0 {
+		return
+	}
+	now := s.Now()
+	if all {
+		s.commitTimes.Set("", now)
+	}
+	for typ := range types {
+		s.commitTimes.Set(typ.Name(), now)
+	}
+}
+
+// lastCommit returns the commit time of the last Update changing any of types since the store was opened, or the zero time if there was none.
+func (s *Snek) lastCommit(types map[reflect.Type]bool) time.Time {
+	result, _ := s.commitTimes.Get("")
+	for typ := range types {
+		if committed, found := s.commitTimes.Get(typ.Name()); found && committed.After(result) {
+			result = committed
+		}
+	}
+	return result
+}
+
+// loadGenerated replaces the generated fields of the struct in info, which contain whatever the caller put there, with the values
+// computed by SQLite, so that the struct can be matched against subscriptions and watches, and the caller sees what was stored.
+func (u *Update) loadGenerated(info *valueInfo) error {
+	generated := generatedColumns(info.typ)
+	if len(generated) == 0 {
+		return nil
+	}
+	stored := reflect.New(info.typ)
+	if err := u.get(stored.Interface(), info); err != nil {
+		return err
+	}
+	for field := range generated {
+		copyField(info.val, stored.Elem(), strings.Split(field, "."))
+	}
 	return nil
 }
 
@@ -196,13 +780,15 @@ func (u *Update) loadAndAddSubscriptionsForCurrent(info *valueInfo) (any, error)
 	if err := u.get(existingVal.Interface(), info); err != nil {
 		return nil, err
 	}
-	u.subscriptions.merge(u.snek.getSubscriptionsFor(existingVal.Elem()))
+	u.addSubscriptionsFor(existingVal.Elem())
 	return existingVal.Interface(), nil
 }
 
 // Remove removes the data at structPointer.ID.
+// If the type is a Relater, structs referring to it are handled according to their Relations after the update control allows the removal,
+// but before the data is removed. Cascaded removals consult the update controls of their types, and notify their subscriptions.
 func (u *Update) Remove(structPointer any) error {
-	info, err := getValueInfo(reflect.ValueOf(structPointer))
+	info, err := u.snek.getValueInfo(reflect.ValueOf(structPointer))
 	if err != nil {
 		return err
 	}
@@ -216,16 +802,27 @@ func (u *Update) Remove(structPointer any) error {
 		return err
 	}
 
-	sql, params := info.toDelStatement()
+	key := removalKey(info)
+	u.removing[key] = true
+	defer delete(u.removing, key)
+	if err := u.removeRelated(&valueInfo{val: reflect.ValueOf(current).Elem(), typ: info.typ, id: info.id, key: info.key}); err != nil {
+		return err
+	}
+
+	prevVisible := u.visibleToWatchers(info.typ, info.keySet())
+	sql, params := info.toDelStatement(u.snek.naming())
 	if err := u.exec(sql, params...); err != nil {
 		return err
 	}
-	return nil
+	u.recordChange(info.typ, prevVisible, current, nil, nil)
+	return u.recordHistory(info, true)
 }
 
 // Update replaces the data at structPointer.ID with the data inside structPointer.
+// Changes to fields tagged `snek:"immutable"` are rejected with an ImmutableFieldError before the update control is consulted.
+// Tag options can be combined, e.g. `snek:"index,immutable"`.
 func (u *Update) Update(structPointer any) error {
-	info, err := getValueInfo(reflect.ValueOf(structPointer))
+	info, err := u.snek.getValueInfo(reflect.ValueOf(structPointer))
 	if err != nil {
 		return err
 	}
@@ -235,39 +832,215 @@ func (u *Update) Update(structPointer any) error {
 		return err
 	}
 
+	if err := beforeSave(structPointer); err != nil {
+		return err
+	}
+
+	if err := normalizeText(info); err != nil {
+		return err
+	}
+
+	if err := handleNonFiniteFloats(info, u.snek.options.NonFiniteFloats, nil); err != nil {
+		return err
+	}
+
+	if err := u.immutableControl(info, current, structPointer); err != nil {
+		return err
+	}
+
 	if err := u.updateControl(info.typ, current, structPointer); err != nil {
 		return err
 	}
 
-	sql, params := info.toUpdateStatement()
+	if err := u.snek.encrypt(info); err != nil {
+		return err
+	}
+	prevVisible := u.visibleToWatchers(info.typ, info.keySet())
+	sql, params := info.toUpdateStatement(u.snek.naming(), nil)
+	if err := u.exec(sql, params...); err != nil {
+		return wrapConstraintError(u.snek.naming(), info, err)
+	}
+	if err := u.loadGenerated(info); err != nil {
+		return err
+	}
+	u.recordChange(info.typ, prevVisible, current, u.visibleToWatchers(info.typ, info.keySet()), structPointer)
+	if err := u.recordHistory(info, false); err != nil {
+		return err
+	}
+	u.addSubscriptionsFor(info.val)
+	return nil
+}
+
+// UpdateFields replaces the named fields of the data at structPointer.ID with the same fields inside structPointer, leaving other fields unchanged.
+// Nested fields are named the same way as in Cond, e.g. "Inner.Float".
+// Changes BeforeSave or the update control make to other fields are stored as well.
+// After a successful update structPointer contains the updated data.
+// Like in Update, changes to fields tagged `snek:"immutable"` are rejected.
+func (u *Update) UpdateFields(structPointer any, fields ...string) error {
+	info, err := u.snek.getValueInfo(reflect.ValueOf(structPointer))
+	if err != nil {
+		return err
+	}
+
+	if len(fields) == 0 {
+		return fmt.Errorf("no fields to update")
+	}
+	onlyFields := map[string]bool{}
+	existingFields := info.fields(false)
+	for _, field := range fields {
+		fieldInfo, found := existingFields[field]
+		if !found {
+			return fmt.Errorf("%s has no field %q", info.typ.Name(), field)
+		}
+		if fieldInfo.primaryKey {
+			return fmt.Errorf("primary key %q of %s can't be updated", field, info.typ.Name())
+		}
+		if fieldInfo.generated != "" {
+			return fmt.Errorf("generated field %q of %s can't be updated", field, info.typ.Name())
+		}
+		onlyFields[field] = true
+	}
+
+	current, err := u.loadAndAddSubscriptionsForCurrent(info)
+	if err != nil {
+		return err
+	}
+
+	next := reflect.New(info.typ)
+	next.Elem().Set(reflect.ValueOf(current).Elem())
+	for field := range onlyFields {
+		copyField(next.Elem(), info.val, strings.Split(field, "."))
+	}
+
+	if err := beforeSave(next.Interface()); err != nil {
+		return err
+	}
+
+	nextInfo, err := u.snek.getValueInfo(next)
+	if err != nil {
+		return err
+	}
+	if err := normalizeText(nextInfo); err != nil {
+		return err
+	}
+	if err := handleNonFiniteFloats(nextInfo, u.snek.options.NonFiniteFloats, onlyFields); err != nil {
+		return err
+	}
+
+	if err := u.immutableControl(info, current, next.Interface()); err != nil {
+		return err
+	}
+
+	if err := u.updateControl(info.typ, current, next.Interface()); err != nil {
+		return err
+	}
+
+	// The fields BeforeSave and the update control changed are stored along with the named ones.
+	currentFields := (&valueInfo{val: reflect.ValueOf(current).Elem(), typ: info.typ}).fields(true)
+	changedFields := map[string]bool{}
+	for field, fieldInfo := range nextInfo.fields(true) {
+		if onlyFields[field] || !reflect.DeepEqual(fieldInfo.value, currentFields[field].value) {
+			changedFields[field] = true
+		}
+	}
+
+	if err := u.snek.encrypt(nextInfo); err != nil {
+		return err
+	}
+	prevVisible := u.visibleToWatchers(info.typ, info.keySet())
+	sql, params := nextInfo.toUpdateStatement(u.snek.naming(), changedFields)
 	if err := u.exec(sql, params...); err != nil {
+		return wrapConstraintError(u.snek.naming(), nextInfo, err)
+	}
+	if err := u.loadGenerated(nextInfo); err != nil {
+		return err
+	}
+	u.recordChange(info.typ, prevVisible, current, u.visibleToWatchers(info.typ, info.keySet()), next.Interface())
+	if err := u.recordHistory(nextInfo, false); err != nil {
 		return err
 	}
-	u.subscriptions.merge(u.snek.getSubscriptionsFor(info.val))
+	info.val.Set(next.Elem())
+	u.addSubscriptionsFor(info.val)
 	return nil
 }
 
 // Insert places the data inside structPointer at structPointer.ID.
 func (u *Update) Insert(structPointer any) error {
-	info, err := getValueInfo(reflect.ValueOf(structPointer))
+	info, err := u.snek.getValueInfo(reflect.ValueOf(structPointer))
 	if err != nil {
 		return err
 	}
 
+	if err := beforeSave(structPointer); err != nil {
+		return err
+	}
+
+	if err := normalizeText(info); err != nil {
+		return err
+	}
+
+	if err := handleNonFiniteFloats(info, u.snek.options.NonFiniteFloats, nil); err != nil {
+		return err
+	}
+
 	if err := u.updateControl(info.typ, nil, structPointer); err != nil {
 		return err
 	}
 
-	sql, params := info.toInsertStatement()
+	if err := u.snek.encrypt(info); err != nil {
+		return err
+	}
+	sql, params := info.toInsertStatement(u.snek.naming())
 	if err := u.exec(sql, params...); err != nil {
+		return wrapConstraintError(u.snek.naming(), info, err)
+	}
+	if err := u.loadGenerated(info); err != nil {
+		return err
+	}
+	u.recordChange(info.typ, nil, nil, u.visibleToWatchers(info.typ, info.keySet()), structPointer)
+	if err := u.recordHistory(info, false); err != nil {
 		return err
 	}
-	u.subscriptions.merge(u.snek.getSubscriptionsFor(info.val))
+	u.addSubscriptionsFor(info.val)
 	return nil
 }
 
+// InsertIfAbsent inserts structPointer unless absenceQuery (as seen through the query control) selects any structs of the same type,
+// and returns whether it was inserted.
+// Since the check and the insert happen in the same transaction concurrent calls can't both insert, but with deferred transactions
+// (the SQLite default) the losers may fail with a busy error instead of returning false. Use e.g. "?_txlock=immediate&_busy_timeout=5000"
+// in Options.Path to make them wait for the write lock instead.
+func (u *Update) InsertIfAbsent(structPointer any, absenceQuery *Query) (bool, error) {
+	if absenceQuery == nil {
+		absenceQuery = &Query{}
+	}
+	limited := absenceQuery.clone()
+	limited.Limit = 1
+	count, err := u.Count(structPointer, limited)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return false, nil
+	}
+	if err := u.Insert(structPointer); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Exec executes raw SQL, e.g. DDL in migrations. Since it bypasses all access control, only system callers may use it.
+func (u *Update) Exec(sql string, params ...any) error {
+	if !u.caller.IsSystem() {
+		return fmt.Errorf("only system callers can execute raw SQL")
+	}
+	u.changedAll = true
+	return u.exec(sql, params...)
+}
+
 func (u *Update) exec(sql string, params ...any) error {
-	_, err := u.tx.ExecContext(u.snek.ctx, sql, params...)
-	u.View.logSQL(sql, params, nil, err)
+	started := time.Now()
+	_, err := u.tx.ExecContext(u.ctx, sql, params...)
+	u.View.logSQL(sql, params, nil, started, err)
 	return err
 }
@@ -0,0 +1,192 @@
+package snek
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/zond/snek/synch"
+)
+
+// Change describes a change of a struct of type T, delivered by Watch.
+// Prev is nil for inserts, and Next is nil for removals.
+type Change[T any] struct {
+	Prev *T
+	Next *T
+}
+
+type watcher interface {
+	getCaller() Caller
+	// deliver sends the change to the watcher without blocking, and returns false if its buffer is full.
+	deliver(prev, next any) bool
+	close()
+}
+
+type typedWatcher[T any] struct {
+	caller  Caller
+	changes chan Change[T]
+}
+
+func (t *typedWatcher[T]) getCaller() Caller {
+	return t.caller
+}
+
+func (t *typedWatcher[T]) deliver(prev, next any) bool {
+	change := Change[T]{}
+	if prev != nil {
+		change.Prev = prev.(*T)
+	}
+	if next != nil {
+		change.Next = next.(*T)
+	}
+	select {
+	case t.changes <- change:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *typedWatcher[T]) close() {
+	close(t.changes)
+}
+
+// pendingChange is a change recorded in an Update, delivered to its watcher after the Update commits.
+type pendingChange struct {
+	typ       reflect.Type
+	watcherID string
+	watcher   watcher
+	prev      any
+	next      any
+}
+
+// Watch returns a channel of the changes to structs of type T made using Update.Insert, Update, UpdateFields, and Remove,
+// and a function closing the watch, which closes the channel. Changes made using Update.Exec or Truncate aren't delivered.
+//
+// Unlike subscriptions, which deliver the results of a query, a watch delivers each change, in the order the Updates committed.
+// The Prev and Next of a change are only included if they are visible to the caller through the query control (and default Set) of T,
+// and changes where neither is visible aren't delivered.
+//
+// The channel buffers up to bufferSize changes. If a consumer falls so far behind that the buffer is full, the watch is closed,
+// since the consumer has lost changes and must resynchronize anyway. Delivery never blocks Updates.
+func Watch[T any](s *Snek, caller Caller, bufferSize int) (<-chan Change[T], func()) {
+	typ := reflect.TypeOf(*new(T))
+	w := &typedWatcher[T]{
+		caller:  caller,
+		changes: make(chan Change[T], bufferSize),
+	}
+	id := string(s.NewID())
+	s.getWatchers(typ).Set(id, w)
+	return w.changes, func() {
+		s.closeWatcher(typ, id)
+	}
+}
+
+func (s *Snek) getWatchers(typ reflect.Type) *synch.SMap[string, watcher] {
+	result, _ := s.watchers.SetIfMissing(typ.Name(), synch.NewSMap[string, watcher]())
+	return result
+}
+
+// closeWatcher removes and closes the watcher, unless it's already closed.
+func (s *Snek) closeWatcher(typ reflect.Type, id string) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+	if w, found := s.getWatchers(typ).Del(id); found {
+		w.close()
+	}
+}
+
+// visibleToWatchers returns the IDs of the watchers of typ that can see the struct in keySet, as it currently is in the update.
+func (u *Update) visibleToWatchers(typ reflect.Type, keySet Set) map[string]bool {
+	result := map[string]bool{}
+	u.snek.getWatchers(typ).Each(func(watcherID string, w watcher) {
+		view := &View{
+			tx:     u.tx,
+			snek:   u.snek,
+			ctx:    u.ctx,
+			caller: unwrapCaller(w.getCaller()),
+		}
+		// Errors, e.g. from the query control rejecting the caller, hide the struct from the watcher.
+		count, err := view.count(typ, &Query{Set: keySet})
+		result[watcherID] = err == nil && count > 0
+	})
+	return result
+}
+
+// recordChange records a change of a struct of typ, from prev to next, for delivery to the watchers that could see prev
+// (according to prevVisible) or can see next (according to nextVisible) after the update commits.
+func (u *Update) recordChange(typ reflect.Type, prevVisible map[string]bool, prev any, nextVisible map[string]bool, next any) {
+	if len(prevVisible) == 0 && len(nextVisible) == 0 {
+		return
+	}
+	if prev != nil {
+		prev = copyStruct(prev)
+	}
+	if next != nil {
+		next = copyStruct(next)
+	}
+	u.snek.getWatchers(typ).Each(func(watcherID string, w watcher) {
+		change := pendingChange{typ: typ, watcherID: watcherID, watcher: w}
+		if prevVisible[watcherID] {
+			change.prev = prev
+		}
+		if nextVisible[watcherID] {
+			change.next = next
+		}
+		if change.prev == nil && change.next == nil {
+			return
+		}
+		if err := u.watcherFieldControl(w, &change); err != nil {
+			// Like errors checking visibility, errors from the field control hide the change from the watcher.
+			log.Printf("while controlling the fields of %v for %+v: %v", typ.Name(), w.getCaller(), err)
+			return
+		}
+		u.changes = append(u.changes, change)
+	})
+}
+
+// watcherFieldControl replaces the structs of change with copies passed through the field control of their type for the caller of w, if it has one.
+func (u *Update) watcherFieldControl(w watcher, change *pendingChange) error {
+	view := &View{
+		tx:     u.tx,
+		snek:   u.snek,
+		ctx:    u.ctx,
+		caller: unwrapCaller(w.getCaller()),
+	}
+	if !view.hasFieldControl(change.typ) {
+		return nil
+	}
+	for _, structPointer := range []*any{&change.prev, &change.next} {
+		if *structPointer == nil {
+			continue
+		}
+		*structPointer = copyStruct(*structPointer)
+		if err := view.fieldControl(change.typ, *structPointer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyStruct returns a pointer to a shallow copy of the struct structPointer points to.
+func copyStruct(structPointer any) any {
+	val := reflect.ValueOf(structPointer).Elem()
+	result := reflect.New(val.Type())
+	result.Elem().Set(val)
+	return result.Interface()
+}
+
+// deliverChanges delivers the recorded changes to their watchers, closing watchers whose buffers are full.
+// Must be called with the watch lock held, to deliver the changes of different Updates in commit order.
+func (u *Update) deliverChanges() {
+	for _, change := range u.changes {
+		watchers := u.snek.getWatchers(change.typ)
+		if current, found := watchers.Get(change.watcherID); !found || current != change.watcher {
+			continue
+		}
+		if !change.watcher.deliver(change.prev, change.next) {
+			log.Printf("closing watcher %+v of %v with full buffer", change.watcher.getCaller(), change.typ.Name())
+			watchers.Del(change.watcherID)
+			change.watcher.close()
+		}
+	}
+}